@@ -10,12 +10,18 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/deso-protocol/core/lib"
 	"github.com/spf13/viper"
 )
 
+// defaultStateChangeDir is the state-change directory used when STATE_CHANGE_DIR is unset. It matches
+// config.DefaultStateChangeDir in the main module, which this tool doesn't import so it builds on its own.
+const defaultStateChangeDir = "/db"
+
 type BlockHeightInfo struct {
 	EntryIndex uint64
 	Height     uint64
@@ -27,9 +33,10 @@ func main() {
 	viper.ReadInConfig()
 	viper.AutomaticEnv()
 
+	// Resolved like the repair tool's, so one STATE_CHANGE_DIR (or none) serves both.
 	stateChangeDir := viper.GetString("STATE_CHANGE_DIR")
 	if stateChangeDir == "" {
-		stateChangeDir = "/tmp/state-changes"
+		stateChangeDir = defaultStateChangeDir
 	}
 
 	// Create log file
@@ -40,9 +47,10 @@ func main() {
 	}
 	defer logFile.Close()
 
-	// Setup multi-writer to write to both stdout and file
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(multiWriter)
+	// Setup multi-writer to write to both stdout and file. In pipe mode stdout carries only the gap list, so
+	// the logs go to stderr instead.
+	gapsToStdout := viper.GetBool("ANALYZE_GAPS_TO_STDOUT")
+	log.SetOutput(logOutput(gapsToStdout, os.Stdout, os.Stderr, logFile))
 
 	startTime := time.Now()
 
@@ -72,93 +80,106 @@ func main() {
 	log.Printf("Index file size: %d bytes", indexStat.Size())
 	log.Printf("Data file size: %d bytes", dataStat.Size())
 
-	totalEntries := uint64(indexStat.Size() / 8)
+	totalEntries := uint64(indexStat.Size() / indexRecordSize)
 	log.Printf("Total entries in index: %d", totalEntries)
 
+	// A quick pre-flight that only follows the data file's length prefixes: a count that doesn't match the
+	// index means a corrupt or mismatched file pair, which the scan would otherwise report as odd gaps.
+	if !viper.GetBool("SKIP_ENTRY_COUNT_CHECK") {
+		dataEntries, err := checkEntryCount(indexStat.Size(), io.NewSectionReader(dataFile, 0, dataStat.Size()), dataStat.Size())
+		if err != nil {
+			log.Printf("WARNING: Entry count check failed: %v", err)
+		} else {
+			log.Printf("Data file entries match the index: %d", dataEntries)
+		}
+	}
+
 	// Scan all entries to find block heights
 	log.Printf("Scanning entries for block heights...")
 	log.Printf("")
 
-	blockHeights := make(map[uint64]uint64) // height -> entry index
-	var maxHeight uint64
-	var minHeight uint64 = ^uint64(0)
-	blockCount := 0
-	lastLoggedBlock := uint64(0)
-	progressInterval := uint64(1000000) // Log every 1 million blocks
-
-	for entryIdx := uint64(0); entryIdx < totalEntries; entryIdx++ {
-		if entryIdx%100000 == 0 && entryIdx > 0 {
-			pct := float64(entryIdx) / float64(totalEntries) * 100
-			elapsed := time.Since(startTime)
-			entriesPerSec := float64(entryIdx) / elapsed.Seconds()
-			remaining := time.Duration(float64(totalEntries-entryIdx)/entriesPerSec) * time.Second
-
-			log.Printf("Progress: %d/%d entries (%.2f%%) - %d blocks found - Elapsed: %v - ETA: %v",
-				entryIdx, totalEntries, pct, blockCount, elapsed.Round(time.Second), remaining.Round(time.Second))
-
-			// Check if we've found another million blocks
-			blocksFoundSinceLastLog := blockCount - int(lastLoggedBlock)
-			if blocksFoundSinceLastLog >= int(progressInterval) {
-				log.Printf("  └─ Milestone: Found %d blocks (total: %d)", progressInterval, blockCount)
-				lastLoggedBlock = uint64(blockCount)
-			}
-		}
-
-		// Read index entry
-		entryIndexBytes := make([]byte, 8)
-		fileBytesPosition := int64(entryIdx * 8)
-
-		bytesRead, err := indexFile.ReadAt(entryIndexBytes, fileBytesPosition)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Warning: Failed to read index at %d: %v", entryIdx, err)
-			continue
-		}
-		if bytesRead != 8 {
-			continue
-		}
+	// Index parsing can be spread across many goroutines, while data-file reads are gated by a
+	// separate semaphore so a spinning disk isn't thrashed by unbounded concurrent seeks.
+	scanWorkers := viper.GetInt("ANALYZE_WORKERS")
+	if scanWorkers <= 0 {
+		scanWorkers = 1
+	}
+	readConcurrency := viper.GetInt("ANALYZE_READ_CONCURRENCY")
+	if readConcurrency <= 0 {
+		readConcurrency = scanWorkers
+	}
+	log.Printf("Scan workers: %d, concurrent data-file reads: %d", scanWorkers, readConcurrency)
 
-		dbIndex := binary.LittleEndian.Uint64(entryIndexBytes)
+	topN := 10
+	if viper.IsSet("ANALYZE_TOP_BLOCKS") {
+		topN = viper.GetInt("ANALYZE_TOP_BLOCKS")
+	}
 
-		// Seek to data position
-		if _, err := dataFile.Seek(int64(dbIndex), io.SeekStart); err != nil {
-			log.Printf("Warning: Failed to seek to %d: %v", dbIndex, err)
-			continue
-		}
+	// A file that mostly fails to decode would otherwise report misleadingly few gaps.
+	maxDecodeErrorRate := 0.01
+	if viper.IsSet("ANALYZE_MAX_DECODE_ERROR_RATE") {
+		maxDecodeErrorRate = viper.GetFloat64("ANALYZE_MAX_DECODE_ERROR_RATE")
+	}
 
-		// Read entry
-		bufReader := bufio.NewReader(dataFile)
-		entryLength, err := lib.ReadUvarint(bufReader)
-		if err != nil {
-			continue
-		}
+	// The transaction density report needs the transaction count of every height, so it is opt-in.
+	txnDensity := viper.GetBool("ANALYZE_TXN_DENSITY")
+	txnBucketSize := uint64(100000)
+	if viper.IsSet("ANALYZE_TXN_BUCKET_SIZE") {
+		txnBucketSize = viper.GetUint64("ANALYZE_TXN_BUCKET_SIZE")
+	}
+	if txnBucketSize == 0 {
+		log.Fatalf("ANALYZE_TXN_BUCKET_SIZE must be positive")
+	}
 
-		entryBytes := make([]byte, entryLength)
-		if _, err := io.ReadFull(bufReader, entryBytes); err != nil {
-			continue
+	cfg := scanConfig{
+		Workers:            scanWorkers,
+		ReadConcurrency:    readConcurrency,
+		TopN:               topN,
+		MaxDecodeErrorRate: maxDecodeErrorRate,
+		CountTxns:          txnDensity,
+	}
+	// A spot check of the head and/or tail of the file replaces the full gap analysis.
+	headEntries := viper.GetUint64("ANALYZE_HEAD_ENTRIES")
+	tailEntries := viper.GetUint64("ANALYZE_TAIL_ENTRIES")
+	if headEntries > 0 || tailEntries > 0 {
+		log.Printf("Spot-checking the first %d and last %d entries", headEntries, tailEntries)
+		if _, err := spotCheck(indexFile, dataFile, totalEntries, spotCheckRanges(totalEntries, headEntries, tailEntries), cfg, startTime); err != nil {
+			log.Fatalf("Aborting spot check: %v", err)
 		}
+		log.Printf("\n=== Spot Check Complete ===")
+		log.Printf("Total time: %v", time.Since(startTime).Round(time.Second))
+		return
+	}
 
-		// Decode entry
-		entry := &lib.StateChangeEntry{}
-		rr := bytes.NewReader(entryBytes)
-		if _, err := lib.DecodeFromBytes(entry, rr); err != nil {
-			continue
-		}
-
-		// Only track block entries
-		if entry.EncoderType == lib.EncoderTypeBlock {
-			blockHeights[entry.BlockHeight] = entryIdx
-			blockCount++
-
-			if entry.BlockHeight > maxHeight {
-				maxHeight = entry.BlockHeight
-			}
-			if entry.BlockHeight < minHeight {
-				minHeight = entry.BlockHeight
-			}
+	var result *scanResult
+	// With checkpointing, progress is saved every ANALYZE_CHECKPOINT_EVERY entries, so a crash loses at most
+	// that many entries of work and the next run resumes from the checkpoint.
+	if checkpointEvery := viper.GetUint64("ANALYZE_CHECKPOINT_EVERY"); checkpointEvery > 0 {
+		checkpointPath := viper.GetString("ANALYZE_CHECKPOINT_FILE")
+		if checkpointPath == "" {
+			checkpointPath = filepath.Join(stateChangeDir, "state-changes-analysis.checkpoint")
 		}
+		log.Printf("Checkpointing every %d entries to %s", checkpointEvery, checkpointPath)
+		result, err = scanWithCheckpoints(indexFile, dataFile, totalEntries, cfg, checkpointConfig{
+			Path:      checkpointPath,
+			Every:     checkpointEvery,
+			IndexSize: indexStat.Size(),
+			DataSize:  dataStat.Size(),
+		}, startTime)
+	} else {
+		result, err = scanBlockHeights(indexFile, dataFile, totalEntries, cfg, startTime)
+	}
+	if err != nil {
+		log.Fatalf("Aborting analysis: %v", err)
+	}
+	blockHeights := result.BlockHeights
+	largestBlocks := result.Largest
+	blockCount := int(result.BlockCount)
+	log.Printf("Decode errors: %d/%d entries", result.DecodeErrors, result.Scanned)
+	var maxHeight uint64
+	var minHeight uint64 = ^uint64(0)
+	if lo, hi, ok := blockHeights.bounds(); ok {
+		minHeight, maxHeight = lo, hi
 	}
 
 	log.Printf("\n=== Analysis Results ===")
@@ -174,31 +195,10 @@ func main() {
 	log.Printf("\n=== Checking for gaps ===")
 	log.Printf("Scanning height range %d to %d...", minHeight, maxHeight)
 
-	// Sort heights
-	heights := make([]uint64, 0, len(blockHeights))
-	for h := range blockHeights {
-		heights = append(heights, h)
-	}
-	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
-
-	gaps := []struct{ Start, End, Missing uint64 }{}
-	totalMissingInGaps := uint64(0)
-
-	// Check from min to max
-	for h := minHeight; h <= maxHeight; h++ {
-		if _, exists := blockHeights[h]; !exists {
-			// Found missing height, find the end of this gap
-			gapStart := h
-			for h <= maxHeight {
-				if _, exists := blockHeights[h]; exists {
-					break
-				}
-				h++
-			}
-			gapEnd := h - 1
-			missing := gapEnd - gapStart + 1
-			gaps = append(gaps, struct{ Start, End, Missing uint64 }{gapStart, gapEnd, missing})
-			totalMissingInGaps += missing
+	gaps, totalMissingInGaps := findGaps(blockHeights, minHeight, maxHeight)
+	if gapsToStdout {
+		if err := writeGapLines(os.Stdout, gaps); err != nil {
+			log.Fatalf("Failed to write gaps to stdout: %v", err)
 		}
 	}
 
@@ -220,7 +220,7 @@ func main() {
 			fmt.Fprintf(gapsFile, "Total missing blocks: %d\n\n", totalMissingInGaps)
 
 			for i, gap := range gaps {
-				line := fmt.Sprintf("Gap %d: heights %d -> %d (%d blocks missing)\n", i+1, gap.Start, gap.End, gap.Missing)
+				line := gapLine(i, gap)
 				fmt.Fprint(gapsFile, line)
 
 				// Only print first 100 and last 100 gaps to console
@@ -236,14 +236,26 @@ func main() {
 	}
 
 	// Show last 10 blocks
-	log.Printf("\n=== Last 10 blocks in state-changes ===")
-	startIdx := len(heights) - 10
-	if startIdx < 0 {
-		startIdx = 0
+	log.Printf("\n=== Last %d blocks in state-changes ===", lastBlocksShown)
+	lastHeights := make([]uint64, 0, len(result.Last.entries))
+	for h := range result.Last.entries {
+		lastHeights = append(lastHeights, h)
 	}
-	for i := startIdx; i < len(heights); i++ {
-		h := heights[i]
-		log.Printf("  Height %d (entry index: %d)", h, blockHeights[h])
+	sort.Slice(lastHeights, func(i, j int) bool { return lastHeights[i] < lastHeights[j] })
+	for _, h := range lastHeights {
+		log.Printf("  Height %d (entry index: %d)", h, result.Last.entries[h])
+	}
+
+	// Show the blocks with the most transactions, the ones most likely to slow down a repair
+	if topN > 0 {
+		log.Printf("\n=== Top %d blocks by transaction count ===", topN)
+		for i, b := range largestBlocks.sorted() {
+			log.Printf("  %d. Height %d: %d txns (entry index: %d)", i+1, b.Height, b.TxnCount, b.EntryIndex)
+		}
+	}
+
+	if txnDensity {
+		logTxnDensity(summarizeTxnDensity(result.TxnCounts, txnBucketSize), txnBucketSize)
 	}
 
 	// Final summary
@@ -256,3 +268,316 @@ func main() {
 	log.Printf("Log saved to: %s", logFilePath)
 	log.Printf("Finished at: %s", time.Now().Format(time.RFC3339))
 }
+
+// gapRange is a run of heights missing from the state-change files.
+type gapRange struct{ Start, End, Missing uint64 }
+
+// findGaps returns the runs of heights in [minHeight, maxHeight] missing from blockHeights, and the total
+// number of heights missing.
+func findGaps(blockHeights *heightSet, minHeight, maxHeight uint64) ([]gapRange, uint64) {
+	gaps := []gapRange{}
+	totalMissing := uint64(0)
+
+	// Check from min to max
+	for h := minHeight; h <= maxHeight; h++ {
+		if !blockHeights.has(h) {
+			// Found missing height, find the end of this gap
+			gapStart := h
+			for h <= maxHeight {
+				if blockHeights.has(h) {
+					break
+				}
+				h++
+			}
+			gapEnd := h - 1
+			missing := gapEnd - gapStart + 1
+			gaps = append(gaps, gapRange{gapStart, gapEnd, missing})
+			totalMissing += missing
+		}
+	}
+	return gaps, totalMissing
+}
+
+// gapLine formats the i'th gap in the gap-file format the repair tool reads.
+func gapLine(i int, gap gapRange) string {
+	return fmt.Sprintf("Gap %d: heights %d -> %d (%d blocks missing)\n", i+1, gap.Start, gap.End, gap.Missing)
+}
+
+// writeGapLines writes gaps to w in the gap-file format, one per line and nothing else, so the output can be
+// piped into the repair tool.
+func writeGapLines(w io.Writer, gaps []gapRange) error {
+	buf := bufio.NewWriter(w)
+	for i, gap := range gaps {
+		if _, err := buf.WriteString(gapLine(i, gap)); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// logOutput returns where the logs go: stdout and logFile normally, or stderr and logFile when stdout is
+// reserved for the gap list.
+func logOutput(gapsToStdout bool, stdout, stderr, logFile io.Writer) io.Writer {
+	if gapsToStdout {
+		return io.MultiWriter(stderr, logFile)
+	}
+	return io.MultiWriter(stdout, logFile)
+}
+
+// readLimiter bounds the number of concurrent reads against the data file, independently of the
+// number of goroutines parsing the index.
+type readLimiter struct {
+	sem chan struct{}
+	// active and peak track in-flight reads so the effective concurrency can be reported.
+	active int64
+	peak   int64
+}
+
+func newReadLimiter(limit int) *readLimiter {
+	return &readLimiter{sem: make(chan struct{}, limit)}
+}
+
+func (l *readLimiter) acquire() {
+	l.sem <- struct{}{}
+	active := atomic.AddInt64(&l.active, 1)
+	for {
+		peak := atomic.LoadInt64(&l.peak)
+		if active <= peak || atomic.CompareAndSwapInt64(&l.peak, peak, active) {
+			return
+		}
+	}
+}
+
+func (l *readLimiter) release() {
+	atomic.AddInt64(&l.active, -1)
+	<-l.sem
+}
+
+// readEntry is how scans read an entry from the data file. Tests replace it to slow reads down.
+var readEntry = readEntryAt
+
+// readEntryAt decodes the length-prefixed state change entry stored at offset in the data file.
+// It only uses ReadAt, so it is safe to call from multiple goroutines on the same file.
+func readEntryAt(dataFile io.ReaderAt, offset int64) (*lib.StateChangeEntry, error) {
+	bufReader := bufio.NewReader(io.NewSectionReader(dataFile, offset, 1<<62))
+	entryLength, err := lib.ReadUvarint(bufReader)
+	if err != nil {
+		return nil, err
+	}
+
+	entryBytes := make([]byte, entryLength)
+	if _, err := io.ReadFull(bufReader, entryBytes); err != nil {
+		return nil, err
+	}
+
+	entry := &lib.StateChangeEntry{}
+	rr := bytes.NewReader(entryBytes)
+	if _, err := lib.DecodeFromBytes(entry, rr); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// decodeErrorMinSample is how many entries must be scanned before the decode error rate can abort a scan
+// early, so a few bad entries at the start of the file don't trip it.
+const decodeErrorMinSample = 100000
+
+// scanConfig controls scanBlockHeights.
+type scanConfig struct {
+	Workers         int
+	ReadConcurrency int
+	// TopN is how many blocks to keep by transaction count.
+	TopN int
+	// MaxDecodeErrorRate is the fraction of entries allowed to fail to read or decode before the scan aborts.
+	MaxDecodeErrorRate float64
+	// CountTxns records the transaction count of every block height for the transaction density report.
+	CountTxns bool
+}
+
+// scanResult is what scanBlockHeights found.
+type scanResult struct {
+	BlockHeights *heightSet
+	// Last is the entry index of the highest block heights.
+	Last         *highestBlocks
+	BlockCount   uint64
+	Largest      *topBlocks
+	Scanned      uint64
+	DecodeErrors uint64
+	// TxnCounts is the transaction count of every block height, when scanConfig.CountTxns is set.
+	TxnCounts map[uint64]int
+	// PeakReads is the most data-file reads that were in flight at once.
+	PeakReads int64
+}
+
+// decodeErrorRateExceeded returns an error if more than maxRate of the scanned entries failed to decode.
+func decodeErrorRateExceeded(decodeErrors, scanned uint64, maxRate float64) error {
+	if scanned == 0 {
+		return nil
+	}
+	rate := float64(decodeErrors) / float64(scanned)
+	if rate <= maxRate {
+		return nil
+	}
+	return fmt.Errorf("%d of %d entries (%.2f%%) failed to decode, above the %.2f%% limit; the state-change files are likely corrupt and gap results would be misleading",
+		decodeErrors, scanned, rate*100, maxRate*100)
+}
+
+// scanBlockHeights walks every index entry and records every block height, the entry index of the highest
+// ones, the number of block entries seen and the cfg.TopN blocks by transaction count. The index is split
+// into contiguous chunks, one per worker, and data-file reads are limited to cfg.ReadConcurrency at a time.
+// Entries that fail to decode are counted, and the scan aborts once they exceed cfg.MaxDecodeErrorRate.
+func scanBlockHeights(indexFile, dataFile *os.File, totalEntries uint64, cfg scanConfig, startTime time.Time) (*scanResult, error) {
+	return scanEntryRange(indexFile, dataFile, 0, totalEntries, totalEntries, cfg, startTime)
+}
+
+// scanEntryRange is scanBlockHeights over the index entries [first, end) of totalEntries.
+func scanEntryRange(indexFile, dataFile *os.File, first, end, totalEntries uint64, cfg scanConfig, startTime time.Time) (*scanResult, error) {
+	workers := cfg.Workers
+	rangeStart := time.Now()
+	topN := cfg.TopN
+	limiter := newReadLimiter(cfg.ReadConcurrency)
+	progressInterval := uint64(1000000) // Log every 1 million blocks
+
+	var scanned, blockCount, lastLoggedBlock, decodeErrors uint64
+	var aborted int32
+	var mu sync.Mutex
+	largest := newTopBlocks(topN)
+	// Each worker's chunk follows the previous one's, so merging them in worker order lets later entries win,
+	// matching a sequential scan.
+	type chunkResult struct {
+		heights   *heightSet
+		last      *highestBlocks
+		txnCounts map[uint64]int
+	}
+	chunks := make([]chunkResult, workers)
+
+	chunkSize := (end - first + uint64(workers) - 1) / uint64(workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		chunkStart := first + uint64(w)*chunkSize
+		chunkEnd := chunkStart + chunkSize
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+		if chunkStart >= chunkEnd {
+			break
+		}
+
+		wg.Add(1)
+		go func(w int, chunkStart, chunkEnd uint64) {
+			defer wg.Done()
+			localHeights := newHeightSet()
+			localLast := newHighestBlocks(lastBlocksShown)
+			var localTxnCounts map[uint64]int
+			if cfg.CountTxns {
+				localTxnCounts = make(map[uint64]int)
+			}
+			localLargest := newTopBlocks(topN)
+			defer func() {
+				chunks[w] = chunkResult{heights: localHeights, last: localLast, txnCounts: localTxnCounts}
+			}()
+			entryIndexBytes := make([]byte, 8)
+
+			for entryIdx := chunkStart; entryIdx < chunkEnd; entryIdx++ {
+				if atomic.LoadInt32(&aborted) != 0 {
+					return
+				}
+				if n := atomic.AddUint64(&scanned, 1); n%100000 == 0 {
+					done := first + n
+					pct := float64(done) / float64(totalEntries) * 100
+					elapsed := time.Since(startTime)
+					entriesPerSec := float64(n) / time.Since(rangeStart).Seconds()
+					remaining := time.Duration(float64(totalEntries-done)/entriesPerSec) * time.Second
+					found := atomic.LoadUint64(&blockCount)
+
+					log.Printf("Progress: %d/%d entries (%.2f%%) - %d blocks found - Elapsed: %v - ETA: %v",
+						done, totalEntries, pct, found, elapsed.Round(time.Second), remaining.Round(time.Second))
+
+					// Check if we've found another million blocks
+					last := atomic.LoadUint64(&lastLoggedBlock)
+					if found-last >= progressInterval && atomic.CompareAndSwapUint64(&lastLoggedBlock, last, found) {
+						log.Printf("  └─ Milestone: Found %d blocks (total: %d)", progressInterval, found)
+					}
+				}
+
+				// Read index entry
+				bytesRead, err := indexFile.ReadAt(entryIndexBytes, int64(entryIdx*8))
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					log.Printf("Warning: Failed to read index at %d: %v", entryIdx, err)
+					continue
+				}
+				if bytesRead != 8 {
+					continue
+				}
+
+				dbIndex := binary.LittleEndian.Uint64(entryIndexBytes)
+
+				limiter.acquire()
+				entry, err := readEntry(dataFile, int64(dbIndex))
+				limiter.release()
+				if err != nil {
+					failed := atomic.AddUint64(&decodeErrors, 1)
+					n := atomic.LoadUint64(&scanned)
+					if n >= decodeErrorMinSample && decodeErrorRateExceeded(failed, n, cfg.MaxDecodeErrorRate) != nil {
+						atomic.StoreInt32(&aborted, 1)
+					}
+					continue
+				}
+
+				// Only track block entries
+				if entry.EncoderType == lib.EncoderTypeBlock {
+					localHeights.add(entry.BlockHeight)
+					localLast.add(entry.BlockHeight, entryIdx)
+					atomic.AddUint64(&blockCount, 1)
+					if txnCount, ok := blockTxnCount(entry); ok {
+						localLargest.add(BlockTxnCount{Height: entry.BlockHeight, EntryIndex: entryIdx, TxnCount: txnCount})
+						if cfg.CountTxns {
+							localTxnCounts[entry.BlockHeight] = txnCount
+						}
+					}
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			largest.merge(localLargest)
+		}(w, chunkStart, chunkEnd)
+	}
+	wg.Wait()
+
+	blockHeights := newHeightSet()
+	last := newHighestBlocks(lastBlocksShown)
+	var txnCounts map[uint64]int
+	if cfg.CountTxns {
+		txnCounts = make(map[uint64]int)
+	}
+	for _, chunk := range chunks {
+		if chunk.heights == nil {
+			continue
+		}
+		blockHeights.union(chunk.heights)
+		last.merge(chunk.last.entries)
+		for h, txnCount := range chunk.txnCounts {
+			txnCounts[h] = txnCount
+		}
+	}
+
+	peakReads := atomic.LoadInt64(&limiter.peak)
+	log.Printf("Peak concurrent data-file reads: %d (limit %d)", peakReads, cfg.ReadConcurrency)
+	if err := decodeErrorRateExceeded(decodeErrors, scanned, cfg.MaxDecodeErrorRate); err != nil {
+		return nil, err
+	}
+	return &scanResult{
+		BlockHeights: blockHeights,
+		Last:         last,
+		BlockCount:   blockCount,
+		Largest:      largest,
+		Scanned:      scanned,
+		DecodeErrors: decodeErrors,
+		TxnCounts:    txnCounts,
+		PeakReads:    peakReads,
+	}, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+func TestReadLimiterBoundsConcurrentReads(t *testing.T) {
+	const limit = 3
+	limiter := newReadLimiter(limit)
+
+	var inFlight, maxSeen int64
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.acquire()
+			n := atomic.AddInt64(&inFlight, 1)
+			for {
+				m := atomic.LoadInt64(&maxSeen)
+				if n <= m || atomic.CompareAndSwapInt64(&maxSeen, m, n) {
+					break
+				}
+			}
+			time.Sleep(2 * time.Millisecond)
+			atomic.AddInt64(&inFlight, -1)
+			limiter.release()
+		}()
+	}
+	wg.Wait()
+
+	if maxSeen > limit {
+		t.Fatalf("observed %d concurrent reads, limit is %d", maxSeen, limit)
+	}
+	if limiter.peak > limit {
+		t.Fatalf("limiter reported peak %d, limit is %d", limiter.peak, limit)
+	}
+}
+
+func TestScanBlockHeightsKeepsReadsWithinLimit(t *testing.T) {
+	var heights []uint64
+	for h := uint64(1); h <= 200; h++ {
+		heights = append(heights, h)
+	}
+	indexFile, dataFile := writeBlockEntries(t, heights)
+	const readConcurrency = 2
+	// Slow reads keep the workers queued on the limiter, so one letting too many through would show.
+	defer func(read func(io.ReaderAt, int64) (*lib.StateChangeEntry, error)) { readEntry = read }(readEntry)
+	readEntry = func(dataFile io.ReaderAt, offset int64) (*lib.StateChangeEntry, error) {
+		time.Sleep(time.Millisecond)
+		return readEntryAt(dataFile, offset)
+	}
+
+	result, err := scanBlockHeights(indexFile, dataFile, uint64(len(heights)), scanConfig{Workers: 16, ReadConcurrency: readConcurrency}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PeakReads < 1 || result.PeakReads > readConcurrency {
+		t.Fatalf("peak concurrent reads = %d, want 1 to %d", result.PeakReads, readConcurrency)
+	}
+	if result.BlockCount != uint64(len(heights)) || !reflect.DeepEqual(setHeights(result.BlockHeights), heights) {
+		t.Fatalf("found %d blocks, want heights 1 to %d", result.BlockCount, len(heights))
+	}
+}
+
+func TestTopBlocksKeepsLargestByTxnCount(t *testing.T) {
+	txnCounts := map[uint64]int{1: 5, 2: 40, 3: 0, 4: 17, 5: 40, 6: 3, 7: 99, 8: 17}
+
+	// Split the blocks across two workers and merge, as scanBlockHeights does.
+	first, second := newTopBlocks(4), newTopBlocks(4)
+	for height := uint64(1); height <= 8; height++ {
+		entry := &lib.StateChangeEntry{
+			EncoderType: lib.EncoderTypeBlock,
+			BlockHeight: height,
+			Encoder:     &lib.MsgDeSoBlock{Txns: make([]*lib.MsgDeSoTxn, txnCounts[height])},
+		}
+		txnCount, ok := blockTxnCount(entry)
+		if !ok {
+			t.Fatalf("height %d: expected a block txn count", height)
+		}
+		target := first
+		if height%2 == 0 {
+			target = second
+		}
+		target.add(BlockTxnCount{Height: height, EntryIndex: height * 10, TxnCount: txnCount})
+	}
+	// A later entry for an already-kept block replaces it rather than taking a second slot.
+	second.add(BlockTxnCount{Height: 2, EntryIndex: 100, TxnCount: 40})
+
+	largest := newTopBlocks(4)
+	largest.merge(first)
+	largest.merge(second)
+
+	want := []BlockTxnCount{
+		{Height: 7, EntryIndex: 70, TxnCount: 99},
+		{Height: 2, EntryIndex: 100, TxnCount: 40},
+		{Height: 5, EntryIndex: 50, TxnCount: 40},
+		{Height: 4, EntryIndex: 40, TxnCount: 17},
+	}
+	got := largest.sorted()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("top blocks = %+v, want %+v", got, want)
+	}
+}
+
+func TestScanAbortsOnCorruptFile(t *testing.T) {
+	// Every entry is an empty record, which can't decode as a StateChangeEntry.
+	dir := t.TempDir()
+	var index, data []byte
+	for i := 0; i < 20; i++ {
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+		data = binary.AppendUvarint(data, 0)
+	}
+	indexFile := writeFixture(t, filepath.Join(dir, "index"), index)
+	dataFile := writeFixture(t, filepath.Join(dir, "data"), data)
+
+	_, err := scanBlockHeights(indexFile, dataFile, 20, scanConfig{Workers: 2, ReadConcurrency: 2, MaxDecodeErrorRate: 0.5}, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "likely corrupt") {
+		t.Fatalf("expected a corrupt-file abort, got %v", err)
+	}
+
+	// A threshold of 1 tolerates any failure rate.
+	result, err := scanBlockHeights(indexFile, dataFile, 20, scanConfig{Workers: 2, ReadConcurrency: 2, MaxDecodeErrorRate: 1}, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.DecodeErrors != 20 || result.Scanned != 20 || result.BlockCount != 0 {
+		t.Fatalf("got %d decode errors in %d entries with %d blocks", result.DecodeErrors, result.Scanned, result.BlockCount)
+	}
+}
+
+func TestDecodeErrorRateExceeded(t *testing.T) {
+	if err := decodeErrorRateExceeded(1, 100, 0.01); err != nil {
+		t.Fatalf("1%% failures at a 1%% limit should pass: %v", err)
+	}
+	if err := decodeErrorRateExceeded(2, 100, 0.01); err == nil {
+		t.Fatalf("2%% failures at a 1%% limit should fail")
+	}
+	if err := decodeErrorRateExceeded(0, 0, 0); err != nil {
+		t.Fatalf("an empty scan should pass: %v", err)
+	}
+}
+
+func writeFixture(t *testing.T, path string, contents []byte) *os.File {
+	t.Helper()
+	if err := os.WriteFile(path, contents, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestGapsToStdoutSeparatesGapsFromLogs(t *testing.T) {
+	var stdout, stderr, logFile strings.Builder
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(logOutput(true, &stdout, &stderr, &logFile))
+
+	blockHeights := newHeightSet()
+	for _, h := range []uint64{10, 11, 14, 15, 20} {
+		blockHeights.add(h)
+	}
+	gaps, missing := findGaps(blockHeights, 10, 20)
+	log.Printf("Found %d gaps (total %d blocks missing)", len(gaps), missing)
+	if err := writeGapLines(&stdout, gaps); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Gap 1: heights 12 -> 13 (2 blocks missing)\nGap 2: heights 16 -> 19 (4 blocks missing)\n"
+	if stdout.String() != want {
+		t.Fatalf("stdout = %q, want only the gap lines %q", stdout.String(), want)
+	}
+	for name, out := range map[string]string{"stderr": stderr.String(), "log file": logFile.String()} {
+		if !strings.Contains(out, "Found 2 gaps (total 6 blocks missing)") {
+			t.Fatalf("%s = %q, want the logs", name, out)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// analyzeCheckpoint is the progress of a scan saved to disk, so a crashed run can resume from NextEntry
+// instead of rescanning the whole index.
+type analyzeCheckpoint struct {
+	// IndexSize and DataSize are the file sizes when the scan started. The files only grow, so a checkpoint
+	// taken against larger files than the current ones belongs to other files.
+	IndexSize    int64             `json:"index_size"`
+	DataSize     int64             `json:"data_size"`
+	NextEntry    uint64            `json:"next_entry"`
+	BlockHeights *heightSet        `json:"block_heights"`
+	LastBlocks   map[uint64]uint64 `json:"last_blocks"`
+	BlockCount   uint64            `json:"block_count"`
+	Scanned      uint64            `json:"scanned"`
+	DecodeErrors uint64            `json:"decode_errors"`
+	Largest      []BlockTxnCount   `json:"largest"`
+	TxnCounts    map[uint64]int    `json:"txn_counts,omitempty"`
+}
+
+// checkpointConfig controls scanWithCheckpoints.
+type checkpointConfig struct {
+	Path string
+	// Every is how many index entries are scanned between checkpoints, the most a crash can lose.
+	Every     uint64
+	IndexSize int64
+	DataSize  int64
+}
+
+// afterCheckpoint is called after each checkpoint is written. Tests replace it to interrupt a scan.
+var afterCheckpoint = func(nextEntry uint64) error { return nil }
+
+// loadAnalyzeCheckpoint reads the checkpoint at path. It returns nil if there is none, and an error if it
+// doesn't match the current files.
+func loadAnalyzeCheckpoint(path string, indexSize, dataSize int64, totalEntries uint64) (*analyzeCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint %s: %w", path, err)
+	}
+	var cp analyzeCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("parse checkpoint %s: %w", path, err)
+	}
+	if cp.IndexSize > indexSize || cp.DataSize > dataSize {
+		return nil, fmt.Errorf("checkpoint %s was taken against larger files (index %d, data %d bytes) than the current ones (index %d, data %d bytes)",
+			path, cp.IndexSize, cp.DataSize, indexSize, dataSize)
+	}
+	if cp.NextEntry > totalEntries {
+		return nil, fmt.Errorf("checkpoint %s resumes at entry %d, past the %d entries in the index", path, cp.NextEntry, totalEntries)
+	}
+	if cp.BlockHeights == nil {
+		cp.BlockHeights = newHeightSet()
+	}
+	return &cp, nil
+}
+
+// save writes the checkpoint to path through a temporary file, so a crash mid-write leaves the previous
+// checkpoint intact.
+func (cp *analyzeCheckpoint) save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("replace checkpoint: %w", err)
+	}
+	return nil
+}
+
+// add merges the result of scanning the next range of entries. Entries in the range come after every entry
+// already merged, so they win for heights seen before, matching a single scan.
+func (cp *analyzeCheckpoint) add(result *scanResult, topN int) {
+	cp.BlockHeights.union(result.BlockHeights)
+	last := cp.last()
+	last.merge(result.Last.entries)
+	cp.LastBlocks = last.entries
+	for h, txnCount := range result.TxnCounts {
+		if cp.TxnCounts == nil {
+			cp.TxnCounts = make(map[uint64]int)
+		}
+		cp.TxnCounts[h] = txnCount
+	}
+	cp.BlockCount += result.BlockCount
+	cp.Scanned += result.Scanned
+	cp.DecodeErrors += result.DecodeErrors
+	largest := cp.largest(topN)
+	largest.merge(result.Largest)
+	cp.Largest = largest.sorted()
+}
+
+func (cp *analyzeCheckpoint) last() *highestBlocks {
+	last := newHighestBlocks(lastBlocksShown)
+	last.merge(cp.LastBlocks)
+	return last
+}
+
+func (cp *analyzeCheckpoint) largest(topN int) *topBlocks {
+	largest := newTopBlocks(topN)
+	for _, block := range cp.Largest {
+		largest.add(block)
+	}
+	return largest
+}
+
+// scanWithCheckpoints is scanBlockHeights that saves its progress to ckpt.Path every ckpt.Every entries and
+// resumes from that file if it exists. A checkpoint that doesn't match the current files is ignored. The
+// checkpoint is removed once the scan completes.
+func scanWithCheckpoints(indexFile, dataFile *os.File, totalEntries uint64, cfg scanConfig, ckpt checkpointConfig, startTime time.Time) (*scanResult, error) {
+	cp, err := loadAnalyzeCheckpoint(ckpt.Path, ckpt.IndexSize, ckpt.DataSize, totalEntries)
+	if err != nil {
+		log.Printf("Warning: Ignoring checkpoint: %v", err)
+	}
+	if cp == nil {
+		cp = &analyzeCheckpoint{BlockHeights: newHeightSet()}
+	} else {
+		log.Printf("Resuming from checkpoint %s at entry %d/%d (%d blocks found so far)", ckpt.Path, cp.NextEntry, totalEntries, cp.BlockCount)
+	}
+	// The checkpoint keeps the sizes of the files it started against, so it still validates as they grow.
+	if cp.IndexSize == 0 && cp.DataSize == 0 {
+		cp.IndexSize, cp.DataSize = ckpt.IndexSize, ckpt.DataSize
+	}
+
+	var peakReads int64
+	for cp.NextEntry < totalEntries {
+		end := cp.NextEntry + ckpt.Every
+		if end > totalEntries {
+			end = totalEntries
+		}
+		// Each range is held to the decode error limit on its own, as well as the whole scan.
+		result, err := scanEntryRange(indexFile, dataFile, cp.NextEntry, end, totalEntries, cfg, startTime)
+		if err != nil {
+			return nil, err
+		}
+		cp.add(result, cfg.TopN)
+		if result.PeakReads > peakReads {
+			peakReads = result.PeakReads
+		}
+		cp.NextEntry = end
+		if err := cp.save(ckpt.Path); err != nil {
+			return nil, err
+		}
+		if err := afterCheckpoint(cp.NextEntry); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := decodeErrorRateExceeded(cp.DecodeErrors, cp.Scanned, cfg.MaxDecodeErrorRate); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(ckpt.Path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: Could not remove checkpoint %s: %v", ckpt.Path, err)
+	}
+	return &scanResult{
+		BlockHeights: cp.BlockHeights,
+		Last:         cp.last(),
+		BlockCount:   cp.BlockCount,
+		Largest:      cp.largest(cfg.TopN),
+		Scanned:      cp.Scanned,
+		DecodeErrors: cp.DecodeErrors,
+		TxnCounts:    cp.TxnCounts,
+		PeakReads:    peakReads,
+	}, nil
+}
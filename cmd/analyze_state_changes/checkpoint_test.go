@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// writeBlockEntries writes a state-change index and data file holding a block entry per height, and returns
+// them opened for reading.
+func writeBlockEntries(t *testing.T, heights []uint64) (*os.File, *os.File) {
+	t.Helper()
+	var index, data []byte
+	for i, height := range heights {
+		entry := &lib.StateChangeEntry{
+			OperationType: lib.DbOperationTypeInsert,
+			EncoderType:   lib.EncoderTypeBlock,
+			BlockHeight:   height,
+			Encoder: &lib.MsgDeSoBlock{
+				Header: &lib.MsgDeSoHeader{
+					Version:               1,
+					PrevBlockHash:         &lib.BlockHash{},
+					TransactionMerkleRoot: &lib.BlockHash{},
+					Height:                height,
+				},
+				Txns: make([]*lib.MsgDeSoTxn, i%5),
+			},
+		}
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+		entryBytes := lib.EncodeToBytes(height, entry)
+		data = binary.AppendUvarint(data, uint64(len(entryBytes)))
+		data = append(data, entryBytes...)
+	}
+	dir := t.TempDir()
+	return writeFixture(t, filepath.Join(dir, "index"), index), writeFixture(t, filepath.Join(dir, "data"), data)
+}
+
+func TestScanWithCheckpointsResumesAfterCrash(t *testing.T) {
+	var heights []uint64
+	for h := uint64(1); h <= 40; h++ {
+		if h != 17 && h != 18 {
+			heights = append(heights, h)
+		}
+	}
+	// A height written twice: the later entry must win on resume too.
+	heights = append(heights, 5)
+	indexFile, dataFile := writeBlockEntries(t, heights)
+	totalEntries := uint64(len(heights))
+	cfg := scanConfig{Workers: 3, ReadConcurrency: 2, TopN: 4, MaxDecodeErrorRate: 0}
+
+	want, err := scanBlockHeights(indexFile, dataFile, totalEntries, cfg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexStat, _ := indexFile.Stat()
+	dataStat, _ := dataFile.Stat()
+	ckpt := checkpointConfig{
+		Path:      filepath.Join(t.TempDir(), "analysis.checkpoint"),
+		Every:     7,
+		IndexSize: indexStat.Size(),
+		DataSize:  dataStat.Size(),
+	}
+	crash := errors.New("crash")
+	afterCheckpoint = func(nextEntry uint64) error {
+		if nextEntry >= 21 {
+			return crash
+		}
+		return nil
+	}
+	defer func() { afterCheckpoint = func(uint64) error { return nil } }()
+	if _, err := scanWithCheckpoints(indexFile, dataFile, totalEntries, cfg, ckpt, time.Now()); !errors.Is(err, crash) {
+		t.Fatalf("expected the simulated crash, got %v", err)
+	}
+	cp, err := loadAnalyzeCheckpoint(ckpt.Path, ckpt.IndexSize, ckpt.DataSize, totalEntries)
+	if err != nil || cp == nil || cp.NextEntry != 21 {
+		t.Fatalf("expected a checkpoint at entry 21, got %+v (%v)", cp, err)
+	}
+
+	afterCheckpoint = func(uint64) error { return nil }
+	got, err := scanWithCheckpoints(indexFile, dataFile, totalEntries, cfg, ckpt, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Scanned != want.Scanned || got.BlockCount != want.BlockCount || got.DecodeErrors != want.DecodeErrors {
+		t.Fatalf("resumed scan counted %d entries, %d blocks, %d errors; uninterrupted counted %d, %d, %d",
+			got.Scanned, got.BlockCount, got.DecodeErrors, want.Scanned, want.BlockCount, want.DecodeErrors)
+	}
+	if !reflect.DeepEqual(setHeights(got.BlockHeights), setHeights(want.BlockHeights)) {
+		t.Fatalf("resumed heights %v, uninterrupted %v", setHeights(got.BlockHeights), setHeights(want.BlockHeights))
+	}
+	if !reflect.DeepEqual(got.Last.entries, want.Last.entries) {
+		t.Fatalf("resumed last blocks %v, uninterrupted %v", got.Last.entries, want.Last.entries)
+	}
+	if !reflect.DeepEqual(got.Largest.sorted(), want.Largest.sorted()) {
+		t.Fatalf("resumed top blocks %+v, uninterrupted %+v", got.Largest.sorted(), want.Largest.sorted())
+	}
+	if _, err := os.Stat(ckpt.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected the checkpoint to be removed after a complete scan, got %v", err)
+	}
+}
+
+func TestLoadAnalyzeCheckpointRejectsLargerFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analysis.checkpoint")
+	cp := &analyzeCheckpoint{IndexSize: 800, DataSize: 5000, NextEntry: 50, BlockHeights: newHeightSet()}
+	if err := cp.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadAnalyzeCheckpoint(path, 400, 5000, 50); err == nil {
+		t.Fatalf("expected a checkpoint from a larger index to be rejected")
+	}
+	if _, err := loadAnalyzeCheckpoint(path, 800, 5000, 40); err == nil {
+		t.Fatalf("expected a checkpoint past the end of the index to be rejected")
+	}
+	// The files only grow, so a checkpoint against smaller files still resumes.
+	loaded, err := loadAnalyzeCheckpoint(path, 1600, 9000, 200)
+	if err != nil || loaded.NextEntry != 50 {
+		t.Fatalf("expected the checkpoint to load, got %+v (%v)", loaded, err)
+	}
+}
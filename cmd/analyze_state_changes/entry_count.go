@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// indexRecordSize is the size of one index record: the 8-byte offset of an entry in the data file.
+const indexRecordSize = 8
+
+// checkEntryCount compares the record count of an index of indexSize bytes with the number of entries in the
+// data file, found by following their length prefixes without decoding anything. A mismatch means the files
+// are corrupt or don't belong together. It returns the data file's entry count.
+func checkEntryCount(indexSize int64, dataFile io.Reader, dataSize int64) (uint64, error) {
+	if indexSize%indexRecordSize != 0 {
+		return 0, fmt.Errorf("index of %d bytes isn't a whole number of %d-byte records", indexSize, indexRecordSize)
+	}
+	records := uint64(indexSize / indexRecordSize)
+	r := bufio.NewReaderSize(dataFile, 1<<20)
+	var entries, offset uint64
+	for offset < uint64(dataSize) {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return entries, fmt.Errorf("read length of entry %d at offset %d: %w", entries, offset, err)
+		}
+		offset += uint64(len(binary.AppendUvarint(nil, length))) + length
+		if offset > uint64(dataSize) {
+			return entries, fmt.Errorf("entry %d runs %d bytes past the end of the data file", entries, offset-uint64(dataSize))
+		}
+		if _, err := r.Discard(int(length)); err != nil {
+			return entries, fmt.Errorf("skip entry %d: %w", entries, err)
+		}
+		entries++
+	}
+	if records != entries {
+		return entries, fmt.Errorf("the index has %d records but the data file holds %d entries; the files are corrupt or don't belong together",
+			records, entries)
+	}
+	return entries, nil
+}
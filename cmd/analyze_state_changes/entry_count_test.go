@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestCheckEntryCountComparesIndexWithDataFile(t *testing.T) {
+	var data []byte
+	for _, entry := range [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 200), nil} {
+		data = binary.AppendUvarint(data, uint64(len(entry)))
+		data = append(data, entry...)
+	}
+	check := func(indexSize int64, data []byte) (uint64, error) {
+		return checkEntryCount(indexSize, bytes.NewReader(data), int64(len(data)))
+	}
+
+	if entries, err := check(3*indexRecordSize, data); err != nil || entries != 3 {
+		t.Fatalf("matching files: got %d entries, %v", entries, err)
+	}
+	if _, err := check(4*indexRecordSize, data); err == nil || !strings.Contains(err.Error(), "4 records but the data file holds 3 entries") {
+		t.Fatalf("extra index record: got %v", err)
+	}
+	if _, err := check(3*indexRecordSize+1, data); err == nil || !strings.Contains(err.Error(), "whole number") {
+		t.Fatalf("partial index record: got %v", err)
+	}
+	if _, err := check(3*indexRecordSize, data[:len(data)-2]); err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Fatalf("truncated data file: got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"math/bits"
+	"sort"
+)
+
+// heightSetPageBits is log2 of how many heights one page of a heightSet covers.
+const heightSetPageBits = 16
+
+const heightSetPageWords = (1 << heightSetPageBits) / 64
+
+// heightSet is the set of block heights found, as a bitmap split into pages of 65536 heights that are only
+// allocated once a height in them is added. Block heights are dense, so it takes about one bit per height,
+// where a map entry per height took tens of bytes and didn't fit in memory for the largest chains.
+type heightSet struct {
+	pages map[uint64]*[heightSetPageWords]uint64
+	count uint64
+}
+
+func newHeightSet() *heightSet {
+	return &heightSet{pages: make(map[uint64]*[heightSetPageWords]uint64)}
+}
+
+// add adds h to the set.
+func (s *heightSet) add(h uint64) {
+	if s.pages == nil {
+		s.pages = make(map[uint64]*[heightSetPageWords]uint64)
+	}
+	page := s.pages[h>>heightSetPageBits]
+	if page == nil {
+		page = new([heightSetPageWords]uint64)
+		s.pages[h>>heightSetPageBits] = page
+	}
+	word, bit := (h&(1<<heightSetPageBits-1))/64, h%64
+	if page[word]&(1<<bit) == 0 {
+		page[word] |= 1 << bit
+		s.count++
+	}
+}
+
+// has reports whether h is in the set.
+func (s *heightSet) has(h uint64) bool {
+	page := s.pages[h>>heightSetPageBits]
+	if page == nil {
+		return false
+	}
+	return page[(h&(1<<heightSetPageBits-1))/64]&(1<<(h%64)) != 0
+}
+
+// size is the number of heights in the set.
+func (s *heightSet) size() uint64 { return s.count }
+
+// union adds every height of other to the set.
+func (s *heightSet) union(other *heightSet) {
+	for key, otherPage := range other.pages {
+		page := s.pages[key]
+		if page == nil {
+			page = new([heightSetPageWords]uint64)
+			s.pages[key] = page
+		}
+		for i, word := range otherPage {
+			s.count += uint64(bits.OnesCount64(word &^ page[i]))
+			page[i] |= word
+		}
+	}
+}
+
+// each calls fn for every height in ascending order.
+func (s *heightSet) each(fn func(h uint64)) {
+	keys := make([]uint64, 0, len(s.pages))
+	for key := range s.pages {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, key := range keys {
+		for i, word := range s.pages[key] {
+			for word != 0 {
+				bit := uint64(bits.TrailingZeros64(word))
+				fn(key<<heightSetPageBits + uint64(i)*64 + bit)
+				word &= word - 1
+			}
+		}
+	}
+}
+
+// bounds returns the lowest and highest heights in the set, or ok false if it is empty.
+func (s *heightSet) bounds() (minHeight, maxHeight uint64, ok bool) {
+	s.each(func(h uint64) {
+		if !ok {
+			minHeight, ok = h, true
+		}
+		maxHeight = h
+	})
+	return minHeight, maxHeight, ok
+}
+
+// MarshalJSON writes the set as a list of [start, end] runs, which stays small for dense heights.
+func (s *heightSet) MarshalJSON() ([]byte, error) {
+	runs := [][2]uint64{}
+	s.each(func(h uint64) {
+		if n := len(runs); n > 0 && runs[n-1][1]+1 == h {
+			runs[n-1][1] = h
+			return
+		}
+		runs = append(runs, [2]uint64{h, h})
+	})
+	return json.Marshal(runs)
+}
+
+func (s *heightSet) UnmarshalJSON(data []byte) error {
+	var runs [][2]uint64
+	if err := json.Unmarshal(data, &runs); err != nil {
+		return err
+	}
+	*s = *newHeightSet()
+	for _, run := range runs {
+		for h := run[0]; h <= run[1]; h++ {
+			s.add(h)
+		}
+	}
+	return nil
+}
+
+// lastBlocksShown is how many of the highest heights the report lists with their entry index.
+const lastBlocksShown = 10
+
+// highestBlocks keeps the entry index of the limit highest block heights seen, the only heights whose entry
+// index the report shows.
+type highestBlocks struct {
+	limit   int
+	entries map[uint64]uint64 // height -> entry index
+}
+
+func newHighestBlocks(limit int) *highestBlocks {
+	return &highestBlocks{limit: limit, entries: make(map[uint64]uint64)}
+}
+
+// add records the block at height found at entryIndex. A later entry for a kept height replaces it.
+func (hb *highestBlocks) add(height, entryIndex uint64) {
+	if _, ok := hb.entries[height]; !ok && len(hb.entries) >= hb.limit {
+		lowest := height
+		for h := range hb.entries {
+			if h < lowest {
+				lowest = h
+			}
+		}
+		if lowest == height {
+			return
+		}
+		delete(hb.entries, lowest)
+	}
+	hb.entries[height] = entryIndex
+}
+
+// merge adds other's blocks, which must come from later entries.
+func (hb *highestBlocks) merge(other map[uint64]uint64) {
+	for h, idx := range other {
+		hb.add(h, idx)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// setHeights returns the heights in s in ascending order.
+func setHeights(s *heightSet) []uint64 {
+	var heights []uint64
+	s.each(func(h uint64) { heights = append(heights, h) })
+	return heights
+}
+
+func TestHeightSetAcrossPages(t *testing.T) {
+	s := newHeightSet()
+	heights := []uint64{0, 63, 64, 65535, 65536, 1 << 40, 5}
+	for _, h := range heights {
+		s.add(h)
+	}
+	s.add(64)
+	if s.size() != uint64(len(heights)) {
+		t.Fatalf("size = %d, want %d", s.size(), len(heights))
+	}
+	want := []uint64{0, 5, 63, 64, 65535, 65536, 1 << 40}
+	if got := setHeights(s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("heights = %v, want %v", got, want)
+	}
+	if s.has(1) || !s.has(65536) {
+		t.Fatalf("membership is wrong")
+	}
+	if lo, hi, ok := s.bounds(); !ok || lo != 0 || hi != 1<<40 {
+		t.Fatalf("bounds = %d, %d, %v", lo, hi, ok)
+	}
+
+	other := newHeightSet()
+	other.add(5)
+	other.add(6)
+	s.union(other)
+	if s.size() != uint64(len(heights)+1) || !s.has(6) {
+		t.Fatalf("union gave %v", setHeights(s))
+	}
+
+	// Checkpoints store the set as runs of consecutive heights.
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "[[0,0],[5,6],[63,64],[65535,65536],[1099511627776,1099511627776]]" {
+		t.Fatalf("json = %s", data)
+	}
+	var decoded heightSet
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(setHeights(&decoded), setHeights(s)) || decoded.size() != s.size() {
+		t.Fatalf("decoded %v, want %v", setHeights(&decoded), setHeights(s))
+	}
+}
+
+func TestHighestBlocksKeepsHighestHeights(t *testing.T) {
+	hb := newHighestBlocks(3)
+	for i, h := range []uint64{5, 1, 9, 7, 3, 9} {
+		hb.add(h, uint64(i))
+	}
+	// The later entry for height 9 wins.
+	if want := map[uint64]uint64{5: 0, 7: 3, 9: 5}; !reflect.DeepEqual(hb.entries, want) {
+		t.Fatalf("entries = %v, want %v", hb.entries, want)
+	}
+}
+
+// benchmarkHeights is the number of dense block heights each benchmark records, about a tenth of a large
+// chain's.
+const benchmarkHeights = 10_000_000
+
+// BenchmarkBlockHeightsMap measures the map the scan used to keep, for comparison with
+// BenchmarkBlockHeightsSet. Compare their B/op.
+func BenchmarkBlockHeightsMap(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		heights := make(map[uint64]uint64)
+		for h := uint64(0); h < benchmarkHeights; h++ {
+			heights[h] = h
+		}
+		if uint64(len(heights)) != benchmarkHeights {
+			b.Fatal("missing heights")
+		}
+	}
+}
+
+func BenchmarkBlockHeightsSet(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		heights := newHeightSet()
+		for h := uint64(0); h < benchmarkHeights; h++ {
+			heights.add(h)
+		}
+		if heights.size() != benchmarkHeights {
+			b.Fatal("missing heights")
+		}
+	}
+}
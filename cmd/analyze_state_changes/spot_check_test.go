@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpotCheckScansOnlyHeadAndTail(t *testing.T) {
+	var heights []uint64
+	for h := uint64(100); h < 130; h++ {
+		heights = append(heights, h)
+	}
+	indexFile, dataFile := writeBlockEntries(t, heights)
+	totalEntries := uint64(len(heights))
+	cfg := scanConfig{Workers: 2, ReadConcurrency: 2}
+
+	ranges := spotCheckRanges(totalEntries, 3, 4)
+	want := []entryRange{{Name: "head", First: 0, End: 3}, {Name: "tail", First: 26, End: 30}}
+	if !reflect.DeepEqual(ranges, want) {
+		t.Fatalf("ranges = %+v, want %+v", ranges, want)
+	}
+	results, err := spotCheck(indexFile, dataFile, totalEntries, ranges, cfg, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := setHeights(results["head"].BlockHeights); !reflect.DeepEqual(got, []uint64{100, 101, 102}) {
+		t.Fatalf("head heights = %v", got)
+	}
+	if got := results["tail"].Last.entries; !reflect.DeepEqual(got, map[uint64]uint64{126: 26, 127: 27, 128: 28, 129: 29}) {
+		t.Fatalf("tail heights = %v", got)
+	}
+	if scanned := results["head"].Scanned + results["tail"].Scanned; scanned != 7 {
+		t.Fatalf("scanned %d entries, want 7", scanned)
+	}
+}
+
+func TestSpotCheckRangesMergeWhenOverlapping(t *testing.T) {
+	if got := spotCheckRanges(10, 6, 5); !reflect.DeepEqual(got, []entryRange{{Name: "head+tail", First: 0, End: 10}}) {
+		t.Fatalf("overlapping ranges = %+v", got)
+	}
+	if got := spotCheckRanges(10, 0, 20); !reflect.DeepEqual(got, []entryRange{{Name: "tail", First: 0, End: 10}}) {
+		t.Fatalf("oversized tail = %+v", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// BlockTxnCount is a block height with the number of transactions in its state-change entry.
+type BlockTxnCount struct {
+	Height     uint64
+	EntryIndex uint64
+	TxnCount   int
+}
+
+// topBlocks keeps the limit blocks with the most transactions seen so far. It is a min-heap, so the
+// lowest-ranked kept block is the one evicted.
+type topBlocks struct {
+	limit  int
+	blocks []BlockTxnCount
+}
+
+func newTopBlocks(limit int) *topBlocks {
+	return &topBlocks{limit: limit}
+}
+
+// ranksAbove reports whether a should be kept ahead of b: more transactions, then the lower height.
+func ranksAbove(a, b BlockTxnCount) bool {
+	if a.TxnCount != b.TxnCount {
+		return a.TxnCount > b.TxnCount
+	}
+	return a.Height < b.Height
+}
+
+func (t *topBlocks) Len() int           { return len(t.blocks) }
+func (t *topBlocks) Less(i, j int) bool { return ranksAbove(t.blocks[j], t.blocks[i]) }
+func (t *topBlocks) Swap(i, j int)      { t.blocks[i], t.blocks[j] = t.blocks[j], t.blocks[i] }
+func (t *topBlocks) Push(x interface{}) { t.blocks = append(t.blocks, x.(BlockTxnCount)) }
+func (t *topBlocks) Pop() interface{} {
+	last := t.blocks[len(t.blocks)-1]
+	t.blocks = t.blocks[:len(t.blocks)-1]
+	return last
+}
+
+// add records a block. A block written more than once only takes one slot, keeping its latest entry.
+func (t *topBlocks) add(block BlockTxnCount) {
+	if t.limit <= 0 {
+		return
+	}
+	if len(t.blocks) == t.limit && !ranksAbove(block, t.blocks[0]) {
+		return
+	}
+	for i := range t.blocks {
+		if t.blocks[i].Height == block.Height {
+			if block.EntryIndex > t.blocks[i].EntryIndex {
+				t.blocks[i] = block
+				heap.Fix(t, i)
+			}
+			return
+		}
+	}
+	if len(t.blocks) < t.limit {
+		heap.Push(t, block)
+		return
+	}
+	t.blocks[0] = block
+	heap.Fix(t, 0)
+}
+
+// merge adds every block kept by other.
+func (t *topBlocks) merge(other *topBlocks) {
+	for _, block := range other.blocks {
+		t.add(block)
+	}
+}
+
+// sorted returns the kept blocks with the most transactions first.
+func (t *topBlocks) sorted() []BlockTxnCount {
+	blocks := append([]BlockTxnCount(nil), t.blocks...)
+	sort.Slice(blocks, func(i, j int) bool { return ranksAbove(blocks[i], blocks[j]) })
+	return blocks
+}
+
+// blockTxnCount returns the number of transactions in a block entry, or false if the entry's encoder isn't
+// a decoded block.
+func blockTxnCount(entry *lib.StateChangeEntry) (int, bool) {
+	block, ok := entry.Encoder.(*lib.MsgDeSoBlock)
+	if !ok || block == nil {
+		return 0, false
+	}
+	return len(block.Txns), true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// txnDensitySummary is how the transactions of the scanned blocks are spread over the chain.
+type txnDensitySummary struct {
+	Total  uint64
+	Blocks uint64
+	// Buckets maps the first height of each bucket of heights to the transactions in its blocks.
+	Buckets map[uint64]uint64
+}
+
+// summarizeTxnDensity totals txnCounts (transactions by block height) overall and per bucket of bucketSize
+// heights.
+func summarizeTxnDensity(txnCounts map[uint64]int, bucketSize uint64) txnDensitySummary {
+	summary := txnDensitySummary{Buckets: make(map[uint64]uint64)}
+	for h, txnCount := range txnCounts {
+		summary.Total += uint64(txnCount)
+		summary.Blocks++
+		summary.Buckets[h/bucketSize*bucketSize] += uint64(txnCount)
+	}
+	return summary
+}
+
+// logTxnDensity logs the totals, the average per block and the per-bucket counts in height order.
+func logTxnDensity(summary txnDensitySummary, bucketSize uint64) {
+	log.Printf("\n=== Transaction density ===")
+	log.Printf("Total transactions: %d in %d blocks", summary.Total, summary.Blocks)
+	if summary.Blocks > 0 {
+		log.Printf("Average per block: %.2f", float64(summary.Total)/float64(summary.Blocks))
+	}
+	starts := make([]uint64, 0, len(summary.Buckets))
+	for start := range summary.Buckets {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		log.Printf("  Heights %d -> %d: %d txns", start, start+bucketSize-1, summary.Buckets[start])
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTxnDensityCountsTransactionsPerBucket(t *testing.T) {
+	// writeBlockEntries gives the i'th entry i%5 transactions. Height 5 is written again last with none, and
+	// the later entry wins as it does for the gap analysis.
+	var heights []uint64
+	for h := uint64(1); h <= 25; h++ {
+		heights = append(heights, h)
+	}
+	heights = append(heights, 5)
+	indexFile, dataFile := writeBlockEntries(t, heights)
+
+	for _, workers := range []int{1, 3} {
+		cfg := scanConfig{Workers: workers, ReadConcurrency: workers, MaxDecodeErrorRate: 1, CountTxns: true}
+		result, err := scanBlockHeights(indexFile, dataFile, uint64(len(heights)), cfg, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := summarizeTxnDensity(result.TxnCounts, 10)
+		want := txnDensitySummary{Total: 46, Blocks: 25, Buckets: map[uint64]uint64{0: 12, 10: 20, 20: 14}}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%d workers: density = %+v, want %+v", workers, got, want)
+		}
+	}
+}
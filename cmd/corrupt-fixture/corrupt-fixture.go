@@ -0,0 +1,63 @@
+// corrupt-fixture writes corrupted copies of a clean state-change fixture, one directory per corruption, for
+// testing the repair tool's corruption detectors. It is a test-support tool and isn't part of a repair.
+package main
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/config"
+	"github.com/deso-protocol/postgres-data-handler/repair/corrupt"
+	"github.com/spf13/viper"
+)
+
+func main() {
+	if _, err := config.LoadConfig(viper.GetViper()); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	sourceDir := viper.GetString("CORRUPT_SOURCE_DIR")
+	outputDir := viper.GetString("CORRUPT_OUTPUT_DIR")
+	if sourceDir == "" || outputDir == "" {
+		log.Fatalf("CORRUPT_SOURCE_DIR and CORRUPT_OUTPUT_DIR are required")
+	}
+	clean, err := corrupt.Read(sourceDir)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", sourceDir, err)
+	}
+	log.Printf("Read %d entries from %s", clean.Entries(), sourceDir)
+
+	variants := map[string]func() (*corrupt.Files, error){
+		"truncated-final-entry": func() (*corrupt.Files, error) { return corrupt.TruncateFinalEntry(clean) },
+		"overlapping-offsets":   func() (*corrupt.Files, error) { return corrupt.OverlapOffsets(clean, 1) },
+	}
+	// The block-level corruptions target the block at CORRUPT_HEIGHT.
+	if viper.IsSet("CORRUPT_HEIGHT") {
+		height := viper.GetUint64("CORRUPT_HEIGHT")
+		variants["wrong-block-hash"] = func() (*corrupt.Files, error) {
+			return corrupt.WrongBlockHash(clean, height, make([]byte, lib.HashSizeBytes))
+		}
+		variants["missing-index-pointer"] = func() (*corrupt.Files, error) {
+			i, err := clean.BlockEntryIndex(height)
+			if err != nil {
+				return nil, err
+			}
+			return corrupt.DropIndexRecord(clean, i)
+		}
+	} else {
+		log.Printf("CORRUPT_HEIGHT is unset, skipping the wrong-block-hash and missing-index-pointer variants")
+	}
+
+	for name, build := range variants {
+		files, err := build()
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		dir := filepath.Join(outputDir, name)
+		if err := files.Write(dir); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		log.Printf("Wrote %s", dir)
+	}
+}
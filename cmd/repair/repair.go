@@ -1,25 +1,22 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/binary"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"path/filepath"
-	"sync"
+	"runtime"
+	"strings"
 	"time"
 
 	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/config"
+	"github.com/deso-protocol/postgres-data-handler/entries"
 	"github.com/deso-protocol/postgres-data-handler/handler"
+	"github.com/deso-protocol/postgres-data-handler/repair"
 	lru "github.com/hashicorp/golang-lru/v2"
 	_ "github.com/lib/pq"
 	"github.com/spf13/viper"
@@ -29,691 +26,673 @@ import (
 	"github.com/uptrace/bun/extra/bundebug"
 )
 
-// Gap represents a contiguous range of missing block heights.
-type Gap struct{ Start, End uint64 }
+func main() {
+	// Load configuration the same way as the other repair commands
+	if configFile, err := config.LoadConfig(viper.GetViper()); err != nil {
+		log.Fatalf("%v", err)
+	} else if configFile != "" {
+		log.Printf("Read config from %s", configFile)
+	}
+	stateChangeDir := config.ResolveStateChangeDir(viper.GetViper())
+	log.Printf("State-change directory: %s", stateChangeDir)
 
-// parseGapsFromFile reads a gap list file like state-changes-gaps.txt
-// Format: "Gap 44865: heights 24195810 -> 24195811 (2 blocks missing)"
-func parseGapsFromFile(filename string) ([]Gap, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("open gap file: %w", err)
-	}
-	defer file.Close()
-
-	var gaps []Gap
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		var start, end uint64
-		// Parse lines like: "Gap 44865: heights 24195810 -> 24195811 (2 blocks missing)"
-		if _, err := fmt.Sscanf(line, "Gap %d: heights %d -> %d", new(int), &start, &end); err == nil {
-			gaps = append(gaps, Gap{Start: start, End: end})
-		} else {
-			// Try alternate format
-			if _, err := fmt.Sscanf(line, "%d -> %d", &start, &end); err == nil {
-				gaps = append(gaps, Gap{Start: start, End: end})
-			}
+	// The self-test needs neither the DB nor the node, so it runs before either is set up.
+	if viper.GetBool("SELF_TEST") {
+		problems, err := repair.SelfTest(&lib.DeSoMainnetParams)
+		if err != nil {
+			log.Fatalf("selfTest: %v", err)
 		}
+		for _, problem := range problems {
+			log.Printf("SELF-TEST FAILURE: %s", problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		log.Printf("Self-test passed")
+		return
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("reading file: %w", err)
-	}
-	return gaps, nil
-}
 
-// detectGaps runs the user-provided SQL to return missing block ranges.
-func detectGaps(db *bun.DB) ([]Gap, error) {
-	type gapRow struct{ StartHeight, EndHeight, MissingCount uint64 }
-	var rows []gapRow
-	query := `
-WITH ordered AS (
-  SELECT DISTINCT height FROM block
-),
-sequenced AS (
-  SELECT 
-    height,
-    LEAD(height) OVER (ORDER BY height) AS next_height
-  FROM ordered
-)
-SELECT
-  height + 1 AS start_height,
-  next_height - 1 AS end_height,
-  (next_height - height - 1) AS missing_count
-FROM sequenced
-WHERE next_height IS NOT NULL
-  AND next_height > height + 1
-ORDER BY start_height;
-	`
-	err := db.NewRaw(query).Scan(context.Background(), &rows)
-	if err != nil {
-		return nil, fmt.Errorf("detectGaps query failed: %w", err)
-	}
-	var gaps []Gap
-	for _, r := range rows {
-		gaps = append(gaps, Gap{Start: r.StartHeight, End: r.EndHeight})
+	// Index dump mode: print the first and last DUMP_INDEX index records under both known layouts, to tell
+	// which one the state-change files use, and exit. It doesn't need the DB either.
+	if n := viper.GetUint64("DUMP_INDEX"); n > 0 {
+		indexFile, dataFile, err := repair.OpenStateChangeFiles(stateChangeDir)
+		if err != nil {
+			log.Fatalf("dumpIndex: %v", err)
+		}
+		indexInfo, err := indexFile.Stat()
+		if err != nil {
+			log.Fatalf("dumpIndex: %v", err)
+		}
+		dataInfo, err := dataFile.Stat()
+		if err != nil {
+			log.Fatalf("dumpIndex: %v", err)
+		}
+		if err := repair.DumpIndex(os.Stdout, indexFile, indexInfo.Size(), dataFile, dataInfo.Size(), n); err != nil {
+			log.Fatalf("dumpIndex: %v", err)
+		}
+		return
 	}
-	return gaps, nil
-}
 
-// fetchBlockByHeight fetches a block from the DeSo node by height using the /api/v1/block endpoint.
-// Returns the block and its hash (from the API, not computed).
-func fetchBlockByHeight(nodeURL string, height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
-	url := fmt.Sprintf("%s/api/v1/block", nodeURL)
-	body, err := json.Marshal(map[string]interface{}{
-		"Height":    height,
-		"FullBlock": true,
-	})
+	dbSettings, err := config.ResolveDBSettings(viper.GetViper())
 	if err != nil {
-		return nil, nil, fmt.Errorf("marshal block request: %w", err)
+		log.Fatalf("%v", err)
 	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, nil, fmt.Errorf("create request: %w", err)
+	// APPLICATION_NAME identifies this run's connections in pg_stat_activity.
+	applicationName := viper.GetString("APPLICATION_NAME")
+	if applicationName == "" {
+		applicationName = repair.DefaultApplicationName("repair")
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	log.Printf("Postgres application_name: %s", applicationName)
+	dbTimeouts, err := repair.ParseDBTimeouts(viper.GetString("DB_CONNECT_TIMEOUT"), viper.GetString("DB_OPERATION_TIMEOUT"))
 	if err != nil {
-		return nil, nil, fmt.Errorf("request failed: %w", err)
+		log.Fatalf("%v", err)
 	}
-	defer resp.Body.Close()
+	log.Printf("Postgres timeouts: connect %s, operation %s", dbTimeouts.Connect, dbTimeouts.Operation)
+	pgURI := repair.PostgresDSN(dbSettings, applicationName, dbTimeouts)
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, nil, fmt.Errorf("read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+	// Open DB using the same pattern as main.go
+	pgdb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(pgURI)))
+	if pgdb == nil {
+		log.Fatalf("Failed to open postgres DB")
 	}
+	db := bun.NewDB(pgdb, pgdialect.New())
+	db.SetConnMaxLifetime(0)
 
-	// Parse APIBlockResponse format
-	// The API returns hashes as hex strings in specific field names
-	var apiResult struct {
-		Header struct {
-			BlockHashHex                 string `json:"BlockHashHex"`
-			Version                      uint32 `json:"Version"`
-			PrevBlockHashHex             string `json:"PrevBlockHashHex"`
-			TransactionMerkleRootHex     string `json:"TransactionMerkleRootHex"`
-			TstampNanoSecs               int64  `json:"TstampNanoSecs"`
-			Height                       uint64 `json:"Height"`
-			Nonce                        uint64 `json:"Nonce"`
-			ExtraNonce                   uint64 `json:"ExtraNonce"`
-			ProposerVotingPublicKey      string `json:"ProposerVotingPublicKey"`
-			ProposerRandomSeedSignature  string `json:"ProposerRandomSeedSignature"`
-			ProposedInView               uint64 `json:"ProposedInView"`
-			ProposerVotePartialSignature string `json:"ProposerVotePartialSignature"`
-		} `json:"Header"`
-		Transactions []struct {
-			RawTransactionHex string `json:"RawTransactionHex"`
-		} `json:"Transactions"`
-		Error string `json:"Error"`
-	}
-	if err := json.Unmarshal(respBody, &apiResult); err != nil {
-		return nil, nil, fmt.Errorf("unmarshal response: %w", err)
+	// Optional: serve pprof so CPU and heap profiles can be captured from a running repair
+	pprofServer, pprofAddr, err := repair.StartPprofServer(viper.GetString("PPROF_ADDR"))
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
-
-	if apiResult.Error != "" {
-		return nil, nil, fmt.Errorf("API error: %s", apiResult.Error)
+	if pprofServer != nil {
+		defer pprofServer.Close()
+		log.Printf("pprof listening on http://%s/debug/pprof/", pprofAddr)
 	}
 
-	// Decode hex strings to BlockHash
-	prevBlockHash, err := decodeBlockHash(apiResult.Header.PrevBlockHashHex)
-	if err != nil {
-		return nil, nil, fmt.Errorf("decode prev block hash: %w", err)
+	opts := repair.DefaultOptions()
+
+	// Get worker count from environment (default 100, or derived from the CPU count with AUTO_WORKERS_FROM_CPU).
+	// FETCH_WORKERS and DB_WORKERS tune the node and DB sides separately; REPAIR_WORKERS sets both.
+	if workerCount := viper.GetInt("FETCH_WORKERS"); workerCount != 0 {
+		opts.Workers = workerCount
+	} else if workerCount := viper.GetInt("REPAIR_WORKERS"); workerCount != 0 {
+		opts.Workers = workerCount
+	} else if viper.GetBool("AUTO_WORKERS_FROM_CPU") {
+		opts.Workers = repair.WorkersForCPUs(runtime.NumCPU(), viper.GetBool("USE_STATE_CHANGES"))
+		log.Printf("Derived %d workers from %d CPUs", opts.Workers, runtime.NumCPU())
 	}
-
-	txnMerkleRoot, err := decodeBlockHash(apiResult.Header.TransactionMerkleRootHex)
-	if err != nil {
-		return nil, nil, fmt.Errorf("decode txn merkle root: %w", err)
+	opts.DBWorkers = viper.GetInt("DB_WORKERS")
+	if opts.Workers < 1 || opts.DBWorkers < 0 {
+		log.Fatalf("FETCH_WORKERS/REPAIR_WORKERS must be at least 1 and DB_WORKERS can't be negative")
 	}
+	// Size the connection pool for the DB workers
+	dbWorkers := opts.DBWorkerCount()
+	db.SetMaxIdleConns(dbWorkers + 10)
+	db.SetMaxOpenConns(dbWorkers + 20)
+	log.Printf("Fetch workers: %d, DB workers: %d, Max DB connections: %d", opts.Workers, dbWorkers, dbWorkers+20)
 
-	// Build the proper Header struct
-	header := &lib.MsgDeSoHeader{
-		Version:               apiResult.Header.Version,
-		PrevBlockHash:         prevBlockHash,
-		TransactionMerkleRoot: txnMerkleRoot,
-		TstampNanoSecs:        apiResult.Header.TstampNanoSecs,
-		Height:                apiResult.Header.Height,
-		Nonce:                 apiResult.Header.Nonce,
-		ExtraNonce:            apiResult.Header.ExtraNonce,
-		ProposedInView:        apiResult.Header.ProposedInView,
+	// Optional: enable query logging
+	if viper.GetBool("LOG_QUERIES") {
+		db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
 	}
 
-	// For PoS blocks, the API returns BLS fields as base64-encoded strings
-	// We need to decode them, but for now we'll use a simpler approach:
-	// Just fetch the raw block bytes from a different endpoint or skip BLS validation
-	// The state-consumer doesn't validate block hashes, it just stores them
-	// So we can leave BLS fields nil and use the block hash from the API response
-
-	// Decode transactions from hex
-	txns := make([]*lib.MsgDeSoTxn, len(apiResult.Transactions))
-	for i, txData := range apiResult.Transactions {
-		txnBytes, err := hex.DecodeString(txData.RawTransactionHex)
+	// Time-range mode: resolve REPAIR_START_TIME/REPAIR_END_TIME to heights from the block table's timestamps
+	// and use them as REPAIR_START_HEIGHT/REPAIR_END_HEIGHT, for the repair and every mode that reads them.
+	if viper.IsSet("REPAIR_START_TIME") || viper.IsSet("REPAIR_END_TIME") {
+		if viper.GetUint64("REPAIR_START_HEIGHT") != 0 || viper.GetUint64("REPAIR_END_HEIGHT") != 0 {
+			log.Fatalf("REPAIR_START_TIME/REPAIR_END_TIME can't be combined with REPAIR_START_HEIGHT/REPAIR_END_HEIGHT")
+		}
+		startTime, endTime, err := repair.ParseTimeRange(viper.GetString("REPAIR_START_TIME"), viper.GetString("REPAIR_END_TIME"))
 		if err != nil {
-			return nil, nil, fmt.Errorf("decode transaction %d hex: %w", i, err)
+			log.Fatalf("%v", err)
 		}
-
-		txn := &lib.MsgDeSoTxn{}
-		if err := txn.FromBytes(txnBytes); err != nil {
-			return nil, nil, fmt.Errorf("parse transaction %d bytes: %w", i, err)
+		heights, err := repair.ResolveTimeRange(context.Background(), db, startTime, endTime)
+		if err != nil {
+			log.Fatalf("resolveTimeRange: %v", err)
 		}
-		txns[i] = txn
+		log.Printf("Time range %s -> %s resolves to heights %d -> %d (%d blocks)",
+			startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), heights.Start, heights.End, heights.End-heights.Start+1)
+		viper.Set("REPAIR_START_HEIGHT", heights.Start)
+		viper.Set("REPAIR_END_HEIGHT", heights.End)
 	}
 
-	block := &lib.MsgDeSoBlock{
-		Header: header,
-		Txns:   txns,
+	// Get node URL for API calls
+	nodeURL := viper.GetString("NODE_URL")
+	if nodeURL == "" {
+		nodeURL = "http://localhost:17001" // Default for mainnet node
 	}
+	log.Printf("Using DeSo node URL: %s", nodeURL)
 
-	// Return the block hash from the API (don't compute it, as that requires BLS fields for PoS blocks)
-	blockHash, err := decodeBlockHash(apiResult.Header.BlockHashHex)
-	if err != nil {
-		return nil, nil, fmt.Errorf("decode block hash from API: %w", err)
+	source := repair.NewAPIBlockSource(nodeURL)
+	source.VerifyTxnCount = viper.GetBool("VERIFY_BLOCK_TXN_COUNT")
+	if viper.IsSet("TRUNCATED_BLOCK_RETRIES") {
+		source.TruncatedRetries = viper.GetInt("TRUNCATED_BLOCK_RETRIES")
 	}
-
-	return block, blockHash, nil
-}
-
-// decodeBlockHash converts a hex string to *lib.BlockHash
-func decodeBlockHash(hexStr string) (*lib.BlockHash, error) {
-	if hexStr == "" {
-		return nil, nil
+	if rawBlockPath := viper.GetString("RAW_BLOCK_ENDPOINT"); rawBlockPath != "" {
+		source.RawBlockPath = rawBlockPath
+		log.Printf("Fetching serialized blocks from %s%s when available", nodeURL, rawBlockPath)
 	}
-
-	hashBytes, err := hex.DecodeString(hexStr)
-	if err != nil {
-		return nil, err
+	if viper.GetBool("NODE_HTTP2") {
+		source.Client.Transport = repair.NewHTTP2Transport()
+		log.Printf("Fetching from the node over HTTP/2 only")
 	}
-
-	if len(hashBytes) != lib.HashSizeBytes {
-		return nil, fmt.Errorf("invalid hash length: got %d, want %d", len(hashBytes), lib.HashSizeBytes)
+	if extraFields := viper.GetString("BLOCK_REQUEST_EXTRA_FIELDS"); extraFields != "" {
+		if source.ExtraRequestFields, err = repair.ParseExtraRequestFields(extraFields); err != nil {
+			log.Fatalf("%v", err)
+		}
+		log.Printf("Adding %s to every block request", extraFields)
+	}
+	if source.VerifyTxnCount {
+		log.Printf("Cross-checking fetched blocks against the node's reported txn count (%d retries)", source.TruncatedRetries)
 	}
 
-	var blockHash lib.BlockHash
-	copy(blockHash[:], hashBytes)
-	return &blockHash, nil
-}
-
-// processBlockFromAPI fetches and processes a block from the node API
-// With OperationType=Upsert, bulkInsertBlockEntry will extract and process all transactions
-func processBlockFromAPI(nodeURL string, height uint64, pdh *handler.PostgresDataHandler) error {
-	block, blockHash, err := fetchBlockByHeight(nodeURL, height)
+	opts.StateChangeDir = stateChangeDir
+	opts.IndexFormat, err = repair.ParseIndexFormat(viper.GetInt("STATE_CHANGE_INDEX_RECORD_SIZE"), viper.GetString("STATE_CHANGE_INDEX_ENDIANNESS"), viper.GetString("STATE_CHANGE_INDEX_ADDRESSING"))
 	if err != nil {
-		return err
+		log.Fatalf("%v", err)
 	}
-
-	log.Printf("Fetched block %d with %d transactions", height, len(block.Txns))
-
-	// Use the block hash from the API (don't compute it)
-	// Create state change entry for the block with UPSERT operation
-	// CRITICAL: Using Upsert ensures bulkInsertBlockEntry processes the block
-	// bulkInsertBlockEntry will automatically:
-	// 1. Insert/update the block
-	// 2. Extract ALL transactions from block.Txns[]
-	// 3. Process each transaction (posts, follows, likes, diamonds, etc.)
-	// 4. Insert transactions into transaction table
-	blockEntry := &lib.StateChangeEntry{
-		EncoderType:   lib.EncoderTypeBlock,
-		OperationType: lib.DbOperationTypeUpsert, // UPSERT triggers transaction processing
-		Encoder:       block,
-		Block:         block,
-		BlockHeight:   height,
-		KeyBytes:      blockHash[:],
+	opts.CommitInterval = viper.GetDuration("COMMIT_INTERVAL")
+	opts.CommitTxnRows = viper.GetUint64("COMMIT_TXN_ROWS")
+	if opts.CommitRampStart = viper.GetUint64("COMMIT_RAMP_START"); opts.CommitRampStart > 0 {
+		if opts.CommitRampStart >= opts.CommitBatchSize {
+			log.Fatalf("COMMIT_RAMP_START (%d) must be below the commit batch size (%d)", opts.CommitRampStart, opts.CommitBatchSize)
+		}
+		log.Printf("Ramping the commit size from %d up to %d", opts.CommitRampStart, opts.CommitBatchSize)
 	}
-
-	// Process the block entry - this processes the block AND all its transactions
-	if err := pdh.HandleEntryBatch([]*lib.StateChangeEntry{blockEntry}, false); err != nil {
-		return fmt.Errorf("failed to process block for height %d: %w", height, err)
+	if viper.IsSet("BEGIN_TXN_RETRIES") {
+		opts.BeginRetries = viper.GetInt("BEGIN_TXN_RETRIES")
 	}
-
-	log.Printf("Successfully processed block %d via API (%d transactions)", height, len(block.Txns))
-	return nil
-}
-
-// openStateChangeFiles opens both the index and data files for reading
-func openStateChangeFiles(stateChangeDir string) (*os.File, *os.File, error) {
-	indexPath := filepath.Join(stateChangeDir, lib.StateChangeIndexFileName)
-	dataPath := filepath.Join(stateChangeDir, lib.StateChangeFileName)
-
-	indexFile, err := os.Open(indexPath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open index file %s: %w", indexPath, err)
+	if viper.IsSet("BEGIN_TXN_BACKOFF") {
+		opts.BeginRetryBackoff = viper.GetDuration("BEGIN_TXN_BACKOFF")
 	}
-
-	dataFile, err := os.Open(dataPath)
-	if err != nil {
-		indexFile.Close()
-		return nil, nil, fmt.Errorf("failed to open data file %s: %w", dataPath, err)
+	opts.PerGapTransaction = viper.GetBool("PER_GAP_TRANSACTION")
+	if opts.PerGapTransaction {
+		log.Printf("PER_GAP_TRANSACTION: each gap is committed whole or rolled back; batch commit settings are ignored")
 	}
-
-	return indexFile, dataFile, nil
-}
-
-// readBlockFromStateChange reads a StateChangeEntry for a specific block height from state-change files
-func readBlockFromStateChange(indexFile, dataFile *os.File, height uint64) (*lib.StateChangeEntry, error) {
-	// Read the byte position from the index file
-	// Index file stores uint64 at position (height * 8)
-	entryIndexBytes := make([]byte, 8)
-	fileBytesPosition := int64(height * 8)
-
-	bytesRead, err := indexFile.ReadAt(entryIndexBytes, fileBytesPosition)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read index at height %d: %w", height, err)
+	if viper.IsSet("MAX_DECODE_ERROR_RATIO") {
+		opts.MaxDecodeErrorRatio = viper.GetFloat64("MAX_DECODE_ERROR_RATIO")
+		if opts.MaxDecodeErrorRatio < 0 || opts.MaxDecodeErrorRatio >= 1 {
+			log.Fatalf("MAX_DECODE_ERROR_RATIO must be at least 0 and below 1, got %v", opts.MaxDecodeErrorRatio)
+		}
 	}
-	if bytesRead != 8 {
-		return nil, fmt.Errorf("expected to read 8 bytes from index, got %d", bytesRead)
+	if opts.UnsupportedEncoderPolicy, err = repair.ParseUnsupportedEncoderPolicy(viper.GetString("UNSUPPORTED_ENCODER_POLICY")); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	// Decode the byte position in the data file
-	dbIndex := binary.LittleEndian.Uint64(entryIndexBytes)
-
-	// Seek to the position in the data file
-	if _, err := dataFile.Seek(int64(dbIndex), io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to position %d in data file: %w", dbIndex, err)
+	// Choose network params
+	params := &lib.DeSoMainnetParams
+	if viper.GetBool("IS_TESTNET") {
+		params = &lib.DeSoTestnetParams
+		if viper.GetBool("REGTEST") {
+			params.EnableRegtest(viper.GetBool("ACCELERATED_REGTEST"))
+		}
 	}
+	lib.GlobalDeSoParams = *params
 
-	// Read the entry length (uvarint)
-	bufReader := bufio.NewReader(dataFile)
-	entryLength, err := lib.ReadUvarint(bufReader)
+	// Create PostgresDataHandler for transactionality
+	cachedEntries, err := lru.New[string, []byte](int(handler.EntryCacheSize))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read entry length at height %d: %w", height, err)
-	}
-
-	// Read the entry bytes
-	entryBytes := make([]byte, entryLength)
-	if _, err := io.ReadFull(bufReader, entryBytes); err != nil {
-		return nil, fmt.Errorf("failed to read entry bytes at height %d: %w", height, err)
+		log.Fatalf("LRU cache: %v", err)
 	}
-
-	// Decode the entry
-	entry := &lib.StateChangeEntry{}
-	rr := bytes.NewReader(entryBytes)
-	if _, err := lib.DecodeFromBytes(entry, rr); err != nil {
-		return nil, fmt.Errorf("failed to decode entry at height %d: %w", height, err)
+	pdh := &handler.PostgresDataHandler{
+		DB:            db,
+		Params:        params,
+		CachedEntries: cachedEntries,
 	}
-
-	return entry, nil
-}
-
-// processGapFromStateChange processes a gap by reading directly from state-change files
-func processGapFromStateChange(stateChangeDir string, startHeight, endHeight uint64, pdh *handler.PostgresDataHandler, skipBlocks bool) error {
-	log.Printf("Opening state-change files from %s", stateChangeDir)
-
-	indexFile, dataFile, err := openStateChangeFiles(stateChangeDir)
+	// Optionally pin the isolation level of repair transactions instead of using the database default.
+	pdh.IsolationLevel, err = repair.ParseIsolationLevel(viper.GetString("DB_ISOLATION_LEVEL"))
 	if err != nil {
-		return fmt.Errorf("failed to open state-change files: %w", err)
+		log.Fatalf("%v", err)
+	}
+	if pdh.IsolationLevel != sql.LevelDefault {
+		log.Printf("Repair transactions use isolation level %s", pdh.IsolationLevel)
 	}
-	defer indexFile.Close()
-	defer dataFile.Close()
 
-	if skipBlocks {
-		log.Printf("Processing NON-BLOCK state changes for blocks %d -> %d from state-change files", startHeight, endHeight)
-		log.Printf("Skipping blocks (already in DB), processing: posts, likes, follows, diamonds, transactions, etc.")
-	} else {
-		log.Printf("Processing ALL state changes for blocks %d -> %d from state-change files", startHeight, endHeight)
-	}
-
-	// Track statistics
-	blocksFound := make(map[uint64]bool)
-	blocksSkipped := uint64(0)
-	entriesProcessed := uint64(0)
-	entriesSkipped := uint64(0)
-	totalEntries := uint64(0)
-	lastLogTime := time.Now()
-
-	// Scan through all entries in the state-change files
-	bufReader := bufio.NewReader(dataFile)
-	
-	for {
-		totalEntries++
-
-		// Log progress every 100K entries or every 10 seconds
-		if totalEntries%100000 == 0 || time.Since(lastLogTime) > 10*time.Second {
-			log.Printf("Progress: Scanned %d entries, found %d blocks in range, processed %d entries, skipped %d blocks",
-				totalEntries, len(blocksFound), entriesProcessed, blocksSkipped)
-			lastLogTime = time.Now()
-		}
-
-		// Read index entry (8 bytes: offset into data file, little-endian)
-		indexBytes := make([]byte, 8)
-		if _, err := io.ReadFull(indexFile, indexBytes); err != nil {
-			if err == io.EOF {
+	// Signer detection mode: find PoS blocks with no block_signer rows and optionally repair them.
+	if viper.GetBool("DETECT_MISSING_SIGNERS") {
+		posCutoverHeight := uint64(params.ForkHeights.ProofOfStake2ConsensusCutoverBlockHeight)
+		if viper.IsSet("POS_CUTOVER_HEIGHT") {
+			posCutoverHeight = viper.GetUint64("POS_CUTOVER_HEIGHT")
+		}
+		blocks, err := repair.DetectSignerlessBlocks(db, posCutoverHeight,
+			viper.GetUint64("REPAIR_START_HEIGHT"), viper.GetUint64("REPAIR_END_HEIGHT"))
+		if err != nil {
+			log.Fatalf("detectSignerlessBlocks: %v", err)
+		}
+		log.Printf("Found %d PoS block(s) above height %d with no block_signer rows", len(blocks), posCutoverHeight)
+		for i, b := range blocks {
+			if i >= 10 {
+				log.Printf("  ... and %d more", len(blocks)-10)
 				break
 			}
-			return fmt.Errorf("error reading index: %w", err)
+			log.Printf("  Height %d (%s)", b.Height, b.BlockHash)
 		}
-
-		offset := binary.LittleEndian.Uint64(indexBytes[0:8])
-
-		// Read the state change entry from data file
-		if _, err := dataFile.Seek(int64(offset), 0); err != nil {
-			return fmt.Errorf("seek error at offset %d: %w", offset, err)
+		if len(blocks) > 0 && viper.GetBool("REPAIR_MISSING_SIGNERS") {
+			repaired, err := repair.RepairSignerlessBlocks(opts.StateChangeDir, opts.IndexFormat, blocks, pdh)
+			if err != nil {
+				log.Fatalf("repairSignerlessBlocks: %v", err)
+			}
+			log.Printf("Repaired signers for %d/%d block(s)", repaired, len(blocks))
 		}
+		return
+	}
 
-		// Reset buffered reader after seek
-		bufReader.Reset(dataFile)
-
-		// Read entry length (uvarint)
-		entryLength, err := binary.ReadUvarint(bufReader)
+	// Signer verification mode: compare each block's block_signer row count with the signers in its QC.
+	if viper.GetBool("VERIFY_SIGNERS") {
+		start := viper.GetUint64("REPAIR_START_HEIGHT")
+		end := viper.GetUint64("REPAIR_END_HEIGHT")
+		if end == 0 || start > end {
+			log.Fatalf("VERIFY_SIGNERS requires a valid REPAIR_START_HEIGHT/REPAIR_END_HEIGHT range")
+		}
+		var mismatches []repair.SignerMismatch
+		if viper.GetBool("USE_STATE_CHANGES") {
+			log.Printf("Verifying block signers for %d -> %d against state-change files in %s", start, end, opts.StateChangeDir)
+			mismatches, err = repair.VerifySignersFromStateChanges(context.Background(), db, opts.StateChangeDir, opts.IndexFormat, start, end)
+		} else {
+			log.Printf("Verifying block signers for %d -> %d against node", start, end)
+			mismatches, err = repair.VerifySigners(context.Background(), db, source, start, end)
+		}
 		if err != nil {
-			log.Printf("WARNING: Failed to read entry length at offset %d: %v", offset, err)
-			continue
+			log.Fatalf("verifySigners: %v", err)
 		}
-
-		// Sanity check: max 10MB per entry
-		if entryLength > 10*1024*1024 {
-			log.Printf("WARNING: Entry too large at offset %d: %d bytes", offset, entryLength)
-			continue
+		log.Printf("Found %d block(s) whose signer rows don't match their QC", len(mismatches))
+		for i, m := range mismatches {
+			if i >= 100 {
+				log.Printf("  ... and %d more", len(mismatches)-100)
+				break
+			}
+			log.Printf("  Height %d (%s): %d signer row(s), QC has %d", m.Height, m.BlockHash, m.Actual, m.Expected)
 		}
-
-		entryBytes := make([]byte, entryLength)
-		if _, err := io.ReadFull(bufReader, entryBytes); err != nil {
-			log.Printf("WARNING: Failed to read entry data: %v", err)
-			continue
+		if len(mismatches) > 0 {
+			os.Exit(1)
 		}
+		return
+	}
 
-		// Decode the state change entry
-		entry := &lib.StateChangeEntry{}
-		rr := bytes.NewReader(entryBytes)
-		if _, err := lib.DecodeFromBytes(entry, rr); err != nil {
-			log.Printf("WARNING: Failed to decode entry at offset %d: %v", offset, err)
-			continue
+	// Orphaned signer mode: find block_signer rows whose block row is gone and optionally delete them.
+	if viper.GetBool("DETECT_ORPHANED_SIGNERS") {
+		orphans, err := repair.DetectOrphanedSigners(context.Background(), db)
+		if err != nil {
+			log.Fatalf("detectOrphanedSigners: %v", err)
 		}
-
-		// Get block height from the decoded entry
-		blockHeight := entry.BlockHeight
-
-		// Debug: log first few entries to verify parsing
-		if totalEntries <= 10 {
-			log.Printf("DEBUG: Entry %d - offset=%d, encoder_type=%d, blockHeight=%d",
-				totalEntries, offset, entry.EncoderType, blockHeight)
+		rows := 0
+		for _, o := range orphans {
+			rows += o.Rows
 		}
-
-		// Skip entries outside our range
-		if blockHeight < startHeight || blockHeight > endHeight {
-			continue
+		log.Printf("Found %d block_signer row(s) for %d block hash(es) with no block row", rows, len(orphans))
+		for i, o := range orphans {
+			if i >= 100 {
+				log.Printf("  ... and %d more", len(orphans)-100)
+				break
+			}
+			log.Printf("  %s: %d signer row(s)", o.BlockHash, o.Rows)
 		}
+		if len(orphans) == 0 {
+			return
+		}
+		if !viper.GetBool("DELETE_ORPHANED_SIGNERS") {
+			os.Exit(1)
+		}
+		deleted, err := repair.DeleteOrphanedSigners(context.Background(), db)
+		if err != nil {
+			log.Fatalf("deleteOrphanedSigners: %v", err)
+		}
+		log.Printf("Deleted %d orphaned block_signer row(s)", deleted)
+		return
+	}
 
-		// Track blocks found
-		if entry.EncoderType == lib.EncoderTypeBlock {
-			blocksFound[blockHeight] = true
-
-			// Skip block entries if blocks already exist in DB
-			if skipBlocks {
-				blocksSkipped++
-				if blocksSkipped%1000 == 0 {
-					log.Printf("Found %d blocks in state-changes (skipped, already in DB)", blocksSkipped)
-				}
-				continue
+	// Orphaned stake reward mode: find stake_reward rows whose block row is gone and optionally delete them.
+	if viper.GetBool("DETECT_ORPHANED_STAKE_REWARDS") {
+		orphans, err := repair.DetectOrphanedStakeRewards(context.Background(), db)
+		if err != nil {
+			log.Fatalf("detectOrphanedStakeRewards: %v", err)
+		}
+		rows := 0
+		for _, o := range orphans {
+			rows += o.Rows
+		}
+		log.Printf("Found %d stake_reward row(s) for %d block hash(es) with no block row", rows, len(orphans))
+		for i, o := range orphans {
+			if i >= 100 {
+				log.Printf("  ... and %d more", len(orphans)-100)
+				break
 			}
+			log.Printf("  %s: %d reward row(s), %d nanos", o.BlockHash, o.Rows, o.RewardNanos)
 		}
-
-		// Change operation type from Insert to Upsert for repair operations
-		entry.OperationType = lib.DbOperationTypeUpsert
-
-		// Process this entry
-		if err := pdh.HandleEntryBatch([]*lib.StateChangeEntry{entry}, false); err != nil {
-			log.Printf("WARNING: Failed to process entry for block %d, encoder type %v: %v", blockHeight, entry.EncoderType, err)
-			entriesSkipped++
-			continue
+		if len(orphans) == 0 {
+			return
 		}
-
-		entriesProcessed++
-
-		// Log progress
-		if entriesProcessed%10000 == 0 {
-			log.Printf("Processed %d entries (skipped %d blocks, %d failed)", entriesProcessed, blocksSkipped, entriesSkipped)
+		if !viper.GetBool("DELETE_ORPHANED_STAKE_REWARDS") {
+			os.Exit(1)
+		}
+		deleted, err := repair.DeleteOrphanedStakeRewards(context.Background(), db)
+		if err != nil {
+			log.Fatalf("deleteOrphanedStakeRewards: %v", err)
 		}
+		log.Printf("Deleted %d orphaned stake_reward row(s)", deleted)
+		return
+	}
 
-		// Commit periodically to avoid huge transactions
-		if entriesProcessed%10000 == 0 {
-			log.Printf("Committing batch after %d entries...", entriesProcessed)
-			if err := pdh.CommitTransaction(); err != nil {
-				return fmt.Errorf("commit transaction: %w", err)
-			}
-			if err := pdh.InitiateTransaction(); err != nil {
-				return fmt.Errorf("initiate transaction: %w", err)
+	// Block rows written without a hash can't be referenced by their transactions or signers.
+	if viper.GetBool("DETECT_EMPTY_BLOCK_HASHES") {
+		heights, err := repair.DetectEmptyBlockHashes(context.Background(), db)
+		if err != nil {
+			log.Fatalf("detectEmptyBlockHashes: %v", err)
+		}
+		log.Printf("Found %d block row height(s) with an empty or all-zero block_hash", len(heights))
+		for i, h := range heights {
+			if i >= 100 {
+				log.Printf("  ... and %d more", len(heights)-100)
+				break
 			}
+			log.Printf("  Height %d", h)
+		}
+		if len(heights) > 0 {
+			os.Exit(1)
 		}
+		return
 	}
 
-	log.Printf("Successfully processed %d state changes", entriesProcessed)
-	log.Printf("Found %d blocks in range (skipped: %d)", len(blocksFound), blocksSkipped)
-	log.Printf("Scanned %d total entries in state-change files", totalEntries)
-	log.Printf("Failed to process: %d entries", entriesSkipped)
-
-	// Verify all blocks in range were found
-	missingBlocks := uint64(0)
-	for h := startHeight; h <= endHeight; h++ {
-		if !blocksFound[h] {
-			missingBlocks++
-			if missingBlocks <= 10 {
-				log.Printf("WARNING: Block %d not found in state-change files", h)
+	// Index overlap check mode: report index entries whose data regions alias each other and exit.
+	if viper.GetBool("CHECK_INDEX_OVERLAPS") {
+		log.Printf("Checking state-change index in %s for overlapping entries", opts.StateChangeDir)
+		overlaps, checked, err := repair.CheckIndexOverlaps(opts.StateChangeDir, opts.IndexFormat)
+		if err != nil {
+			log.Fatalf("checkIndexOverlaps: %v", err)
+		}
+		log.Printf("Checked %d index entries, found %d overlap(s)", checked, len(overlaps))
+		for i, o := range overlaps {
+			if i >= 100 {
+				log.Printf("  ... and %d more", len(overlaps)-100)
+				break
 			}
+			log.Printf("  Entry %d [%d, %d) overlaps entry %d [%d, %d)",
+				o.Second.EntryIndex, o.Second.Offset, o.Second.End(), o.First.EntryIndex, o.First.Offset, o.First.End())
 		}
-	}
-	if missingBlocks > 10 {
-		log.Printf("WARNING: %d additional blocks not found in state-change files", missingBlocks-10)
+		if len(overlaps) > 0 {
+			os.Exit(1)
+		}
+		return
 	}
 
-	return nil
-}
-
-// processGapParallel fetches and processes blocks in parallel using streaming batches
-func processGapParallel(nodeURL string, startHeight, endHeight uint64, pdh *handler.PostgresDataHandler, workers int) error {
-	type blockJob struct {
-		height uint64
-	}
-	type blockResult struct {
-		height uint64
-		entry  *lib.StateChangeEntry
-		err    error
+	// Schema fingerprint mode: print the relevant tables' normalized schema and its hash to stdout, so two
+	// environments can be compared with diff, and exit.
+	if viper.GetBool("DUMP_SCHEMA_FINGERPRINT") {
+		tables := repair.DefaultFingerprintTables
+		if tableList := viper.GetString("FINGERPRINT_TABLES"); tableList != "" {
+			tables = strings.Split(tableList, ",")
+		}
+		fingerprint, err := repair.FingerprintSchema(context.Background(), db, tables)
+		if err != nil {
+			log.Fatalf("fingerprintSchema: %v", err)
+		}
+		for _, line := range fingerprint.Lines {
+			fmt.Println(line)
+		}
+		fmt.Printf("fingerprint %s\n", fingerprint.Hash)
+		return
 	}
 
-	totalBlocks := endHeight - startHeight + 1
-	fetchBatchSize := uint64(50000)  // Fetch 50k blocks at a time
-	commitBatchSize := uint64(10000) // Commit every 10k blocks
-
-	blocksCommitted := uint64(0)
-
-	// Process in fetch batches for better progress visibility
-	for batchStart := startHeight; batchStart <= endHeight; batchStart += fetchBatchSize {
-		batchEnd := batchStart + fetchBatchSize - 1
-		if batchEnd > endHeight {
-			batchEnd = endHeight
+	// Gap detection plan mode: run the automatic gap-detection query under EXPLAIN (ANALYZE, BUFFERS), print
+	// the plan to stdout and exit, to see whether a slow detection uses the block.height index or spills.
+	if viper.GetBool("PRINT_SQL_PLAN") {
+		workMem := viper.GetString("DETECT_WORK_MEM")
+		if workMem != "" {
+			log.Printf("Explaining gap detection with work_mem = %s", workMem)
 		}
-
-		log.Printf("Fetching batch: heights %d -> %d", batchStart, batchEnd)
-
-		jobs := make(chan blockJob, workers*2)
-		results := make(chan blockResult, workers*2)
-
-		// Start workers
-		var wg sync.WaitGroup
-		for i := 0; i < workers; i++ {
-			wg.Add(1)
-			go func(workerID int) {
-				defer wg.Done()
-				for job := range jobs {
-					block, blockHash, err := fetchBlockByHeight(nodeURL, job.height)
-					if err != nil {
-						results <- blockResult{height: job.height, err: err}
-						continue
-					}
-
-					// Use the block hash from the API (don't compute it)
-					blockEntry := &lib.StateChangeEntry{
-						OperationType: lib.DbOperationTypeUpsert,
-						EncoderType:   lib.EncoderTypeBlock,
-						KeyBytes:      blockHash[:],
-						Encoder:       block,
-						BlockHeight:   job.height,
-					}
-					results <- blockResult{height: job.height, entry: blockEntry, err: nil}
-				}
-			}(i)
+		if err := repair.ExplainGapDetection(db, workMem, os.Stdout); err != nil {
+			log.Fatalf("explainGapDetection: %v", err)
 		}
+		return
+	}
 
-		// Send jobs for this batch
-		go func() {
-			for h := batchStart; h <= batchEnd; h++ {
-				jobs <- blockJob{height: h}
-			}
-			close(jobs)
-		}()
-
-		// Close results when all workers done
-		go func() {
-			wg.Wait()
-			close(results)
-		}()
-
-		// Collect results for this batch
-		blocks := make(map[uint64]*lib.StateChangeEntry)
-		var errors []error
-
-		for result := range results {
-			if result.err != nil {
-				log.Printf("WARNING: Failed to fetch block %d: %v", result.height, result.err)
-				errors = append(errors, result.err)
-				continue
-			}
-			blocks[result.height] = result.entry
+	// Block hash export mode: write the DB's (height, block_hash) mapping for a range, so it can be compared
+	// against another node or an archive, and exit.
+	if viper.GetBool("EMIT_BLOCK_HASHES") {
+		start := viper.GetUint64("REPAIR_START_HEIGHT")
+		end := viper.GetUint64("REPAIR_END_HEIGHT")
+		if end == 0 || start > end {
+			log.Fatalf("EMIT_BLOCK_HASHES requires a valid REPAIR_START_HEIGHT/REPAIR_END_HEIGHT range")
 		}
-
-		if len(errors) > 0 {
-			return fmt.Errorf("failed to fetch %d blocks in batch %d->%d", len(errors), batchStart, batchEnd)
+		format := viper.GetString("EMIT_FORMAT")
+		if format == "" {
+			format = "csv"
 		}
-
-		// Process blocks in height order with commits
-		log.Printf("Processing %d fetched blocks...", len(blocks))
-		for h := batchStart; h <= batchEnd; h++ {
-			entry, ok := blocks[h]
-			if !ok {
-				return fmt.Errorf("missing block %d", h)
-			}
-
-			if err := pdh.HandleEntryBatch([]*lib.StateChangeEntry{entry}, false); err != nil {
-				return fmt.Errorf("failed to process block %d: %w", h, err)
-			}
-
-			blocksCommitted++
-
-			// Commit every commitBatchSize blocks and at the end
-			if blocksCommitted%commitBatchSize == 0 || h == endHeight {
-				if err := pdh.CommitTransaction(); err != nil {
-					return fmt.Errorf("failed to commit at block %d: %w", h, err)
-				}
-				log.Printf("✓ Committed: %d/%d blocks (%.2f%%)",
-					blocksCommitted, totalBlocks, float64(blocksCommitted)/float64(totalBlocks)*100)
-
-				// Start new transaction if not at end
-				if h < endHeight {
-					if err := pdh.InitiateTransaction(); err != nil {
-						return fmt.Errorf("failed to start new transaction at block %d: %w", h, err)
-					}
-				}
-			} else if blocksCommitted%1000 == 0 {
-				log.Printf("Progress: %d/%d blocks processed", blocksCommitted, totalBlocks)
+		out := io.Writer(os.Stdout)
+		if outputPath := viper.GetString("EMIT_OUTPUT_FILE"); outputPath != "" {
+			f, err := os.Create(outputPath)
+			if err != nil {
+				log.Fatalf("create %s: %v", outputPath, err)
 			}
+			defer f.Close()
+			out = f
 		}
+		n, err := repair.EmitBlockHashes(context.Background(), db, out, format, start, end, viper.GetUint64("EMIT_PAGE_HEIGHTS"))
+		if err != nil {
+			log.Fatalf("emitBlockHashes: %v", err)
+		}
+		log.Printf("Emitted %d block hash(es) for %d -> %d", n, start, end)
+		return
 	}
 
-	return nil
-}
-
-func main() {
-	// Load configuration the same way as main.go
-	viper.SetConfigFile(".env")
-	if err := viper.ReadInConfig(); err != nil && !os.IsNotExist(err) {
-		log.Fatalf("Error reading .env: %v", err)
-	}
-	viper.AutomaticEnv()
-
-	dbHost := viper.GetString("DB_HOST")
-	dbPort := viper.GetString("DB_PORT")
-	dbUser := viper.GetString("DB_USERNAME")
-	dbPass := viper.GetString("DB_PASSWORD")
-	dbName := "postgres"
-	if n := viper.GetString("DB_NAME"); n != "" {
-		dbName = n
+	// Block dump mode: print the block row(s) at the DUMP_BLOCK height or hash as JSON, with the counts of their
+	// signer and transaction rows, to see what a repair actually wrote.
+	if ref := viper.GetString("DUMP_BLOCK"); ref != "" {
+		n, err := repair.DumpBlock(context.Background(), db, os.Stdout, ref)
+		if err != nil {
+			log.Fatalf("dumpBlock: %v", err)
+		}
+		if n > 1 {
+			log.Printf("WARNING: %d block rows match %s", n, ref)
+		}
+		return
 	}
-	pgURI := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&timeout=18000s", dbUser, dbPass, dbHost, dbPort, dbName)
 
-	// Open DB using the same pattern as main.go
-	pgdb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(pgURI)))
-	if pgdb == nil {
-		log.Fatalf("Failed to open postgres DB")
+	// Completeness mode: compare the DB's block coverage with the node's current tip and exit.
+	if viper.GetBool("COMPLETENESS_REPORT") {
+		c, err := repair.CheckCompleteness(context.Background(), db, source)
+		if err != nil {
+			log.Fatalf("checkCompleteness: %v", err)
+		}
+		log.Printf("Node tip height: %d", c.TipHeight)
+		log.Printf("DB max height: %d (%d behind tip)", c.DBMaxHeight, c.BehindTip())
+		log.Printf("Blocks stored: %d/%d (%.4f%% complete, %d missing)", c.StoredBlocks, c.ExpectedBlocks, c.Percent(), c.Missing())
+		if c.Missing() > 0 {
+			log.Printf("Run with auto-detection to repair interior gaps; blocks past the DB max height will arrive from the consumer")
+			os.Exit(1)
+		}
+		return
 	}
-	db := bun.NewDB(pgdb, pgdialect.New())
-	db.SetConnMaxLifetime(0)
 
-	// Get worker count from environment (default 100)
-	workerCount := viper.GetInt("REPAIR_WORKERS")
-	if workerCount == 0 {
-		workerCount = 100
+	// Height reconciliation mode: a presence-only check of REPAIR_START_HEIGHT..REPAIR_END_HEIGHT (the node's
+	// tip if unset), with no per-block node fetches or hash comparison.
+	if viper.GetBool("RECONCILE_HEIGHTS_ONLY") {
+		start := viper.GetUint64("REPAIR_START_HEIGHT")
+		end := viper.GetUint64("REPAIR_END_HEIGHT")
+		result, err := repair.ReconcileHeights(context.Background(), db, source, start, end)
+		if err != nil {
+			log.Fatalf("reconcileHeights: %v", err)
+		}
+		log.Printf("Reconciled heights %d -> %d: %d missing", result.Start, result.End, len(result.Missing))
+		for _, g := range repair.HeightsToGaps(result.Missing) {
+			log.Printf("  Missing: %d -> %d (%d blocks)", g.Start, g.End, g.End-g.Start+1)
+		}
+		if len(result.Missing) > 0 {
+			os.Exit(1)
+		}
+		return
 	}
-	// Set max connections to support parallel workers
-	db.SetMaxIdleConns(workerCount + 10)
-	db.SetMaxOpenConns(workerCount + 20)
-	log.Printf("Worker count: %d, Max DB connections: %d", workerCount, workerCount+20)
 
-	// Optional: enable query logging
-	if viper.GetBool("LOG_QUERIES") {
-		db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
+	// Transaction index check mode: report blocks whose index_in_block values have holes and exit.
+	if viper.GetBool("CHECK_TXN_INDEX_HOLES") {
+		start := viper.GetUint64("REPAIR_START_HEIGHT")
+		end := viper.GetUint64("REPAIR_END_HEIGHT")
+		if end == 0 || start > end {
+			log.Fatalf("CHECK_TXN_INDEX_HOLES requires a valid REPAIR_START_HEIGHT/REPAIR_END_HEIGHT range")
+		}
+		log.Printf("Checking transaction index_in_block sequences for %d -> %d", start, end)
+		holes, err := repair.FindTxnIndexHoles(context.Background(), db, start, end)
+		if err != nil {
+			log.Fatalf("findTxnIndexHoles: %v", err)
+		}
+		log.Printf("Found %d block(s) with index_in_block holes", len(holes))
+		for i, h := range holes {
+			if i >= 100 {
+				log.Printf("  ... and %d more", len(holes)-100)
+				break
+			}
+			log.Printf("  Height %d (%s): missing %v, duplicated %v", h.Height, h.BlockHash, h.Missing, h.Duplicates)
+		}
+		if len(holes) > 0 {
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Get node URL for API calls
-	nodeURL := viper.GetString("NODE_URL")
-	if nodeURL == "" {
-		nodeURL = "http://localhost:17001" // Default for mainnet node
+	// Timestamp fix mode: overwrite only the block timestamps in a range with the node's header values.
+	if viper.GetBool("FIX_TIMESTAMPS") {
+		start := viper.GetUint64("REPAIR_START_HEIGHT")
+		end := viper.GetUint64("REPAIR_END_HEIGHT")
+		if end == 0 || start > end {
+			log.Fatalf("FIX_TIMESTAMPS requires a valid REPAIR_START_HEIGHT/REPAIR_END_HEIGHT range")
+		}
+		log.Printf("Fixing block timestamps for %d -> %d from node", start, end)
+		fixed, err := repair.FixBlockTimestamps(db, source, start, end, opts.Workers, opts.DBWorkerCount())
+		if err != nil {
+			log.Fatalf("fixBlockTimestamps: %v", err)
+		}
+		log.Printf("Fixed %d block timestamp(s) in %d -> %d", fixed, start, end)
+		return
 	}
-	log.Printf("Using DeSo node URL: %s", nodeURL)
 
-	// Get state-change directory (optional, defaults to /db)
-	stateChangeDir := viper.GetString("STATE_CHANGE_DIR")
-	if stateChangeDir == "" {
-		stateChangeDir = "/db"
+	// Bad timestamp detection mode: list blocks whose timestamp is NULL or epoch-zero, optionally refetch just
+	// their timestamps, and exit.
+	if viper.GetBool("DETECT_BAD_TIMESTAMPS") {
+		heights, err := repair.DetectBadTimestamps(context.Background(), db,
+			viper.GetUint64("REPAIR_START_HEIGHT"), viper.GetUint64("REPAIR_END_HEIGHT"))
+		if err != nil {
+			log.Fatalf("detectBadTimestamps: %v", err)
+		}
+		log.Printf("Found %d block(s) with a NULL or epoch-zero timestamp", len(heights))
+		for i, h := range heights {
+			if i >= 100 {
+				log.Printf("  ... and %d more", len(heights)-100)
+				break
+			}
+			log.Printf("  Height %d", h)
+		}
+		if len(heights) == 0 {
+			return
+		}
+		if !viper.GetBool("REPAIR_BAD_TIMESTAMPS") {
+			os.Exit(1)
+		}
+		fixed, err := repair.FixBlockTimestampsInGaps(db, source, repair.HeightsToGaps(heights), opts.Workers, opts.DBWorkerCount())
+		if err != nil {
+			log.Fatalf("fixBlockTimestamps: %v", err)
+		}
+		log.Printf("Fixed %d/%d block timestamp(s)", fixed, len(heights))
+		return
 	}
-	log.Printf("State-change directory: %s", stateChangeDir)
 
-	// Choose network params
-	params := &lib.DeSoMainnetParams
-	if viper.GetBool("IS_TESTNET") {
-		params = &lib.DeSoTestnetParams
-		if viper.GetBool("REGTEST") {
-			params.EnableRegtest(viper.GetBool("ACCELERATED_REGTEST"))
+	// Sample verify mode: spot-check a random subset of a repaired range against the node and exit.
+	if viper.GetBool("SAMPLE_VERIFY") {
+		start := viper.GetUint64("REPAIR_START_HEIGHT")
+		end := viper.GetUint64("REPAIR_END_HEIGHT")
+		if end == 0 || start > end {
+			log.Fatalf("SAMPLE_VERIFY requires a valid REPAIR_START_HEIGHT/REPAIR_END_HEIGHT range")
 		}
+		k := viper.GetInt("SAMPLE_VERIFY_COUNT")
+		if k <= 0 {
+			k = 100
+		}
+		seed := viper.GetInt64("SAMPLE_VERIFY_SEED")
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		mismatches, err := repair.RunSampleVerify(db, source, start, end, k, seed)
+		if err != nil {
+			log.Fatalf("runSampleVerify: %v", err)
+		}
+		if len(mismatches) > 0 {
+			os.Exit(1)
+		}
+		return
 	}
-	lib.GlobalDeSoParams = *params
 
-	// Create PostgresDataHandler for transactionality
-	cachedEntries, err := lru.New[string, []byte](int(handler.EntryCacheSize))
-	if err != nil {
-		log.Fatalf("LRU cache: %v", err)
-	}
-	pdh := &handler.PostgresDataHandler{
-		DB:            db,
-		Params:        params,
-		CachedEntries: cachedEntries,
+	// Encoder type replay mode: reprocess one encoder type across the whole state-change file, ignoring
+	// heights, and exit.
+	if encoderTypeValue := viper.GetString("REPROCESS_ENCODER_TYPE"); encoderTypeValue != "" {
+		encoderType, err := repair.ParseEncoderType(encoderTypeValue)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := repair.NewRepairer(pdh, source, opts).ReprocessEncoderType(context.Background(), encoderType, viper.GetBool("REPROCESS_CLEAN")); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
 	}
 
 	// Check for manual range specification
-	var gaps []Gap
+	var gaps []repair.Gap
 	startHeight := viper.GetUint64("REPAIR_START_HEIGHT")
 	endHeight := viper.GetUint64("REPAIR_END_HEIGHT")
 	gapFile := viper.GetString("GAP_FILE")
+	gapQuery := viper.GetString("GAP_QUERY")
+	// With ONLY_RANGE_WITHIN_GAPS, the manual range is a window the gaps are clipped to rather than a range
+	// to re-upsert as a whole.
+	onlyWithinGaps := viper.GetBool("ONLY_RANGE_WITHIN_GAPS")
+	if onlyWithinGaps && (endHeight == 0 || startHeight > endHeight) {
+		log.Fatalf("ONLY_RANGE_WITHIN_GAPS requires a valid REPAIR_START_HEIGHT/REPAIR_END_HEIGHT window")
+	}
+	// Rebuilding transactions targets blocks that are already in the DB, which gap detection never returns.
+	transactionsOnly := viper.GetBool("REPROCESS_TRANSACTIONS_ONLY")
+	if transactionsOnly && (onlyWithinGaps || (endHeight == 0 && gapFile == "" && gapQuery == "")) {
+		log.Fatalf("REPROCESS_TRANSACTIONS_ONLY needs REPAIR_START_HEIGHT/REPAIR_END_HEIGHT, GAP_FILE or GAP_QUERY")
+	}
+	window := repair.Gap{Start: startHeight, End: endHeight}
 
-	if gapFile != "" {
-		// Load gaps from file
+	if viper.GetBool("REPAIR_EMPTY_BLOCK_HASHES") {
+		// Delete the blocks written without a hash and refetch their heights as gaps
+		heights, err := repair.DetectEmptyBlockHashes(context.Background(), db)
+		if err != nil {
+			log.Fatalf("detectEmptyBlockHashes: %v", err)
+		}
+		if len(heights) == 0 {
+			log.Printf("No blocks with an empty block_hash, nothing to repair")
+			return
+		}
+		deleted, err := repair.DeleteEmptyHashBlocks(context.Background(), db)
+		if err != nil {
+			log.Fatalf("deleteEmptyHashBlocks: %v", err)
+		}
+		gaps = repair.HeightsToGaps(heights)
+		log.Printf("Deleted %d block row(s) with an empty block_hash, refetching %d height(s) in %d gap(s)", deleted, len(heights), len(gaps))
+	} else if gapQuery != "" {
+		// Use the rows of a custom SQL query as the gap list
 		var err error
-		gaps, err = parseGapsFromFile(gapFile)
+		gaps, err = repair.QueryGaps(context.Background(), db, gapQuery)
 		if err != nil {
-			log.Fatalf("parseGapsFromFile: %v", err)
+			log.Fatalf("queryGaps: %v", err)
+		}
+		log.Printf("Loaded %d gap(s) from GAP_QUERY", len(gaps))
+		for i, g := range gaps {
+			if i < 10 { // Show first 10
+				log.Printf("  Gap %d: %d -> %d (%d blocks)", i+1, g.Start, g.End, g.End-g.Start+1)
+			}
+		}
+		if len(gaps) > 10 {
+			log.Printf("  ... and %d more gaps", len(gaps)-10)
+		}
+	} else if gapFile != "" {
+		// Load gaps from file, in GAP_FILE_FORMAT (sniffed from the file by default)
+		gapFileFormat := viper.GetString("GAP_FILE_FORMAT")
+		if err := repair.ValidateGapFileFormat(gapFileFormat); err != nil {
+			log.Fatalf("%v", err)
+		}
+		var err error
+		gaps, err = repair.ParseGapFile(gapFile, gapFileFormat)
+		if err != nil {
+			log.Fatalf("parseGapFile: %v", err)
 		}
 		log.Printf("Loaded %d gap(s) from file: %s", len(gaps), gapFile)
 		for i, g := range gaps {
@@ -724,39 +703,146 @@ func main() {
 		if len(gaps) > 10 {
 			log.Printf("  ... and %d more gaps", len(gaps)-10)
 		}
-	} else if startHeight > 0 || endHeight > 0 {
+	} else if (startHeight > 0 || endHeight > 0) && !onlyWithinGaps {
 		// Manual range specified
-		if startHeight == 0 {
-			startHeight = 0 // Allow starting from block 0
-		}
 		if endHeight == 0 {
 			log.Fatalf("REPAIR_END_HEIGHT must be specified when using manual range")
 		}
 		if startHeight > endHeight {
 			log.Fatalf("REPAIR_START_HEIGHT (%d) cannot be greater than REPAIR_END_HEIGHT (%d)", startHeight, endHeight)
 		}
-		gaps = []Gap{{Start: startHeight, End: endHeight}}
+		gaps = []repair.Gap{{Start: startHeight, End: endHeight}}
 		log.Printf("Manual repair mode: processing range %d -> %d (%d blocks)", startHeight, endHeight, endHeight-startHeight+1)
 	} else {
-		// Automatic gap detection
+		// Automatic gap detection, optionally restricted to one height partition
 		var err error
-		gaps, err = detectGaps(db)
-		if err != nil {
-			log.Fatalf("detectGaps: %v", err)
+		if onlyWithinGaps {
+			// Only the window can contribute gaps, so only it is scanned.
+			log.Printf("Detecting gaps within window %d -> %d", window.Start, window.End)
+			gaps, err = repair.DetectGapsInRange(context.Background(), db, window)
+			if err != nil {
+				log.Fatalf("detectGapsInRange: %v", err)
+			}
+		} else if partitionRange := viper.GetString("DETECT_PARTITION_RANGE"); partitionRange != "" {
+			bounds, err := repair.ParsePartitionRange(partitionRange)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			log.Printf("Detecting gaps within partition range %d -> %d", bounds.Start, bounds.End)
+			gaps, err = repair.DetectGapsInRange(context.Background(), db, bounds)
+			if err != nil {
+				log.Fatalf("detectGapsInRange: %v", err)
+			}
+		} else {
+			workMem := viper.GetString("DETECT_WORK_MEM")
+			if workMem != "" {
+				log.Printf("Running gap detection with work_mem = %s", workMem)
+			}
+			gaps, err = repair.DetectGaps(db, workMem)
+			if err != nil {
+				log.Fatalf("detectGaps: %v", err)
+			}
 		}
 		log.Printf("Found %d gap(s)", len(gaps))
+		// Show the wall-clock window each gap covers, from the blocks either side of it.
+		if spans, err := repair.GapTimeSpans(context.Background(), db, gaps); err != nil {
+			log.Printf("WARNING: Failed to look up gap timestamps: %v", err)
+			for _, g := range gaps {
+				log.Printf("Gap: %d -> %d (%d blocks)", g.Start, g.End, g.End-g.Start+1)
+			}
+		} else {
+			for _, s := range spans {
+				log.Printf("Gap: %s", s)
+			}
+		}
+	}
+
+	if onlyWithinGaps {
+		gaps = repair.IntersectGaps(gaps, window)
+		log.Printf("ONLY_RANGE_WITHIN_GAPS: %d gap(s) within %d -> %d", len(gaps), window.Start, window.End)
 		for _, g := range gaps {
-			log.Printf("Gap: %d -> %d (%d blocks)", g.Start, g.End, g.End-g.Start+1)
+			log.Printf("  Gap: %d -> %d (%d blocks)", g.Start, g.End, g.End-g.Start+1)
 		}
 	}
 
 	// Check if we should use state-change files
-	useStateChanges := viper.GetBool("USE_STATE_CHANGES")
-	skipBlocks := viper.GetBool("SKIP_BLOCKS")
+	opts.UseStateChanges = viper.GetBool("USE_STATE_CHANGES")
+	opts.SkipBlocks = viper.GetBool("SKIP_BLOCKS")
+	opts.DeleteOpsOnly = viper.GetBool("DELETE_OPS_ONLY")
+	opts.UtxoOpsOnly = viper.GetBool("REPAIR_UTXO_OPERATIONS")
+	if opts.TransactionsOnly = transactionsOnly; transactionsOnly {
+		if opts.SkipBlocks || opts.DeleteOpsOnly || opts.UtxoOpsOnly {
+			log.Fatalf("REPROCESS_TRANSACTIONS_ONLY rebuilds transactions from block entries, so it can't be combined with SKIP_BLOCKS, DELETE_OPS_ONLY or REPAIR_UTXO_OPERATIONS")
+		}
+		entries.SetTransactionsOnly(true)
+		log.Printf("REPROCESS_TRANSACTIONS_ONLY=true: Replacing the transaction rows of each block in range, block rows are left untouched")
+	}
+	opts.ReverseIndexOrder = viper.GetBool("STATE_CHANGE_REVERSE_ORDER")
+	opts.DeferFailed = viper.GetBool("DEFER_FAILED_BLOCKS")
+	opts.StopAtBlockNotFound = viper.GetBool("STOP_AT_BLOCK_NOT_FOUND")
+	opts.InterGapDelay = viper.GetDuration("INTER_GAP_DELAY")
+	if viper.IsSet("REPAIR_QUEUE_DEPTH_MULTIPLIER") {
+		opts.QueueDepthMultiplier = viper.GetInt("REPAIR_QUEUE_DEPTH_MULTIPLIER")
+		if opts.QueueDepthMultiplier < 1 {
+			log.Fatalf("REPAIR_QUEUE_DEPTH_MULTIPLIER must be at least 1, got %d", opts.QueueDepthMultiplier)
+		}
+	}
+	if viper.IsSet("REORDER_BUFFER_SIZE") {
+		opts.ReorderBufferSize = viper.GetInt("REORDER_BUFFER_SIZE")
+		if opts.ReorderBufferSize < 1 {
+			log.Fatalf("REORDER_BUFFER_SIZE must be at least 1, got %d", opts.ReorderBufferSize)
+		}
+	}
+	if conflictTarget := viper.GetString("BLOCK_CONFLICT_TARGET"); conflictTarget != "" {
+		if err := entries.SetBlockConflictTarget(strings.Split(conflictTarget, ",")); err != nil {
+			log.Fatalf("BLOCK_CONFLICT_TARGET: %v", err)
+		}
+		log.Printf("Upserting blocks ON CONFLICT (%s)", conflictTarget)
+	}
+	if viper.GetBool("SKIP_EXISTING_TRANSACTIONS") {
+		log.Printf("SKIP_EXISTING_TRANSACTIONS=true: Transactions already in the DB will not be re-inserted")
+		entries.SetSkipExistingTransactions(true)
+	}
+	if mode := viper.GetString("VALIDATE_UTF8"); mode != "" {
+		if err := entries.SetUTF8Validation(mode); err != nil {
+			log.Fatalf("VALIDATE_UTF8: %v", err)
+		}
+		log.Printf("VALIDATE_UTF8=%s: Checking block and transaction string fields for invalid UTF-8 before insert", mode)
+	}
+	if maxInnerTxns := viper.GetInt("MAX_ATOMIC_INNER_TXNS"); maxInnerTxns > 0 {
+		entries.SetMaxAtomicInnerTxns(maxInnerTxns)
+		log.Printf("MAX_ATOMIC_INNER_TXNS=%d: Rejecting blocks with an atomic wrapper of more inner transactions", maxInnerTxns)
+	}
+	opts.MinBlockTxns, opts.MaxBlockTxns = viper.GetInt("MIN_BLOCK_TXNS"), viper.GetInt("MAX_BLOCK_TXNS")
+	if opts.MinBlockTxns > 0 || opts.MaxBlockTxns > 0 {
+		if opts.MaxBlockTxns > 0 && opts.MinBlockTxns > opts.MaxBlockTxns {
+			log.Fatalf("MIN_BLOCK_TXNS (%d) cannot be greater than MAX_BLOCK_TXNS (%d)", opts.MinBlockTxns, opts.MaxBlockTxns)
+		}
+		log.Printf("Only processing heights whose block has %d to %d txns (0 = no maximum)", opts.MinBlockTxns, opts.MaxBlockTxns)
+	}
+	if opts.CommitInterval > 0 {
+		log.Printf("Committing every %d entries or %v, whichever comes first", opts.CommitBatchSize, opts.CommitInterval)
+	}
+	if opts.DeleteOpsOnly && !opts.UseStateChanges {
+		log.Fatalf("DELETE_OPS_ONLY requires USE_STATE_CHANGES=true")
+	}
+	if opts.ReverseIndexOrder && !opts.UseStateChanges {
+		log.Fatalf("STATE_CHANGE_REVERSE_ORDER requires USE_STATE_CHANGES=true")
+	}
+	if opts.UtxoOpsOnly {
+		// The node API returns no utxo operations, so they can only come from the state-change files, even
+		// when the blocks themselves were repaired from the API.
+		if !opts.UseStateChanges {
+			log.Fatalf("REPAIR_UTXO_OPERATIONS reads utxo operations from the state-change files and requires USE_STATE_CHANGES=true")
+		}
+		if opts.DeleteOpsOnly {
+			log.Fatalf("REPAIR_UTXO_OPERATIONS and DELETE_OPS_ONLY cannot be combined")
+		}
+	}
 
-	if useStateChanges {
+	if opts.UseStateChanges {
 		log.Printf("Using state-change file processing")
-		if skipBlocks {
+		if opts.SkipBlocks {
 			log.Printf("SKIP_BLOCKS=true: Will skip EncoderTypeBlock entries (blocks already in DB)")
 			log.Printf("This processes only transactions: posts, likes, follows, diamonds, etc.")
 		} else {
@@ -764,71 +850,382 @@ func main() {
 		}
 	}
 
-	// Process each gap
-	for _, gap := range gaps {
-		blockCount := gap.End - gap.Start + 1
-		log.Printf("Processing gap: %d -> %d (%d blocks)", gap.Start, gap.End, blockCount)
+	repairer := repair.NewRepairer(pdh, source, opts)
+
+	// Optionally read blocks from a stopped node's badger DB instead of its API.
+	if badgerDir := viper.GetString("BADGER_SNAPSHOT_DIR"); badgerDir != "" {
+		badgerSource, err := repair.OpenBadgerBlockSource(badgerDir)
+		if err != nil {
+			log.Fatalf("OpenBadgerBlockSource: %v", err)
+		}
+		defer badgerSource.Close()
+		repairer.Source = badgerSource
+		log.Printf("Reading blocks from badger snapshot %s instead of %s", badgerDir, nodeURL)
+	}
 
-		// Skip verification check if in manual mode or using state-changes
-		if startHeight == 0 && endHeight == 0 && !useStateChanges {
-			// Auto-detect mode: verify the gap actually exists by checking a sample block
-			count, err := db.NewSelect().
-				Table("block").
-				Where("height = ?", gap.Start).
-				Count(context.Background())
-			if err == nil && count > 0 {
-				log.Printf("WARNING: Block %d already exists in database (%d records), skipping gap. This may indicate duplicate heights.", gap.Start, count)
-				continue
+	// Abort instead of crawling when the block source is alive but its p99 fetch latency is over the limit.
+	// It wraps whichever source was chosen above.
+	if viper.IsSet("MAX_RESPONSE_TIME_P99_ABORT") {
+		breaker := repair.NewLatencyBreaker(repairer.Source, viper.GetDuration("MAX_RESPONSE_TIME_P99_ABORT"))
+		if window := viper.GetInt("LATENCY_WINDOW"); window > 0 {
+			breaker.Window = window
+		}
+		repairer.Source = breaker
+		log.Printf("Aborting if p99 fetch latency over the last %d fetches exceeds %s", breaker.Window, breaker.Threshold)
+	}
+
+	if viper.GetInt("HALT_ON_GAP_REAPPEARANCE") > 0 && !viper.GetBool("RECORD_GAPS_TABLE") {
+		log.Fatalf("HALT_ON_GAP_REAPPEARANCE counts earlier repairs in repair_gaps and requires RECORD_GAPS_TABLE=true")
+	}
+	// Optionally record the gaps in the repair_gaps table so repair progress can be tracked in SQL.
+	if viper.GetBool("RECORD_GAPS_TABLE") {
+		if err := repair.EnsureRepairGapsTable(db); err != nil {
+			log.Fatalf("ensureRepairGapsTable: %v", err)
+		}
+		if maxReappearances := viper.GetInt("HALT_ON_GAP_REAPPEARANCE"); maxReappearances > 0 {
+			stuck, remaining, err := repair.StuckGaps(context.Background(), db, gaps, maxReappearances)
+			if err != nil {
+				log.Fatalf("stuckGaps: %v", err)
+			}
+			if len(stuck) > 0 {
+				log.Printf("WARNING: %d gap(s) were repaired %d or more times by earlier runs and reappeared each time.", len(stuck), maxReappearances)
+				log.Printf("WARNING: They are marked %q and skipped; repairing them again won't fill them.", repair.GapStatusStuck)
+				for _, g := range stuck {
+					log.Printf("WARNING:   Gap %d -> %d (%d blocks)", g.Start, g.End, g.End-g.Start+1)
+				}
+				stuckRows, err := repair.RecordGaps(db, stuck)
+				if err != nil {
+					log.Fatalf("recordGaps: %v", err)
+				}
+				for _, row := range stuckRows {
+					if err := repair.UpdateGapStatus(db, row, repair.GapStatusStuck); err != nil {
+						log.Printf("WARNING: %v", err)
+					}
+				}
+			}
+			gaps = remaining
+		}
+		gapRows, err := repair.RecordGaps(db, gaps)
+		if err != nil {
+			log.Fatalf("recordGaps: %v", err)
+		}
+		log.Printf("Recorded %d gap(s) in repair_gaps table", len(gapRows))
+		repairer.OnGapStatus = func(i int, status string) {
+			if err := repair.UpdateGapStatus(db, gapRows[i], status); err != nil {
+				log.Printf("WARNING: %v", err)
 			}
 		}
+	}
 
-		if err := pdh.InitiateTransaction(); err != nil {
-			log.Fatalf("InitiateTransaction: %v", err)
+	// Notify downstream caches of each committed height range. Commits arriving faster than the interval
+	// are held for the next delivery.
+	var commitHook *repair.CommitWebhook
+	if webhookURL := viper.GetString("POST_COMMIT_WEBHOOK_URL"); webhookURL != "" {
+		interval := 5 * time.Second
+		if viper.IsSet("POST_COMMIT_WEBHOOK_INTERVAL") {
+			interval = viper.GetDuration("POST_COMMIT_WEBHOOK_INTERVAL")
+		}
+		commitHook = repair.NewCommitWebhook(webhookURL, interval)
+		repairer.OnCommit = commitHook.Notify
+		log.Printf("Posting committed height ranges to %s (at most every %s)", webhookURL, interval)
+	}
+	if viper.GetBool("AUDIT_RAW_ENTRIES") {
+		if !opts.UseStateChanges {
+			log.Fatalf("AUDIT_RAW_ENTRIES records state-change entries and requires USE_STATE_CHANGES=true")
+		}
+		auditPath := viper.GetString("AUDIT_LOG_FILE")
+		if auditPath == "" {
+			auditPath = "repair-audit.log"
 		}
+		audit, err := repair.OpenAuditLog(auditPath)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer audit.Close()
+		repairer.Audit = audit
+		log.Printf("Recording the raw bytes of every processed entry to %s", auditPath)
+	}
+	if opts.UnsupportedEncoderPolicy == repair.UnsupportedEncoderDeadLetter {
+		deadLetterPath := viper.GetString("DEAD_LETTER_FILE")
+		if deadLetterPath == "" {
+			deadLetterPath = "repair-dead-letter.log"
+		}
+		deadLetter, err := repair.OpenAuditLog(deadLetterPath)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer deadLetter.Close()
+		repairer.DeadLetter = deadLetter
+		log.Printf("Recording entries of encoder types the handler doesn't support to %s", deadLetterPath)
+	}
+	flushCommitHook := func() {
+		if commitHook != nil {
+			commitHook.Flush()
+		}
+	}
 
-		if useStateChanges {
-			// Process from state-change files
-			log.Printf("Processing from state-change files: %s", stateChangeDir)
-			if err := processGapFromStateChange(stateChangeDir, gap.Start, gap.End, pdh, skipBlocks); err != nil {
-				log.Fatalf("processGapFromStateChange: %v", err)
+	// Skip verification check if in manual mode or using state-changes, or when rebuilding transactions, whose
+	// blocks are all in the DB already
+	if startHeight == 0 && endHeight == 0 && !opts.UseStateChanges && !transactionsOnly {
+		// Auto-detect mode: check every height of the gap and repair only the ones still missing
+		repairer.MissingRanges = func(gap repair.Gap) ([]repair.Gap, error) {
+			missing, err := repair.FindMissingHeights(context.Background(), db, gap.Start, gap.End)
+			if err != nil {
+				return nil, err
 			}
-			if err := pdh.CommitTransaction(); err != nil {
-				log.Fatalf("CommitTransaction: %v", err)
+			return repair.HeightsToGaps(missing), nil
+		}
+	}
+
+	// Bound the whole run by RUN_DEADLINE, if set. On deadline the current batch is committed and the
+	// remaining gaps are checkpointed so the run can be resumed with GAP_FILE.
+	ctx := context.Background()
+	if runDeadline := viper.GetString("RUN_DEADLINE"); runDeadline != "" {
+		deadline, err := repair.ParseRunDeadline(runDeadline, time.Now())
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+		log.Printf("Run deadline: %s", deadline.Format(time.RFC3339))
+	}
+	checkpointFile := viper.GetString("REPAIR_CHECKPOINT_FILE")
+	if checkpointFile == "" {
+		checkpointFile = "repair-checkpoint.txt"
+	}
+
+	// Snapshot row counts for the gaps so the run's effect can be reported afterwards.
+	rowCountReport := viper.GetString("ROW_COUNT_REPORT")
+	var countsBefore []repair.RangeCounts
+	if rowCountReport != "" {
+		countsBefore, err = repair.CountRows(context.Background(), db, gaps)
+		if err != nil {
+			log.Fatalf("countRows: %v", err)
+		}
+	}
+	writeRowCountReport := func(partial bool) {
+		if rowCountReport == "" {
+			return
+		}
+		countsAfter, err := repair.CountRows(context.Background(), db, gaps)
+		if err != nil {
+			log.Printf("WARNING: Failed to count rows for report: %v", err)
+			return
+		}
+		f, err := os.Create(rowCountReport)
+		if err != nil {
+			log.Printf("WARNING: Failed to create row count report: %v", err)
+			return
+		}
+		defer f.Close()
+		if err := repair.WriteRowCountReport(io.MultiWriter(f, log.Writer()), repair.DiffRowCounts(countsBefore, countsAfter), partial); err != nil {
+			log.Printf("WARNING: Failed to write row count report: %v", err)
+			return
+		}
+		log.Printf("Row count report written to %s", rowCountReport)
+	}
+
+	// Optionally record the run in the repair_runs table, finalized with its outcome once it ends.
+	var run *repair.PGRepairRun
+	var heightsCommitted uint64
+	if viper.GetBool("RECORD_RUNS_TABLE") {
+		if err := repair.EnsureRepairRunsTable(db); err != nil {
+			log.Fatalf("ensureRepairRunsTable: %v", err)
+		}
+		mode := "api"
+		if opts.UseStateChanges {
+			mode = "state-changes"
+			if opts.UtxoOpsOnly {
+				mode = "utxo-operations"
+			} else if opts.DeleteOpsOnly {
+				mode = "delete-ops"
 			}
+		}
+		run, err = repair.StartRepairRun(db, gaps, mode, nodeURL)
+		if err != nil {
+			log.Fatalf("startRepairRun: %v", err)
+		}
+		log.Printf("Recording this run as repair_runs row %d", run.ID)
+		onCommit := repairer.OnCommit
+		repairer.OnCommit = func(committed repair.Gap) {
+			heightsCommitted += committed.End - committed.Start + 1
+			if onCommit != nil {
+				onCommit(committed)
+			}
+		}
+	}
+
+	// Log overall progress across every gap of the run, alongside the per-gap progress lines.
+	progressInterval := 30 * time.Second
+	if viper.IsSet("OVERALL_PROGRESS_INTERVAL") {
+		progressInterval = viper.GetDuration("OVERALL_PROGRESS_INTERVAL")
+	}
+	progress := repair.NewProgressAggregator(gaps, progressInterval)
+	notifyCommit := repairer.OnCommit
+	repairer.OnCommit = func(committed repair.Gap) {
+		progress.Notify(committed)
+		if notifyCommit != nil {
+			notifyCommit(committed)
+		}
+	}
+
+	// Before scanning the state-change files, check the index and data file agree on how many entries there
+	// are. It reads only the length prefixes, so a corrupt or mismatched pair shows up before a long scan.
+	if opts.UseStateChanges && opts.IndexFormat.Addressing != repair.IndexAddressingHeight && !viper.GetBool("SKIP_ENTRY_COUNT_CHECK") {
+		checkStart := time.Now()
+		records, _, err := repair.CheckStateChangeEntryCounts(opts.StateChangeDir, opts.IndexFormat)
+		if err != nil {
+			log.Printf("WARNING: State-change entry count check failed: %v", err)
 		} else {
-			// Process blocks from API
-			// Each block will be processed with ALL its transactions via bulkInsertBlockEntry
-			// Hybrid strategy:
-			// - Small gaps (≤100 blocks): Sequential API calls
-			// - Medium/Large gaps (>100 blocks): Parallel API calls
-			if blockCount <= 100 {
-				// Sequential processing for small gaps
-				log.Printf("Using sequential API processing for small gap...")
-				for h := gap.Start; h <= gap.End; h++ {
-					log.Printf("Processing height %d...", h)
-					if err := processBlockFromAPI(nodeURL, h, pdh); err != nil {
-						log.Printf("WARNING: Failed to process block %d: %v", h, err)
-						continue
-					}
-				}
-			} else {
-				// Parallel API processing for medium and large gaps
-				log.Printf("Using parallel API processing (%d workers) for gap...", workerCount)
-				if err := processGapParallel(nodeURL, gap.Start, gap.End, pdh, workerCount); err != nil {
-					log.Fatalf("processGapParallel: %v", err)
-				}
-				// Transaction is committed inside processGapParallel in batches
+			log.Printf("State-change index and data file both hold %d entries (checked in %v)", records, time.Since(checkStart).Round(time.Millisecond))
+		}
+	}
+
+	// Repair-and-verify mode: verify each committed range against the node right after it is committed, and
+	// make the run's outcome depend on the verification as well as the repair.
+	var verifier *repair.CommitVerifier
+	if viper.GetBool("REPAIR_AND_VERIFY") {
+		if opts.UtxoOpsOnly || opts.DeleteOpsOnly || opts.SkipBlocks {
+			log.Fatalf("REPAIR_AND_VERIFY checks block rows, so it can't be combined with REPAIR_UTXO_OPERATIONS, DELETE_OPS_ONLY or SKIP_BLOCKS")
+		}
+		verifier = &repair.CommitVerifier{DB: db, Source: source}
+		notifyVerify := repairer.OnCommit
+		repairer.OnCommit = func(committed repair.Gap) {
+			verifier.Verify(committed)
+			if notifyVerify != nil {
+				notifyVerify(committed)
 			}
+		}
+		log.Printf("Verifying each committed range against %s", nodeURL)
+	}
 
-			// For small gaps, commit here (large gaps commit inside processGapParallel)
-			if blockCount <= 100 {
-				if err := pdh.CommitTransaction(); err != nil {
-					log.Fatalf("CommitTransaction: %v", err)
-				}
+	// Staging mode: write repaired block rows to a staging table and merge them into block after the run, so
+	// block only takes the one merge statement instead of every repair batch.
+	stageBlocks := viper.GetBool("STAGE_BLOCKS")
+	if stageBlocks {
+		if verifier != nil || opts.SkipBlocks || opts.UtxoOpsOnly || opts.DeleteOpsOnly {
+			log.Fatalf("STAGE_BLOCKS writes block rows to %s, so it can't be combined with REPAIR_AND_VERIFY, REPAIR_UTXO_OPERATIONS, DELETE_OPS_ONLY or SKIP_BLOCKS", repair.StagingBlockTable)
+		}
+		if err := repair.CreateBlockStagingTable(context.Background(), db); err != nil {
+			log.Fatalf("STAGE_BLOCKS: %v", err)
+		}
+		entries.SetBlockInsertTable(repair.StagingBlockTable)
+		log.Printf("STAGE_BLOCKS=true: Writing block rows to %s and merging them into block after the run", repair.StagingBlockTable)
+	}
+
+	err = repairer.Run(ctx, gaps)
+	flushCommitHook()
+	// Everything committed to staging is merged, even after a failure, as the handler only commits whole
+	// batches.
+	mergeFailed := false
+	if stageBlocks {
+		merged, mergeErr := repair.MergeStagedBlocks(context.Background(), db, entries.BlockConflictTarget())
+		if mergeErr != nil {
+			log.Printf("ERROR: %v (the rows stay in %s and the next STAGE_BLOCKS run merges them)", mergeErr, repair.StagingBlockTable)
+			mergeFailed = true
+		} else {
+			log.Printf("Merged %d staged block row(s) from %s into block", merged, repair.StagingBlockTable)
+		}
+	}
+	writeRowCountReport(err != nil)
+	if unsupported := repairer.UnsupportedEncoderSummary(); len(unsupported) > 0 {
+		log.Printf("Entries skipped because the handler doesn't support their encoder type (UNSUPPORTED_ENCODER_POLICY=%s):", opts.UnsupportedEncoderPolicy)
+		for _, u := range unsupported {
+			log.Printf("  Encoder type %d: %d entries", u.EncoderType, u.Entries)
+		}
+	}
+	if len(repairer.Timings) > 0 {
+		if err := repair.WriteGapTimingReport(log.Writer(), repairer.Timings); err != nil {
+			log.Printf("WARNING: Failed to write gap timing report: %v", err)
+		}
+	}
+	verifyFailed := false
+	if verifier != nil {
+		verifier.Finish(err)
+		if err := repair.WriteRepairVerifyReport(log.Writer(), &verifier.Report); err != nil {
+			log.Printf("WARNING: Failed to write repair and verify report: %v", err)
+		}
+		verifyFailed = !verifier.Report.Passed()
+	}
+	if run != nil {
+		if err := repair.FinishRepairRun(db, run, heightsCommitted, err); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
+	if err != nil {
+		var stopped *repair.RunStoppedError
+		if !errors.As(err, &stopped) {
+			log.Fatalf("%v", err)
+		}
+		if err := repair.WriteGapCheckpoint(checkpointFile, stopped.Remaining); err != nil {
+			log.Printf("WARNING: Failed to write checkpoint: %v", err)
+		} else {
+			log.Printf("Checkpoint written to %s (%d gap(s) remaining, resume with GAP_FILE=%s)", checkpointFile, len(stopped.Remaining), checkpointFile)
+		}
+		log.Printf("Repair stopped at height %d. Exit reason: %s", stopped.NextHeight, repair.ExitReason(stopped.Cause))
+		// A failure still exits non-zero, but only after the work done before it is committed and checkpointed.
+		if verifyFailed || mergeFailed || (!errors.Is(stopped.Cause, context.Canceled) && !errors.Is(stopped.Cause, context.DeadlineExceeded)) {
+			os.Exit(1)
+		}
+		return
+	}
+	if dropped := repair.EntriesDroppedByTransform(); dropped > 0 {
+		log.Printf("Entry transform skipped %d entries", dropped)
+	}
+
+	// Verify the repaired gaps with one query per VERIFY_BATCH_HEIGHTS heights rather than one per gap or
+	// height.
+	if !opts.UtxoOpsOnly {
+		batchHeights := uint64(repair.DefaultVerifyBatchHeights)
+		if viper.IsSet("VERIFY_BATCH_HEIGHTS") {
+			batchHeights = viper.GetUint64("VERIFY_BATCH_HEIGHTS")
+		}
+		missing, err := repair.FindMissingHeightsInGaps(context.Background(), db, gaps, batchHeights)
+		if err != nil {
+			log.Printf("WARNING: Failed to verify the repaired gaps: %v", err)
+		} else {
+			for _, m := range repair.HeightsToGaps(missing) {
+				log.Printf("WARNING: Heights %d -> %d are still missing after repair", m.Start, m.End)
 			}
+			log.Printf("Verification: %d height(s) still missing across %d gap(s)", len(missing), len(gaps))
 		}
+	}
 
-		log.Printf("Successfully repaired gap %d -> %d", gap.Start, gap.End)
+	// Confirm the repaired blocks link into one chain, including where each gap joins the blocks below it.
+	if viper.GetBool("VERIFY_PREV_HASH_CHAIN") {
+		totalBreaks := 0
+		for _, g := range gaps {
+			breaks, err := repair.VerifyPrevHashChain(context.Background(), db, g.Start, g.End)
+			if err != nil {
+				log.Fatalf("verifyPrevHashChain: %v", err)
+			}
+			for _, b := range breaks {
+				log.Printf("CHAIN BREAK at height %d: block %s has prev_block_hash %s, block below is %s",
+					b.Height, b.BlockHash, b.PrevBlockHash, b.ExpectedPrevHash)
+			}
+			totalBreaks += len(breaks)
+		}
+		log.Printf("Prev hash chain check: %d break(s) across %d gap(s)", totalBreaks, len(gaps))
+		if totalBreaks > 0 {
+			os.Exit(1)
+		}
+	}
+	if verifyFailed {
+		log.Printf("Repair completed but verification failed")
+		os.Exit(1)
+	}
+	if mergeFailed {
+		log.Printf("Repair completed but the staged block rows were not merged")
+		os.Exit(1)
+	}
+	if len(repairer.Undecodable) > 0 {
+		log.Printf("Repair completed but %d range(s) had too many undecodable state-change entries:", len(repairer.Undecodable))
+		for _, u := range repairer.Undecodable {
+			log.Printf("  %d -> %d: %d of %d entries failed (%.1f%%)", u.Gap.Start, u.Gap.End, u.Failed, u.Failed+u.Decoded, 100*u.Ratio())
+		}
+		log.Printf("Repair them from the node with USE_STATE_CHANGES=false and REPAIR_START_HEIGHT/REPAIR_END_HEIGHT or a GAP_FILE")
+		os.Exit(1)
 	}
 	log.Println("Repair completed successfully")
 }
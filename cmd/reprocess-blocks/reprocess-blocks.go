@@ -11,6 +11,8 @@ import (
 	"strings"
 
 	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/config"
+	"github.com/deso-protocol/postgres-data-handler/repair"
 	"github.com/spf13/viper"
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
@@ -34,22 +36,29 @@ func main() {
 	}
 	log.Printf("Loaded %d block heights", len(blockHeights))
 
-	// Load config from .env (like repair.go)
-	viper.SetConfigFile(".env")
-	if err := viper.ReadInConfig(); err != nil && !os.IsNotExist(err) {
-		log.Fatalf("Error reading .env: %v", err)
+	// Load config the same way as repair.go
+	if configFile, err := config.LoadConfig(viper.GetViper()); err != nil {
+		log.Fatalf("%v", err)
+	} else if configFile != "" {
+		log.Printf("Read config from %s", configFile)
 	}
-	viper.AutomaticEnv()
-
-	dbHost := viper.GetString("DB_HOST")
-	dbPort := viper.GetString("DB_PORT")
-	dbUser := viper.GetString("DB_USERNAME")
-	dbPass := viper.GetString("DB_PASSWORD")
-	dbName := "postgres"
-	if n := viper.GetString("DB_NAME"); n != "" {
-		dbName = n
+
+	dbSettings, err := config.ResolveDBSettings(viper.GetViper())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	// APPLICATION_NAME identifies this run's connections in pg_stat_activity.
+	applicationName := viper.GetString("APPLICATION_NAME")
+	if applicationName == "" {
+		applicationName = repair.DefaultApplicationName("reprocess-blocks")
+	}
+	log.Printf("Postgres application_name: %s", applicationName)
+	dbTimeouts, err := repair.ParseDBTimeouts(viper.GetString("DB_CONNECT_TIMEOUT"), viper.GetString("DB_OPERATION_TIMEOUT"))
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
-	pgURI := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&timeout=18000s", dbUser, dbPass, dbHost, dbPort, dbName)
+	log.Printf("Postgres timeouts: connect %s, operation %s", dbTimeouts.Connect, dbTimeouts.Operation)
+	pgURI := repair.PostgresDSN(dbSettings, applicationName, dbTimeouts)
 
 	pgdb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(pgURI)))
 	if pgdb == nil {
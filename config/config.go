@@ -0,0 +1,135 @@
+// Package config holds the configuration loading and database settings shared by the data handler and
+// the repair commands.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultConfigFiles are the config files LoadConfig looks for, in order, when CONFIG_FILE is unset. Both
+// use the same flat keys (DB_HOST, NODE_URL, ...); YAML keys may be written in either case.
+var DefaultConfigFiles = []string{"config.yaml", ".env"}
+
+// LoadConfig reads the commands' configuration into v: the file named by the CONFIG_FILE environment
+// variable, or else the first of DefaultConfigFiles that exists, with environment variables overriding it.
+// It returns the file it read, or "" if there was none. A missing CONFIG_FILE is an error; missing default
+// files are not, so a purely environment-driven deployment keeps working.
+func LoadConfig(v *viper.Viper) (string, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("CONFIG_FILE: %w", err)
+		}
+	} else {
+		for _, candidate := range DefaultConfigFiles {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return "", fmt.Errorf("read config %s: %w", path, err)
+		}
+	}
+	v.AutomaticEnv()
+	return path, nil
+}
+
+// DefaultStateChangeDir is where the commands read the state-change files from when STATE_CHANGE_DIR is
+// unset. cmd/analyze_state_changes, a separate module, keeps its own copy of it.
+const DefaultStateChangeDir = "/db"
+
+// ResolveStateChangeDir returns the state-change directory configured in v, or DefaultStateChangeDir. The repair
+// commands resolve it here, so setting STATE_CHANGE_DIR once (or not at all) points them all at the same
+// files.
+func ResolveStateChangeDir(v *viper.Viper) string {
+	if dir := v.GetString("STATE_CHANGE_DIR"); dir != "" {
+		return dir
+	}
+	return DefaultStateChangeDir
+}
+
+// DefaultSSLMode is the sslmode used when POSTGRES_URI doesn't set one.
+const DefaultSSLMode = "disable"
+
+// DBSettings are the Postgres connection settings every command connects with.
+type DBSettings struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	Name     string
+	SSLMode  string
+}
+
+// ResolveDBSettings reads the DB settings from v. They can be given as the DB_HOST, DB_PORT, DB_USERNAME,
+// DB_PASSWORD and DB_NAME components or as a single POSTGRES_URI; a component that is set explicitly wins
+// over the URI's. Of POSTGRES_URI's query parameters only sslmode is kept, since the rest of the connection
+// string is rebuilt by URI. The database name defaults to postgres and sslmode to DefaultSSLMode.
+func ResolveDBSettings(v *viper.Viper) (DBSettings, error) {
+	var settings DBSettings
+	if uri := v.GetString("POSTGRES_URI"); uri != "" {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return DBSettings{}, fmt.Errorf("POSTGRES_URI: %w", err)
+		}
+		if parsed.Scheme != "postgres" && parsed.Scheme != "postgresql" {
+			return DBSettings{}, fmt.Errorf("POSTGRES_URI: unsupported scheme %q", parsed.Scheme)
+		}
+		settings.Host = parsed.Hostname()
+		settings.Port = parsed.Port()
+		settings.Username = parsed.User.Username()
+		settings.Password, _ = parsed.User.Password()
+		if len(parsed.Path) > 1 {
+			settings.Name = parsed.Path[1:]
+		}
+		settings.SSLMode = parsed.Query().Get("sslmode")
+	}
+	for _, component := range []struct {
+		key   string
+		value *string
+	}{
+		{"DB_HOST", &settings.Host},
+		{"DB_PORT", &settings.Port},
+		{"DB_USERNAME", &settings.Username},
+		{"DB_PASSWORD", &settings.Password},
+		{"DB_NAME", &settings.Name},
+	} {
+		if value := v.GetString(component.key); value != "" {
+			*component.value = value
+		}
+	}
+	if settings.Host == "" {
+		return DBSettings{}, errors.New("no database configured: set DB_HOST or POSTGRES_URI")
+	}
+	if settings.Port == "" {
+		settings.Port = "5432"
+	}
+	if settings.Name == "" {
+		settings.Name = "postgres"
+	}
+	if settings.SSLMode == "" {
+		settings.SSLMode = DefaultSSLMode
+	}
+	return settings, nil
+}
+
+// URI builds the postgres:// connection string for these settings, with params added to the query after
+// sslmode. The username and password are escaped, so they may contain any character.
+func (s DBSettings) URI(params url.Values) string {
+	query := url.Values{"sslmode": {s.SSLMode}}
+	for key, values := range params {
+		query[key] = values
+	}
+	return fmt.Sprintf("postgres://%s@%s/%s?%s", url.UserPassword(s.Username, s.Password).String(),
+		net.JoinHostPort(s.Host, s.Port), url.PathEscape(s.Name), query.Encode())
+}
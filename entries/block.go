@@ -3,7 +3,11 @@ package entries
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/deso-protocol/core/lib"
@@ -38,6 +42,8 @@ type PGBlockEntry struct {
 type BlockSigner struct {
 	BlockHash   string
 	SignerIndex uint64
+	// View is the view of the QC the signer voted in. The QC doesn't carry an epoch, so none is stored.
+	View uint64
 }
 
 type PGBlockSigner struct {
@@ -45,8 +51,88 @@ type PGBlockSigner struct {
 	BlockSigner
 }
 
+// blockConflictColumns are the block columns that can serve as the upsert's conflict target, each backed by a
+// unique constraint in some schema variant.
+var blockConflictColumns = map[string]bool{
+	"block_hash": true,
+	"height":     true,
+	"badger_key": true,
+}
+
+var (
+	blockConflictTargetMu sync.RWMutex
+	blockConflictTarget   = "block_hash"
+	// blockInsertTable, if set, is the table block rows are inserted into instead of block.
+	blockInsertTable string
+)
+
+// SetBlockConflictTarget sets the columns of the ON CONFLICT target used when upserting blocks, for schemas
+// whose effective uniqueness key isn't block_hash. An empty list restores the default.
+func SetBlockConflictTarget(columns []string) error {
+	if len(columns) == 0 {
+		columns = []string{"block_hash"}
+	}
+	normalized := make([]string, 0, len(columns))
+	seen := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !blockConflictColumns[column] {
+			return fmt.Errorf("SetBlockConflictTarget: %q is not a block conflict column (block_hash, height, badger_key)", column)
+		}
+		if seen[column] {
+			return fmt.Errorf("SetBlockConflictTarget: %q is listed twice", column)
+		}
+		seen[column] = true
+		normalized = append(normalized, column)
+	}
+	blockConflictTargetMu.Lock()
+	blockConflictTarget = strings.Join(normalized, ", ")
+	blockConflictTargetMu.Unlock()
+	return nil
+}
+
+// BlockConflictTarget returns the columns of the ON CONFLICT target used when upserting blocks.
+func BlockConflictTarget() string {
+	blockConflictTargetMu.RLock()
+	defer blockConflictTargetMu.RUnlock()
+	return blockConflictTarget
+}
+
+// SetBlockInsertTable makes block rows go to table, e.g. a staging table with block's columns and
+// constraints, instead of block. Deletes still apply to block. An empty table restores the default.
+func SetBlockInsertTable(table string) {
+	blockConflictTargetMu.Lock()
+	blockInsertTable = table
+	blockConflictTargetMu.Unlock()
+}
+
+// transactionsOnly makes bulkInsertBlockEntry rebuild only the transaction rows of the blocks it is given.
+var transactionsOnly atomic.Bool
+
+// SetTransactionsOnly makes block upserts replace the transaction rows stored under each block's hash with
+// the ones derived from the block, without writing the block or block_signer rows, e.g. to rebuild the
+// transaction table for a range after a transaction parsing fix.
+func SetTransactionsOnly(only bool) {
+	transactionsOnly.Store(only)
+}
+
+// blockInsertQuery builds the insert for a batch of blocks, upserting on the configured conflict target.
+func blockInsertQuery(db bun.IDB, pgBlockEntrySlice []*PGBlockEntry, operationType lib.StateSyncerOperationType) *bun.InsertQuery {
+	blockConflictTargetMu.RLock()
+	target, table := blockConflictTarget, blockInsertTable
+	blockConflictTargetMu.RUnlock()
+	blockQuery := db.NewInsert().Model(&pgBlockEntrySlice)
+	if table != "" {
+		blockQuery = blockQuery.ModelTableExpr(table)
+	}
+	if operationType == lib.DbOperationTypeUpsert {
+		blockQuery = blockQuery.On(fmt.Sprintf("CONFLICT (%s) DO UPDATE", target))
+	}
+	return blockQuery
+}
+
 // Convert the UserAssociation DeSo encoder to the PG struct used by bun.
-func BlockEncoderToPGStruct(block *lib.MsgDeSoBlock, keyBytes []byte, params *lib.DeSoParams) (*PGBlockEntry, []*PGBlockSigner) {
+func BlockEncoderToPGStruct(block *lib.MsgDeSoBlock, keyBytes []byte, params *lib.DeSoParams) (*PGBlockEntry, []*PGBlockSigner, error) {
 	// Use keyBytes if provided (from state-consumer or API), otherwise compute hash
 	var blockHashHex string
 	if len(keyBytes) > 0 {
@@ -57,9 +143,15 @@ func BlockEncoderToPGStruct(block *lib.MsgDeSoBlock, keyBytes []byte, params *li
 			blockHashHex = hex.EncodeToString(blockHash[:])
 		}
 	}
+	// Hash() returns nil for a PoS block missing its BLS fields, which would otherwise be written as a block
+	// row with an empty hash that nothing can reference.
+	if isEmptyBlockHash(blockHashHex) {
+		return nil, nil, errors.Errorf("BlockEncoderToPGStruct: block at height %d has an empty block hash", block.Header.Height)
+	}
 	qc := block.Header.GetQC()
 	blockSigners := []*PGBlockSigner{}
 	if !isInterfaceNil(qc) {
+		qcView := qc.GetView()
 		aggSig := qc.GetAggregatedSignature()
 		if !isInterfaceNil(aggSig) {
 			signersList := aggSig.GetSignersList()
@@ -73,6 +165,7 @@ func BlockEncoderToPGStruct(block *lib.MsgDeSoBlock, keyBytes []byte, params *li
 						BlockSigner: BlockSigner{
 							BlockHash:   blockHashHex,
 							SignerIndex: uint64(ii),
+							View:        qcView,
 						},
 					})
 				}
@@ -122,27 +215,54 @@ func BlockEncoderToPGStruct(block *lib.MsgDeSoBlock, keyBytes []byte, params *li
 			ProposerVotePartialSignature: proposerVotePartialSignature,
 			BadgerKey:                    keyBytes,
 		},
-	}, blockSigners
+	}, blockSigners, nil
+}
+
+// isEmptyBlockHash reports whether blockHashHex is empty or all zeros.
+func isEmptyBlockHash(blockHashHex string) bool {
+	return strings.Trim(blockHashHex, "0") == ""
 }
 
+// insertBlockEntries and deleteBlockEntries are what BlockBatchOperation hands each partition of a batch to.
+// Tests replace them.
+var (
+	insertBlockEntries = bulkInsertBlockEntry
+	deleteBlockEntries = bulkDeleteBlockEntry
+)
+
 // PostBatchOperation is the entry point for processing a batch of post entries. It determines the appropriate handler
 // based on the operation type and executes it.
 func BlockBatchOperation(entries []*lib.StateChangeEntry, db bun.IDB, params *lib.DeSoParams) error {
-	// We check before we call this function that there is at least one operation type.
-	// We also ensure before this that all entries have the same operation type.
-	operationType := entries[0].OperationType
-	var err error
-	if operationType == lib.DbOperationTypeDelete {
-		err = bulkDeleteBlockEntry(entries, db, operationType)
-	} else {
-		err = bulkInsertBlockEntry(entries, db, operationType, params)
-	}
-	if err != nil {
-		return errors.Wrapf(err, "entries.PostBatchOperation: Problem with operation type %v", operationType)
+	// A batch normally shares one operation type, but a mixed one is split into runs of the same type,
+	// processed in order so a delete and a later re-insert of the same block keep their effect.
+	for _, partition := range partitionByOperationType(entries) {
+		operationType := partition[0].OperationType
+		var err error
+		if operationType == lib.DbOperationTypeDelete {
+			err = deleteBlockEntries(partition, db, operationType)
+		} else {
+			err = insertBlockEntries(partition, db, operationType, params)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "entries.PostBatchOperation: Problem with operation type %v", operationType)
+		}
 	}
 	return nil
 }
 
+// partitionByOperationType splits entries into consecutive runs that share an operation type.
+func partitionByOperationType(entries []*lib.StateChangeEntry) [][]*lib.StateChangeEntry {
+	var partitions [][]*lib.StateChangeEntry
+	start := 0
+	for ii := 1; ii <= len(entries); ii++ {
+		if ii == len(entries) || entries[ii].OperationType != entries[start].OperationType {
+			partitions = append(partitions, entries[start:ii])
+			start = ii
+		}
+	}
+	return partitions
+}
+
 // bulkInsertUtxoOperationsEntry inserts a batch of user_association entries into the database.
 func bulkInsertBlockEntry(entries []*lib.StateChangeEntry, db bun.IDB, operationType lib.StateSyncerOperationType, params *lib.DeSoParams) error {
 	// If this block is a part of the initial sync, skip it - it will be handled by the utxo operations.
@@ -150,6 +270,56 @@ func bulkInsertBlockEntry(entries []*lib.StateChangeEntry, db bun.IDB, operation
 		return nil
 	}
 
+	pgBlockEntrySlice, pgTransactionEntrySlice, pgBlockSignersEntrySlice, err := BlockEntriesToPGStructs(entries, params)
+	if err != nil {
+		return errors.Wrapf(err, "entries.bulkInsertBlockEntry")
+	}
+
+	if transactionsOnly.Load() {
+		return replaceBlockTransactions(db, pgBlockEntrySlice, pgTransactionEntrySlice, operationType)
+	}
+
+	// Handle conflicts on the configured uniqueness key (block_hash by default)
+	blockQuery := blockInsertQuery(db, pgBlockEntrySlice, operationType)
+
+	result, err := blockQuery.Exec(context.Background())
+	if err != nil {
+		return errors.Wrapf(err, "entries.bulkInsertBlock: Error inserting entries")
+	}
+
+	// Verify that PostgreSQL confirmed the insert/update
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "entries.bulkInsertBlock: Error getting rows affected")
+	}
+	if rowsAffected != int64(len(pgBlockEntrySlice)) {
+		return errors.Errorf("entries.bulkInsertBlock: Expected %d rows affected, got %d", len(pgBlockEntrySlice), rowsAffected)
+	}
+
+	if err := bulkInsertTransactionEntry(pgTransactionEntrySlice, db, operationType); err != nil {
+		return errors.Wrapf(err, "entries.bulkInsertBlock: Error inserting transaction entries")
+	}
+
+	if len(pgBlockSignersEntrySlice) > 0 {
+		// Execute the insert query.
+		query := db.NewInsert().Model(&pgBlockSignersEntrySlice)
+
+		if operationType == lib.DbOperationTypeUpsert {
+			query = query.On("CONFLICT (block_hash, signer_index) DO UPDATE")
+		}
+
+		if _, err := query.Returning("").Exec(context.Background()); err != nil {
+			return errors.Wrapf(err, "entries.bulkInsertBlockEntry: Error inserting block signers")
+		}
+	}
+
+	return nil
+}
+
+// BlockEntriesToPGStructs converts block entries to the block, transaction and block signer rows
+// bulkInsertBlockEntry writes for them, including the inner transactions of atomic wrappers. A block that
+// appears more than once is converted once.
+func BlockEntriesToPGStructs(entries []*lib.StateChangeEntry, params *lib.DeSoParams) ([]*PGBlockEntry, []*PGTransactionEntry, []*PGBlockSigner, error) {
 	// Track the unique entries we've inserted so we don't insert the same entry twice.
 	uniqueBlocks := consumer.UniqueEntries(entries)
 
@@ -160,7 +330,15 @@ func bulkInsertBlockEntry(entries []*lib.StateChangeEntry, db bun.IDB, operation
 
 	for _, entry := range uniqueBlocks {
 		block := entry.Encoder.(*lib.MsgDeSoBlock)
-		blockEntry, blockSigners := BlockEncoderToPGStruct(block, entry.KeyBytes, params)
+		blockEntry, blockSigners, err := BlockEncoderToPGStruct(block, entry.KeyBytes, params)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "entries.BlockEntriesToPGStructs: Problem converting block to PG struct")
+		}
+		if err := checkRowStrings(blockEntry, func() string {
+			return fmt.Sprintf("block %d (%s)", blockEntry.Height, blockEntry.BlockHash)
+		}); err != nil {
+			return nil, nil, nil, err
+		}
 		pgBlockEntrySlice = append(pgBlockEntrySlice, blockEntry)
 		pgBlockSignersEntrySlice = append(pgBlockSignersEntrySlice, blockSigners...)
 		for jj, transaction := range block.Txns {
@@ -176,7 +354,7 @@ func bulkInsertBlockEntry(entries []*lib.StateChangeEntry, db bun.IDB, operation
 				params,
 			)
 			if err != nil {
-				return errors.Wrapf(err, "entries.bulkInsertBlockEntry: Problem converting transaction to PG struct")
+				return nil, nil, nil, errors.Wrapf(err, "entries.BlockEntriesToPGStructs: Problem converting transaction to PG struct")
 			}
 			pgTransactionEntrySlice = append(pgTransactionEntrySlice, pgTransactionEntry)
 			if transaction.TxnMeta.GetTxnType() != lib.TxnTypeAtomicTxnsWrapper {
@@ -184,50 +362,34 @@ func bulkInsertBlockEntry(entries []*lib.StateChangeEntry, db bun.IDB, operation
 			}
 			innerTxns, err := parseInnerTxnsFromAtomicTxn(pgTransactionEntry, params)
 			if err != nil {
-				return errors.Wrapf(err, "entries.bulkInsertBlockEntry: Problem parsing inner txns from atomic txn")
+				return nil, nil, nil, errors.Wrapf(err, "entries.BlockEntriesToPGStructs: Problem parsing inner txns from atomic txn")
 			}
 			pgTransactionEntrySlice = append(pgTransactionEntrySlice, innerTxns...)
 		}
 	}
+	return pgBlockEntrySlice, pgTransactionEntrySlice, pgBlockSignersEntrySlice, nil
+}
 
-	blockQuery := db.NewInsert().Model(&pgBlockEntrySlice)
-
-	if operationType == lib.DbOperationTypeUpsert {
-		// Handle conflicts on block_hash primary key
-		blockQuery = blockQuery.On("CONFLICT (block_hash) DO UPDATE")
-	}
-
-	result, err := blockQuery.Exec(context.Background())
-	if err != nil {
-		return errors.Wrapf(err, "entries.bulkInsertBlock: Error inserting entries")
+// replaceBlockTransactions deletes the transaction rows of the given blocks, including inner atomic ones, and
+// inserts pgTransactionEntrySlice in their place. The block rows themselves are left untouched.
+func replaceBlockTransactions(db bun.IDB, pgBlockEntrySlice []*PGBlockEntry, pgTransactionEntrySlice []*PGTransactionEntry, operationType lib.StateSyncerOperationType) error {
+	if len(pgBlockEntrySlice) == 0 {
+		return nil
 	}
-
-	// Verify that PostgreSQL confirmed the insert/update
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return errors.Wrapf(err, "entries.bulkInsertBlock: Error getting rows affected")
+	blockHashes := make([]string, len(pgBlockEntrySlice))
+	for ii, blockEntry := range pgBlockEntrySlice {
+		blockHashes[ii] = blockEntry.BlockHash
 	}
-	if rowsAffected != int64(len(pgBlockEntrySlice)) {
-		return errors.Errorf("entries.bulkInsertBlock: Expected %d rows affected, got %d", len(pgBlockEntrySlice), rowsAffected)
+	if _, err := db.NewDelete().
+		Model(&PGTransactionEntry{}).
+		Where("block_hash IN (?)", bun.In(blockHashes)).
+		Returning("").
+		Exec(context.Background()); err != nil {
+		return errors.Wrapf(err, "entries.replaceBlockTransactions: Error deleting transaction entries")
 	}
-
 	if err := bulkInsertTransactionEntry(pgTransactionEntrySlice, db, operationType); err != nil {
-		return errors.Wrapf(err, "entries.bulkInsertBlock: Error inserting transaction entries")
+		return errors.Wrapf(err, "entries.replaceBlockTransactions: Error inserting transaction entries")
 	}
-
-	if len(pgBlockSignersEntrySlice) > 0 {
-		// Execute the insert query.
-		query := db.NewInsert().Model(&pgBlockSignersEntrySlice)
-
-		if operationType == lib.DbOperationTypeUpsert {
-			query = query.On("CONFLICT (block_hash, signer_index) DO UPDATE")
-		}
-
-		if _, err := query.Returning("").Exec(context.Background()); err != nil {
-			return errors.Wrapf(err, "entries.bulkInsertBlockEntry: Error inserting block signers")
-		}
-	}
-
 	return nil
 }
 
@@ -0,0 +1,258 @@
+package entries
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/deso-protocol/core/collections/bitset"
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+func TestBlockInsertQueryUsesConfiguredConflictTarget(t *testing.T) {
+	// The query is only formatted, so the connector never dials.
+	db := bun.NewDB(sql.OpenDB(pgdriver.NewConnector()), pgdialect.New())
+	defer db.Close()
+	defer SetBlockConflictTarget(nil)
+	blocks := []*PGBlockEntry{{BlockEntry: BlockEntry{BlockHash: "aa", Height: 7, BadgerKey: []byte{1}}}}
+
+	require.Contains(t, blockInsertQuery(db, blocks, lib.DbOperationTypeUpsert).String(), "ON CONFLICT (block_hash) DO UPDATE")
+
+	require.NoError(t, SetBlockConflictTarget([]string{"Height"}))
+	query := blockInsertQuery(db, blocks, lib.DbOperationTypeUpsert).String()
+	require.Contains(t, query, "ON CONFLICT (height) DO UPDATE")
+	require.NotContains(t, query, "(block_hash)")
+
+	require.NoError(t, SetBlockConflictTarget([]string{"badger_key", "height"}))
+	require.Contains(t, blockInsertQuery(db, blocks, lib.DbOperationTypeUpsert).String(), "ON CONFLICT (badger_key, height) DO UPDATE")
+
+	// Inserts carry no conflict clause.
+	require.NotContains(t, blockInsertQuery(db, blocks, lib.DbOperationTypeInsert).String(), "ON CONFLICT")
+}
+
+func TestBlockInsertQueryWritesToConfiguredTable(t *testing.T) {
+	db := bun.NewDB(sql.OpenDB(pgdriver.NewConnector()), pgdialect.New())
+	defer db.Close()
+	defer SetBlockInsertTable("")
+	blocks := []*PGBlockEntry{{BlockEntry: BlockEntry{BlockHash: "aa", Height: 7, BadgerKey: []byte{1}}}}
+
+	require.Contains(t, blockInsertQuery(db, blocks, lib.DbOperationTypeUpsert).String(), `INSERT INTO "block"`)
+
+	SetBlockInsertTable("block_repair_staging")
+	query := blockInsertQuery(db, blocks, lib.DbOperationTypeUpsert).String()
+	require.Contains(t, query, "INSERT INTO block_repair_staging")
+	require.NotContains(t, query, `"block"`)
+	require.Contains(t, query, "ON CONFLICT (block_hash) DO UPDATE")
+}
+
+func TestSetBlockConflictTargetRejectsUnknownColumns(t *testing.T) {
+	defer SetBlockConflictTarget(nil)
+	require.Error(t, SetBlockConflictTarget([]string{"block_hash; DROP TABLE block"}))
+	require.Error(t, SetBlockConflictTarget([]string{"timestamp"}))
+	require.Error(t, SetBlockConflictTarget([]string{"height", "height"}))
+}
+
+func TestBlockEncoderToPGStructRecordsSignerView(t *testing.T) {
+	signers := bitset.NewBitset()
+	signers.Set(1, true)
+	signers.Set(4, true)
+	block := &lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{
+		Version:        lib.HeaderVersion2,
+		Height:         300,
+		ProposedInView: 58,
+		ValidatorsVoteQC: &lib.QuorumCertificate{
+			BlockHash:                         &lib.BlockHash{},
+			ProposedInView:                    57,
+			ValidatorsVoteAggregatedSignature: &lib.AggregatedBLSSignature{SignersList: signers},
+		},
+	}}
+
+	_, blockSigners, err := BlockEncoderToPGStruct(block, []byte{0xab}, &lib.DeSoTestnetParams)
+	require.NoError(t, err)
+	require.Len(t, blockSigners, 2)
+	for i, index := range []uint64{1, 4} {
+		require.Equal(t, BlockSigner{BlockHash: "ab", SignerIndex: index, View: 57}, blockSigners[i].BlockSigner)
+	}
+
+	// Blocks without a QC have no signers at all.
+	_, blockSigners, err = BlockEncoderToPGStruct(&lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{Height: 5}}, []byte{0xab}, &lib.DeSoTestnetParams)
+	require.NoError(t, err)
+	require.Empty(t, blockSigners)
+}
+
+func TestBlockEncoderToPGStructRejectsEmptyBlockHash(t *testing.T) {
+	block := &lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{Height: 5}}
+
+	_, _, err := BlockEncoderToPGStruct(block, make([]byte, lib.HashSizeBytes), &lib.DeSoTestnetParams)
+	require.ErrorContains(t, err, "block at height 5 has an empty block hash")
+
+	require.True(t, isEmptyBlockHash(""))
+	require.False(t, isEmptyBlockHash("00ab"))
+}
+
+func TestBlockBatchOperationPartitionsMixedBatch(t *testing.T) {
+	insert, del := insertBlockEntries, deleteBlockEntries
+	defer func() { insertBlockEntries, deleteBlockEntries = insert, del }()
+
+	var calls []string
+	record := func(name string, batch []*lib.StateChangeEntry) {
+		call := name
+		for _, entry := range batch {
+			call += fmt.Sprintf(" %d", entry.BlockHeight)
+		}
+		calls = append(calls, call)
+	}
+	insertBlockEntries = func(batch []*lib.StateChangeEntry, db bun.IDB, operationType lib.StateSyncerOperationType, params *lib.DeSoParams) error {
+		record(fmt.Sprintf("insert(%v)", operationType), batch)
+		return nil
+	}
+	deleteBlockEntries = func(batch []*lib.StateChangeEntry, db bun.IDB, operationType lib.StateSyncerOperationType) error {
+		record("delete", batch)
+		return nil
+	}
+
+	entry := func(height uint64, operationType lib.StateSyncerOperationType) *lib.StateChangeEntry {
+		return &lib.StateChangeEntry{OperationType: operationType, EncoderType: lib.EncoderTypeBlock, BlockHeight: height}
+	}
+	batch := []*lib.StateChangeEntry{
+		entry(1, lib.DbOperationTypeInsert), entry(2, lib.DbOperationTypeInsert),
+		entry(3, lib.DbOperationTypeDelete),
+		entry(4, lib.DbOperationTypeUpsert), entry(5, lib.DbOperationTypeUpsert),
+		entry(6, lib.DbOperationTypeDelete),
+	}
+	require.NoError(t, BlockBatchOperation(batch, nil, &lib.DeSoTestnetParams))
+
+	require.Equal(t, []string{
+		fmt.Sprintf("insert(%v) 1 2", lib.DbOperationTypeInsert),
+		"delete 3",
+		fmt.Sprintf("insert(%v) 4 5", lib.DbOperationTypeUpsert),
+		"delete 6",
+	}, calls)
+	require.Empty(t, partitionByOperationType(nil))
+}
+
+// recordingConnector is a database/sql connector that records every statement run through it and answers
+// queries with no rows.
+type recordingConnector struct {
+	mu         sync.Mutex
+	statements []string
+}
+
+func (c *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{c}, nil
+}
+
+func (c *recordingConnector) Driver() driver.Driver {
+	return c
+}
+
+func (c *recordingConnector) Open(string) (driver.Conn, error) {
+	return recordingConn{c}, nil
+}
+
+func (c *recordingConnector) record(query string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = append(c.statements, query)
+}
+
+type recordingConn struct{ c *recordingConnector }
+
+func (recordingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (recordingConn) Close() error {
+	return nil
+}
+
+func (recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("begin not supported")
+}
+
+func (conn recordingConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	conn.c.record(query)
+	return driver.RowsAffected(0), nil
+}
+
+func (conn recordingConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	conn.c.record(query)
+	return emptyRows{}, nil
+}
+
+func TestBlockEntriesToPGStructsConvertsEachBlockOnce(t *testing.T) {
+	block := func(key byte, height uint64) *lib.StateChangeEntry {
+		return &lib.StateChangeEntry{
+			OperationType: lib.DbOperationTypeUpsert,
+			EncoderType:   lib.EncoderTypeBlock,
+			KeyBytes:      []byte{key},
+			Encoder:       &lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{Height: height, Nonce: height * 3}},
+			BlockHeight:   height,
+		}
+	}
+
+	blocks, txns, signers, err := BlockEntriesToPGStructs([]*lib.StateChangeEntry{block(0xab, 5), block(0xcd, 6), block(0xab, 5)}, &lib.DeSoTestnetParams)
+	require.NoError(t, err)
+	nonces := make(map[string]uint64)
+	for _, row := range blocks {
+		nonces[row.BlockHash] = row.Nonce
+	}
+	require.Len(t, blocks, 2)
+	require.Equal(t, map[string]uint64{"ab": 15, "cd": 18}, nonces)
+	require.Empty(t, txns)
+	require.Empty(t, signers)
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string         { return nil }
+func (emptyRows) Close() error              { return nil }
+func (emptyRows) Next([]driver.Value) error { return io.EOF }
+
+func TestTransactionsOnlyRebuildsTransactionsWithoutTouchingBlocks(t *testing.T) {
+	connector := &recordingConnector{}
+	db := bun.NewDB(sql.OpenDB(connector), pgdialect.New())
+	defer db.Close()
+	SetTransactionsOnly(true)
+	defer SetTransactionsOnly(false)
+
+	// A block's transactions are deleted by its hash and re-derived from the block, which has none here.
+	block := &lib.StateChangeEntry{
+		OperationType: lib.DbOperationTypeUpsert,
+		EncoderType:   lib.EncoderTypeBlock,
+		KeyBytes:      []byte{0xab},
+		Encoder:       &lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{Height: 5}},
+		BlockHeight:   5,
+	}
+	require.NoError(t, bulkInsertBlockEntry([]*lib.StateChangeEntry{block}, db, lib.DbOperationTypeUpsert, &lib.DeSoTestnetParams))
+	require.Len(t, connector.statements, 1)
+	require.Contains(t, connector.statements[0], `DELETE FROM "transaction_partitioned"`)
+	require.Contains(t, connector.statements[0], "block_hash IN ('ab')")
+
+	index, wrapperHash, wrapperIndex := uint64(0), "", uint64(0)
+	blocks := []*PGBlockEntry{{BlockEntry: BlockEntry{BlockHash: "aa", Height: 7}}}
+	txns := []*PGTransactionEntry{{TransactionEntry: TransactionEntry{
+		TransactionHash: "t1", BlockHash: "aa", BlockHeight: 7,
+		IndexInBlock: &index, WrapperTransactionHash: &wrapperHash, IndexInWrapperTransaction: &wrapperIndex,
+	}}}
+	require.NoError(t, replaceBlockTransactions(db, blocks, txns, lib.DbOperationTypeUpsert))
+	require.Len(t, connector.statements, 3)
+	require.Contains(t, connector.statements[1], "block_hash IN ('aa')")
+	require.Contains(t, connector.statements[2], `INSERT INTO "transaction_partitioned"`)
+	require.Contains(t, connector.statements[2], "'t1'")
+
+	// Neither the block nor its signers were written.
+	for _, statement := range connector.statements {
+		require.NotContains(t, statement, `"block"`)
+		require.NotContains(t, statement, "block_signer")
+	}
+}
@@ -8,9 +8,35 @@ import (
 	"github.com/deso-protocol/state-consumer/consumer"
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
+	"sync/atomic"
 	"time"
 )
 
+// skipExistingTransactions makes bulkInsertTransactionEntry leave transaction rows that are already in the
+// database untouched, so reprocessing a block range is idempotent for the transaction table.
+var skipExistingTransactions atomic.Bool
+
+// SetSkipExistingTransactions enables or disables skipping transactions that already exist on insert.
+func SetSkipExistingTransactions(skip bool) {
+	skipExistingTransactions.Store(skip)
+}
+
+// maxAtomicInnerTxns caps the inner transactions parseInnerTxnsFromAtomicTxn expands from one atomic wrapper, so
+// a malformed wrapper can't generate an unbounded number of rows. Zero, the default, disables the limit.
+var maxAtomicInnerTxns atomic.Int64
+
+// SetMaxAtomicInnerTxns sets the most inner transactions an atomic wrapper may hold before it is rejected.
+// Zero disables the limit.
+func SetMaxAtomicInnerTxns(max int) {
+	maxAtomicInnerTxns.Store(int64(max))
+}
+
+// transactionKey identifies a transaction row by the columns of the table's unique constraint.
+type transactionKey struct {
+	TransactionHash string
+	TxnType         uint16
+}
+
 type TransactionEntry struct {
 	TransactionHash              string `pg:",pk,use_zero"`
 	TransactionId                string `pg:",use_zero"`
@@ -177,6 +203,24 @@ func TransformTransactionEntry(entries []*lib.StateChangeEntry, params *lib.DeSo
 }
 
 func bulkInsertTransactionEntry(entries []*PGTransactionEntry, db bun.IDB, operationType lib.StateSyncerOperationType) error {
+	if skipExistingTransactions.Load() && len(entries) > 0 {
+		existing, err := existingTransactionKeys(entries, db)
+		if err != nil {
+			return errors.Wrapf(err, "entries.bulkInsertTransaction: Error loading existing transactions")
+		}
+		entries = excludeExistingTransactions(entries, existing)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, entry := range entries {
+		if err := checkRowStrings(entry, func() string {
+			return fmt.Sprintf("transaction %s in block %d", entry.TransactionHash, entry.BlockHeight)
+		}); err != nil {
+			return errors.Wrapf(err, "entries.bulkInsertTransaction")
+		}
+	}
+
 	// Bulk insert the entries.
 	transactionQuery := db.NewInsert().Model(&entries)
 
@@ -190,6 +234,42 @@ func bulkInsertTransactionEntry(entries []*PGTransactionEntry, db bun.IDB, opera
 	return nil
 }
 
+// existingTransactionKeys returns the keys of the given transactions that already have rows in the database.
+func existingTransactionKeys(entries []*PGTransactionEntry, db bun.IDB) (map[transactionKey]struct{}, error) {
+	hashes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		hashes = append(hashes, entry.TransactionHash)
+	}
+	var rows []transactionKey
+	if err := db.NewSelect().
+		Model((*PGTransactionEntry)(nil)).
+		Column("transaction_hash", "txn_type").
+		Where("transaction_hash IN (?)", bun.In(hashes)).
+		Scan(context.Background(), &rows); err != nil {
+		return nil, err
+	}
+	existing := make(map[transactionKey]struct{}, len(rows))
+	for _, row := range rows {
+		existing[row] = struct{}{}
+	}
+	return existing, nil
+}
+
+// excludeExistingTransactions returns the entries whose keys aren't in existing.
+func excludeExistingTransactions(entries []*PGTransactionEntry, existing map[transactionKey]struct{}) []*PGTransactionEntry {
+	if len(existing) == 0 {
+		return entries
+	}
+	newEntries := make([]*PGTransactionEntry, 0, len(entries))
+	for _, entry := range entries {
+		if _, ok := existing[transactionKey{TransactionHash: entry.TransactionHash, TxnType: entry.TxnType}]; ok {
+			continue
+		}
+		newEntries = append(newEntries, entry)
+	}
+	return newEntries
+}
+
 // transformAndBulkInsertTransactionEntry inserts a batch of user_association entries into the database.
 func transformAndBulkInsertTransactionEntry(entries []*lib.StateChangeEntry, db bun.IDB, operationType lib.StateSyncerOperationType, params *lib.DeSoParams) error {
 	pgTransactionEntrySlice, err := TransformTransactionEntry(entries, params)
@@ -242,7 +322,13 @@ func parseInnerTxnsFromAtomicTxn(
 	if !ok {
 		return nil, errors.New("parseInnerTxnsFromAtomicTxn: txn meta is not an atomic txn wrapper")
 	}
-	innerTxns := make([]*PGTransactionEntry, 0)
+	// Inner txns are not expanded further, so a nested wrapper adds one row rather than recursing; only the
+	// number of inner txns needs a bound.
+	if max := maxAtomicInnerTxns.Load(); max > 0 && int64(len(realTxMeta.Txns)) > max {
+		return nil, errors.Errorf("parseInnerTxnsFromAtomicTxn: atomic txn %v has %d inner txns, more than the limit of %d",
+			pgAtomicTxn.TransactionHash, len(realTxMeta.Txns), max)
+	}
+	innerTxns := make([]*PGTransactionEntry, 0, len(realTxMeta.Txns))
 	for ii, txn := range realTxMeta.Txns {
 		indexInWrapper := uint64(ii)
 		pgInnerTxn, err := TransactionEncoderToPGStruct(
@@ -0,0 +1,44 @@
+package entries
+
+import (
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExcludeExistingTransactionsSkipsPreexistingRows(t *testing.T) {
+	newTxn := func(hash string, txnType uint16) *PGTransactionEntry {
+		return &PGTransactionEntry{TransactionEntry: TransactionEntry{TransactionHash: hash, TxnType: txnType}}
+	}
+	batch := []*PGTransactionEntry{newTxn("aa", 1), newTxn("bb", 2), newTxn("cc", 5), newTxn("bb", 44)}
+	// Rows already in the table: "aa" and "bb" as a basic transfer. "bb" with another type is a different row.
+	existing := map[transactionKey]struct{}{
+		{TransactionHash: "aa", TxnType: 1}: {},
+		{TransactionHash: "bb", TxnType: 2}: {},
+		{TransactionHash: "zz", TxnType: 1}: {},
+	}
+
+	inserted := excludeExistingTransactions(batch, existing)
+	require.Equal(t, []*PGTransactionEntry{batch[2], batch[3]}, inserted)
+
+	require.Equal(t, batch, excludeExistingTransactions(batch, nil))
+}
+
+func TestParseInnerTxnsFromAtomicTxnLimitsInnerTxns(t *testing.T) {
+	defer SetMaxAtomicInnerTxns(0)
+	SetMaxAtomicInnerTxns(2)
+	wrapper := func(innerTxns int) *PGTransactionEntry {
+		return &PGTransactionEntry{TransactionEntry: TransactionEntry{
+			TransactionHash: "aa",
+			TxnMeta:         &lib.AtomicTxnsWrapperMetadata{Txns: make([]*lib.MsgDeSoTxn, innerTxns)},
+		}}
+	}
+
+	_, err := parseInnerTxnsFromAtomicTxn(wrapper(3), &lib.DeSoMainnetParams)
+	require.ErrorContains(t, err, "has 3 inner txns, more than the limit of 2")
+
+	innerTxns, err := parseInnerTxnsFromAtomicTxn(wrapper(0), &lib.DeSoMainnetParams)
+	require.NoError(t, err)
+	require.Empty(t, innerTxns)
+}
@@ -0,0 +1,150 @@
+package entries
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+// UTF-8 validation modes for SetUTF8Validation.
+const (
+	// UTF8ValidationOff inserts string fields as they are.
+	UTF8ValidationOff = "off"
+	// UTF8ValidationReport fails the insert with an *InvalidStringError naming the row and field.
+	UTF8ValidationReport = "report"
+	// UTF8ValidationHex replaces the value with its hex encoding and logs the row and field.
+	UTF8ValidationHex = "hex"
+)
+
+var utf8ValidationModes = []string{UTF8ValidationOff, UTF8ValidationReport, UTF8ValidationHex}
+
+// utf8Validation is the index in utf8ValidationModes of the mode checkRowStrings applies.
+var utf8Validation atomic.Int32
+
+// SetUTF8Validation sets how the string fields of block and transaction rows are checked before insert.
+// Postgres rejects text holding invalid UTF-8 or a NUL byte with an encoding error that aborts the whole batch
+// without saying which row caused it. An empty mode turns the check off.
+func SetUTF8Validation(mode string) error {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" {
+		mode = UTF8ValidationOff
+	}
+	for i, m := range utf8ValidationModes {
+		if m == mode {
+			utf8Validation.Store(int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("SetUTF8Validation: unknown mode %q (want %s)", mode, strings.Join(utf8ValidationModes, ", "))
+}
+
+// InvalidStringError is a string field Postgres would reject as text.
+type InvalidStringError struct {
+	// Row describes the row, e.g. "block 123 (<hash>)".
+	Row   string
+	Field string
+	Value string
+}
+
+func (e *InvalidStringError) Error() string {
+	return fmt.Sprintf("%s: field %s holds invalid UTF-8 or a NUL byte (hex %s)", e.Row, e.Field, hex.EncodeToString([]byte(e.Value)))
+}
+
+// validText reports whether Postgres accepts s as text.
+func validText(s string) bool {
+	return utf8.ValidString(s) && strings.IndexByte(s, 0) < 0
+}
+
+// checkRowStrings applies the UTF-8 validation mode to the exported string fields of the struct row points
+// at, including *string fields and the keys and values of map[string]string and []map[string]string fields.
+// describe names the row in errors and logs; it is only called when the check is on.
+func checkRowStrings(row any, describe func() string) error {
+	mode := utf8ValidationModes[utf8Validation.Load()]
+	if mode == UTF8ValidationOff {
+		return nil
+	}
+	return checkStructStrings(reflect.ValueOf(row).Elem(), describe(), mode == UTF8ValidationHex)
+}
+
+func checkStructStrings(v reflect.Value, desc string, sanitize bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if field.Anonymous && value.Kind() == reflect.Struct {
+			if err := checkStructStrings(value, desc, sanitize); err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case value.Kind() == reflect.String:
+			if err := checkString(value, desc, field.Name, sanitize); err != nil {
+				return err
+			}
+		case value.Kind() == reflect.Pointer && value.Type().Elem().Kind() == reflect.String:
+			if !value.IsNil() {
+				if err := checkString(value.Elem(), desc, field.Name, sanitize); err != nil {
+					return err
+				}
+			}
+		case value.Type() == reflect.TypeOf(map[string]string(nil)):
+			if err := checkStringMap(value.Interface().(map[string]string), desc, field.Name, sanitize); err != nil {
+				return err
+			}
+		case value.Type() == reflect.TypeOf([]map[string]string(nil)):
+			for j, m := range value.Interface().([]map[string]string) {
+				if err := checkStringMap(m, desc, fmt.Sprintf("%s[%d]", field.Name, j), sanitize); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func checkString(value reflect.Value, desc, name string, sanitize bool) error {
+	s := value.String()
+	if validText(s) {
+		return nil
+	}
+	if !sanitize {
+		return &InvalidStringError{Row: desc, Field: name, Value: s}
+	}
+	glog.Warningf("%s: field %s holds invalid UTF-8 or a NUL byte, storing it hex-encoded", desc, name)
+	value.SetString(hex.EncodeToString([]byte(s)))
+	return nil
+}
+
+// checkStringMap checks the keys and values of m, replacing an invalid key's entry with one under the
+// hex-encoded key when sanitizing.
+func checkStringMap(m map[string]string, desc, name string, sanitize bool) error {
+	for key, val := range m {
+		keyName := fmt.Sprintf("%s[%q]", name, key)
+		if !validText(key) {
+			if !sanitize {
+				return &InvalidStringError{Row: desc, Field: name + " key", Value: key}
+			}
+			glog.Warningf("%s: a key of field %s holds invalid UTF-8 or a NUL byte, storing it hex-encoded", desc, name)
+			delete(m, key)
+			key = hex.EncodeToString([]byte(key))
+			keyName = fmt.Sprintf("%s[%q]", name, key)
+			m[key] = val
+		}
+		if !validText(val) {
+			if !sanitize {
+				return &InvalidStringError{Row: desc, Field: keyName, Value: val}
+			}
+			glog.Warningf("%s: field %s holds invalid UTF-8 or a NUL byte, storing it hex-encoded", desc, keyName)
+			m[key] = hex.EncodeToString([]byte(val))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package entries
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRowStringsHandlesInvalidUTF8(t *testing.T) {
+	defer SetUTF8Validation("")
+	newBlock := func() *PGBlockEntry {
+		return &PGBlockEntry{BlockEntry: BlockEntry{BlockHash: "aa", Height: 7, ProposerVotingPublicKey: "ok\xff\xfe"}}
+	}
+	describe := func() string { return "block 7 (aa)" }
+
+	// Off by default, so the row goes to Postgres as is.
+	block := newBlock()
+	require.NoError(t, checkRowStrings(block, describe))
+	require.Equal(t, "ok\xff\xfe", block.ProposerVotingPublicKey)
+
+	require.NoError(t, SetUTF8Validation("report"))
+	err := checkRowStrings(newBlock(), describe)
+	var invalid *InvalidStringError
+	require.ErrorAs(t, err, &invalid)
+	require.Equal(t, "ProposerVotingPublicKey", invalid.Field)
+	require.EqualError(t, err, "block 7 (aa): field ProposerVotingPublicKey holds invalid UTF-8 or a NUL byte (hex 6f6bfffe)")
+
+	require.NoError(t, SetUTF8Validation("HEX"))
+	block = newBlock()
+	require.NoError(t, checkRowStrings(block, describe))
+	require.Equal(t, "6f6bfffe", block.ProposerVotingPublicKey)
+	require.Equal(t, "aa", block.BlockHash)
+
+	// Map fields are checked key by key, and a NUL byte is rejected like invalid UTF-8.
+	wrapper := "bb\x00"
+	txn := &PGTransactionEntry{TransactionEntry: TransactionEntry{
+		TransactionHash:        "cc",
+		ExtraData:              map[string]string{"memo": "hi", "\xc3": "x"},
+		Outputs:                []map[string]string{{"amount": "1\x00"}},
+		WrapperTransactionHash: &wrapper,
+	}}
+	require.NoError(t, checkRowStrings(txn, func() string { return "transaction cc in block 7" }))
+	require.Equal(t, map[string]string{"memo": "hi", "c3": "x"}, txn.ExtraData)
+	require.Equal(t, []map[string]string{{"amount": "3100"}}, txn.Outputs)
+	require.Equal(t, "626200", *txn.WrapperTransactionHash)
+
+	require.NoError(t, SetUTF8Validation("report"))
+	txn.Outputs[0]["amount"] = "\xff"
+	require.ErrorContains(t, checkRowStrings(txn, func() string { return "transaction cc in block 7" }),
+		`transaction cc in block 7: field Outputs[0]["amount"] holds invalid UTF-8`)
+
+	require.Error(t, SetUTF8Validation("replace"))
+}
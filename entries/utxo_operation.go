@@ -128,7 +128,10 @@ func bulkInsertUtxoOperationsEntry(entries []*lib.StateChangeEntry, db bun.IDB,
 		if entry.Block != nil {
 			insertTransactions = true
 			block := entry.Block
-			blockEntry, blockSigners := BlockEncoderToPGStruct(block, entry.KeyBytes, params)
+			blockEntry, blockSigners, err := BlockEncoderToPGStruct(block, entry.KeyBytes, params)
+			if err != nil {
+				return errors.Wrapf(err, "entries.bulkInsertUtxoOperationsEntry: Problem converting block to PG struct")
+			}
 			blockEntries = append(blockEntries, blockEntry)
 			pgBlockSigners = append(pgBlockSigners, blockSigners...)
 			for ii, txn := range block.Txns {
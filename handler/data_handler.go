@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"strings"
 
 	"github.com/deso-protocol/core/lib"
 	"github.com/deso-protocol/postgres-data-handler/entries"
@@ -30,6 +31,22 @@ type PostgresDataHandler struct {
 
 	// LRU containing cached entries, to reduce duplicative database operations
 	CachedEntries *lru.Cache[string, []byte]
+
+	// IsolationLevel is the isolation level transactions are begun with. The zero value uses the database
+	// default. pgdriver rejects non-default levels in BeginTx, so it is set with SET TRANSACTION instead.
+	IsolationLevel sql.IsolationLevel
+}
+
+// UnsupportedEncoderError is returned by HandleEntryBatch for entries of an encoder type it has no handling
+// for, e.g. one added to core after this version of the handler. Unlike other errors, retrying won't help.
+type UnsupportedEncoderError struct {
+	EncoderType lib.EncoderType
+	BlockHeight uint64
+}
+
+func (e *UnsupportedEncoderError) Error() string {
+	return fmt.Sprintf("PostgresDataHandler.HandleEntryBatch: Unknown or missing EncoderType (%d) for entry at height %d",
+		e.EncoderType, e.BlockHeight)
 }
 
 // HandleEntryBatch performs a bulk operation for a batch of entries, based on the encoder type.
@@ -116,8 +133,7 @@ func (postgresDataHandler *PostgresDataHandler) HandleEntryBatch(batchedEntries
 		err = entries.BlockNodeOperation(batchedEntries, dbHandle, postgresDataHandler.Params)
 	default:
 		// CRITICAL: If we reach here, an entry with an unrecognized or zero EncoderType was passed
-		return errors.Errorf("PostgresDataHandler.HandleEntryBatch: Unknown or missing EncoderType (%d) for entry at height %d",
-			encoderType, batchedEntries[0].BlockHeight)
+		return &UnsupportedEncoderError{EncoderType: encoderType, BlockHeight: batchedEntries[0].BlockHeight}
 	}
 
 	if err != nil {
@@ -211,10 +227,19 @@ func (postgresDataHandler *PostgresDataHandler) InitiateTransaction() error {
 	if err := AcquireAdvisoryLock(postgresDataHandler.DB); err != nil {
 		return errors.Wrapf(err, "PostgresDataHandler.InitiateTransaction: Error acquiring advisory lock")
 	}
-	tx, err := postgresDataHandler.DB.BeginTx(context.Background(), &sql.TxOptions{})
+	tx, err := postgresDataHandler.DB.BeginTx(context.Background(), nil)
 	if err != nil {
 		return errors.Wrapf(err, "PostgresDataHandler.InitiateTransaction: Error beginning transaction")
 	}
+	if level := postgresDataHandler.IsolationLevel; level != sql.LevelDefault {
+		// This has to be the transaction's first statement.
+		if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL " + strings.ToUpper(level.String())); err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				glog.Errorf("Error rolling back transaction: %v", rollbackErr)
+			}
+			return errors.Wrapf(err, "PostgresDataHandler.InitiateTransaction: Error setting isolation level")
+		}
+	}
 	postgresDataHandler.Txn = &tx
 	return nil
 }
@@ -265,6 +290,11 @@ func (postgresDataHandler *PostgresDataHandler) RollbackTransaction() error {
 	return nil
 }
 
+// InTransaction returns true if a transaction is currently open.
+func (postgresDataHandler *PostgresDataHandler) InTransaction() bool {
+	return postgresDataHandler.Txn != nil
+}
+
 func (postgresDataHandler *PostgresDataHandler) GetParams() *lib.DeSoParams {
 	return postgresDataHandler.Params
 }
@@ -4,10 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"flag"
-	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/config"
 	"github.com/deso-protocol/postgres-data-handler/handler"
 	"github.com/deso-protocol/postgres-data-handler/migrations/initial_migrations"
 	"github.com/deso-protocol/postgres-data-handler/migrations/post_sync_migrations"
@@ -29,10 +30,8 @@ func main() {
 	pgURI, stateChangeDir, consumerProgressDir, batchBytes, threadLimit, logQueries, readOnlyUserPassword,
 		explorerStatistics, datadogProfiler, isTestnet, isRegtest, isAcceleratedRegtest, syncMempool := getConfigValues()
 
-	dbName := "postgres"
-	if viper.GetString("DB_NAME") != "" {
-		dbName = viper.GetString("DB_NAME")
-	}
+	// getConfigValues has already checked the DB settings resolve.
+	dbSettings, _ := config.ResolveDBSettings(viper.GetViper())
 	// Print all the config values in a single printf call broken up
 	// with newlines and make it look pretty both printed out and in code
 	glog.Infof(`
@@ -53,8 +52,8 @@ func main() {
 		REGTEST: %t
 		ACCELERATED_REGTEST: %t
 		SYNC_MEMPOOL: %t
-		`, viper.GetString("DB_HOST"), viper.GetString("DB_PORT"),
-		viper.GetString("DB_USERNAME"), dbName,
+		`, dbSettings.Host, dbSettings.Port,
+		dbSettings.Username, dbSettings.Name,
 		stateChangeDir, consumerProgressDir, batchBytes, threadLimit,
 		logQueries, explorerStatistics, datadogProfiler, isTestnet, isRegtest, isAcceleratedRegtest, syncMempool)
 
@@ -121,16 +120,12 @@ func setupFlags() {
 
 func getConfigValues() (pgURI string, stateChangeDir string, consumerProgressDir string, batchBytes uint64, threadLimit int, logQueries bool, readonlyUserPassword string, explorerStatistics bool, datadogProfiler bool, isTestnet bool, isRegtest bool, isAcceleratedRegtest bool, syncMempool bool) {
 
-	dbHost := viper.GetString("DB_HOST")
-	dbPort := viper.GetString("DB_PORT")
-	dbUsername := viper.GetString("DB_USERNAME")
-	dbPassword := viper.GetString("DB_PASSWORD")
-	dbName := "postgres"
-	if viper.GetString("DB_NAME") != "" {
-		dbName = viper.GetString("DB_NAME")
+	dbSettings, err := config.ResolveDBSettings(viper.GetViper())
+	if err != nil {
+		glog.Fatal(err)
 	}
 
-	pgURI = fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&timeout=18000s", dbUsername, dbPassword, dbHost, dbPort, dbName)
+	pgURI = dbSettings.URI(url.Values{"timeout": {"18000s"}})
 
 	stateChangeDir = viper.GetString("STATE_CHANGE_DIR")
 	if stateChangeDir == "" {
@@ -0,0 +1,28 @@
+package initial_migrations
+
+import (
+	"context"
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		// Signers recorded before this column existed keep a NULL view until their block is re-synced.
+		_, err := db.Exec(`
+			ALTER TABLE block_signer ADD COLUMN IF NOT EXISTS view BIGINT;
+			CREATE INDEX IF NOT EXISTS block_signer_view_idx ON block_signer (view);
+		`)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.Exec(`
+			ALTER TABLE block_signer DROP COLUMN IF EXISTS view;
+		`)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,62 @@
+package repair
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// AuditLog appends the raw bytes of every processed state-change entry to a file, so an investigation can
+// replay exactly what a run wrote. Each record is one line: the entry's offset in the data file, its block
+// height and its bytes in hex. The records of the open transaction are held in memory and only written when
+// it commits; a rollback discards them, so the file never lists an entry the DB doesn't hold.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	// pending holds the records of the open transaction.
+	pending bytes.Buffer
+}
+
+// OpenAuditLog opens path for appending, creating it if needed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Record holds one entry until its transaction commits.
+func (a *AuditLog) Record(offset, height uint64, raw []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Fprintf(&a.pending, "%d %d %s\n", offset, height, hex.EncodeToString(raw))
+	return nil
+}
+
+// Flush writes the records of the transaction that just committed to the file.
+func (a *AuditLog) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := a.pending.WriteTo(a.file)
+	a.pending.Reset()
+	if err != nil {
+		return fmt.Errorf("flush audit log: %w", err)
+	}
+	return nil
+}
+
+// Discard drops the records of the transaction that was just rolled back.
+func (a *AuditLog) Discard() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending.Reset()
+}
+
+// Close closes the file. Records of a transaction that never committed are dropped.
+func (a *AuditLog) Close() error {
+	a.Discard()
+	return a.file.Close()
+}
@@ -0,0 +1,91 @@
+package repair
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/dgraph-io/badger/v3"
+)
+
+// BadgerBlockSource reads blocks from a copy of a node's badger DB, using the node's own key scheme, so a
+// repair needs neither the node API nor the state-change files. The snapshot must have been written by a
+// node built against the same core version as this tool (badger v3); it is opened read-only.
+type BadgerBlockSource struct {
+	db *badger.DB
+}
+
+// OpenBadgerBlockSource opens the badger snapshot in dir read-only. The node must not be running on it.
+func OpenBadgerBlockSource(dir string) (*BadgerBlockSource, error) {
+	opts := badger.DefaultOptions(dir).WithReadOnly(true).WithLogger(nil)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("open badger snapshot %s: %w", dir, err)
+	}
+	return &BadgerBlockSource{db: db}, nil
+}
+
+// Close closes the snapshot.
+func (s *BadgerBlockSource) Close() error { return s.db.Close() }
+
+// FetchBlock reads the block at height. The height index can hold several blocks at one height when there
+// were forks; the committed one is used, and a height with several uncommitted candidates is an error.
+func (s *BadgerBlockSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	var block *lib.MsgDeSoBlock
+	var blockHash *lib.BlockHash
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		blockHash, err = mainChainHashAtHeight(txn, height)
+		if err != nil {
+			return err
+		}
+		item, err := txn.Get(lib.BlockHashToBlockKey(blockHash))
+		if err != nil {
+			return fmt.Errorf("block %x at height %d: %w", blockHash[:], height, err)
+		}
+		blockBytes, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		block = &lib.MsgDeSoBlock{}
+		if err := block.FromBytes(blockBytes); err != nil {
+			return fmt.Errorf("decode block at height %d: %w", height, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, blockHash, nil
+}
+
+// mainChainHashAtHeight returns the hash of the block at height from the height-to-node index.
+func mainChainHashAtHeight(txn *badger.Txn, height uint64) (*lib.BlockHash, error) {
+	prefix := append(append([]byte{}, lib.Prefixes.PrefixHeightHashToNodeInfo...), binary.BigEndian.AppendUint32(nil, uint32(height))...)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+
+	var candidates []*lib.BlockNode
+	for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+		nodeBytes, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		node, err := lib.DeserializeBlockNode(nodeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("decode block node at height %d: %w", height, err)
+		}
+		if node.IsCommitted() {
+			return node.Hash, nil
+		}
+		candidates = append(candidates, node)
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("no block at height %d in badger snapshot", height)
+	case 1:
+		return candidates[0].Hash, nil
+	default:
+		return nil, fmt.Errorf("%d uncommitted blocks at height %d in badger snapshot, can't tell which is on the main chain", len(candidates), height)
+	}
+}
@@ -0,0 +1,80 @@
+package repair
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// putBadgerBlock stores block under the node's block and height-index keys.
+func putBadgerBlock(t *testing.T, txn *badger.Txn, block *lib.MsgDeSoBlock, status lib.BlockStatus) *lib.BlockHash {
+	t.Helper()
+	blockHash, err := block.Hash()
+	require.NoError(t, err)
+	blockBytes, err := block.ToBytes(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Set(lib.BlockHashToBlockKey(blockHash), blockBytes))
+
+	node := &lib.BlockNode{
+		Hash:             blockHash,
+		Height:           uint32(block.Header.Height),
+		DifficultyTarget: &lib.BlockHash{},
+		CumWork:          big.NewInt(0),
+		Header:           block.Header,
+		Status:           status,
+	}
+	nodeBytes, err := lib.SerializeBlockNode(node)
+	require.NoError(t, err)
+	key := append(append([]byte{}, lib.Prefixes.PrefixHeightHashToNodeInfo...), binary.BigEndian.AppendUint32(nil, uint32(block.Header.Height))...)
+	require.NoError(t, txn.Set(append(key, blockHash[:]...), nodeBytes))
+	return blockHash
+}
+
+func badgerTestBlock(height uint64, nonce uint64) *lib.MsgDeSoBlock {
+	return &lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{
+		Version:               1,
+		PrevBlockHash:         &lib.BlockHash{},
+		TransactionMerkleRoot: &lib.BlockHash{},
+		Height:                height,
+		Nonce:                 nonce,
+	}}
+}
+
+func TestBadgerBlockSourceReadsBlocksByHeight(t *testing.T) {
+	dir := t.TempDir()
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	require.NoError(t, err)
+	want := make(map[uint64]*lib.BlockHash)
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		for height := uint64(1); height <= 3; height++ {
+			want[height] = putBadgerBlock(t, txn, badgerTestBlock(height, 0), lib.StatusBlockStored)
+		}
+		// Height 4 forked: only the committed block is on the main chain.
+		putBadgerBlock(t, txn, badgerTestBlock(4, 1), lib.StatusBlockStored)
+		want[4] = putBadgerBlock(t, txn, badgerTestBlock(4, 2), lib.StatusBlockStored|lib.StatusBlockCommitted)
+		// Height 5 forked with no committed block.
+		putBadgerBlock(t, txn, badgerTestBlock(5, 1), lib.StatusBlockStored)
+		putBadgerBlock(t, txn, badgerTestBlock(5, 2), lib.StatusBlockStored)
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	source, err := OpenBadgerBlockSource(dir)
+	require.NoError(t, err)
+	defer source.Close()
+	for height := uint64(1); height <= 4; height++ {
+		block, blockHash, err := source.FetchBlock(height)
+		require.NoError(t, err, "height %d", height)
+		require.Equal(t, height, block.Header.Height)
+		require.Equal(t, *want[height], *blockHash)
+	}
+
+	_, _, err = source.FetchBlock(5)
+	require.ErrorContains(t, err, "can't tell which is on the main chain")
+	_, _, err = source.FetchBlock(6)
+	require.ErrorContains(t, err, "no block at height 6")
+}
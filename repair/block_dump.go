@@ -0,0 +1,109 @@
+package repair
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlockRow is a block row as DumpBlock prints it, with the counts of the rows that reference it. Nullable
+// columns are nil when NULL.
+type BlockRow struct {
+	BlockHash                    string    `json:"block_hash"`
+	PrevBlockHash                *string   `json:"prev_block_hash"`
+	TxnMerkleRoot                *string   `json:"txn_merkle_root"`
+	Timestamp                    time.Time `json:"timestamp"`
+	Height                       uint64    `json:"height"`
+	Nonce                        uint64    `json:"nonce"`
+	ExtraNonce                   uint64    `json:"extra_nonce"`
+	BlockVersion                 uint32    `json:"block_version"`
+	ProposerVotingPublicKey      *string   `json:"proposer_voting_public_key"`
+	ProposerRandomSeedSignature  *string   `json:"proposer_random_seed_signature"`
+	ProposedInView               uint64    `json:"proposed_in_view"`
+	ProposerVotePartialSignature *string   `json:"proposer_vote_partial_signature"`
+	// BadgerKey is hex-encoded.
+	BadgerKey string `json:"badger_key"`
+	// SignerCount is the number of block_signer rows, TxnCount the number of top-level transaction rows (what
+	// the node reports as the block's transactions) and InnerTxnCount the number of inner atomic ones.
+	SignerCount   int `json:"signer_count"`
+	TxnCount      int `json:"txn_count"`
+	InnerTxnCount int `json:"inner_txn_count"`
+}
+
+// blockRefCondition turns a height or a 64-character hex block hash into a condition on block rows aliased
+// as b.
+func blockRefCondition(ref string) (string, error) {
+	ref = strings.TrimSpace(ref)
+	if height, err := strconv.ParseUint(ref, 10, 64); err == nil {
+		return fmt.Sprintf("b.height = %d", height), nil
+	}
+	hash, err := hex.DecodeString(ref)
+	if err != nil || len(hash) != 32 {
+		return "", fmt.Errorf("block %q is neither a height nor a 64-character hex block hash", ref)
+	}
+	return fmt.Sprintf("b.block_hash = '%s'", hex.EncodeToString(hash)), nil
+}
+
+// LoadBlockRows returns the block rows at the height or with the hex block hash ref. A healthy DB has at most
+// one, but a height can hold several after a bad repair, so all of them are returned.
+func LoadBlockRows(ctx context.Context, db Querier, ref string) ([]BlockRow, error) {
+	condition, err := blockRefCondition(ref)
+	if err != nil {
+		return nil, err
+	}
+	// Inner atomic transactions are stored with a NULL index_in_block.
+	query := `SELECT b.block_hash, b.prev_block_hash, b.txn_merkle_root, b.timestamp, b.height, b.nonce, b.extra_nonce,
+  b.block_version, b.proposer_voting_public_key, b.proposer_random_seed_signature, b.proposed_in_view,
+  b.proposer_vote_partial_signature, b.badger_key,
+  (SELECT COUNT(*) FROM block_signer s WHERE s.block_hash = b.block_hash),
+  (SELECT COUNT(*) FROM "transaction" t WHERE t.block_hash = b.block_hash AND t.index_in_block IS NOT NULL),
+  (SELECT COUNT(*) FROM "transaction" t WHERE t.block_hash = b.block_hash AND t.index_in_block IS NULL)
+FROM block b WHERE ` + condition + ` ORDER BY b.block_hash`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("load block %s: %w", ref, err)
+	}
+	defer rows.Close()
+	var blocks []BlockRow
+	for rows.Next() {
+		var b BlockRow
+		var badgerKey []byte
+		if err := rows.Scan(&b.BlockHash, &b.PrevBlockHash, &b.TxnMerkleRoot, &b.Timestamp, &b.Height, &b.Nonce,
+			&b.ExtraNonce, &b.BlockVersion, &b.ProposerVotingPublicKey, &b.ProposerRandomSeedSignature,
+			&b.ProposedInView, &b.ProposerVotePartialSignature, &badgerKey,
+			&b.SignerCount, &b.TxnCount, &b.InnerTxnCount); err != nil {
+			return nil, fmt.Errorf("load block %s: %w", ref, err)
+		}
+		b.BadgerKey = hex.EncodeToString(badgerKey)
+		blocks = append(blocks, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("load block %s: %w", ref, err)
+	}
+	return blocks, nil
+}
+
+// DumpBlock writes the block rows at the height or with the hex block hash ref to w as indented JSON, one
+// object per row. It returns the number of rows written and fails if there are none.
+func DumpBlock(ctx context.Context, db Querier, w io.Writer, ref string) (int, error) {
+	blocks, err := LoadBlockRows(ctx, db, ref)
+	if err != nil {
+		return 0, err
+	}
+	if len(blocks) == 0 {
+		return 0, fmt.Errorf("no block row for %s", ref)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	for i, b := range blocks {
+		if err := enc.Encode(b); err != nil {
+			return i, err
+		}
+	}
+	return len(blocks), nil
+}
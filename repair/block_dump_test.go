@@ -0,0 +1,63 @@
+package repair
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpBlockPrintsStoredRowAsJSON(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	stamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fixture := &queryFixture{
+		columns: []string{"block_hash", "prev_block_hash", "txn_merkle_root", "timestamp", "height", "nonce",
+			"extra_nonce", "block_version", "proposer_voting_public_key", "proposer_random_seed_signature",
+			"proposed_in_view", "proposer_vote_partial_signature", "badger_key", "signers", "txns", "inner_txns"},
+	}
+	fixture.respond = func(query string) [][]driver.Value {
+		if !strings.Contains(query, "b.height = 42") && !strings.Contains(query, "b.block_hash = '"+hash+"'") {
+			return nil
+		}
+		return [][]driver.Value{{hash, "cd", nil, stamp, int64(42), int64(7), int64(0), int64(2), "pk", "seed",
+			int64(58), nil, []byte{0x01, 0x02}, int64(3), int64(5), int64(2)}}
+	}
+	db := openFixtureDB(t, fixture)
+
+	for _, ref := range []string{"42", strings.ToUpper(hash)} {
+		var out bytes.Buffer
+		n, err := DumpBlock(context.Background(), db, &out, ref)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		var got map[string]interface{}
+		require.NoError(t, json.Unmarshal(out.Bytes(), &got))
+		require.Equal(t, map[string]interface{}{
+			"block_hash":                      hash,
+			"prev_block_hash":                 "cd",
+			"txn_merkle_root":                 nil,
+			"timestamp":                       "2024-03-01T12:00:00Z",
+			"height":                          42.0,
+			"nonce":                           7.0,
+			"extra_nonce":                     0.0,
+			"block_version":                   2.0,
+			"proposer_voting_public_key":      "pk",
+			"proposer_random_seed_signature":  "seed",
+			"proposed_in_view":                58.0,
+			"proposer_vote_partial_signature": nil,
+			"badger_key":                      "0102",
+			"signer_count":                    3.0,
+			"txn_count":                       5.0,
+			"inner_txn_count":                 2.0,
+		}, got)
+	}
+
+	_, err := DumpBlock(context.Background(), db, &bytes.Buffer{}, "43")
+	require.ErrorContains(t, err, "no block row for 43")
+	_, err = DumpBlock(context.Background(), db, &bytes.Buffer{}, "abcd")
+	require.ErrorContains(t, err, "neither a height nor")
+}
@@ -0,0 +1,66 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+)
+
+// emptyBlockHashCondition matches block rows whose block_hash is NULL, empty or all zeros, which a block
+// encoded without a hash (e.g. a PoS block missing its BLS fields) was written with before the encoder
+// refused them.
+const emptyBlockHashCondition = "TRIM(LEADING '0' FROM COALESCE(block_hash, '')) = ''"
+
+// DetectEmptyBlockHashes returns the heights of block rows with an empty or all-zero block_hash, in order.
+func DetectEmptyBlockHashes(ctx context.Context, db Querier) ([]uint64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT height FROM block WHERE "+emptyBlockHashCondition+" ORDER BY height")
+	if err != nil {
+		return nil, fmt.Errorf("empty block hash query failed: %w", err)
+	}
+	defer rows.Close()
+	var heights []uint64
+	for rows.Next() {
+		var height uint64
+		if err := rows.Scan(&height); err != nil {
+			return nil, fmt.Errorf("empty block hash scan: %w", err)
+		}
+		heights = append(heights, height)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("empty block hash rows: %w", err)
+	}
+	return heights, nil
+}
+
+// DeleteEmptyHashBlocks deletes the block rows with an empty or all-zero block_hash, and the block_signer rows
+// written under the same hash, so the heights can be refetched as gaps. The upsert is keyed on the hash, so
+// refetching without deleting would leave the bad row next to the corrected one. The transactions of those
+// blocks are corrected in place by the refetch's upsert. It returns the number of block rows deleted.
+func DeleteEmptyHashBlocks(ctx context.Context, db Querier) (int, error) {
+	// RETURNING lets the deletes run through QueryContext, so any Querier can do them.
+	signerRows, err := db.QueryContext(ctx, "DELETE FROM block_signer WHERE "+emptyBlockHashCondition+" RETURNING block_hash")
+	if err != nil {
+		return 0, fmt.Errorf("delete signers of empty hash blocks: %w", err)
+	}
+	for signerRows.Next() {
+		// Only the block rows are counted.
+	}
+	err = signerRows.Err()
+	signerRows.Close()
+	if err != nil {
+		return 0, fmt.Errorf("delete signers of empty hash blocks: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, "DELETE FROM block WHERE "+emptyBlockHashCondition+" RETURNING height")
+	if err != nil {
+		return 0, fmt.Errorf("delete empty hash blocks: %w", err)
+	}
+	defer rows.Close()
+	deleted := 0
+	for rows.Next() {
+		deleted++
+	}
+	if err := rows.Err(); err != nil {
+		return deleted, fmt.Errorf("delete empty hash blocks: %w", err)
+	}
+	return deleted, nil
+}
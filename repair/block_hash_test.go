@@ -0,0 +1,55 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectAndDeleteEmptyHashBlocks(t *testing.T) {
+	// Block hashes by height; 7 was written without a hash and 9 with an all-zero one.
+	blocks := map[int64]string{6: "aa", 7: "", 8: "bb", 9: strings.Repeat("0", 64)}
+	fixture := &queryFixture{}
+	fixture.respond = func(query string) [][]driver.Value {
+		var rows [][]driver.Value
+		switch {
+		case strings.HasPrefix(query, "DELETE FROM block_signer"):
+			fixture.columns = []string{"block_hash"}
+		case strings.HasPrefix(query, "DELETE FROM block"):
+			fixture.columns = []string{"height"}
+			for height, hash := range blocks {
+				if strings.Trim(hash, "0") == "" {
+					rows = append(rows, []driver.Value{height})
+					delete(blocks, height)
+				}
+			}
+		default:
+			fixture.columns = []string{"height"}
+			for _, height := range []int64{6, 7, 8, 9} {
+				if hash, ok := blocks[height]; ok && strings.Trim(hash, "0") == "" {
+					rows = append(rows, []driver.Value{height})
+				}
+			}
+		}
+		return rows
+	}
+	db := openFixtureDB(t, fixture)
+
+	heights, err := DetectEmptyBlockHashes(context.Background(), db)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{7, 9}, heights)
+	require.Contains(t, fixture.queries[0], emptyBlockHashCondition)
+	require.Equal(t, []Gap{{Start: 7, End: 7}, {Start: 9, End: 9}}, HeightsToGaps(heights))
+
+	deleted, err := DeleteEmptyHashBlocks(context.Background(), db)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+	require.Equal(t, map[int64]string{6: "aa", 8: "bb"}, blocks)
+
+	heights, err = DetectEmptyBlockHashes(context.Background(), db)
+	require.NoError(t, err)
+	require.Empty(t, heights)
+}
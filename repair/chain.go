@@ -0,0 +1,56 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+)
+
+// ChainBreak is a block whose prev_block_hash isn't the hash of the block stored one height below it.
+type ChainBreak struct {
+	Height           uint64
+	BlockHash        string
+	PrevBlockHash    string
+	ExpectedPrevHash string
+}
+
+// VerifyPrevHashChain checks that the blocks in [start, end] link up, each block's prev_block_hash matching
+// the block_hash one height below. The first block is checked against the block just below start, so a
+// repaired range is also checked where it joins the existing chain. A height with no block (or the boundary
+// block missing) can't be checked and is left to presence checks such as RECONCILE_HEIGHTS_ONLY.
+func VerifyPrevHashChain(ctx context.Context, db Querier, start, end uint64) ([]ChainBreak, error) {
+	from := start
+	if from > 0 {
+		from--
+	}
+	query := fmt.Sprintf("SELECT height, block_hash, prev_block_hash FROM block WHERE height BETWEEN %d AND %d ORDER BY height", from, end)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("prev hash chain query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var breaks []ChainBreak
+	var prevHeight uint64
+	var prevHash string
+	havePrev := false
+	for rows.Next() {
+		var height uint64
+		var blockHash, prevBlockHash string
+		if err := rows.Scan(&height, &blockHash, &prevBlockHash); err != nil {
+			return nil, fmt.Errorf("prev hash chain scan: %w", err)
+		}
+		if havePrev && height == prevHeight+1 && prevBlockHash != prevHash {
+			breaks = append(breaks, ChainBreak{
+				Height:           height,
+				BlockHash:        blockHash,
+				PrevBlockHash:    prevBlockHash,
+				ExpectedPrevHash: prevHash,
+			})
+		}
+		prevHeight, prevHash, havePrev = height, blockHash, true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("prev hash chain rows: %w", err)
+	}
+	return breaks, nil
+}
@@ -0,0 +1,46 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPrevHashChainReportsBreakInRepairedRange(t *testing.T) {
+	db := openFixtureDB(t, &queryFixture{
+		columns: []string{"height", "block_hash", "prev_block_hash"},
+		rows: [][]driver.Value{
+			// The block below the range, which the first repaired block must link to.
+			{int64(99), "h99", "h98"},
+			{int64(100), "h100", "h99"},
+			{int64(101), "h101", "h100"},
+			// Repaired from a fork: doesn't link to the stored 101.
+			{int64(102), "h102", "fork101"},
+			{int64(103), "h103", "h102"},
+			// 104 is missing, so 105 can't be checked.
+			{int64(105), "h105", "h104"},
+		},
+	})
+
+	breaks, err := VerifyPrevHashChain(context.Background(), db, 100, 105)
+	require.NoError(t, err)
+	require.Equal(t, []ChainBreak{{Height: 102, BlockHash: "h102", PrevBlockHash: "fork101", ExpectedPrevHash: "h101"}}, breaks)
+}
+
+func TestVerifyPrevHashChainChecksRangeBoundary(t *testing.T) {
+	fixture := &queryFixture{
+		columns: []string{"height", "block_hash", "prev_block_hash"},
+		rows: [][]driver.Value{
+			{int64(99), "h99", "h98"},
+			{int64(100), "h100", "other99"},
+		},
+	}
+	db := openFixtureDB(t, fixture)
+
+	breaks, err := VerifyPrevHashChain(context.Background(), db, 100, 100)
+	require.NoError(t, err)
+	require.Equal(t, []ChainBreak{{Height: 100, BlockHash: "h100", PrevBlockHash: "other99", ExpectedPrevHash: "h99"}}, breaks)
+	require.Contains(t, fixture.queries[0], "BETWEEN 99 AND 100")
+}
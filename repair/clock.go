@@ -0,0 +1,17 @@
+package repair
+
+import "time"
+
+// Clock abstracts the passage of time so retries and progress logging can be driven by a fake in tests.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
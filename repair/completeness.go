@@ -0,0 +1,84 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+)
+
+// Completeness summarizes how much of the chain, from genesis (height 0) up to the node's tip, the DB holds.
+type Completeness struct {
+	TipHeight   uint64
+	DBMaxHeight uint64
+	// StoredBlocks is the number of distinct heights in [0, TipHeight] with a block row.
+	StoredBlocks uint64
+	// ExpectedBlocks is TipHeight + 1.
+	ExpectedBlocks uint64
+}
+
+// Missing returns how many heights up to the tip have no block row.
+func (c *Completeness) Missing() uint64 { return c.ExpectedBlocks - c.StoredBlocks }
+
+// BehindTip returns how many blocks the DB's highest block trails the tip by.
+func (c *Completeness) BehindTip() uint64 {
+	if c.DBMaxHeight >= c.TipHeight {
+		return 0
+	}
+	return c.TipHeight - c.DBMaxHeight
+}
+
+// Percent returns the share of heights up to the tip that are stored.
+func (c *Completeness) Percent() float64 {
+	return float64(c.StoredBlocks) / float64(c.ExpectedBlocks) * 100
+}
+
+// CheckCompleteness compares the DB's block coverage with the tip height reported by tip.
+func CheckCompleteness(ctx context.Context, db Querier, tip TipSource) (*Completeness, error) {
+	tipHeight, err := tip.FetchTipHeight()
+	if err != nil {
+		return nil, fmt.Errorf("fetch tip height: %w", err)
+	}
+	query := fmt.Sprintf("SELECT COALESCE(MAX(height), 0), COUNT(DISTINCT height) FILTER (WHERE height <= %d) FROM block", tipHeight)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("completeness query failed: %w", err)
+	}
+	defer rows.Close()
+	c := &Completeness{TipHeight: tipHeight, ExpectedBlocks: tipHeight + 1}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("completeness query failed: %w", err)
+		}
+		return nil, fmt.Errorf("completeness query returned no rows")
+	}
+	if err := rows.Scan(&c.DBMaxHeight, &c.StoredBlocks); err != nil {
+		return nil, fmt.Errorf("completeness scan: %w", err)
+	}
+	return c, nil
+}
+
+// HeightReconciliation is the result of a presence-only check of a height range.
+type HeightReconciliation struct {
+	Start, End uint64
+	// Missing are the heights in [Start, End] without a block row, ascending.
+	Missing []uint64
+}
+
+// ReconcileHeights checks that every height in [start, end] has a block row, without comparing hashes or
+// fetching any blocks from the node. An end of 0 means the node's tip, which is the only request made to tip.
+func ReconcileHeights(ctx context.Context, db Querier, tip TipSource, start, end uint64) (*HeightReconciliation, error) {
+	if end == 0 {
+		tipHeight, err := tip.FetchTipHeight()
+		if err != nil {
+			return nil, fmt.Errorf("fetch tip height: %w", err)
+		}
+		end = tipHeight
+	}
+	if start > end {
+		return nil, fmt.Errorf("start height %d is after end height %d", start, end)
+	}
+	missing, err := FindMissingHeights(ctx, db, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &HeightReconciliation{Start: start, End: end, Missing: missing}, nil
+}
@@ -0,0 +1,77 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCompletenessAgainstNodeTip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Header": map[string]interface{}{"Height": 99},
+		})
+	}))
+	defer server.Close()
+	// Heights 0-95 are partly stored: 90 distinct heights, the highest being 95.
+	fixture := &queryFixture{
+		columns: []string{"max", "count"},
+		rows:    [][]driver.Value{{int64(95), int64(90)}},
+	}
+	db := openFixtureDB(t, fixture)
+
+	c, err := CheckCompleteness(context.Background(), db, NewAPIBlockSource(server.URL))
+	require.NoError(t, err)
+	require.Equal(t, uint64(99), c.TipHeight)
+	require.Equal(t, uint64(100), c.ExpectedBlocks)
+	require.Equal(t, uint64(10), c.Missing())
+	require.Equal(t, uint64(4), c.BehindTip())
+	require.InDelta(t, 90.0, c.Percent(), 1e-9)
+	require.Contains(t, fixture.queries[0], "height <= 99")
+}
+
+func TestCompletenessAheadOfTip(t *testing.T) {
+	c := &Completeness{TipHeight: 10, DBMaxHeight: 12, StoredBlocks: 11, ExpectedBlocks: 11}
+	require.Zero(t, c.BehindTip())
+	require.Zero(t, c.Missing())
+	require.InDelta(t, 100.0, c.Percent(), 1e-9)
+}
+
+func TestReconcileHeightsReportsMissingHeightsWithoutFetchingBlocks(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Header": map[string]interface{}{"Height": 120},
+		})
+	}))
+	defer server.Close()
+	fixture := &queryFixture{
+		columns: []string{"h"},
+		rows:    [][]driver.Value{{int64(103)}, {int64(110)}, {int64(111)}},
+	}
+	db := openFixtureDB(t, fixture)
+	source := NewAPIBlockSource(server.URL)
+
+	result, err := ReconcileHeights(context.Background(), db, source, 100, 115)
+	require.NoError(t, err)
+	require.Equal(t, &HeightReconciliation{Start: 100, End: 115, Missing: []uint64{103, 110, 111}}, result)
+	require.Empty(t, requests)
+	require.Contains(t, fixture.queries[0], "generate_series(100::bigint, 115::bigint)")
+
+	// Without an end height only the tip is requested.
+	result, err = ReconcileHeights(context.Background(), db, source, 100, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(120), result.End)
+	require.Equal(t, []string{"/api/v1"}, requests)
+	require.Contains(t, fixture.queries[1], "generate_series(100::bigint, 120::bigint)")
+}
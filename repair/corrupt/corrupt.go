@@ -0,0 +1,178 @@
+// Package corrupt produces state-change fixtures with specific, documented corruptions from clean ones, so
+// the repair tool's corruption detectors can be tested against the same damage every time. It reads and
+// writes the 8-byte little-endian index the state syncer writes.
+package corrupt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// recordSize is the size of one index record.
+const recordSize = 8
+
+// Files is the contents of a state-change index and data file.
+type Files struct {
+	Index []byte
+	Data  []byte
+}
+
+// Read loads the state-change files in dir.
+func Read(dir string) (*Files, error) {
+	index, err := os.ReadFile(filepath.Join(dir, lib.StateChangeIndexFileName))
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, lib.StateChangeFileName))
+	if err != nil {
+		return nil, err
+	}
+	if len(index)%recordSize != 0 {
+		return nil, fmt.Errorf("index of %d bytes isn't a whole number of %d-byte records", len(index), recordSize)
+	}
+	return &Files{Index: index, Data: data}, nil
+}
+
+// Write stores the files in dir, creating it if needed.
+func (f *Files) Write(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, lib.StateChangeIndexFileName), f.Index, 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, lib.StateChangeFileName), f.Data, 0o644)
+}
+
+// Entries returns the number of index records.
+func (f *Files) Entries() int { return len(f.Index) / recordSize }
+
+func (f *Files) clone() *Files {
+	return &Files{Index: bytes.Clone(f.Index), Data: bytes.Clone(f.Data)}
+}
+
+func (f *Files) offset(i int) uint64 {
+	return binary.LittleEndian.Uint64(f.Index[i*recordSize:])
+}
+
+func (f *Files) setOffset(i int, offset uint64) {
+	binary.LittleEndian.PutUint64(f.Index[i*recordSize:], offset)
+}
+
+// entry returns the bytes of entry i, without its length prefix, and where they start in the data file.
+func (f *Files) entry(i int) ([]byte, uint64, error) {
+	offset := f.offset(i)
+	if offset >= uint64(len(f.Data)) {
+		return nil, 0, fmt.Errorf("entry %d starts at %d, past the %d-byte data file", i, offset, len(f.Data))
+	}
+	length, n := binary.Uvarint(f.Data[offset:])
+	if n <= 0 || offset+uint64(n)+length > uint64(len(f.Data)) {
+		return nil, 0, fmt.Errorf("entry %d at offset %d has an unreadable length", i, offset)
+	}
+	start := offset + uint64(n)
+	return f.Data[start : start+length], start, nil
+}
+
+// BlockEntryIndex returns the index of the first block entry at height.
+func (f *Files) BlockEntryIndex(height uint64) (int, error) {
+	for i := 0; i < f.Entries(); i++ {
+		entryBytes, _, err := f.entry(i)
+		if err != nil {
+			return 0, err
+		}
+		entry := &lib.StateChangeEntry{}
+		if _, err := lib.DecodeFromBytes(entry, bytes.NewReader(entryBytes)); err != nil {
+			continue
+		}
+		if entry.EncoderType == lib.EncoderTypeBlock && entry.BlockHeight == height {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no block entry at height %d", height)
+}
+
+// TruncateFinalEntry cuts the data file halfway through the entry the last index record points at, as a
+// crash mid-write leaves it. The index still references the whole entry, which the scans report as a
+// repair.DataBeyondEOFError.
+func TruncateFinalEntry(f *Files) (*Files, error) {
+	if f.Entries() == 0 {
+		return nil, fmt.Errorf("no entries to truncate")
+	}
+	last := f.Entries() - 1
+	entryBytes, start, err := f.entry(last)
+	if err != nil {
+		return nil, err
+	}
+	out := f.clone()
+	out.Data = out.Data[:start+uint64(len(entryBytes))/2]
+	return out, nil
+}
+
+// OverlapOffsets points index record i at the entry record i-1 points at, so two records alias the same
+// bytes. Each still decodes on its own; repair.CheckIndexOverlaps reports the pair.
+func OverlapOffsets(f *Files, i int) (*Files, error) {
+	if i < 1 || i >= f.Entries() {
+		return nil, fmt.Errorf("record %d has no record before it in a %d-record index", i, f.Entries())
+	}
+	out := f.clone()
+	out.setOffset(i, out.offset(i-1))
+	return out, nil
+}
+
+// WrongBlockHash replaces the block hash (the entry's key) of the block entry at height with hash and
+// re-encodes it, shifting the offsets of the entries after it. A zero hash is rejected when the block is
+// converted to a row; any other hash breaks the prev_block_hash chain once the block is in the DB.
+func WrongBlockHash(f *Files, height uint64, hash []byte) (*Files, error) {
+	i, err := f.BlockEntryIndex(height)
+	if err != nil {
+		return nil, err
+	}
+	entryBytes, _, err := f.entry(i)
+	if err != nil {
+		return nil, err
+	}
+	entry := &lib.StateChangeEntry{}
+	if _, err := lib.DecodeFromBytes(entry, bytes.NewReader(entryBytes)); err != nil {
+		return nil, fmt.Errorf("decode block entry at height %d: %w", height, err)
+	}
+	entry.KeyBytes = bytes.Clone(hash)
+	return replaceEntry(f, i, lib.EncodeToBytes(entry.BlockHeight, entry))
+}
+
+// DropIndexRecord removes index record i. Its entry stays in the data file but nothing points at it, so
+// the scans never see it: a block entry becomes a missing height.
+func DropIndexRecord(f *Files, i int) (*Files, error) {
+	if i < 0 || i >= f.Entries() {
+		return nil, fmt.Errorf("record %d is outside a %d-record index", i, f.Entries())
+	}
+	out := f.clone()
+	out.Index = append(out.Index[:i*recordSize], out.Index[(i+1)*recordSize:]...)
+	return out, nil
+}
+
+// replaceEntry swaps entry i's bytes for entryBytes and moves every later entry by the change in length.
+func replaceEntry(f *Files, i int, entryBytes []byte) (*Files, error) {
+	old, start, err := f.entry(i)
+	if err != nil {
+		return nil, err
+	}
+	offset := f.offset(i)
+	end := start + uint64(len(old))
+
+	out := f.clone()
+	replacement := binary.AppendUvarint(nil, uint64(len(entryBytes)))
+	replacement = append(replacement, entryBytes...)
+	out.Data = append(append(bytes.Clone(f.Data[:offset]), replacement...), f.Data[end:]...)
+	shift := int64(len(replacement)) - int64(end-offset)
+	for j := 0; j < out.Entries(); j++ {
+		if o := out.offset(j); o >= end {
+			out.setOffset(j, uint64(int64(o)+shift))
+		}
+	}
+	return out, nil
+}
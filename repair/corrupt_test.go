@@ -0,0 +1,88 @@
+package repair
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/entries"
+	"github.com/deso-protocol/postgres-data-handler/repair/corrupt"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptFixture writes the self-test fixture, applies corruption to it and returns the corrupted directory.
+func corruptFixture(t *testing.T, corruption func(*corrupt.Files) (*corrupt.Files, error)) string {
+	t.Helper()
+	fixture, err := selfTestFixture()
+	require.NoError(t, err)
+	clean, err := corrupt.Read(writeStateChangeDir(t, fixture))
+	require.NoError(t, err)
+	corrupted, err := corruption(clean)
+	require.NoError(t, err)
+	dir := filepath.Join(t.TempDir(), "corrupted")
+	require.NoError(t, corrupted.Write(dir))
+	return dir
+}
+
+func TestDetectorsCatchTruncatedFinalEntry(t *testing.T) {
+	dir := corruptFixture(t, corrupt.TruncateFinalEntry)
+
+	err := ForEachStateChangeEntry(dir, DefaultIndexFormat, func(entry *lib.StateChangeEntry) error { return nil })
+	var beyondEOF *DataBeyondEOFError
+	require.ErrorAs(t, err, &beyondEOF)
+	require.Equal(t, uint64(len(selfTestHeights)-1), beyondEOF.EntryIndex)
+}
+
+func TestDetectorsCatchOverlappingOffsets(t *testing.T) {
+	dir := corruptFixture(t, func(f *corrupt.Files) (*corrupt.Files, error) { return corrupt.OverlapOffsets(f, 2) })
+
+	overlaps, checked, err := CheckIndexOverlaps(dir, DefaultIndexFormat)
+	require.NoError(t, err)
+	require.Equal(t, len(selfTestHeights), checked)
+	require.Len(t, overlaps, 1)
+	require.ElementsMatch(t, []uint64{1, 2}, []uint64{overlaps[0].First.EntryIndex, overlaps[0].Second.EntryIndex})
+}
+
+func TestDetectorsCatchWrongBlockHash(t *testing.T) {
+	dir := corruptFixture(t, func(f *corrupt.Files) (*corrupt.Files, error) {
+		return corrupt.WrongBlockHash(f, 4, make([]byte, lib.HashSizeBytes))
+	})
+
+	// The re-encoded entry is a different length, so the entries after it still have to read back intact.
+	indexFile, dataFile, err := OpenStateChangeFiles(dir)
+	require.NoError(t, err)
+	defer indexFile.Close()
+	defer dataFile.Close()
+	entry, err := ReadBlockFromStateChange(indexFile, dataFile, DefaultIndexFormat, 5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), entry.BlockHeight)
+
+	entry, err = ReadBlockFromStateChange(indexFile, dataFile, DefaultIndexFormat, 4)
+	require.NoError(t, err)
+	_, _, err = entries.BlockEncoderToPGStruct(entry.Encoder.(*lib.MsgDeSoBlock), entry.KeyBytes, &lib.DeSoTestnetParams)
+	require.Error(t, err)
+}
+
+func TestDetectorsCatchMissingIndexPointer(t *testing.T) {
+	dir := corruptFixture(t, func(f *corrupt.Files) (*corrupt.Files, error) {
+		i, err := f.BlockEntryIndex(2)
+		if err != nil {
+			return nil, err
+		}
+		return corrupt.DropIndexRecord(f, i)
+	})
+
+	var heights []uint64
+	require.NoError(t, ForEachStateChangeEntry(dir, DefaultIndexFormat, func(entry *lib.StateChangeEntry) error {
+		heights = append(heights, entry.BlockHeight)
+		return nil
+	}))
+	require.Equal(t, []uint64{1, 4, 5}, heights)
+
+	indexFile, dataFile, err := OpenStateChangeFiles(dir)
+	require.NoError(t, err)
+	defer indexFile.Close()
+	defer dataFile.Close()
+	_, err = ReadBlockFromStateChange(indexFile, dataFile, DefaultIndexFormat, 2)
+	require.ErrorContains(t, err, "no block entry at height 2")
+}
@@ -0,0 +1,78 @@
+package repair
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/deso-protocol/postgres-data-handler/config"
+	"github.com/google/uuid"
+)
+
+// DefaultApplicationName returns the application_name a run reports to Postgres when none is configured: the
+// command name and a short random run ID, so concurrent jobs can be told apart in pg_stat_activity.
+func DefaultApplicationName(command string) string {
+	return command + "-" + strings.SplitN(uuid.New().String(), "-", 2)[0]
+}
+
+// DefaultDBTimeout is the connect and operation timeout used when none is configured. It is long enough for
+// the slowest bulk statements.
+const DefaultDBTimeout = 18000 * time.Second
+
+// DBTimeouts are the connection timeouts pgdriver applies, set through the DSN.
+type DBTimeouts struct {
+	// Connect bounds dialing a new connection, so a dead server is noticed quickly.
+	Connect time.Duration
+	// Operation bounds each socket read and write, so it has to outlast the slowest statement.
+	Operation time.Duration
+}
+
+// ParseDBTimeouts parses the DB_CONNECT_TIMEOUT and DB_OPERATION_TIMEOUT settings. An empty value uses
+// DefaultDBTimeout; anything else must be a positive duration.
+func ParseDBTimeouts(connect, operation string) (DBTimeouts, error) {
+	var timeouts DBTimeouts
+	var err error
+	if timeouts.Connect, err = parseDBTimeout("DB_CONNECT_TIMEOUT", connect); err != nil {
+		return DBTimeouts{}, err
+	}
+	if timeouts.Operation, err = parseDBTimeout("DB_OPERATION_TIMEOUT", operation); err != nil {
+		return DBTimeouts{}, err
+	}
+	return timeouts, nil
+}
+
+func parseDBTimeout(name, value string) (time.Duration, error) {
+	if value == "" {
+		return DefaultDBTimeout, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q is not a duration: %w", name, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %s", name, value)
+	}
+	return d, nil
+}
+
+// PostgresDSN builds the connection string the repair tools connect with from settings. A non-empty
+// applicationName is passed as application_name, which Postgres shows in pg_stat_activity. Zero timeouts use
+// DefaultDBTimeout.
+func PostgresDSN(settings config.DBSettings, applicationName string, timeouts DBTimeouts) string {
+	if timeouts.Connect <= 0 {
+		timeouts.Connect = DefaultDBTimeout
+	}
+	if timeouts.Operation <= 0 {
+		timeouts.Operation = DefaultDBTimeout
+	}
+	params := url.Values{
+		"dial_timeout":  {timeouts.Connect.String()},
+		"read_timeout":  {timeouts.Operation.String()},
+		"write_timeout": {timeouts.Operation.String()},
+	}
+	if applicationName != "" {
+		params.Set("application_name", applicationName)
+	}
+	return settings.URI(params)
+}
@@ -0,0 +1,56 @@
+package repair
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deso-protocol/postgres-data-handler/config"
+	"github.com/stretchr/testify/require"
+)
+
+var testDBSettings = config.DBSettings{Host: "db.local", Port: "5432", Username: "user", Password: "pass", Name: "postgres", SSLMode: "disable"}
+
+func TestPostgresDSNCarriesApplicationName(t *testing.T) {
+	dsn := PostgresDSN(testDBSettings, "repair nightly/1", DBTimeouts{})
+	parsed, err := url.Parse(dsn)
+	require.NoError(t, err)
+	require.Equal(t, "repair nightly/1", parsed.Query().Get("application_name"))
+	require.Equal(t, "disable", parsed.Query().Get("sslmode"))
+
+	require.NotContains(t, PostgresDSN(testDBSettings, "", DBTimeouts{}), "application_name")
+}
+
+func TestPostgresDSNCarriesTimeouts(t *testing.T) {
+	timeouts, err := ParseDBTimeouts("10s", "2h")
+	require.NoError(t, err)
+	require.Equal(t, DBTimeouts{Connect: 10 * time.Second, Operation: 2 * time.Hour}, timeouts)
+
+	parsed, err := url.Parse(PostgresDSN(testDBSettings, "", timeouts))
+	require.NoError(t, err)
+	require.Equal(t, "10s", parsed.Query().Get("dial_timeout"))
+	require.Equal(t, "2h0m0s", parsed.Query().Get("read_timeout"))
+	require.Equal(t, "2h0m0s", parsed.Query().Get("write_timeout"))
+	require.False(t, parsed.Query().Has("timeout"))
+
+	// Unset timeouts keep the previous hard-coded value.
+	timeouts, err = ParseDBTimeouts("", "")
+	require.NoError(t, err)
+	require.Equal(t, DBTimeouts{Connect: DefaultDBTimeout, Operation: DefaultDBTimeout}, timeouts)
+	parsed, err = url.Parse(PostgresDSN(testDBSettings, "", DBTimeouts{}))
+	require.NoError(t, err)
+	require.Equal(t, "5h0m0s", parsed.Query().Get("dial_timeout"))
+	require.Equal(t, "5h0m0s", parsed.Query().Get("read_timeout"))
+
+	for _, bad := range [][2]string{{"soon", ""}, {"", "0s"}, {"-1m", ""}} {
+		_, err := ParseDBTimeouts(bad[0], bad[1])
+		require.Error(t, err, bad)
+	}
+}
+
+func TestDefaultApplicationNameIsUniquePerRun(t *testing.T) {
+	first, second := DefaultApplicationName("repair"), DefaultApplicationName("repair")
+	require.True(t, strings.HasPrefix(first, "repair-"), first)
+	require.NotEqual(t, first, second)
+}
@@ -0,0 +1,100 @@
+package repair
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// BlockHashFormats are the formats EmitBlockHashes can write.
+var BlockHashFormats = []string{"csv", "ndjson"}
+
+// DefaultEmitPageHeights is how many heights EmitBlockHashes reads per query.
+const DefaultEmitPageHeights = 10000
+
+// EmitBlockHashes writes the (height, block_hash) of every block row in [start, end] to w in height order,
+// as CSV with a header row or as one JSON object per line. The range is read in windows of pageHeights
+// heights, so memory stays bounded however long the range is. It returns the number of rows written.
+func EmitBlockHashes(ctx context.Context, db Querier, w io.Writer, format string, start, end, pageHeights uint64) (int, error) {
+	if pageHeights == 0 {
+		pageHeights = DefaultEmitPageHeights
+	}
+	buf := bufio.NewWriter(w)
+	var write func(height uint64, blockHash string) error
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(buf)
+		if err := cw.Write([]string{"height", "block_hash"}); err != nil {
+			return 0, err
+		}
+		write = func(height uint64, blockHash string) error {
+			if err := cw.Write([]string{strconv.FormatUint(height, 10), blockHash}); err != nil {
+				return err
+			}
+			// Flush into buf so rows reach w in order; buf batches the actual writes.
+			cw.Flush()
+			return cw.Error()
+		}
+	case "ndjson":
+		enc := json.NewEncoder(buf)
+		write = func(height uint64, blockHash string) error {
+			return enc.Encode(struct {
+				Height    uint64 `json:"height"`
+				BlockHash string `json:"block_hash"`
+			}{height, blockHash})
+		}
+	default:
+		return 0, fmt.Errorf("unknown block hash format %q, expected one of %v", format, BlockHashFormats)
+	}
+
+	written := 0
+	for lo := start; lo <= end; {
+		hi := end
+		if end-lo >= pageHeights {
+			hi = lo + pageHeights - 1
+		}
+		n, err := emitBlockHashPage(ctx, db, write, lo, hi)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if hi == end {
+			break
+		}
+		lo = hi + 1
+	}
+	if err := buf.Flush(); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// emitBlockHashPage writes the block rows in [lo, hi].
+func emitBlockHashPage(ctx context.Context, db Querier, write func(uint64, string) error, lo, hi uint64) (int, error) {
+	query := fmt.Sprintf("SELECT height, block_hash FROM block WHERE height BETWEEN %d AND %d ORDER BY height, block_hash", lo, hi)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("block hash query failed: %w", err)
+	}
+	defer rows.Close()
+	written := 0
+	for rows.Next() {
+		var height uint64
+		var blockHash string
+		if err := rows.Scan(&height, &blockHash); err != nil {
+			return written, fmt.Errorf("block hash scan: %w", err)
+		}
+		if err := write(height, blockHash); err != nil {
+			return written, fmt.Errorf("write block hash at height %d: %w", height, err)
+		}
+		written++
+	}
+	if err := rows.Err(); err != nil {
+		return written, fmt.Errorf("block hash rows: %w", err)
+	}
+	return written, nil
+}
@@ -0,0 +1,58 @@
+package repair
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockTableFixture answers block hash queries from rows of (height, block_hash), honoring the height bounds.
+func blockTableFixture(table [][2]interface{}) *queryFixture {
+	return &queryFixture{
+		columns: []string{"height", "block_hash"},
+		respond: func(query string) [][]driver.Value {
+			var lo, hi uint64
+			fmt.Sscanf(query[strings.Index(query, "BETWEEN"):], "BETWEEN %d AND %d", &lo, &hi)
+			var rows [][]driver.Value
+			for _, row := range table {
+				if height := row[0].(uint64); height >= lo && height <= hi {
+					rows = append(rows, []driver.Value{int64(height), row[1]})
+				}
+			}
+			return rows
+		},
+	}
+}
+
+func TestEmitBlockHashesWritesRowsInHeightOrder(t *testing.T) {
+	fixture := blockTableFixture([][2]interface{}{
+		{uint64(10), "h10"}, {uint64(11), "h11"}, {uint64(12), "h12a"}, {uint64(12), "h12b"},
+		{uint64(14), "h14"}, {uint64(15), "h15"}, {uint64(16), "h16"},
+	})
+	db := openFixtureDB(t, fixture)
+
+	var out bytes.Buffer
+	n, err := EmitBlockHashes(context.Background(), db, &out, "csv", 11, 15, 2)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, "height,block_hash\n11,h11\n12,h12a\n12,h12b\n14,h14\n15,h15\n", out.String())
+	// Each query covers at most two heights.
+	require.Len(t, fixture.queries, 3)
+
+	out.Reset()
+	n, err = EmitBlockHashes(context.Background(), db, &out, "ndjson", 15, 16, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, "{\"height\":15,\"block_hash\":\"h15\"}\n{\"height\":16,\"block_hash\":\"h16\"}\n", out.String())
+}
+
+func TestEmitBlockHashesRejectsUnknownFormat(t *testing.T) {
+	db := openFixtureDB(t, &queryFixture{columns: []string{"height", "block_hash"}})
+	_, err := EmitBlockHashes(context.Background(), db, &bytes.Buffer{}, "xml", 1, 2, 0)
+	require.ErrorContains(t, err, "unknown block hash format")
+}
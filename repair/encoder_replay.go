@@ -0,0 +1,105 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// ParseEncoderType parses REPROCESS_ENCODER_TYPE, the numeric value of a lib.EncoderType.
+func ParseEncoderType(value string) (lib.EncoderType, error) {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("REPROCESS_ENCODER_TYPE %q must be a numeric encoder type: %w", value, err)
+	}
+	return lib.EncoderType(n), nil
+}
+
+// ReprocessEncoderType replays every entry of encoderType in the state-change files in Options.StateChangeDir,
+// whatever its height, for a chain-wide backfill of one mis-processed type. Deletes are replayed as deletes
+// and everything else as an upsert. With clean set, each upsert is preceded by a delete of the same key in
+// the same savepoint, so columns the bad run left behind don't survive the replay. It opens and commits its
+// own transactions every Options.CommitBatchSize entries or Options.CommitInterval.
+func (r *Repairer) ReprocessEncoderType(ctx context.Context, encoderType lib.EncoderType, clean bool) error {
+	log.Printf("Reprocessing encoder type %d across all state-change entries in %s (clean replay: %v)",
+		encoderType, r.Options.StateChangeDir, clean)
+	if err := r.initiateTransaction(); err != nil {
+		return fmt.Errorf("InitiateTransaction: %w", err)
+	}
+
+	processed, failed := uint64(0), uint64(0)
+	uncommittedEntries, uncommittedTxnRows := uint64(0), uint64(0)
+	lastCommit := r.Clock.Now()
+	var uncommitted *Gap
+	commit := func() error {
+		if uncommitted == nil {
+			return r.Handler.CommitTransaction()
+		}
+		err := r.commitRange(*uncommitted)
+		uncommitted = nil
+		uncommittedEntries, uncommittedTxnRows = 0, 0
+		lastCommit = r.Clock.Now()
+		return err
+	}
+
+	err := ForEachStateChangeEntry(r.Options.StateChangeDir, r.Options.IndexFormat, func(entry *lib.StateChangeEntry) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.EncoderType != encoderType {
+			return nil
+		}
+
+		batches := [][]*lib.StateChangeEntry{{entry}}
+		if entry.OperationType != lib.DbOperationTypeDelete {
+			entry.OperationType = lib.DbOperationTypeUpsert
+			if clean {
+				deleteEntry := *entry
+				deleteEntry.OperationType = lib.DbOperationTypeDelete
+				batches = [][]*lib.StateChangeEntry{{&deleteEntry}, {entry}}
+			}
+		}
+		if err := handleEntryBatchesAtomic(r.Handler, batches); err != nil {
+			log.Printf("WARNING: Failed to reprocess entry at height %d: %v", entry.BlockHeight, err)
+			failed++
+			return nil
+		}
+
+		processed++
+		uncommittedEntries++
+		uncommittedTxnRows += entryTxnRows(entry)
+		height := entry.BlockHeight
+		if uncommitted == nil {
+			uncommitted = &Gap{Start: height, End: height}
+		} else if height < uncommitted.Start {
+			uncommitted.Start = height
+		} else if height > uncommitted.End {
+			uncommitted.End = height
+		}
+		if r.commitDue(uncommittedEntries, uncommittedTxnRows, lastCommit) {
+			log.Printf("Reprocessed %d entries (%d failed), committing...", processed, failed)
+			if err := commit(); err != nil {
+				return fmt.Errorf("commit transaction: %w", err)
+			}
+			if err := r.initiateTransaction(); err != nil {
+				return fmt.Errorf("initiate transaction: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Keep what was already written; the replay is idempotent, so rerunning it redoes the rest.
+		if commitErr := commit(); commitErr != nil {
+			log.Printf("WARNING: Failed to commit before stopping: %v", commitErr)
+		}
+		return fmt.Errorf("reprocess encoder type %d: %w", encoderType, err)
+	}
+	if err := commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	log.Printf("Reprocessed %d entries of encoder type %d (%d failed)", processed, encoderType, failed)
+	return nil
+}
@@ -0,0 +1,48 @@
+package repair
+
+import (
+	"context"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReprocessEncoderTypeOnlyReplaysChosenTypeAcrossAllHeights(t *testing.T) {
+	deleted := utxoOpsStateChange(900)
+	deleted.OperationType = lib.DbOperationTypeDelete
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(1), utxoOpsStateChange(1),
+		blockStateChange(500), utxoOpsStateChange(500),
+		deleted, blockStateChange(900),
+	})
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+
+	require.NoError(t, r.ReprocessEncoderType(context.Background(), lib.EncoderTypeUtxoOperationBundle, false))
+
+	require.Equal(t, []uint64{1, 500, 900}, handler.committedHeights())
+	for _, entry := range handler.committed {
+		require.Equal(t, lib.EncoderTypeUtxoOperationBundle, entry.EncoderType)
+	}
+	require.Equal(t, lib.DbOperationTypeUpsert, handler.committed[0].OperationType)
+	require.Equal(t, lib.DbOperationTypeDelete, handler.committed[2].OperationType)
+	require.False(t, handler.InTransaction())
+}
+
+func TestReprocessEncoderTypeCleanReplayDeletesBeforeUpserting(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{blockStateChange(7), utxoOpsStateChange(7)})
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+
+	require.NoError(t, r.ReprocessEncoderType(context.Background(), lib.EncoderTypeUtxoOperationBundle, true))
+
+	require.Len(t, handler.committed, 2)
+	require.Equal(t, lib.DbOperationTypeDelete, handler.committed[0].OperationType)
+	require.Equal(t, lib.DbOperationTypeUpsert, handler.committed[1].OperationType)
+	require.Equal(t, handler.committed[0].KeyBytes, handler.committed[1].KeyBytes)
+}
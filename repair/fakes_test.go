@@ -0,0 +1,202 @@
+package repair
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// fakeHandler is an in-memory EntryHandler. Entries handled inside a transaction only become visible in
+// committed once the transaction commits, and savepoints discard the entries handled after them.
+type fakeHandler struct {
+	inTxn      bool
+	pending    []*lib.StateChangeEntry
+	committed  []*lib.StateChangeEntry
+	savepoints map[string]int
+	nextID     int
+	commits    int
+	rollbacks  int
+	// commitErr, if set, fails every commit and leaves the transaction open, like a commit that fails on the wire.
+	commitErr error
+	// fail, if set, is called for each entry before it is handled; a non-nil error fails the batch.
+	fail func(entry *lib.StateChangeEntry) error
+}
+
+func newFakeHandler() *fakeHandler {
+	return &fakeHandler{savepoints: make(map[string]int)}
+}
+
+func (h *fakeHandler) HandleEntryBatch(batchedEntries []*lib.StateChangeEntry, isMempool bool) error {
+	for _, entry := range batchedEntries {
+		if h.fail != nil {
+			if err := h.fail(entry); err != nil {
+				return err
+			}
+		}
+		h.pending = append(h.pending, entry)
+	}
+	return nil
+}
+
+func (h *fakeHandler) InitiateTransaction() error {
+	h.pending = nil
+	h.inTxn = true
+	return nil
+}
+
+func (h *fakeHandler) CommitTransaction() error {
+	if !h.inTxn {
+		return fmt.Errorf("no transaction to commit")
+	}
+	if h.commitErr != nil {
+		return h.commitErr
+	}
+	h.committed = append(h.committed, h.pending...)
+	h.pending = nil
+	h.inTxn = false
+	h.commits++
+	return nil
+}
+
+func (h *fakeHandler) RollbackTransaction() error {
+	if !h.inTxn {
+		return fmt.Errorf("no transaction to rollback")
+	}
+	h.pending = nil
+	h.inTxn = false
+	h.rollbacks++
+	return nil
+}
+
+func (h *fakeHandler) InTransaction() bool { return h.inTxn }
+
+func (h *fakeHandler) CreateSavepoint() (string, error) {
+	if !h.inTxn {
+		return "", nil
+	}
+	h.nextID++
+	name := fmt.Sprintf("sp%d", h.nextID)
+	h.savepoints[name] = len(h.pending)
+	return name, nil
+}
+
+func (h *fakeHandler) RevertToSavepoint(savepointName string) error {
+	n, ok := h.savepoints[savepointName]
+	if !ok {
+		return fmt.Errorf("unknown savepoint %s", savepointName)
+	}
+	h.pending = h.pending[:n]
+	return nil
+}
+
+func (h *fakeHandler) ReleaseSavepoint(savepointName string) error {
+	delete(h.savepoints, savepointName)
+	return nil
+}
+
+// committedHeights returns the block heights of the committed entries in commit order.
+func (h *fakeHandler) committedHeights() []uint64 {
+	heights := make([]uint64, 0, len(h.committed))
+	for _, entry := range h.committed {
+		heights = append(heights, entry.BlockHeight)
+	}
+	return heights
+}
+
+// hasHeight reports whether an entry for height has been handled, committed or not.
+func (h *fakeHandler) hasHeight(height uint64) bool {
+	for _, entries := range [][]*lib.StateChangeEntry{h.committed, h.pending} {
+		for _, entry := range entries {
+			if entry.BlockHeight == height {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fakeSource serves an empty block for every height. It is safe for concurrent use.
+type fakeSource struct {
+	mu      sync.Mutex
+	fetches map[uint64]int
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{fetches: make(map[uint64]int)}
+}
+
+func (s *fakeSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	s.mu.Lock()
+	s.fetches[height]++
+	s.mu.Unlock()
+	var blockHash lib.BlockHash
+	binary.BigEndian.PutUint64(blockHash[lib.HashSizeBytes-8:], height)
+	return &lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{Height: height}}, &blockHash, nil
+}
+
+// concurrencyGauge records the most callers inside a stage at once. With full set, each caller waits in the
+// stage until full callers are in at the same time (or a second passes), so a stage allowed that much
+// concurrency is sure to reach it.
+type concurrencyGauge struct {
+	mu      sync.Mutex
+	current int
+	max     int
+	full    int
+	once    sync.Once
+	reached chan struct{}
+}
+
+func newConcurrencyGauge(full int) *concurrencyGauge {
+	return &concurrencyGauge{full: full, reached: make(chan struct{})}
+}
+
+func (g *concurrencyGauge) enter() {
+	g.mu.Lock()
+	g.current++
+	if g.current > g.max {
+		g.max = g.current
+	}
+	if g.current == g.full {
+		g.once.Do(func() { close(g.reached) })
+	}
+	g.mu.Unlock()
+	if g.full > 0 {
+		select {
+		case <-g.reached:
+		case <-time.After(time.Second):
+		}
+	}
+	g.mu.Lock()
+	g.current--
+	g.mu.Unlock()
+}
+
+func (g *concurrencyGauge) peak() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+// fakeClock records sleeps instead of blocking.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func heightRange(start, end uint64) []uint64 {
+	heights := make([]uint64, 0, end-start+1)
+	for h := start; h <= end; h++ {
+		heights = append(heights, h)
+	}
+	return heights
+}
@@ -0,0 +1,207 @@
+package repair
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GapFileParser parses a gap file's contents into gaps.
+type GapFileParser func(r io.Reader) ([]Gap, error)
+
+// GapFileFormatAuto picks the parser from the file's extension, or failing that its first non-empty line.
+const GapFileFormatAuto = "auto"
+
+// gapFileParsers are the GAP_FILE_FORMAT values and their parsers. They must only be changed at startup.
+var gapFileParsers = map[string]GapFileParser{
+	"text": parseTextGaps,
+	"csv":  parseCSVGaps,
+	"json": parseJSONGaps,
+}
+
+// RegisterGapFileFormat adds a parser for a custom GAP_FILE_FORMAT, or replaces a built-in one. It must be
+// called at startup (e.g. from an init function in the repair command) before any gap file is read.
+func RegisterGapFileFormat(name string, parser GapFileParser) {
+	gapFileParsers[strings.ToLower(name)] = parser
+}
+
+// ValidateGapFileFormat checks a GAP_FILE_FORMAT value. Empty means auto.
+func ValidateGapFileFormat(format string) error {
+	format = strings.ToLower(format)
+	if format == "" || format == GapFileFormatAuto {
+		return nil
+	}
+	if _, ok := gapFileParsers[format]; !ok {
+		return fmt.Errorf("unknown GAP_FILE_FORMAT %q", format)
+	}
+	return nil
+}
+
+// StdinGapFile is the GAP_FILE name that reads the gaps from stdin, e.g. piped from the analyze tool.
+const StdinGapFile = "-"
+
+// gapFileStdin is where StdinGapFile reads from. Tests replace it.
+var gapFileStdin io.Reader = os.Stdin
+
+// ParseGapFile reads filename with the parser for format (text, csv, json, a registered custom format, or auto).
+// A filename of StdinGapFile reads the gaps from stdin until it is closed.
+func ParseGapFile(filename, format string) ([]Gap, error) {
+	var contents []byte
+	var err error
+	if filename == StdinGapFile {
+		// Stdin can't be reopened or seeked, so it is read once in full and sniffed from the buffered copy.
+		contents, err = io.ReadAll(gapFileStdin)
+		if err != nil {
+			return nil, fmt.Errorf("read gaps from stdin: %w", err)
+		}
+	} else {
+		contents, err = os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("open gap file: %w", err)
+		}
+	}
+	format = strings.ToLower(format)
+	if format == "" || format == GapFileFormatAuto {
+		format = sniffGapFileFormat(filename, contents)
+	}
+	parser, ok := gapFileParsers[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown GAP_FILE_FORMAT %q", format)
+	}
+	gaps, err := parser(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s gap file %s: %w", format, filename, err)
+	}
+	return gaps, nil
+}
+
+// sniffGapFileFormat guesses a gap file's format from its extension, then from its first non-empty line.
+func sniffGapFileFormat(filename string, contents []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return "csv"
+	case ".json":
+		return "json"
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") || strings.HasPrefix(line, "{") {
+			return "json"
+		}
+		if strings.Contains(line, ",") {
+			return "csv"
+		}
+		return "text"
+	}
+	return "text"
+}
+
+// parseTextGaps parses the gap-list format of state-changes-gaps.txt and the checkpoint file, one gap per
+// line as "Gap 44865: heights 24195810 -> 24195811 (2 blocks missing)" or "24195810 -> 24195811". Other
+// lines are ignored.
+func parseTextGaps(r io.Reader) ([]Gap, error) {
+	var gaps []Gap
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var start, end uint64
+		if _, err := fmt.Sscanf(line, "Gap %d: heights %d -> %d", new(int), &start, &end); err == nil {
+			gaps = append(gaps, Gap{Start: start, End: end})
+		} else if _, err := fmt.Sscanf(line, "%d -> %d", &start, &end); err == nil {
+			gaps = append(gaps, Gap{Start: start, End: end})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading file: %w", err)
+	}
+	return gaps, nil
+}
+
+// parseCSVGaps parses rows of start,end heights. A header row is skipped; if it names start_height and
+// end_height columns those are used, otherwise the first two columns are.
+func parseCSVGaps(r io.Reader) ([]Gap, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	startCol, endCol := 0, 1
+	var gaps []Gap
+	for i, record := range records {
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if i == 0 {
+			if _, err := strconv.ParseUint(strings.TrimSpace(record[0]), 10, 64); err != nil {
+				for col, name := range record {
+					switch strings.ToLower(strings.TrimSpace(name)) {
+					case "start_height":
+						startCol = col
+					case "end_height":
+						endCol = col
+					}
+				}
+				continue
+			}
+		}
+		if len(record) <= startCol || len(record) <= endCol {
+			return nil, fmt.Errorf("row %d: expected start and end heights, got %q", i+1, record)
+		}
+		gap, err := parseGapBounds(record[startCol], record[endCol])
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		gaps = append(gaps, gap)
+	}
+	return gaps, nil
+}
+
+// parseJSONGaps parses an array of {"start_height": N, "end_height": M} objects.
+func parseJSONGaps(r io.Reader) ([]Gap, error) {
+	var rows []struct {
+		StartHeight *uint64 `json:"start_height"`
+		EndHeight   *uint64 `json:"end_height"`
+	}
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, err
+	}
+	gaps := make([]Gap, 0, len(rows))
+	for i, row := range rows {
+		if row.StartHeight == nil || row.EndHeight == nil {
+			return nil, fmt.Errorf("gap %d: start_height and end_height are required", i)
+		}
+		if *row.StartHeight > *row.EndHeight {
+			return nil, fmt.Errorf("gap %d: invalid range %d -> %d", i, *row.StartHeight, *row.EndHeight)
+		}
+		gaps = append(gaps, Gap{Start: *row.StartHeight, End: *row.EndHeight})
+	}
+	return gaps, nil
+}
+
+func parseGapBounds(startValue, endValue string) (Gap, error) {
+	start, err := strconv.ParseUint(strings.TrimSpace(startValue), 10, 64)
+	if err != nil {
+		return Gap{}, fmt.Errorf("start height: %w", err)
+	}
+	end, err := strconv.ParseUint(strings.TrimSpace(endValue), 10, 64)
+	if err != nil {
+		return Gap{}, fmt.Errorf("end height: %w", err)
+	}
+	if start > end {
+		return Gap{}, fmt.Errorf("invalid range %d -> %d", start, end)
+	}
+	return Gap{Start: start, End: end}, nil
+}
@@ -0,0 +1,96 @@
+package repair
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGapFileFormatsAgree(t *testing.T) {
+	want := []Gap{{Start: 100, End: 120}, {Start: 500, End: 500}}
+	files := map[string]string{
+		"gaps.txt":   "Gap 1: heights 100 -> 120 (21 blocks missing)\nGap 2: heights 500 -> 500 (1 blocks missing)\n",
+		"plain.txt":  "100 -> 120\n500 -> 500\n",
+		"gaps.csv":   "start_height,end_height\n100,120\n500,500\n",
+		"bare.csv":   "100, 120\n\n500, 500\n",
+		"swapped":    "end_height,start_height\n120,100\n500,500\n",
+		"gaps.json":  `[{"start_height": 100, "end_height": 120}, {"start_height": 500, "end_height": 500}]`,
+		"gaps.jsonl": "\n  [{\"start_height\": 100, \"end_height\": 120},\n{\"start_height\": 500, \"end_height\": 500}]",
+	}
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+		gaps, err := ParseGapFile(path, GapFileFormatAuto)
+		require.NoError(t, err, name)
+		require.Equal(t, want, gaps, name)
+	}
+
+	// An explicit format overrides sniffing.
+	path := filepath.Join(dir, "gaps.dat")
+	require.NoError(t, os.WriteFile(path, []byte("100,120\n500,500\n"), 0o644))
+	gaps, err := ParseGapFile(path, "CSV")
+	require.NoError(t, err)
+	require.Equal(t, want, gaps)
+	_, err = ParseGapFile(path, "json")
+	require.Error(t, err)
+}
+
+func TestParseGapFileRejectsInvalidRows(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"reversed.csv": "120,100\n",
+		"words.csv":    "100,120\nabc,def\n",
+		"missing.json": `[{"start_height": 100}]`,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+		_, err := ParseGapFile(path, GapFileFormatAuto)
+		require.Error(t, err, name)
+	}
+	require.Error(t, ValidateGapFileFormat("yaml"))
+	require.NoError(t, ValidateGapFileFormat(""))
+}
+
+func TestRegisterGapFileFormat(t *testing.T) {
+	defer delete(gapFileParsers, "semicolon")
+	RegisterGapFileFormat("semicolon", func(r io.Reader) ([]Gap, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return parseCSVGaps(bytes.NewReader([]byte(strings.ReplaceAll(string(data), ";", ","))))
+	})
+	path := filepath.Join(t.TempDir(), "gaps.txt")
+	require.NoError(t, os.WriteFile(path, []byte("7;9\n"), 0o644))
+
+	gaps, err := ParseGapFile(path, "semicolon")
+	require.NoError(t, err)
+	require.Equal(t, []Gap{{Start: 7, End: 9}}, gaps)
+}
+
+func TestParseGapFileReadsStdin(t *testing.T) {
+	defer func(stdin io.Reader) { gapFileStdin = stdin }(gapFileStdin)
+	reader, writer := io.Pipe()
+	gapFileStdin = reader
+	go func() {
+		// Written in pieces, as the analyze tool streams them.
+		io.WriteString(writer, "Gap 1: heights 100 -> 120 (21 blocks missing)\n")
+		io.WriteString(writer, "Gap 2: heights 500 -> 500 (1 blocks missing)\n")
+		writer.Close()
+	}()
+
+	gaps, err := ParseGapFile(StdinGapFile, GapFileFormatAuto)
+	require.NoError(t, err)
+	require.Equal(t, []Gap{{Start: 100, End: 120}, {Start: 500, End: 500}}, gaps)
+
+	gapFileStdin = strings.NewReader("100,120\n")
+	gaps, err = ParseGapFile(StdinGapFile, GapFileFormatAuto)
+	require.NoError(t, err)
+	require.Equal(t, []Gap{{Start: 100, End: 120}}, gaps)
+}
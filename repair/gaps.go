@@ -0,0 +1,488 @@
+package repair
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Gap represents a contiguous range of missing block heights.
+type Gap struct{ Start, End uint64 }
+
+// ParseGapsFromFile reads a gap list file like state-changes-gaps.txt
+// Format: "Gap 44865: heights 24195810 -> 24195811 (2 blocks missing)"
+func ParseGapsFromFile(filename string) ([]Gap, error) {
+	return ParseGapFile(filename, "text")
+}
+
+// WriteGapCheckpoint writes the remaining gaps in the gap-file format so the run can be resumed with GAP_FILE.
+func WriteGapCheckpoint(path string, gaps []Gap) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create checkpoint file: %w", err)
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	for i, g := range gaps {
+		fmt.Fprintf(w, "Gap %d: heights %d -> %d (%d blocks missing)\n", i+1, g.Start, g.End, g.End-g.Start+1)
+	}
+	return w.Flush()
+}
+
+// workMemPattern matches a Postgres memory setting such as "512MB". SET can't take bind parameters, so the
+// value is validated before it is inlined.
+var workMemPattern = regexp.MustCompile(`^[0-9]+ ?(kB|MB|GB|TB)?$`)
+
+// ValidateWorkMem checks a DETECT_WORK_MEM value.
+func ValidateWorkMem(workMem string) error {
+	if !workMemPattern.MatchString(workMem) {
+		return fmt.Errorf("DETECT_WORK_MEM %q must be a size like 512MB", workMem)
+	}
+	return nil
+}
+
+// gapDetectionQuery returns every missing block range. The LEAD window over the distinct heights sorts the
+// whole height column, so it is the most expensive query the tool runs on a large block table.
+const gapDetectionQuery = `
+WITH ordered AS (
+  SELECT DISTINCT height FROM block
+),
+sequenced AS (
+  SELECT
+    height,
+    LEAD(height) OVER (ORDER BY height) AS next_height
+  FROM ordered
+)
+SELECT
+  height + 1 AS start_height,
+  next_height - 1 AS end_height,
+  (next_height - height - 1) AS missing_count
+FROM sequenced
+WHERE next_height IS NOT NULL
+  AND next_height > height + 1
+ORDER BY start_height;
+	`
+
+// runGapDetection calls run with db, or, if workMem is set, with a read-only transaction that has first
+// issued SET LOCAL work_mem.
+func runGapDetection(ctx context.Context, db *bun.DB, workMem string, run func(ctx context.Context, db bun.IDB) error) error {
+	if workMem == "" {
+		return run(ctx, db)
+	}
+	if err := ValidateWorkMem(workMem); err != nil {
+		return err
+	}
+	return db.RunInTx(ctx, &sql.TxOptions{ReadOnly: true}, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL work_mem = '%s'", workMem)); err != nil {
+			return fmt.Errorf("set work_mem: %w", err)
+		}
+		return run(ctx, tx)
+	})
+}
+
+// DetectGaps runs the user-provided SQL to return missing block ranges. If workMem is set, the query runs in
+// a read-only transaction that first issues SET LOCAL work_mem, so the sort and window step can stay in
+// memory on a large block table. SET LOCAL lasts until the transaction ends, so the setting is reset
+// afterward without touching the server or session config.
+func DetectGaps(db *bun.DB, workMem string) ([]Gap, error) {
+	type gapRow struct{ StartHeight, EndHeight, MissingCount uint64 }
+	var rows []gapRow
+	err := runGapDetection(context.Background(), db, workMem, func(ctx context.Context, db bun.IDB) error {
+		return db.NewRaw(gapDetectionQuery).Scan(ctx, &rows)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("detectGaps query failed: %w", err)
+	}
+	var gaps []Gap
+	for _, r := range rows {
+		gaps = append(gaps, Gap{Start: r.StartHeight, End: r.EndHeight})
+	}
+	return gaps, nil
+}
+
+// ExplainGapDetection runs the DetectGaps query under EXPLAIN (ANALYZE, BUFFERS) with the same workMem and
+// writes the plan to w, one line per plan row. The plan shows whether the scan uses the block.height index
+// and whether the sort behind the window spills to disk ("Sort Method: external merge"). ANALYZE executes
+// the query, so it costs as much as a detection run.
+func ExplainGapDetection(db *bun.DB, workMem string, w io.Writer) error {
+	err := runGapDetection(context.Background(), db, workMem, func(ctx context.Context, db bun.IDB) error {
+		rows, err := db.QueryContext(ctx, "EXPLAIN (ANALYZE, BUFFERS) "+strings.TrimSpace(gapDetectionQuery))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("explain gap detection: %w", err)
+	}
+	return nil
+}
+
+// ParsePartitionRange parses DETECT_PARTITION_RANGE, given as "start-end" or "start,end".
+func ParsePartitionRange(value string) (Gap, error) {
+	var start, end uint64
+	normalized := strings.ReplaceAll(strings.ReplaceAll(value, ",", " "), "-", " ")
+	if _, err := fmt.Sscanf(normalized, "%d %d", &start, &end); err != nil {
+		return Gap{}, fmt.Errorf("DETECT_PARTITION_RANGE %q must be start-end: %w", value, err)
+	}
+	if start > end {
+		return Gap{}, fmt.Errorf("DETECT_PARTITION_RANGE %q has start after end", value)
+	}
+	return Gap{Start: start, End: end}, nil
+}
+
+// DetectGapsInRange returns the missing block ranges within bounds only, so detection on a table
+// partitioned by height touches a single partition. Heights missing at either edge of bounds count as gaps.
+func DetectGapsInRange(ctx context.Context, db Querier, bounds Gap) ([]Gap, error) {
+	query := fmt.Sprintf("SELECT DISTINCT height FROM block WHERE height BETWEEN %d AND %d ORDER BY height", bounds.Start, bounds.End)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("detectGapsInRange query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var gaps []Gap
+	next := bounds.Start
+	for rows.Next() {
+		var height uint64
+		if err := rows.Scan(&height); err != nil {
+			return nil, fmt.Errorf("detectGapsInRange scan: %w", err)
+		}
+		if height < next || height > bounds.End {
+			continue
+		}
+		if height > next {
+			gaps = append(gaps, Gap{Start: next, End: height - 1})
+		}
+		if height == bounds.End {
+			return gaps, rows.Err()
+		}
+		next = height + 1
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("detectGapsInRange rows: %w", err)
+	}
+	return append(gaps, Gap{Start: next, End: bounds.End}), nil
+}
+
+// FindMissingHeights returns every height in [start, end] without a block row, in ascending order. It's a
+// single anti-join against generate_series, so a range costs one round-trip however many heights it spans.
+func FindMissingHeights(ctx context.Context, db Querier, start, end uint64) ([]uint64, error) {
+	query := fmt.Sprintf(`SELECT h FROM generate_series(%d::bigint, %d::bigint) AS h
+WHERE NOT EXISTS (SELECT 1 FROM block WHERE block.height = h)
+ORDER BY h`, start, end)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("findMissingHeights query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var missing []uint64
+	for rows.Next() {
+		var height uint64
+		if err := rows.Scan(&height); err != nil {
+			return nil, fmt.Errorf("findMissingHeights scan: %w", err)
+		}
+		missing = append(missing, height)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("findMissingHeights rows: %w", err)
+	}
+	return missing, nil
+}
+
+// DefaultVerifyBatchHeights is how many heights one FindMissingHeightsInGaps query spans by default. The
+// present heights of a batch are held in memory, 8 bytes each.
+const DefaultVerifyBatchHeights = 1000000
+
+// FindMissingHeightsInGaps returns every height of gaps without a block row, in ascending order. Gaps are
+// grouped into batches spanning at most batchHeights heights, and each batch is one query for the heights
+// present in it, with the missing ones worked out in memory, so checking thousands of small gaps costs a
+// query per batch rather than per gap or per height. A gap wider than batchHeights is a batch of its own; a
+// batchHeights of 0 puts every gap in one batch.
+func FindMissingHeightsInGaps(ctx context.Context, db Querier, gaps []Gap, batchHeights uint64) ([]uint64, error) {
+	sorted := append([]Gap(nil), gaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var missing []uint64
+	for len(sorted) > 0 {
+		batch := 1
+		end := sorted[0].End
+		for ; batch < len(sorted); batch++ {
+			if batchHeights > 0 && sorted[batch].End-sorted[0].Start+1 > batchHeights {
+				break
+			}
+			if sorted[batch].End > end {
+				end = sorted[batch].End
+			}
+		}
+		present, err := presentHeights(ctx, db, sorted[0].Start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range sorted[:batch] {
+			i := sort.Search(len(present), func(i int) bool { return present[i] >= g.Start })
+			for h := g.Start; h <= g.End; h++ {
+				if i < len(present) && present[i] == h {
+					i++
+					continue
+				}
+				missing = append(missing, h)
+			}
+		}
+		sorted = sorted[batch:]
+	}
+	return missing, nil
+}
+
+// presentHeights returns the distinct heights in [start, end] that have a block row, in ascending order.
+func presentHeights(ctx context.Context, db Querier, start, end uint64) ([]uint64, error) {
+	query := fmt.Sprintf("SELECT DISTINCT height FROM block WHERE height BETWEEN %d AND %d ORDER BY height", start, end)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("presentHeights query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var present []uint64
+	for rows.Next() {
+		var height uint64
+		if err := rows.Scan(&height); err != nil {
+			return nil, fmt.Errorf("presentHeights scan: %w", err)
+		}
+		present = append(present, height)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("presentHeights rows: %w", err)
+	}
+	return present, nil
+}
+
+// HeightsToGaps collapses ascending heights into contiguous gaps.
+func HeightsToGaps(heights []uint64) []Gap {
+	var gaps []Gap
+	for _, h := range heights {
+		if n := len(gaps); n > 0 && gaps[n-1].End+1 == h {
+			gaps[n-1].End = h
+			continue
+		}
+		gaps = append(gaps, Gap{Start: h, End: h})
+	}
+	return gaps
+}
+
+// IntersectGaps returns the parts of gaps that fall within window, in the order of gaps. Gaps entirely
+// outside the window are dropped.
+func IntersectGaps(gaps []Gap, window Gap) []Gap {
+	var within []Gap
+	for _, g := range gaps {
+		if g.End < window.Start || g.Start > window.End {
+			continue
+		}
+		if g.Start < window.Start {
+			g.Start = window.Start
+		}
+		if g.End > window.End {
+			g.End = window.End
+		}
+		within = append(within, g)
+	}
+	return within
+}
+
+// Querier runs a SQL query and returns its rows. *bun.DB and *sql.DB both implement it.
+//
+// The drivers behind it disagree on placeholder syntax, so queries run through a Querier inline their values
+// instead of passing args. Only values that can't carry a quote are inlined: integers, hex, constants and
+// names validated beforehand.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// QueryGaps runs an arbitrary SQL query (GAP_QUERY) and uses its rows as the gap list. The query must return
+// start_height and end_height columns; any other columns are ignored.
+func QueryGaps(ctx context.Context, db Querier, query string) ([]Gap, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("gap query failed: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("gap query columns: %w", err)
+	}
+	startIdx, endIdx := -1, -1
+	for i, column := range columns {
+		switch strings.ToLower(column) {
+		case "start_height":
+			startIdx = i
+		case "end_height":
+			endIdx = i
+		}
+	}
+	if startIdx < 0 || endIdx < 0 {
+		return nil, fmt.Errorf("gap query must return start_height and end_height columns, got %v", columns)
+	}
+
+	var gaps []Gap
+	for rows.Next() {
+		var start, end sql.NullInt64
+		dest := make([]interface{}, len(columns))
+		for i := range dest {
+			dest[i] = new(interface{})
+		}
+		dest[startIdx] = &start
+		dest[endIdx] = &end
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("scan gap query row %d: %w", len(gaps)+1, err)
+		}
+		if !start.Valid || !end.Valid {
+			return nil, fmt.Errorf("gap query row %d has a NULL start_height or end_height", len(gaps)+1)
+		}
+		if start.Int64 < 0 || start.Int64 > end.Int64 {
+			return nil, fmt.Errorf("gap query row %d has an invalid range %d -> %d", len(gaps)+1, start.Int64, end.Int64)
+		}
+		gaps = append(gaps, Gap{Start: uint64(start.Int64), End: uint64(end.Int64)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading gap query rows: %w", err)
+	}
+	return gaps, nil
+}
+
+// Gap statuses recorded in the repair_gaps table.
+const (
+	GapStatusPending  = "pending"
+	GapStatusSkipped  = "skipped"
+	GapStatusRepaired = "repaired"
+	// GapStatusUndecodable is a gap too many of whose state-change entries failed to decode; it should be
+	// repaired from the node instead.
+	GapStatusUndecodable = "undecodable"
+	// GapStatusStuck is a gap that earlier runs repaired but that keeps being detected again, so it is left
+	// alone; see StuckGaps.
+	GapStatusStuck = "stuck"
+	// GapStatusFiltered is a gap repaired except for the heights Options.MinBlockTxns or MaxBlockTxns left out.
+	GapStatusFiltered = "filtered"
+)
+
+// PGRepairGap is a row in the repair_gaps table, which records detected gaps and their repair status.
+type PGRepairGap struct {
+	bun.BaseModel `bun:"table:repair_gaps"`
+	ID            int64 `bun:",pk,autoincrement"`
+	StartHeight   uint64
+	EndHeight     uint64
+	MissingCount  uint64
+	DetectedAt    time.Time
+	Status        string
+	RepairedAt    time.Time `bun:",nullzero"`
+}
+
+// EnsureRepairGapsTable creates the repair_gaps table if it doesn't already exist.
+func EnsureRepairGapsTable(db *bun.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS repair_gaps (
+			id            BIGSERIAL PRIMARY KEY,
+			start_height  BIGINT NOT NULL,
+			end_height    BIGINT NOT NULL,
+			missing_count BIGINT NOT NULL,
+			detected_at   TIMESTAMP NOT NULL,
+			status        VARCHAR NOT NULL,
+			repaired_at   TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS repair_gaps_start_height_idx ON repair_gaps (start_height);
+		CREATE INDEX IF NOT EXISTS repair_gaps_status_idx ON repair_gaps (status);
+	`)
+	if err != nil {
+		return fmt.Errorf("create repair_gaps table: %w", err)
+	}
+	return nil
+}
+
+// RecordGaps inserts the gaps into the repair_gaps table with a pending status. The returned rows
+// are in the same order as gaps and carry the generated IDs for later status updates.
+func RecordGaps(db *bun.DB, gaps []Gap) ([]*PGRepairGap, error) {
+	if len(gaps) == 0 {
+		return nil, nil
+	}
+	detectedAt := time.Now().UTC()
+	rows := make([]*PGRepairGap, len(gaps))
+	for i, g := range gaps {
+		rows[i] = &PGRepairGap{
+			StartHeight:  g.Start,
+			EndHeight:    g.End,
+			MissingCount: g.End - g.Start + 1,
+			DetectedAt:   detectedAt,
+			Status:       GapStatusPending,
+		}
+	}
+	if _, err := db.NewInsert().Model(&rows).Exec(context.Background()); err != nil {
+		return nil, fmt.Errorf("insert repair_gaps rows: %w", err)
+	}
+	return rows, nil
+}
+
+// UpdateGapStatus sets the status of a recorded gap, stamping repaired_at when it is repaired.
+func UpdateGapStatus(db *bun.DB, row *PGRepairGap, status string) error {
+	row.Status = status
+	query := db.NewUpdate().Model(row).Column("status").WherePK()
+	if status == GapStatusRepaired {
+		row.RepairedAt = time.Now().UTC()
+		query = query.Column("repaired_at")
+	}
+	if _, err := query.Exec(context.Background()); err != nil {
+		return fmt.Errorf("update repair_gaps row %d: %w", row.ID, err)
+	}
+	return nil
+}
+
+// StuckGaps splits gaps into those that earlier runs recorded in repair_gaps as repaired at least
+// maxReappearances times, and the rest. A gap that is "repaired" yet detected again run after run (because the
+// node can't serve it, say) would otherwise be retried forever; the stuck ones should be reported and left
+// out of the run.
+func StuckGaps(ctx context.Context, db Querier, gaps []Gap, maxReappearances int) (stuck, remaining []Gap, err error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT start_height, end_height FROM repair_gaps
+WHERE status = '%s' GROUP BY start_height, end_height HAVING COUNT(*) >= %d`, GapStatusRepaired, maxReappearances))
+	if err != nil {
+		return nil, nil, fmt.Errorf("stuck gap query failed: %w", err)
+	}
+	defer rows.Close()
+	repeated := make(map[Gap]bool)
+	for rows.Next() {
+		var g Gap
+		if err := rows.Scan(&g.Start, &g.End); err != nil {
+			return nil, nil, fmt.Errorf("stuck gap scan: %w", err)
+		}
+		repeated[g] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("stuck gap rows: %w", err)
+	}
+	for _, g := range gaps {
+		if repeated[g] {
+			stuck = append(stuck, g)
+		} else {
+			remaining = append(remaining, g)
+		}
+	}
+	return stuck, remaining, nil
+}
@@ -0,0 +1,429 @@
+package repair
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+// fixtureDriver is a database/sql driver whose connections answer every query with a fixed result set,
+// keyed by the DSN passed to sql.Open.
+type fixtureDriver struct{}
+
+type queryFixture struct {
+	columns []string
+	rows    [][]driver.Value
+	queries []string
+	// respond, if set, computes the rows for each query instead of returning rows.
+	respond func(query string) [][]driver.Value
+	// exec, if set, is called for each statement executed without reading rows.
+	exec func(query string)
+	// txOptions records the options of each transaction begun.
+	txOptions []driver.TxOptions
+}
+
+var (
+	fixturesMu sync.Mutex
+	fixtures   = make(map[string]*queryFixture)
+)
+
+func init() {
+	sql.Register("repairfixture", fixtureDriver{})
+}
+
+func openFixtureDB(t *testing.T, fixture *queryFixture) *sql.DB {
+	fixturesMu.Lock()
+	fixtures[t.Name()] = fixture
+	fixturesMu.Unlock()
+	db, err := sql.Open("repairfixture", t.Name())
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func (fixtureDriver) Open(name string) (driver.Conn, error) {
+	fixturesMu.Lock()
+	defer fixturesMu.Unlock()
+	fixture, ok := fixtures[name]
+	if !ok {
+		return nil, errors.New("unknown fixture " + name)
+	}
+	return &fixtureConn{fixture: fixture}, nil
+}
+
+type fixtureConn struct{ fixture *queryFixture }
+
+func (c *fixtureConn) Prepare(query string) (driver.Stmt, error) {
+	// Connections share the fixture, so statements prepared concurrently are recorded under the lock.
+	fixturesMu.Lock()
+	c.fixture.queries = append(c.fixture.queries, query)
+	fixturesMu.Unlock()
+	return &fixtureStmt{fixture: c.fixture, query: query}, nil
+}
+func (c *fixtureConn) Close() error              { return nil }
+func (c *fixtureConn) Begin() (driver.Tx, error) { return fixtureTx{}, nil }
+func (c *fixtureConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.fixture.txOptions = append(c.fixture.txOptions, opts)
+	return fixtureTx{}, nil
+}
+
+type fixtureTx struct{}
+
+func (fixtureTx) Commit() error   { return nil }
+func (fixtureTx) Rollback() error { return nil }
+
+type fixtureStmt struct {
+	fixture *queryFixture
+	query   string
+}
+
+func (s *fixtureStmt) Close() error  { return nil }
+func (s *fixtureStmt) NumInput() int { return -1 }
+func (s *fixtureStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.fixture.exec != nil {
+		s.fixture.exec(s.query)
+	}
+	return driver.RowsAffected(0), nil
+}
+func (s *fixtureStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := s.fixture.rows
+	if s.fixture.respond != nil {
+		rows = s.fixture.respond(s.query)
+	}
+	return &fixtureRows{columns: s.fixture.columns, rows: rows}, nil
+}
+
+type fixtureRows struct {
+	columns []string
+	rows    [][]driver.Value
+	next    int
+}
+
+func (r *fixtureRows) Columns() []string { return r.columns }
+func (r *fixtureRows) Close() error      { return nil }
+func (r *fixtureRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+func TestQueryGapsUsesQueryRows(t *testing.T) {
+	fixture := &queryFixture{
+		columns: []string{"txn_type", "start_height", "end_height"},
+		rows: [][]driver.Value{
+			{int64(5), int64(100), int64(120)},
+			{int64(5), int64(500), int64(500)},
+		},
+	}
+	db := openFixtureDB(t, fixture)
+	query := "SELECT txn_type, start_height, end_height FROM my_coverage_gaps"
+
+	gaps, err := QueryGaps(context.Background(), db, query)
+	require.NoError(t, err)
+	require.Equal(t, []Gap{{Start: 100, End: 120}, {Start: 500, End: 500}}, gaps)
+	require.Equal(t, []string{query}, fixture.queries)
+}
+
+func TestQueryGapsValidatesColumns(t *testing.T) {
+	db := openFixtureDB(t, &queryFixture{
+		columns: []string{"start", "end"},
+		rows:    [][]driver.Value{{int64(1), int64(2)}},
+	})
+	_, err := QueryGaps(context.Background(), db, "SELECT 1 AS start, 2 AS end")
+	require.ErrorContains(t, err, "start_height and end_height")
+}
+
+func TestQueryGapsRejectsInvalidRanges(t *testing.T) {
+	db := openFixtureDB(t, &queryFixture{
+		columns: []string{"start_height", "end_height"},
+		rows:    [][]driver.Value{{int64(10), int64(9)}},
+	})
+	_, err := QueryGaps(context.Background(), db, "SELECT 10, 9")
+	require.ErrorContains(t, err, "invalid range")
+
+	db = openFixtureDB(t, &queryFixture{
+		columns: []string{"start_height", "end_height"},
+		rows:    [][]driver.Value{{int64(10), nil}},
+	})
+	_, err = QueryGaps(context.Background(), db, "SELECT 10, NULL")
+	require.ErrorContains(t, err, "NULL")
+}
+
+func TestGapCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.txt")
+	gaps := []Gap{{Start: 4, End: 5}, {Start: 20, End: 21}}
+	require.NoError(t, WriteGapCheckpoint(path, gaps))
+
+	parsed, err := ParseGapsFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, gaps, parsed)
+}
+
+func TestDetectGapsInRangeOnlyReportsGapsWithinBounds(t *testing.T) {
+	heights := []int64{102, 103, 105, 106, 107, 110}
+	fixture := &queryFixture{columns: []string{"height"}}
+	for _, h := range heights {
+		fixture.rows = append(fixture.rows, []driver.Value{h})
+	}
+	db := openFixtureDB(t, fixture)
+
+	gaps, err := DetectGapsInRange(context.Background(), db, Gap{Start: 100, End: 112})
+	require.NoError(t, err)
+	// Missing heights at both edges of the partition count as gaps.
+	require.Equal(t, []Gap{{Start: 100, End: 101}, {Start: 104, End: 104}, {Start: 108, End: 109}, {Start: 111, End: 112}}, gaps)
+	require.Contains(t, fixture.queries[0], "BETWEEN 100 AND 112")
+
+	fixture.queries = nil
+	gaps, err = DetectGapsInRange(context.Background(), db, Gap{Start: 102, End: 107})
+	require.NoError(t, err)
+	require.Equal(t, []Gap{{Start: 104, End: 104}}, gaps)
+}
+
+func TestDetectGapsSetsWorkMemBeforeQuery(t *testing.T) {
+	fixture := &queryFixture{
+		columns: []string{"start_height", "end_height", "missing_count"},
+		rows:    [][]driver.Value{{int64(5), int64(7), int64(3)}},
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+
+	gaps, err := DetectGaps(db, "512MB")
+	require.NoError(t, err)
+	require.Equal(t, []Gap{{Start: 5, End: 7}}, gaps)
+	require.Len(t, fixture.queries, 2)
+	require.Equal(t, "SET LOCAL work_mem = '512MB'", fixture.queries[0])
+	require.Contains(t, fixture.queries[1], "LEAD(height)")
+
+	// Without a work_mem the query runs on its own.
+	fixture.queries = nil
+	_, err = DetectGaps(db, "")
+	require.NoError(t, err)
+	require.Len(t, fixture.queries, 1)
+
+	_, err = DetectGaps(db, "512MB'; DROP TABLE block; --")
+	require.Error(t, err)
+}
+
+func TestExplainGapDetectionPrintsThePlan(t *testing.T) {
+	fixture := &queryFixture{
+		columns: []string{"QUERY PLAN"},
+		rows: [][]driver.Value{
+			{"Sort  (cost=10.00..10.01 rows=1 width=24) (actual time=0.10..0.10 rows=1 loops=1)"},
+			{"  Sort Method: external merge  Disk: 2048kB"},
+			{"  ->  Index Only Scan using block_height_idx on block  (actual time=0.01..0.05 rows=3 loops=1)"},
+			{"Execution Time: 0.20 ms"},
+		},
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+
+	var out strings.Builder
+	require.NoError(t, ExplainGapDetection(db, "512MB", &out))
+	require.Equal(t, `Sort  (cost=10.00..10.01 rows=1 width=24) (actual time=0.10..0.10 rows=1 loops=1)
+  Sort Method: external merge  Disk: 2048kB
+  ->  Index Only Scan using block_height_idx on block  (actual time=0.01..0.05 rows=3 loops=1)
+Execution Time: 0.20 ms
+`, out.String())
+	// The plan is for the detection query, under the same work_mem a detection run would use.
+	require.Len(t, fixture.queries, 2)
+	require.Equal(t, "SET LOCAL work_mem = '512MB'", fixture.queries[0])
+	require.True(t, strings.HasPrefix(fixture.queries[1], "EXPLAIN (ANALYZE, BUFFERS) WITH ordered AS"), fixture.queries[1])
+	require.Contains(t, fixture.queries[1], "LEAD(height)")
+}
+
+func TestFindMissingHeightsReturnsScatteredHolesInOneQuery(t *testing.T) {
+	fixture := &queryFixture{columns: []string{"h"}}
+	for _, h := range []int64{1001, 1002, 1005, 1010, 1011, 1012, 1020} {
+		fixture.rows = append(fixture.rows, []driver.Value{h})
+	}
+	db := openFixtureDB(t, fixture)
+
+	missing, err := FindMissingHeights(context.Background(), db, 1000, 1020)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1001, 1002, 1005, 1010, 1011, 1012, 1020}, missing)
+	require.Len(t, fixture.queries, 1)
+	require.Contains(t, fixture.queries[0], "generate_series(1000::bigint, 1020::bigint)")
+	require.Contains(t, fixture.queries[0], "NOT EXISTS")
+
+	require.Equal(t, []Gap{{Start: 1001, End: 1002}, {Start: 1005, End: 1005}, {Start: 1010, End: 1012}, {Start: 1020, End: 1020}},
+		HeightsToGaps(missing))
+	require.Empty(t, HeightsToGaps(nil))
+}
+
+func TestFindMissingHeightsInGapsMatchesPerGapQueries(t *testing.T) {
+	present := make(map[uint64]bool)
+	for h := uint64(100); h <= 400; h++ {
+		present[h] = true
+	}
+	for _, h := range []uint64{101, 102, 150, 151, 152, 199, 200, 301, 399, 400} {
+		delete(present, h)
+	}
+	fixture := &queryFixture{columns: []string{"h"}}
+	fixture.respond = func(query string) [][]driver.Value {
+		var start, end uint64
+		var rows [][]driver.Value
+		if i := strings.Index(query, "generate_series("); i >= 0 {
+			if _, err := fmt.Sscanf(query[i:], "generate_series(%d::bigint, %d::bigint)", &start, &end); err != nil {
+				panic(err)
+			}
+			for h := start; h <= end; h++ {
+				if !present[h] {
+					rows = append(rows, []driver.Value{int64(h)})
+				}
+			}
+			return rows
+		}
+		if _, err := fmt.Sscanf(query[strings.Index(query, "BETWEEN"):], "BETWEEN %d AND %d", &start, &end); err != nil {
+			panic(err)
+		}
+		for h := start; h <= end; h++ {
+			if present[h] {
+				rows = append(rows, []driver.Value{int64(h)})
+			}
+		}
+		return rows
+	}
+	db := openFixtureDB(t, fixture)
+	gaps := []Gap{{Start: 300, End: 310}, {Start: 100, End: 105}, {Start: 150, End: 152}, {Start: 195, End: 205}, {Start: 390, End: 400}}
+
+	var perGap []uint64
+	for _, g := range []Gap{gaps[1], gaps[2], gaps[3], gaps[0], gaps[4]} {
+		missing, err := FindMissingHeights(context.Background(), db, g.Start, g.End)
+		require.NoError(t, err)
+		perGap = append(perGap, missing...)
+	}
+	require.Equal(t, []uint64{101, 102, 150, 151, 152, 199, 200, 301, 399, 400}, perGap)
+
+	for _, batchHeights := range []uint64{0, 1, 110, 1000} {
+		fixture.queries = nil
+		missing, err := FindMissingHeightsInGaps(context.Background(), db, gaps, batchHeights)
+		require.NoError(t, err)
+		require.Equal(t, perGap, missing, "batchHeights %d", batchHeights)
+		switch batchHeights {
+		case 0, 1000:
+			require.Len(t, fixture.queries, 1)
+		case 1:
+			// Every gap is wider than the batch, so each is a batch of its own.
+			require.Len(t, fixture.queries, len(gaps))
+		case 110:
+			// 100 -> 205 and 300 -> 400.
+			require.Len(t, fixture.queries, 2)
+		}
+	}
+}
+
+func TestParsePartitionRange(t *testing.T) {
+	bounds, err := ParsePartitionRange("20000000-29999999")
+	require.NoError(t, err)
+	require.Equal(t, Gap{Start: 20000000, End: 29999999}, bounds)
+
+	bounds, err = ParsePartitionRange("5,9")
+	require.NoError(t, err)
+	require.Equal(t, Gap{Start: 5, End: 9}, bounds)
+
+	_, err = ParsePartitionRange("9-5")
+	require.Error(t, err)
+	_, err = ParsePartitionRange("nine")
+	require.Error(t, err)
+}
+
+func TestIntersectGapsClipsGapsToWindow(t *testing.T) {
+	gaps := []Gap{{Start: 1, End: 5}, {Start: 8, End: 12}, {Start: 15, End: 15}, {Start: 18, End: 30}, {Start: 40, End: 45}}
+	require.Equal(t, []Gap{{Start: 10, End: 12}, {Start: 15, End: 15}, {Start: 18, End: 20}},
+		IntersectGaps(gaps, Gap{Start: 10, End: 20}))
+	// A window inside one gap yields the window itself.
+	require.Equal(t, []Gap{{Start: 20, End: 25}}, IntersectGaps(gaps, Gap{Start: 20, End: 25}))
+	// Window bounds are inclusive.
+	require.Equal(t, []Gap{{Start: 5, End: 5}, {Start: 8, End: 8}}, IntersectGaps(gaps, Gap{Start: 5, End: 8}))
+	require.Empty(t, IntersectGaps(gaps, Gap{Start: 6, End: 7}))
+}
+
+func TestRecordedGapsAreMarkedRepaired(t *testing.T) {
+	nextID := int64(0)
+	var updates []string
+	fixture := &queryFixture{
+		columns: []string{"id"},
+		respond: func(query string) [][]driver.Value {
+			var rows [][]driver.Value
+			for range strings.Count(query, "'"+GapStatusPending+"'") {
+				nextID++
+				rows = append(rows, []driver.Value{nextID})
+			}
+			return rows
+		},
+		exec: func(query string) { updates = append(updates, query) },
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+	gaps := []Gap{{Start: 5, End: 7}, {Start: 20, End: 20}}
+
+	rows, err := RecordGaps(db, gaps)
+	require.NoError(t, err)
+	require.Len(t, fixture.queries, 1)
+	require.Contains(t, fixture.queries[0], `INSERT INTO "repair_gaps"`)
+	require.Contains(t, fixture.queries[0], "5, 7, 3, ")
+	require.Contains(t, fixture.queries[0], "20, 20, 1, ")
+	require.Equal(t, int64(1), rows[0].ID)
+	require.Equal(t, int64(2), rows[1].ID)
+
+	r := newTestRepairer(newFakeHandler(), newFakeSource())
+	r.OnGapStatus = func(i int, status string) { require.NoError(t, UpdateGapStatus(db, rows[i], status)) }
+	require.NoError(t, r.Run(context.Background(), gaps))
+
+	require.Len(t, updates, 2)
+	for i, update := range updates {
+		require.Contains(t, update, `UPDATE "repair_gaps"`)
+		require.Contains(t, update, `"status" = 'repaired'`)
+		require.Contains(t, update, `"repaired_at" = '`)
+		require.Contains(t, update, fmt.Sprintf(`"id" = %d`, i+1))
+		require.Equal(t, GapStatusRepaired, rows[i].Status)
+	}
+}
+
+func TestStuckGapsFlagsGapsThatKeepReappearing(t *testing.T) {
+	// repaired counts the repair_gaps rows each gap was marked repaired in.
+	repaired := make(map[Gap]int)
+	fixture := &queryFixture{columns: []string{"start_height", "end_height"}}
+	fixture.respond = func(query string) [][]driver.Value {
+		var rows [][]driver.Value
+		for g, n := range repaired {
+			if n >= 3 {
+				rows = append(rows, []driver.Value{int64(g.Start), int64(g.End)})
+			}
+		}
+		return rows
+	}
+	db := openFixtureDB(t, fixture)
+
+	// The node never serves 10 -> 12, so every "repair" of it leaves it to be detected again. 20 -> 21 is
+	// filled by the first repair.
+	unservable, fillable := Gap{Start: 10, End: 12}, Gap{Start: 20, End: 21}
+	detected := []Gap{unservable, fillable}
+	for cycle := 1; cycle <= 3; cycle++ {
+		stuck, remaining, err := StuckGaps(context.Background(), db, detected, 3)
+		require.NoError(t, err)
+		require.Empty(t, stuck, "cycle %d", cycle)
+		require.Equal(t, detected, remaining)
+		for _, g := range remaining {
+			repaired[g]++
+		}
+		detected = []Gap{unservable}
+	}
+
+	stuck, remaining, err := StuckGaps(context.Background(), db, detected, 3)
+	require.NoError(t, err)
+	require.Equal(t, []Gap{unservable}, stuck)
+	require.Empty(t, remaining)
+	require.Contains(t, fixture.queries[0], "WHERE status = 'repaired' GROUP BY start_height, end_height HAVING COUNT(*) >= 3")
+}
@@ -0,0 +1,110 @@
+package repair
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// EntryHandler is the subset of handler.PostgresDataHandler the repair tool writes through.
+type EntryHandler interface {
+	HandleEntryBatch(batchedEntries []*lib.StateChangeEntry, isMempool bool) error
+	InitiateTransaction() error
+	CommitTransaction() error
+	RollbackTransaction() error
+	InTransaction() bool
+	CreateSavepoint() (string, error)
+	RevertToSavepoint(savepointName string) error
+	ReleaseSavepoint(savepointName string) error
+}
+
+// isolationLevels are the DB_ISOLATION_LEVEL values Postgres distinguishes. READ UNCOMMITTED behaves as
+// READ COMMITTED in Postgres, so it isn't offered.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"":                sql.LevelDefault,
+	"default":         sql.LevelDefault,
+	"read committed":  sql.LevelReadCommitted,
+	"repeatable read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+// ParseIsolationLevel parses a transaction isolation level such as "READ COMMITTED" or "repeatable_read".
+// An empty value is the database default.
+func ParseIsolationLevel(value string) (sql.IsolationLevel, error) {
+	normalized := strings.Join(strings.Fields(strings.ToLower(strings.ReplaceAll(value, "_", " "))), " ")
+	level, ok := isolationLevels[normalized]
+	if !ok {
+		return sql.LevelDefault, fmt.Errorf("unknown isolation level %q, expected READ COMMITTED, REPEATABLE READ or SERIALIZABLE", value)
+	}
+	return level, nil
+}
+
+// handleEntryBatchAtomic processes a batch inside its own savepoint within the open transaction.
+// If any entry in the batch fails, the transaction is rolled back to the savepoint so none of the
+// batch's partial writes survive to the next commit, while earlier batches remain committable.
+// The registered EntryTransform is applied to the batch first.
+func handleEntryBatchAtomic(h EntryHandler, batch []*lib.StateChangeEntry) error {
+	return handleEntryBatchesAtomic(h, [][]*lib.StateChangeEntry{batch})
+}
+
+// handleEntryBatchesAtomic is handleEntryBatchAtomic for several batches that must land together, such as a
+// delete and the upsert that replaces it. The handler only takes one operation type per batch.
+func handleEntryBatchesAtomic(h EntryHandler, batches [][]*lib.StateChangeEntry) error {
+	total := 0
+	for i := range batches {
+		batches[i] = applyEntryTransform(batches[i])
+		total += len(batches[i])
+	}
+	if total == 0 {
+		return nil
+	}
+	if !h.InTransaction() {
+		return fmt.Errorf("no open transaction for batch of %d entries", total)
+	}
+	savepointName, err := h.CreateSavepoint()
+	if err != nil {
+		return fmt.Errorf("create batch savepoint: %w", err)
+	}
+	for _, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if err := h.HandleEntryBatch(batch, false); err != nil {
+			if rollbackErr := h.RevertToSavepoint(savepointName); rollbackErr != nil {
+				return fmt.Errorf("revert batch savepoint after %v: %w", err, rollbackErr)
+			}
+			return err
+		}
+	}
+	if err := h.ReleaseSavepoint(savepointName); err != nil {
+		return fmt.Errorf("release batch savepoint: %w", err)
+	}
+	return nil
+}
+
+// RunStoppedError reports that processing stopped early because the run context ended. Every height of the
+// gap below NextHeight has been committed. Remaining holds the unprocessed gaps, starting at NextHeight,
+// in the gap-file order so they can be checkpointed.
+type RunStoppedError struct {
+	NextHeight uint64
+	Cause      error
+	Remaining  []Gap
+}
+
+func (e *RunStoppedError) Error() string {
+	return fmt.Sprintf("run stopped before height %d: %v", e.NextHeight, e.Cause)
+}
+
+func (e *RunStoppedError) Unwrap() error { return e.Cause }
+
+// EndOfDataError reports that the node has no block at Height, so a gap ended there when
+// Options.StopAtBlockNotFound is set. Every height of the gap below Height has been committed.
+type EndOfDataError struct {
+	Height uint64
+}
+
+func (e *EndOfDataError) Error() string {
+	return fmt.Sprintf("node has no block at height %d", e.Height)
+}
@@ -0,0 +1,63 @@
+package repair
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/handler"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+func TestParseIsolationLevel(t *testing.T) {
+	for value, want := range map[string]sql.IsolationLevel{
+		"":                sql.LevelDefault,
+		"READ COMMITTED":  sql.LevelReadCommitted,
+		"repeatable_read": sql.LevelRepeatableRead,
+		" Serializable ":  sql.LevelSerializable,
+	} {
+		level, err := ParseIsolationLevel(value)
+		require.NoError(t, err, value)
+		require.Equal(t, want, level, value)
+	}
+	_, err := ParseIsolationLevel("snapshot")
+	require.ErrorContains(t, err, "unknown isolation level")
+}
+
+func TestInitiateTransactionUsesConfiguredIsolationLevel(t *testing.T) {
+	fixture := &queryFixture{}
+	level, err := ParseIsolationLevel("repeatable read")
+	require.NoError(t, err)
+	pdh := &handler.PostgresDataHandler{
+		DB:             bun.NewDB(openFixtureDB(t, fixture), pgdialect.New()),
+		Params:         &lib.DeSoTestnetParams,
+		IsolationLevel: level,
+	}
+
+	require.NoError(t, pdh.InitiateTransaction())
+	// pgdriver can't begin a transaction with a custom level, so it is begun with the default and set after.
+	require.Len(t, fixture.txOptions, 1)
+	require.Equal(t, driver.IsolationLevel(sql.LevelDefault), fixture.txOptions[0].Isolation)
+	require.Equal(t, "SET TRANSACTION ISOLATION LEVEL REPEATABLE READ", fixture.queries[len(fixture.queries)-1])
+}
+
+func TestHandleEntryBatchAtomicRevertsEarlierEntriesOnFailure(t *testing.T) {
+	handler := newFakeHandler()
+	handler.fail = func(entry *lib.StateChangeEntry) error {
+		if entry.BlockHeight == 6 {
+			return errors.New("handler failed")
+		}
+		return nil
+	}
+	require.NoError(t, handler.InitiateTransaction())
+	require.NoError(t, handleEntryBatchAtomic(handler, []*lib.StateChangeEntry{utxoOpsStateChange(4)}))
+
+	err := handleEntryBatchAtomic(handler, []*lib.StateChangeEntry{utxoOpsStateChange(5), utxoOpsStateChange(6)})
+	require.ErrorContains(t, err, "handler failed")
+	require.NoError(t, handler.CommitTransaction())
+	require.Equal(t, []uint64{4}, handler.committedHeights())
+}
@@ -0,0 +1,266 @@
+package repair
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// IndexFormat describes the layout of the state-change index file. Each record starts with the entry's
+// offset into the data file; producers that write wider records put extra fields after it, which the repair
+// tool ignores.
+type IndexFormat struct {
+	// RecordSize is the size of one index record in bytes (8 or 24). Zero means detect it from the files.
+	RecordSize int
+	ByteOrder  binary.ByteOrder
+	// Addressing is how ReadBlockFromStateChange finds a height's record. Empty means sequential.
+	Addressing IndexAddressing
+}
+
+// IndexAddressing is how a block height maps to a record of the state-change index.
+type IndexAddressing string
+
+const (
+	// IndexAddressingSequential treats the index as a list of records in write order, one per state-change
+	// entry of any type, so a height's block entry has to be found by scanning. This is what the state syncer
+	// writes, and how the gap scans read the index.
+	IndexAddressingSequential IndexAddressing = "sequential"
+	// IndexAddressingHeight treats record i as the block entry at height i. Only an index holding exactly one
+	// block entry per height from genesis, and nothing else, is laid out this way.
+	IndexAddressingHeight IndexAddressing = "height"
+)
+
+// indexAddressings are the accepted STATE_CHANGE_INDEX_ADDRESSING values.
+var indexAddressings = []IndexAddressing{IndexAddressingSequential, IndexAddressingHeight}
+
+// DefaultIndexFormat is the 8-byte little-endian layout written by the current state syncer.
+var DefaultIndexFormat = IndexFormat{RecordSize: 8, ByteOrder: binary.LittleEndian}
+
+// indexRecordSizes are the record sizes known to be produced, in the order detection tries them.
+var indexRecordSizes = []int{8, 24}
+
+// detectSampleRecords is how many leading records detection checks for plausibility.
+const detectSampleRecords = 64
+
+// ParseIndexFormat builds an IndexFormat from the STATE_CHANGE_INDEX_RECORD_SIZE,
+// STATE_CHANGE_INDEX_ENDIANNESS and STATE_CHANGE_INDEX_ADDRESSING settings. A record size of 0 requests
+// auto-detection.
+func ParseIndexFormat(recordSize int, endianness, addressing string) (IndexFormat, error) {
+	format := IndexFormat{RecordSize: recordSize}
+	switch IndexAddressing(strings.ToLower(addressing)) {
+	case "", IndexAddressingSequential:
+		format.Addressing = IndexAddressingSequential
+	case IndexAddressingHeight:
+		format.Addressing = IndexAddressingHeight
+	default:
+		return IndexFormat{}, fmt.Errorf("STATE_CHANGE_INDEX_ADDRESSING must be one of %v, got %q", indexAddressings, addressing)
+	}
+	switch strings.ToLower(endianness) {
+	case "", "little":
+		format.ByteOrder = binary.LittleEndian
+	case "big":
+		format.ByteOrder = binary.BigEndian
+	default:
+		return IndexFormat{}, fmt.Errorf("STATE_CHANGE_INDEX_ENDIANNESS must be little or big, got %q", endianness)
+	}
+	if recordSize != 0 && !isKnownRecordSize(recordSize) {
+		return IndexFormat{}, fmt.Errorf("STATE_CHANGE_INDEX_RECORD_SIZE must be one of %v, got %d", indexRecordSizes, recordSize)
+	}
+	return format, nil
+}
+
+func isKnownRecordSize(size int) bool {
+	for _, known := range indexRecordSizes {
+		if size == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Offset returns the data-file offset stored in an index record.
+func (f IndexFormat) Offset(record []byte) uint64 {
+	return f.ByteOrder.Uint64(record[:8])
+}
+
+// OffsetAt returns the data-file offset stored in the i-th record of the index.
+func (f IndexFormat) OffsetAt(indexFile io.ReaderAt, i uint64) (uint64, error) {
+	record := make([]byte, f.RecordSize)
+	if _, err := indexFile.ReadAt(record, int64(i)*int64(f.RecordSize)); err != nil {
+		return 0, fmt.Errorf("read index record %d: %w", i, err)
+	}
+	return f.Offset(record), nil
+}
+
+// IndexReader reads data-file offsets from an index file in record order.
+type IndexReader struct {
+	r      *bufio.Reader
+	format IndexFormat
+	record []byte
+}
+
+// NewIndexReader returns an IndexReader over r. format must have a non-zero RecordSize.
+func NewIndexReader(r io.Reader, format IndexFormat) *IndexReader {
+	return &IndexReader{r: bufio.NewReader(r), format: format, record: make([]byte, format.RecordSize)}
+}
+
+// Next returns the offset in the next record, or io.EOF once the index is exhausted. A trailing partial
+// record returns io.ErrUnexpectedEOF.
+func (ir *IndexReader) Next() (uint64, error) {
+	if _, err := io.ReadFull(ir.r, ir.record); err != nil {
+		return 0, err
+	}
+	return ir.format.Offset(ir.record), nil
+}
+
+// ReverseIndexReader reads data-file offsets from an index file from the last record back to the first.
+type ReverseIndexReader struct {
+	r      io.ReaderAt
+	format IndexFormat
+	next   uint64 // records left to read
+	// partial is set when the index ends in a partial record, which is reported before anything is read.
+	partial bool
+}
+
+// NewReverseIndexReader returns a ReverseIndexReader over an index of indexSize bytes. format must have a
+// non-zero RecordSize.
+func NewReverseIndexReader(r io.ReaderAt, indexSize int64, format IndexFormat) *ReverseIndexReader {
+	return &ReverseIndexReader{
+		r:       r,
+		format:  format,
+		next:    uint64(indexSize / int64(format.RecordSize)),
+		partial: indexSize%int64(format.RecordSize) != 0,
+	}
+}
+
+// Next returns the offset in the previous record, or io.EOF once the first record has been read. A trailing
+// partial record returns io.ErrUnexpectedEOF.
+func (ir *ReverseIndexReader) Next() (uint64, error) {
+	if ir.partial {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if ir.next == 0 {
+		return 0, io.EOF
+	}
+	ir.next--
+	return ir.format.OffsetAt(ir.r, ir.next)
+}
+
+// EntryIndex is the index of the record the last call to Next returned.
+func (ir *ReverseIndexReader) EntryIndex() uint64 { return ir.next }
+
+// DetectIndexRecordSize picks the record size whose leading records look like a real index for a data file
+// of dataSize bytes: the index size must be a whole number of records, and the sampled offsets must be
+// strictly increasing and inside the data file, as must the last record's offset. Reading a 24-byte index
+// as 8-byte records interleaves offsets with the extra fields and fails the ordering check, so the narrower
+// size is tried first.
+func DetectIndexRecordSize(indexFile io.ReaderAt, indexSize, dataSize int64, order binary.ByteOrder) (int, error) {
+	for _, size := range indexRecordSizes {
+		if indexSize == 0 || indexSize%int64(size) != 0 {
+			continue
+		}
+		format := IndexFormat{RecordSize: size, ByteOrder: order}
+		records := uint64(indexSize / int64(size))
+		if plausibleIndex(indexFile, format, records, dataSize) {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("index of %d bytes doesn't match any known record size %v for a %d-byte data file; set STATE_CHANGE_INDEX_RECORD_SIZE",
+		indexSize, indexRecordSizes, dataSize)
+}
+
+func plausibleIndex(indexFile io.ReaderAt, format IndexFormat, records uint64, dataSize int64) bool {
+	sample := records
+	if sample > detectSampleRecords {
+		sample = detectSampleRecords
+	}
+	var prev uint64
+	for i := uint64(0); i < sample; i++ {
+		offset, err := format.OffsetAt(indexFile, i)
+		if err != nil || offset >= uint64(dataSize) || (i > 0 && offset <= prev) {
+			return false
+		}
+		prev = offset
+	}
+	last, err := format.OffsetAt(indexFile, records-1)
+	return err == nil && last < uint64(dataSize)
+}
+
+// ResolveIndexFormat returns format with its record size filled in by detection if it was left at zero.
+func ResolveIndexFormat(indexFile, dataFile *os.File, format IndexFormat) (IndexFormat, error) {
+	if format.ByteOrder == nil {
+		format.ByteOrder = binary.LittleEndian
+	}
+	if format.RecordSize != 0 {
+		return format, nil
+	}
+	indexInfo, err := indexFile.Stat()
+	if err != nil {
+		return IndexFormat{}, fmt.Errorf("stat index file: %w", err)
+	}
+	dataInfo, err := dataFile.Stat()
+	if err != nil {
+		return IndexFormat{}, fmt.Errorf("stat data file: %w", err)
+	}
+	size, err := DetectIndexRecordSize(indexFile, indexInfo.Size(), dataInfo.Size(), format.ByteOrder)
+	if err != nil {
+		return IndexFormat{}, err
+	}
+	log.Printf("Detected %d-byte state-change index records", size)
+	format.RecordSize = size
+	return format, nil
+}
+
+// DataBeyondEOFError reports an index record whose entry extends past the end of the data file. It means the
+// data file was truncated after the index was written, not that the entry is corrupt.
+type DataBeyondEOFError struct {
+	EntryIndex uint64
+	Offset     uint64
+	// End is where the entry's bytes would end, including the length prefix.
+	End      uint64
+	DataSize int64
+}
+
+func (e *DataBeyondEOFError) Error() string {
+	return fmt.Sprintf("index references data beyond EOF at offset %d (entry %d ends at byte %d, data file is %d bytes); the data file was likely truncated",
+		e.Offset, e.EntryIndex, e.End, e.DataSize)
+}
+
+// checkEntryInData returns a *DataBeyondEOFError if an entry at offset with a length prefix declaring length
+// bytes doesn't fit in a data file of dataSize bytes. Pass a length of 0 to check the offset alone, before
+// the length prefix has been read.
+func checkEntryInData(entryIndex, offset, length uint64, dataSize int64) error {
+	end := offset + uint64(len(binary.AppendUvarint(nil, length))) + length
+	if end > uint64(dataSize) {
+		return &DataBeyondEOFError{EntryIndex: entryIndex, Offset: offset, End: end, DataSize: dataSize}
+	}
+	return nil
+}
+
+// dataFileSize stats the data file once so each entry can be bounds-checked against it.
+func dataFileSize(dataFile *os.File) (int64, error) {
+	info, err := dataFile.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat data file: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// OpenStateChangeIndex opens the state-change files in stateChangeDir and resolves format against them.
+func OpenStateChangeIndex(stateChangeDir string, format IndexFormat) (*os.File, *os.File, IndexFormat, error) {
+	indexFile, dataFile, err := OpenStateChangeFiles(stateChangeDir)
+	if err != nil {
+		return nil, nil, IndexFormat{}, err
+	}
+	format, err = ResolveIndexFormat(indexFile, dataFile, format)
+	if err != nil {
+		indexFile.Close()
+		dataFile.Close()
+		return nil, nil, IndexFormat{}, err
+	}
+	return indexFile, dataFile, format, nil
+}
@@ -0,0 +1,182 @@
+package repair
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// IndexRegion is the byte range of the data file that one index entry points at: the uvarint length prefix
+// plus the encoded entry.
+type IndexRegion struct {
+	EntryIndex uint64
+	Offset     uint64
+	Length     uint64
+}
+
+// End returns the offset just past the region.
+func (r IndexRegion) End() uint64 { return r.Offset + r.Length }
+
+// IndexOverlap is a pair of index entries whose data regions share bytes.
+type IndexOverlap struct {
+	First, Second IndexRegion
+}
+
+// ReadIndexRegions reads every offset from the index and the length prefix it points at in the data file.
+// An offset whose length prefix can't be read is logged and skipped, since its extent is unknown.
+func ReadIndexRegions(indexFile io.Reader, dataFile io.ReaderAt, format IndexFormat) ([]IndexRegion, error) {
+	indexReader := NewIndexReader(indexFile, format)
+	prefix := make([]byte, binary.MaxVarintLen64)
+	var regions []IndexRegion
+	for entryIndex := uint64(0); ; entryIndex++ {
+		offset, err := indexReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return regions, nil
+			}
+			return nil, fmt.Errorf("error reading index entry %d: %w", entryIndex, err)
+		}
+
+		n, err := dataFile.ReadAt(prefix, int64(offset))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read length prefix at offset %d: %w", offset, err)
+		}
+		entryLength, prefixLength := binary.Uvarint(prefix[:n])
+		if prefixLength <= 0 {
+			log.Printf("WARNING: Unreadable length prefix for index entry %d at offset %d", entryIndex, offset)
+			continue
+		}
+		regions = append(regions, IndexRegion{
+			EntryIndex: entryIndex,
+			Offset:     offset,
+			Length:     uint64(prefixLength) + entryLength,
+		})
+	}
+}
+
+// FindIndexOverlaps sorts regions by offset and returns every pair where a region starts before an earlier
+// one has ended. Each entry may still decode on its own, so this is the only way to see the aliasing.
+func FindIndexOverlaps(regions []IndexRegion) []IndexOverlap {
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].Offset != regions[j].Offset {
+			return regions[i].Offset < regions[j].Offset
+		}
+		return regions[i].EntryIndex < regions[j].EntryIndex
+	})
+	var overlaps []IndexOverlap
+	if len(regions) == 0 {
+		return overlaps
+	}
+	// Compare against the region reaching furthest so far, so a long region that swallows several later
+	// ones reports each of them.
+	furthest := regions[0]
+	for _, region := range regions[1:] {
+		if region.Offset < furthest.End() {
+			overlaps = append(overlaps, IndexOverlap{First: furthest, Second: region})
+		}
+		if region.End() > furthest.End() {
+			furthest = region
+		}
+	}
+	return overlaps
+}
+
+// CheckIndexOverlaps reads the index in stateChangeDir and returns the overlapping entries along with the
+// number of entries checked. It holds one IndexRegion per index entry in memory.
+func CheckIndexOverlaps(stateChangeDir string, format IndexFormat) ([]IndexOverlap, int, error) {
+	indexFile, dataFile, format, err := OpenStateChangeIndex(stateChangeDir, format)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open state-change files: %w", err)
+	}
+	defer indexFile.Close()
+	defer dataFile.Close()
+
+	regions, err := ReadIndexRegions(indexFile, dataFile, format)
+	if err != nil {
+		return nil, 0, err
+	}
+	return FindIndexOverlaps(regions), len(regions), nil
+}
+
+// EntryCountMismatchError reports an index whose record count differs from the number of entries in the
+// data file, which means one of the files is corrupt or they don't belong together.
+type EntryCountMismatchError struct {
+	IndexRecords uint64
+	DataEntries  uint64
+}
+
+func (e *EntryCountMismatchError) Error() string {
+	return fmt.Sprintf("the index has %d records but the data file holds %d entries; the files are corrupt or don't belong together",
+		e.IndexRecords, e.DataEntries)
+}
+
+// CountDataEntries counts the entries in a data file of dataSize bytes by following their length prefixes
+// from the start, without decoding them. An entry running past the end stops the count with a
+// *DataBeyondEOFError.
+func CountDataEntries(dataFile io.Reader, dataSize int64) (uint64, error) {
+	r := bufio.NewReaderSize(dataFile, 1<<20)
+	var entries, offset uint64
+	for offset < uint64(dataSize) {
+		length, err := binary.ReadUvarint(r)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return entries, &DataBeyondEOFError{EntryIndex: entries, Offset: offset, End: uint64(dataSize) + 1, DataSize: dataSize}
+		}
+		if err != nil {
+			return entries, fmt.Errorf("read length of entry %d at offset %d: %w", entries, offset, err)
+		}
+		if err := checkEntryInData(entries, offset, length, dataSize); err != nil {
+			return entries, err
+		}
+		if _, err := r.Discard(int(length)); err != nil {
+			return entries, fmt.Errorf("skip entry %d at offset %d: %w", entries, offset, err)
+		}
+		offset += uint64(len(binary.AppendUvarint(nil, length))) + length
+		entries++
+	}
+	return entries, nil
+}
+
+// CheckEntryCounts compares the record count of an index of indexSize bytes with the number of entries
+// CountDataEntries finds in the data file, a quick pre-flight before a scan: a mismatch (an
+// *EntryCountMismatchError) shows the file pair is bad without decoding anything. It returns both counts.
+// Only a sequentially addressed index has one record per entry, so a height-addressed one isn't checked.
+func CheckEntryCounts(indexSize int64, dataFile io.Reader, dataSize int64, format IndexFormat) (uint64, uint64, error) {
+	if format.Addressing == IndexAddressingHeight {
+		return 0, 0, nil
+	}
+	if indexSize%int64(format.RecordSize) != 0 {
+		return 0, 0, fmt.Errorf("index of %d bytes isn't a whole number of %d-byte records", indexSize, format.RecordSize)
+	}
+	records := uint64(indexSize / int64(format.RecordSize))
+	entries, err := CountDataEntries(dataFile, dataSize)
+	if err != nil {
+		return records, entries, err
+	}
+	if records != entries {
+		return records, entries, &EntryCountMismatchError{IndexRecords: records, DataEntries: entries}
+	}
+	return records, entries, nil
+}
+
+// CheckStateChangeEntryCounts runs CheckEntryCounts on the state-change files in stateChangeDir.
+func CheckStateChangeEntryCounts(stateChangeDir string, format IndexFormat) (uint64, uint64, error) {
+	indexFile, dataFile, format, err := OpenStateChangeIndex(stateChangeDir, format)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open state-change files: %w", err)
+	}
+	defer indexFile.Close()
+	defer dataFile.Close()
+	indexInfo, err := indexFile.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("stat index file: %w", err)
+	}
+	dataSize, err := dataFileSize(dataFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	return CheckEntryCounts(indexInfo.Size(), dataFile, dataSize, format)
+}
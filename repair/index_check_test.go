@@ -0,0 +1,81 @@
+package repair
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// buildStateChangeFiles lays out entries of the given payload sizes back to back in a data file and returns
+// it with an index pointing at each one.
+func buildStateChangeFiles(sizes []int) (index []byte, data []byte) {
+	for _, size := range sizes {
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+		data = binary.AppendUvarint(data, uint64(size))
+		data = append(data, make([]byte, size)...)
+	}
+	return index, data
+}
+
+func TestFindIndexOverlapsReportsOverlappingEntries(t *testing.T) {
+	index, data := buildStateChangeFiles([]int{10, 20, 30})
+	// Point a fourth entry into the middle of the second entry's bytes.
+	index = binary.LittleEndian.AppendUint64(index, 11+5)
+
+	regions, err := ReadIndexRegions(bytes.NewReader(index), bytes.NewReader(data), DefaultIndexFormat)
+	require.NoError(t, err)
+	require.Len(t, regions, 4)
+	require.Equal(t, IndexRegion{EntryIndex: 1, Offset: 11, Length: 21}, regions[1])
+
+	overlaps := FindIndexOverlaps(regions)
+	require.Len(t, overlaps, 1)
+	require.Equal(t, uint64(1), overlaps[0].First.EntryIndex)
+	require.Equal(t, uint64(3), overlaps[0].Second.EntryIndex)
+}
+
+func TestFindIndexOverlapsAcceptsContiguousEntries(t *testing.T) {
+	index, data := buildStateChangeFiles([]int{10, 200, 0, 30})
+	regions, err := ReadIndexRegions(bytes.NewReader(index), bytes.NewReader(data), DefaultIndexFormat)
+	require.NoError(t, err)
+	require.Empty(t, FindIndexOverlaps(regions))
+}
+
+func TestFindIndexOverlapsReportsEveryEntryInsideALongOne(t *testing.T) {
+	regions := []IndexRegion{
+		{EntryIndex: 0, Offset: 0, Length: 100},
+		{EntryIndex: 1, Offset: 10, Length: 5},
+		{EntryIndex: 2, Offset: 50, Length: 5},
+		{EntryIndex: 3, Offset: 100, Length: 5},
+	}
+	overlaps := FindIndexOverlaps(regions)
+	require.Len(t, overlaps, 2)
+	require.Equal(t, uint64(1), overlaps[0].Second.EntryIndex)
+	require.Equal(t, uint64(2), overlaps[1].Second.EntryIndex)
+	require.Equal(t, uint64(0), overlaps[1].First.EntryIndex)
+}
+
+func TestCheckEntryCountsReportsMissingDataEntries(t *testing.T) {
+	index, data := buildStateChangeFiles([]int{10, 20, 30})
+
+	records, entries, err := CheckEntryCounts(int64(len(index)), bytes.NewReader(data), int64(len(data)), DefaultIndexFormat)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), records)
+	require.Equal(t, uint64(3), entries)
+
+	// The index claims a fourth entry the data file doesn't hold.
+	index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+	records, entries, err = CheckEntryCounts(int64(len(index)), bytes.NewReader(data), int64(len(data)), DefaultIndexFormat)
+	var mismatch *EntryCountMismatchError
+	require.ErrorAs(t, err, &mismatch)
+	require.Equal(t, EntryCountMismatchError{IndexRecords: 4, DataEntries: 3}, *mismatch)
+	require.Equal(t, uint64(4), records)
+	require.Equal(t, uint64(3), entries)
+
+	// A data file cut off inside its last entry is reported as truncated.
+	_, _, err = CheckEntryCounts(int64(len(index)), bytes.NewReader(data[:len(data)-5]), int64(len(data)-5), DefaultIndexFormat)
+	var truncated *DataBeyondEOFError
+	require.ErrorAs(t, err, &truncated)
+	require.Equal(t, uint64(2), truncated.EntryIndex)
+}
@@ -0,0 +1,106 @@
+package repair
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// dumpIndexFormats are the two index layouts producers are known to write, shown side by side by DumpIndex.
+var dumpIndexFormats = []IndexFormat{
+	DefaultIndexFormat,
+	{RecordSize: 24, ByteOrder: binary.BigEndian},
+}
+
+// DumpIndex writes the first and last n records of the index under both the 8-byte little-endian and the
+// 24-byte big-endian layout, side by side: each record's raw bytes, the offset it holds under that layout,
+// and whether a decodable entry starts at that offset in the data file. Only the layout the files were
+// actually written with points at entries throughout, which is what settles STATE_CHANGE_INDEX_RECORD_SIZE
+// and STATE_CHANGE_INDEX_ENDIANNESS when detection can't.
+func DumpIndex(w io.Writer, indexFile io.ReaderAt, indexSize int64, dataFile io.ReaderAt, dataSize int64, n uint64) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Index dump: index %d bytes, data %d bytes\n", indexSize, dataSize)
+	records := make([]uint64, len(dumpIndexFormats))
+	headers := make([]string, len(dumpIndexFormats))
+	for i, format := range dumpIndexFormats {
+		records[i] = uint64(indexSize / int64(format.RecordSize))
+		headers[i] = fmt.Sprintf("%d-byte %s (%d records", format.RecordSize, byteOrderName(format.ByteOrder), records[i])
+		if rest := indexSize % int64(format.RecordSize); rest != 0 {
+			headers[i] += fmt.Sprintf(", %d trailing bytes", rest)
+		}
+		headers[i] += ")"
+	}
+
+	var rows [][]string
+	rows = append(rows, headers)
+	for k := uint64(0); k < n; k++ {
+		row := make([]string, len(dumpIndexFormats))
+		for i, format := range dumpIndexFormats {
+			row[i] = dumpIndexRecord(indexFile, dataFile, dataSize, format, k, records[i])
+		}
+		rows = append(rows, row)
+	}
+	// The last n records, skipping any a short index already showed among the first n.
+	rows = append(rows, nil)
+	for k := n; k > 0; k-- {
+		row := make([]string, len(dumpIndexFormats))
+		shown := false
+		for i, format := range dumpIndexFormats {
+			if records[i] < k || records[i]-k < n {
+				row[i] = "-"
+				continue
+			}
+			row[i] = dumpIndexRecord(indexFile, dataFile, dataSize, format, records[i]-k, records[i])
+			shown = true
+		}
+		if shown {
+			rows = append(rows, row)
+		}
+	}
+
+	width := 0
+	for _, row := range rows {
+		if len(row) > 0 && len(row[0]) > width {
+			width = len(row[0])
+		}
+	}
+	fmt.Fprintf(bw, "## First %d records\n", n)
+	for _, row := range rows {
+		if row == nil {
+			fmt.Fprintf(bw, "## Last %d records\n", n)
+			continue
+		}
+		fmt.Fprintf(bw, "%-*s | %s\n", width, row[0], row[1])
+	}
+	return bw.Flush()
+}
+
+// dumpIndexRecord describes record i of an index of records records read with format.
+func dumpIndexRecord(indexFile, dataFile io.ReaderAt, dataSize int64, format IndexFormat, i, records uint64) string {
+	if i >= records {
+		return "-"
+	}
+	record := make([]byte, format.RecordSize)
+	if _, err := indexFile.ReadAt(record, int64(i)*int64(format.RecordSize)); err != nil {
+		return fmt.Sprintf("#%d unreadable: %v", i, err)
+	}
+	offset := format.Offset(record)
+	entry, err := readEntryAt(dataFile, dataSize, i, offset)
+	var beyondEOF *DataBeyondEOFError
+	switch {
+	case errors.As(err, &beyondEOF):
+		return fmt.Sprintf("#%d %x -> %d: beyond EOF", i, record, offset)
+	case err != nil:
+		return fmt.Sprintf("#%d %x -> %d: no valid entry", i, record, offset)
+	}
+	return fmt.Sprintf("#%d %x -> %d: valid entry (height %d)", i, record, offset, entry.BlockHeight)
+}
+
+func byteOrderName(order binary.ByteOrder) string {
+	if order == binary.BigEndian {
+		return "big-endian"
+	}
+	return "little-endian"
+}
@@ -0,0 +1,207 @@
+package repair
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeIndex writes offsets as index records in format. Wider records carry the entry's length and a block
+// height after the offset, like the producers that write them.
+func encodeIndex(format IndexFormat, offsets []uint64) []byte {
+	var index []byte
+	for i, offset := range offsets {
+		record := make([]byte, format.RecordSize)
+		format.ByteOrder.PutUint64(record, offset)
+		if format.RecordSize >= 24 {
+			format.ByteOrder.PutUint64(record[8:], 7)
+			format.ByteOrder.PutUint64(record[16:], uint64(1000+i))
+		}
+		index = append(index, record...)
+	}
+	return index
+}
+
+func TestIndexReaderRoundTripsRecordSizes(t *testing.T) {
+	offsets := []uint64{0, 11, 32, 1 << 40}
+	for _, format := range []IndexFormat{
+		DefaultIndexFormat,
+		{RecordSize: 24, ByteOrder: binary.LittleEndian},
+		{RecordSize: 8, ByteOrder: binary.BigEndian},
+		{RecordSize: 24, ByteOrder: binary.BigEndian},
+	} {
+		index := encodeIndex(format, offsets)
+		reader := NewIndexReader(bytes.NewReader(index), format)
+		var got []uint64
+		for {
+			offset, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			got = append(got, offset)
+		}
+		require.Equal(t, offsets, got, "record size %d", format.RecordSize)
+
+		offset, err := format.OffsetAt(bytes.NewReader(index), 2)
+		require.NoError(t, err)
+		require.Equal(t, uint64(32), offset)
+	}
+}
+
+func TestReverseIndexReaderReadsForwardEntriesBackwards(t *testing.T) {
+	format := IndexFormat{RecordSize: 24, ByteOrder: binary.LittleEndian}
+	index := encodeIndex(format, []uint64{0, 10, 25, 40})
+
+	var forward []uint64
+	ir := NewIndexReader(bytes.NewReader(index), format)
+	for {
+		offset, err := ir.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		forward = append(forward, offset)
+	}
+
+	var reverse, entryIndexes []uint64
+	rr := NewReverseIndexReader(bytes.NewReader(index), int64(len(index)), format)
+	for {
+		offset, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		reverse = append(reverse, offset)
+		entryIndexes = append(entryIndexes, rr.EntryIndex())
+	}
+	require.Equal(t, []uint64{40, 25, 10, 0}, reverse)
+	require.Equal(t, []uint64{3, 2, 1, 0}, entryIndexes)
+	require.ElementsMatch(t, forward, reverse)
+
+	_, err := NewReverseIndexReader(bytes.NewReader(index[:len(index)-1]), int64(len(index)-1), format).Next()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestIndexReaderRejectsPartialRecord(t *testing.T) {
+	format := IndexFormat{RecordSize: 24, ByteOrder: binary.LittleEndian}
+	index := encodeIndex(format, []uint64{0, 11})
+	reader := NewIndexReader(bytes.NewReader(index[:40]), format)
+	_, err := reader.Next()
+	require.NoError(t, err)
+	_, err = reader.Next()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadIndexRegionsWithWideRecords(t *testing.T) {
+	narrow, data := buildStateChangeFiles([]int{10, 20, 30})
+	format := IndexFormat{RecordSize: 24, ByteOrder: binary.LittleEndian}
+	var offsets []uint64
+	reader := NewIndexReader(bytes.NewReader(narrow), DefaultIndexFormat)
+	for {
+		offset, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		offsets = append(offsets, offset)
+	}
+
+	regions, err := ReadIndexRegions(bytes.NewReader(encodeIndex(format, offsets)), bytes.NewReader(data), format)
+	require.NoError(t, err)
+	require.Len(t, regions, 3)
+	require.Equal(t, IndexRegion{EntryIndex: 1, Offset: 11, Length: 21}, regions[1])
+}
+
+func TestDetectIndexRecordSize(t *testing.T) {
+	offsets := []uint64{0, 11, 32, 63}
+	dataSize := int64(100)
+	for _, size := range []int{8, 24} {
+		format := IndexFormat{RecordSize: size, ByteOrder: binary.LittleEndian}
+		index := encodeIndex(format, offsets)
+		detected, err := DetectIndexRecordSize(bytes.NewReader(index), int64(len(index)), dataSize, binary.LittleEndian)
+		require.NoError(t, err)
+		require.Equal(t, size, detected)
+	}
+
+	// Offsets beyond the data file fit neither size.
+	index := encodeIndex(DefaultIndexFormat, []uint64{0, 11, 500})
+	_, err := DetectIndexRecordSize(bytes.NewReader(index), int64(len(index)), dataSize, binary.LittleEndian)
+	require.Error(t, err)
+}
+
+func TestOpenStateChangeIndexDetectsRecordSize(t *testing.T) {
+	narrow, data := buildStateChangeFiles([]int{10, 20, 30})
+	offsets := []uint64{0, 11, 32}
+	require.Equal(t, encodeIndex(DefaultIndexFormat, offsets), narrow)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, lib.StateChangeFileName), data, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, lib.StateChangeIndexFileName),
+		encodeIndex(IndexFormat{RecordSize: 24, ByteOrder: binary.LittleEndian}, offsets), 0o644))
+
+	indexFile, dataFile, format, err := OpenStateChangeIndex(dir, IndexFormat{})
+	require.NoError(t, err)
+	defer indexFile.Close()
+	defer dataFile.Close()
+	require.Equal(t, 24, format.RecordSize)
+	require.Equal(t, binary.ByteOrder(binary.LittleEndian), format.ByteOrder)
+
+	// An explicit record size is used as given.
+	indexFile2, dataFile2, format, err := OpenStateChangeIndex(dir, DefaultIndexFormat)
+	require.NoError(t, err)
+	indexFile2.Close()
+	dataFile2.Close()
+	require.Equal(t, 8, format.RecordSize)
+}
+
+func TestParseIndexFormat(t *testing.T) {
+	format, err := ParseIndexFormat(0, "", "")
+	require.NoError(t, err)
+	require.Equal(t, IndexFormat{ByteOrder: binary.LittleEndian, Addressing: IndexAddressingSequential}, format)
+
+	format, err = ParseIndexFormat(24, "BIG", "Height")
+	require.NoError(t, err)
+	require.Equal(t, IndexFormat{RecordSize: 24, ByteOrder: binary.BigEndian, Addressing: IndexAddressingHeight}, format)
+
+	_, err = ParseIndexFormat(16, "little", "")
+	require.Error(t, err)
+	_, err = ParseIndexFormat(8, "middle", "")
+	require.Error(t, err)
+	_, err = ParseIndexFormat(8, "little", "offset")
+	require.Error(t, err)
+}
+
+func TestDumpIndexShowsBothInterpretations(t *testing.T) {
+	fixture, err := selfTestFixture()
+	require.NoError(t, err)
+	dir := writeStateChangeDir(t, fixture)
+	narrow, err := os.ReadFile(filepath.Join(dir, lib.StateChangeIndexFileName))
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(dir, lib.StateChangeFileName))
+	require.NoError(t, err)
+	var offsets []uint64
+	for i := 0; i < len(narrow); i += 8 {
+		offsets = append(offsets, binary.LittleEndian.Uint64(narrow[i:]))
+	}
+	wideFormat := IndexFormat{RecordSize: 24, ByteOrder: binary.BigEndian}
+	index := encodeIndex(wideFormat, offsets)
+
+	var out bytes.Buffer
+	require.NoError(t, DumpIndex(&out, bytes.NewReader(index), int64(len(index)), bytes.NewReader(data), int64(len(data)), 2))
+	dump := out.String()
+
+	require.Contains(t, dump, "8-byte little-endian (12 records)")
+	require.Contains(t, dump, "24-byte big-endian (4 records)")
+	// Record 1 under the 8-byte scheme is the length field of the first 24-byte record, read little-endian.
+	require.Regexp(t, fmt.Sprintf(`#1 0000000000000007 -> %d: beyond EOF +\| #1 %x -> %d: valid entry \(height 2\)`,
+		uint64(7)<<56, index[24:48], offsets[1]), dump)
+	require.Contains(t, dump, fmt.Sprintf("| #3 %x -> %d: valid entry (height 5)", index[72:96], offsets[3]))
+}
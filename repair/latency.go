@@ -0,0 +1,101 @@
+package repair
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// ErrNodeTooSlow is returned by a LatencyBreaker once the rolling p99 fetch latency exceeds its threshold.
+var ErrNodeTooSlow = errors.New("node too slow")
+
+// DefaultLatencyWindow is the number of recent fetches a LatencyBreaker computes its p99 over.
+const DefaultLatencyWindow = 200
+
+// LatencyBreaker wraps a BlockSource and trips once the p99 latency of the last Window fetches exceeds
+// Threshold. A slow but healthy node keeps its p99 under the threshold; once it's crossed every further
+// fetch fails fast with ErrNodeTooSlow so the run aborts instead of crawling.
+type LatencyBreaker struct {
+	Source    BlockSource
+	Clock     Clock
+	Threshold time.Duration
+	Window    int
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	tripped error
+}
+
+// NewLatencyBreaker returns a LatencyBreaker over source using the wall clock and the default window.
+func NewLatencyBreaker(source BlockSource, threshold time.Duration) *LatencyBreaker {
+	return &LatencyBreaker{
+		Source:    source,
+		Clock:     SystemClock,
+		Threshold: threshold,
+		Window:    DefaultLatencyWindow,
+	}
+}
+
+// FetchBlock fetches from the wrapped source and records how long it took.
+func (b *LatencyBreaker) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	b.mu.Lock()
+	tripped := b.tripped
+	b.mu.Unlock()
+	if tripped != nil {
+		return nil, nil, tripped
+	}
+
+	start := b.Clock.Now()
+	block, blockHash, err := b.Source.FetchBlock(height)
+	if tripErr := b.record(b.Clock.Now().Sub(start)); tripErr != nil {
+		return nil, nil, tripErr
+	}
+	return block, blockHash, err
+}
+
+// record adds a latency sample and trips the breaker if the window is full and its p99 is over the threshold.
+func (b *LatencyBreaker) record(latency time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tripped != nil {
+		return b.tripped
+	}
+	if len(b.samples) < b.Window {
+		b.samples = append(b.samples, latency)
+	} else {
+		b.samples[b.next] = latency
+		b.next = (b.next + 1) % b.Window
+	}
+	if len(b.samples) < b.Window {
+		return nil
+	}
+
+	sorted := make([]time.Duration, len(b.samples))
+	copy(sorted, b.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p99 := latencyPercentile(sorted, 0.99)
+	if p99 <= b.Threshold {
+		return nil
+	}
+	distribution := fmt.Sprintf("p50=%s p90=%s p99=%s max=%s over last %d fetches",
+		latencyPercentile(sorted, 0.50), latencyPercentile(sorted, 0.90), p99, sorted[len(sorted)-1], len(sorted))
+	log.Printf("ERROR: Fetch latency p99 %s exceeds %s, aborting: %s", p99, b.Threshold, distribution)
+	b.tripped = fmt.Errorf("%w: p99 fetch latency %s exceeds %s (%s)", ErrNodeTooSlow, p99, b.Threshold, distribution)
+	return b.tripped
+}
+
+// latencyPercentile returns the nearest-rank percentile p of the ascending samples.
+func latencyPercentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,76 @@
+package repair
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+)
+
+// slowingSource is a fake node whose response time grows by step with every fetch.
+type slowingSource struct {
+	*fakeSource
+	clock   *fakeClock
+	step    time.Duration
+	latency time.Duration
+}
+
+func (s *slowingSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	s.latency += s.step
+	s.clock.Sleep(s.latency)
+	return s.fakeSource.FetchBlock(height)
+}
+
+func TestLatencyBreakerTripsWhenP99CrossesThreshold(t *testing.T) {
+	clock := &fakeClock{}
+	source := &slowingSource{fakeSource: newFakeSource(), clock: clock, step: 10 * time.Millisecond}
+	breaker := NewLatencyBreaker(source, 500*time.Millisecond)
+	breaker.Clock = clock
+	breaker.Window = 20
+
+	var tripErr error
+	fetches := 0
+	for h := uint64(1); h <= 100 && tripErr == nil; h++ {
+		fetches++
+		_, _, tripErr = breaker.FetchBlock(h)
+	}
+	require.ErrorIs(t, tripErr, ErrNodeTooSlow)
+	require.Contains(t, tripErr.Error(), "p50=")
+	// The 51st fetch is the first to take longer than 500ms, and with a window of 20 the p99 is the max.
+	require.Equal(t, 51, fetches)
+
+	// Once tripped, fetches fail without reaching the node.
+	_, _, err := breaker.FetchBlock(101)
+	require.ErrorIs(t, err, ErrNodeTooSlow)
+	require.Zero(t, source.fetches[101])
+}
+
+func TestLatencyBreakerIgnoresSlowButSteadyNode(t *testing.T) {
+	clock := &fakeClock{}
+	source := &slowingSource{fakeSource: newFakeSource(), clock: clock, latency: 400 * time.Millisecond}
+	breaker := NewLatencyBreaker(source, 500*time.Millisecond)
+	breaker.Clock = clock
+	breaker.Window = 20
+
+	for h := uint64(1); h <= 100; h++ {
+		_, _, err := breaker.FetchBlock(h)
+		require.NoError(t, err)
+	}
+}
+
+func TestRunAbortsOnSlowNode(t *testing.T) {
+	clock := &fakeClock{}
+	source := &slowingSource{fakeSource: newFakeSource(), clock: clock, step: 100 * time.Millisecond}
+	breaker := NewLatencyBreaker(source, time.Second)
+	breaker.Clock = clock
+	breaker.Window = 5
+
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, breaker)
+	err := r.Run(context.Background(), []Gap{{Start: 1, End: 50}})
+
+	require.ErrorIs(t, err, ErrNodeTooSlow)
+	require.Empty(t, handler.committedHeights())
+}
@@ -0,0 +1,35 @@
+package repair
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// StartPprofServer serves the net/http/pprof endpoints under /debug/pprof/ on addr (PPROF_ADDR) in the
+// background. It returns nil without listening when addr is empty. The caller should Close the server.
+func StartPprofServer(addr string) (*http.Server, net.Addr, error) {
+	if addr == "" {
+		return nil, nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen for pprof on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("WARNING: pprof server stopped: %v", err)
+		}
+	}()
+	return server, listener.Addr(), nil
+}
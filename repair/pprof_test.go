@@ -0,0 +1,30 @@
+package repair
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPprofServerServesProfilesWhenEnabled(t *testing.T) {
+	server, addr, err := StartPprofServer("127.0.0.1:0")
+	require.NoError(t, err)
+	require.NotNil(t, server)
+	defer server.Close()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/goroutine?debug=1"} {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, path))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
+
+func TestPprofServerDisabledByDefault(t *testing.T) {
+	server, addr, err := StartPprofServer("")
+	require.NoError(t, err)
+	require.Nil(t, server)
+	require.Nil(t, addr)
+}
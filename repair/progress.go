@@ -0,0 +1,57 @@
+package repair
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ProgressAggregator totals the heights committed across every gap of a run, however many are processed
+// concurrently, and logs one overall progress line at most every Interval. Its Notify method has the
+// OnCommit signature and is safe to call from multiple goroutines.
+type ProgressAggregator struct {
+	// Total is the number of heights the run covers.
+	Total    uint64
+	Interval time.Duration
+	Clock    Clock
+
+	mu        sync.Mutex
+	committed uint64
+	commits   int
+	lastLog   time.Time
+}
+
+// NewProgressAggregator returns a ProgressAggregator for gaps using the wall clock.
+func NewProgressAggregator(gaps []Gap, interval time.Duration) *ProgressAggregator {
+	var total uint64
+	for _, g := range gaps {
+		total += g.End - g.Start + 1
+	}
+	return &ProgressAggregator{Total: total, Interval: interval, Clock: SystemClock}
+}
+
+// Notify adds the heights of a commit to the total and logs the overall progress if Interval has passed
+// since the last line.
+func (p *ProgressAggregator) Notify(committed Gap) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.committed += committed.End - committed.Start + 1
+	p.commits++
+	now := p.Clock.Now()
+	if !p.lastLog.IsZero() && now.Sub(p.lastLog) < p.Interval {
+		return
+	}
+	p.lastLog = now
+	percent := 100.0
+	if p.Total > 0 {
+		percent = float64(p.committed) / float64(p.Total) * 100
+	}
+	log.Printf("Overall progress: %d/%d heights committed (%.2f%%) in %d commits", p.committed, p.Total, percent, p.commits)
+}
+
+// Committed returns the number of heights committed so far.
+func (p *ProgressAggregator) Committed() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.committed
+}
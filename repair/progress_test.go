@@ -0,0 +1,60 @@
+package repair
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lockedClock is a fakeClock safe for concurrent use.
+type lockedClock struct {
+	mu    sync.Mutex
+	clock fakeClock
+}
+
+func (c *lockedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clock.Now()
+}
+
+func (c *lockedClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock.Sleep(d)
+}
+
+func TestProgressAggregatorSumsConcurrentGaps(t *testing.T) {
+	gaps := []Gap{{Start: 0, End: 999}, {Start: 5000, End: 5499}, {Start: 9000, End: 9249}, {Start: 20000, End: 20099}}
+	progress := NewProgressAggregator(gaps, time.Minute)
+	progress.Clock = &lockedClock{}
+	require.Equal(t, uint64(1850), progress.Total)
+
+	// Each simulated gap commits its heights in chunks of 10 from its own goroutine.
+	perGap := make([]uint64, len(gaps))
+	var wg sync.WaitGroup
+	for i, g := range gaps {
+		wg.Add(1)
+		go func(i int, g Gap) {
+			defer wg.Done()
+			for start := g.Start; start <= g.End; start += 10 {
+				chunk := Gap{Start: start, End: start + 9}
+				if chunk.End > g.End {
+					chunk.End = g.End
+				}
+				progress.Notify(chunk)
+				perGap[i] += chunk.End - chunk.Start + 1
+			}
+		}(i, g)
+	}
+	wg.Wait()
+
+	var sum uint64
+	for _, n := range perGap {
+		sum += n
+	}
+	require.Equal(t, sum, progress.Committed())
+	require.Equal(t, progress.Total, progress.Committed())
+}
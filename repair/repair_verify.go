@@ -0,0 +1,165 @@
+package repair
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+)
+
+// committedBlock is a block row read back for verification, with its top-level transaction count.
+type committedBlock struct {
+	BlockHash string
+	TxnCount  int
+}
+
+// VerifyCommittedRange compares every height in committed with the node: the DB must hold exactly one block
+// row there, with the node's hash and as many top-level transactions as the node's block.
+func VerifyCommittedRange(ctx context.Context, db Querier, source BlockSource, committed Gap) ([]SampleMismatch, error) {
+	// Inner atomic transactions are stored with a NULL index_in_block, so only top-level ones are counted.
+	query := fmt.Sprintf(`SELECT b.height, b.block_hash,
+  (SELECT COUNT(*) FROM "transaction" t WHERE t.block_hash = b.block_hash AND t.index_in_block IS NOT NULL)
+FROM block b WHERE b.height BETWEEN %d AND %d ORDER BY b.height`, committed.Start, committed.End)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("read back blocks %d -> %d: %w", committed.Start, committed.End, err)
+	}
+	stored := make(map[uint64][]committedBlock)
+	for rows.Next() {
+		var height uint64
+		var block committedBlock
+		if err := rows.Scan(&height, &block.BlockHash, &block.TxnCount); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("read back blocks %d -> %d: %w", committed.Start, committed.End, err)
+		}
+		stored[height] = append(stored[height], block)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read back blocks %d -> %d: %w", committed.Start, committed.End, err)
+	}
+
+	var mismatches []SampleMismatch
+	for h := committed.Start; h <= committed.End; h++ {
+		block, blockHash, err := source.FetchBlock(h)
+		if err != nil {
+			return nil, fmt.Errorf("fetch block %d from node: %w", h, err)
+		}
+		if reason := committedBlockMismatch(stored[h], hex.EncodeToString(blockHash[:]), len(block.Txns)); reason != "" {
+			mismatches = append(mismatches, SampleMismatch{Height: h, Reason: reason})
+		}
+	}
+	return mismatches, nil
+}
+
+// committedBlockMismatch returns why the rows stored at a height don't match the node's block, or "".
+func committedBlockMismatch(stored []committedBlock, nodeHash string, nodeTxns int) string {
+	switch {
+	case len(stored) == 0:
+		return "missing from DB"
+	case len(stored) > 1:
+		return fmt.Sprintf("%d block rows at this height", len(stored))
+	case stored[0].BlockHash != nodeHash:
+		return fmt.Sprintf("hash mismatch: db=%s node=%s", stored[0].BlockHash, nodeHash)
+	case stored[0].TxnCount != nodeTxns:
+		return fmt.Sprintf("transaction count mismatch: db=%d node=%d", stored[0].TxnCount, nodeTxns)
+	}
+	return ""
+}
+
+// VerifiedRange is one committed range of a repair-and-verify run and what verifying it found.
+type VerifiedRange struct {
+	Range      Gap
+	Verified   bool
+	Mismatches []SampleMismatch
+	// Error is why the range couldn't be verified, if it couldn't.
+	Error string
+}
+
+// RepairVerifyReport is the combined outcome of a repair-and-verify run.
+type RepairVerifyReport struct {
+	Ranges []VerifiedRange
+	// RunError is why the repair itself didn't finish, if it didn't.
+	RunError string
+}
+
+// Passed reports whether the repair finished and every committed range verified without mismatches.
+func (r *RepairVerifyReport) Passed() bool {
+	if r.RunError != "" {
+		return false
+	}
+	for _, vr := range r.Ranges {
+		if !vr.Verified || len(vr.Mismatches) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CommitVerifier verifies each range the repair commits against the node as soon as it is committed. Set
+// Verify as the Repairer's OnCommit.
+type CommitVerifier struct {
+	DB     Querier
+	Source BlockSource
+	Report RepairVerifyReport
+}
+
+// Verify verifies committed and records the result in the report.
+func (v *CommitVerifier) Verify(committed Gap) {
+	vr := VerifiedRange{Range: committed}
+	mismatches, err := VerifyCommittedRange(context.Background(), v.DB, v.Source, committed)
+	if err != nil {
+		log.Printf("WARNING: Could not verify committed heights %d -> %d: %v", committed.Start, committed.End, err)
+		vr.Error = err.Error()
+	} else {
+		vr.Verified = true
+		vr.Mismatches = mismatches
+		for _, m := range mismatches {
+			log.Printf("MISMATCH at height %d: %s", m.Height, m.Reason)
+		}
+	}
+	v.Report.Ranges = append(v.Report.Ranges, vr)
+}
+
+// Finish records the repair's outcome; runErr is what Repairer.Run returned.
+func (v *CommitVerifier) Finish(runErr error) {
+	if runErr != nil {
+		v.Report.RunError = runErr.Error()
+	}
+}
+
+// WriteRepairVerifyReport writes one line per committed range with its verification result, the
+// mismatches found, and a final PASS or FAIL line.
+func WriteRepairVerifyReport(w io.Writer, report *RepairVerifyReport) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Repair and verify report\n")
+	var heights uint64
+	mismatches := 0
+	for _, vr := range report.Ranges {
+		heights += vr.Range.End - vr.Range.Start + 1
+		mismatches += len(vr.Mismatches)
+		switch {
+		case !vr.Verified:
+			fmt.Fprintf(bw, "  heights %d -> %d: repaired, NOT verified (%s)\n", vr.Range.Start, vr.Range.End, vr.Error)
+		case len(vr.Mismatches) > 0:
+			fmt.Fprintf(bw, "  heights %d -> %d: repaired, verified with %d mismatch(es)\n", vr.Range.Start, vr.Range.End, len(vr.Mismatches))
+			for _, m := range vr.Mismatches {
+				fmt.Fprintf(bw, "    height %d: %s\n", m.Height, m.Reason)
+			}
+		default:
+			fmt.Fprintf(bw, "  heights %d -> %d: repaired, verified\n", vr.Range.Start, vr.Range.End)
+		}
+	}
+	if report.RunError != "" {
+		fmt.Fprintf(bw, "Repair did not finish: %s\n", report.RunError)
+	}
+	result := "PASS"
+	if !report.Passed() {
+		result = "FAIL"
+	}
+	fmt.Fprintf(bw, "Result: %s (%d height(s) in %d committed range(s), %d mismatch(es))\n", result, heights, len(report.Ranges), mismatches)
+	return bw.Flush()
+}
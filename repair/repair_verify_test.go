@@ -0,0 +1,88 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+)
+
+// committedBlocksFixture answers the read-back query with a block row for each height the handler has
+// committed, hashed the way fakeSource hashes them unless wrongHash holds the height.
+func committedBlocksFixture(handler *fakeHandler, wrongHash map[uint64]bool) *queryFixture {
+	fixture := &queryFixture{columns: []string{"height", "block_hash", "count"}}
+	fixture.respond = func(query string) [][]driver.Value {
+		var start, end uint64
+		if _, err := fmt.Sscanf(query[strings.Index(query, "BETWEEN"):], "BETWEEN %d AND %d", &start, &end); err != nil {
+			panic(err)
+		}
+		var rows [][]driver.Value
+		for _, h := range handler.committedHeights() {
+			if h < start || h > end {
+				continue
+			}
+			var blockHash lib.BlockHash
+			binary.BigEndian.PutUint64(blockHash[lib.HashSizeBytes-8:], h)
+			if wrongHash[h] {
+				blockHash[0] = 0xff
+			}
+			rows = append(rows, []driver.Value{int64(h), hex.EncodeToString(blockHash[:]), int64(0)})
+		}
+		return rows
+	}
+	return fixture
+}
+
+func TestRepairAndVerifyReportsEachCommittedRange(t *testing.T) {
+	handler := newFakeHandler()
+	source := newFakeSource()
+	r := newTestRepairer(handler, source)
+	r.Options.SequentialThreshold = 0
+	r.Options.CommitBatchSize = 4
+	verifier := &CommitVerifier{DB: openFixtureDB(t, committedBlocksFixture(handler, nil)), Source: source}
+	r.OnCommit = verifier.Verify
+
+	err := r.Run(context.Background(), []Gap{{Start: 1, End: 8}})
+	verifier.Finish(err)
+
+	require.NoError(t, err)
+	require.Equal(t, []VerifiedRange{
+		{Range: Gap{Start: 1, End: 4}, Verified: true},
+		{Range: Gap{Start: 5, End: 8}, Verified: true},
+	}, verifier.Report.Ranges)
+	require.True(t, verifier.Report.Passed())
+	var report strings.Builder
+	require.NoError(t, WriteRepairVerifyReport(&report, &verifier.Report))
+	require.Contains(t, report.String(), "heights 1 -> 4: repaired, verified\n")
+	require.Contains(t, report.String(), "Result: PASS (8 height(s) in 2 committed range(s), 0 mismatch(es))")
+}
+
+func TestRepairAndVerifySurfacesVerificationFailure(t *testing.T) {
+	handler := newFakeHandler()
+	source := newFakeSource()
+	r := newTestRepairer(handler, source)
+	// Height 6 is stored under the wrong hash.
+	verifier := &CommitVerifier{DB: openFixtureDB(t, committedBlocksFixture(handler, map[uint64]bool{6: true})), Source: source}
+	r.OnCommit = verifier.Verify
+
+	err := r.Run(context.Background(), []Gap{{Start: 5, End: 7}})
+	verifier.Finish(err)
+
+	// The repair itself succeeded; only the verification fails the combined result.
+	require.NoError(t, err)
+	require.False(t, verifier.Report.Passed())
+	require.Len(t, verifier.Report.Ranges, 1)
+	require.Len(t, verifier.Report.Ranges[0].Mismatches, 1)
+	require.Equal(t, uint64(6), verifier.Report.Ranges[0].Mismatches[0].Height)
+	require.Contains(t, verifier.Report.Ranges[0].Mismatches[0].Reason, "hash mismatch")
+	var report strings.Builder
+	require.NoError(t, WriteRepairVerifyReport(&report, &verifier.Report))
+	require.Contains(t, report.String(), "heights 5 -> 7: repaired, verified with 1 mismatch(es)")
+	require.Contains(t, report.String(), "Result: FAIL")
+}
@@ -0,0 +1,1055 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/config"
+)
+
+// Options controls how gaps are processed.
+type Options struct {
+	// Workers is the number of concurrent block fetches for parallel gap processing.
+	Workers int
+	// DBWorkers is how many DB connections the repair works through at once: the size of the connection pool
+	// and the concurrency of DB-bound stages such as the timestamp fix's updates. Zero uses Workers. A parallel
+	// gap still writes its blocks through one transaction in height order.
+	DBWorkers int
+	// UseStateChanges processes gaps from the state-change files in StateChangeDir instead of the node API.
+	UseStateChanges bool
+	StateChangeDir  string
+	// IndexFormat is the layout of the state-change index. A zero RecordSize detects it from the files.
+	IndexFormat IndexFormat
+	// SkipBlocks skips block entries when processing from state-change files (blocks already in the DB).
+	SkipBlocks bool
+	// DeleteOpsOnly replays only Delete entries when processing from state-change files.
+	DeleteOpsOnly bool
+	// UtxoOpsOnly replays only utxo-operation entries from state-change files, backfilling the tables derived
+	// from them (balances, stake rewards) for blocks that were repaired from the API, which returns none.
+	UtxoOpsOnly bool
+	// TransactionsOnly replays only block entries from state-change files. It goes with
+	// entries.SetTransactionsOnly, which makes the handler rebuild the blocks' transaction rows and leave the
+	// block rows alone.
+	TransactionsOnly bool
+	// ReverseIndexOrder reads the state-change index from the last entry back, so the most recent entries are
+	// repaired first. Entries are then applied in the opposite order they were written, so it only suits
+	// backfilling missing rows, not reconstructing state from a sequence such as an insert then a delete.
+	ReverseIndexOrder bool
+	// DeferFailed queues blocks that fail to process and retries them after the rest of the gap.
+	DeferFailed bool
+	// StopAtBlockNotFound treats the first height the source reports ErrBlockNotFound for as the end of the
+	// node's data: the heights below it are committed and the run stops cleanly, as on a pruned node.
+	StopAtBlockNotFound bool
+	// SequentialThreshold is the largest gap processed with sequential API calls; larger gaps run in parallel.
+	SequentialThreshold uint64
+	// QueueDepthMultiplier sizes the job and result queues of a parallel fetch at this many entries per
+	// worker. Deeper queues keep workers busy through latency spikes at the cost of holding more fetched
+	// blocks in memory. Zero uses DefaultQueueDepthMultiplier.
+	QueueDepthMultiplier int
+	// CommitBatchSize is how many blocks (or state-change entries) are written per transaction.
+	CommitBatchSize uint64
+	// CommitRampStart, if non-zero, is the batch size of a run's first commit. Each successful commit doubles
+	// it until it reaches CommitBatchSize, so a long run shows progress early instead of after one full batch.
+	CommitRampStart uint64
+	// CommitTxnRows, if non-zero, also commits once the blocks written since the last commit hold this many
+	// transactions, since one block entry can expand into tens of thousands of transaction rows.
+	CommitTxnRows uint64
+	// BeginRetries is how many times a failed InitiateTransaction is retried before giving up, so a brief DB
+	// outage (failover, restart) doesn't end the run.
+	BeginRetries int
+	// BeginRetryBackoff is the wait before the first retry; it doubles on each further attempt.
+	BeginRetryBackoff time.Duration
+	// InterGapDelay, if non-zero, is slept between processed gaps so a shared node gets a pause.
+	InterGapDelay time.Duration
+	// ReorderBufferSize is how far the workers of a parallel gap may fetch ahead of the next height to write.
+	// Fetched blocks wait in a buffer until every lower height has been written, and the buffer never holds
+	// more than this many blocks. Zero uses DefaultReorderBufferSize.
+	ReorderBufferSize int
+	// CommitInterval, if non-zero, also commits once this long has passed since the last commit, bounding
+	// how long a transaction stays open when blocks are large.
+	CommitInterval time.Duration
+	// PerGapTransaction processes each gap, all of its missing ranges included, in one transaction that is
+	// committed only once the whole gap has succeeded. The batch commit settings are ignored, and any failure,
+	// including a block or entry that would otherwise be logged and skipped, or a stop, rolls the whole gap
+	// back. The transaction holds its locks and the DB keeps its writes pending until the gap ends, so it suits
+	// gaps of modest size.
+	PerGapTransaction bool
+	// MaxDecodeErrorRatio, if non-zero, is the largest fraction of a gap's state-change entries that may fail
+	// to read or decode before the gap is flagged as likely unrepairable from the files. The entries that did
+	// decode are still applied, but the gap isn't reported as repaired.
+	MaxDecodeErrorRatio float64
+	// UnsupportedEncoderPolicy is what happens to state-change entries the handler has no handling for:
+	// UnsupportedEncoderSkip (the default when empty), UnsupportedEncoderFail or UnsupportedEncoderDeadLetter.
+	UnsupportedEncoderPolicy string
+	// MinBlockTxns and MaxBlockTxns, if set, leave out every height whose block has fewer or more transactions,
+	// e.g. to process only the giant blocks of a range or to bisect around them. A filtered height is left out
+	// whole, state-change entries and all, and its gap is marked GapStatusFiltered instead of repaired. A zero
+	// MaxBlockTxns has no upper bound.
+	MinBlockTxns int
+	MaxBlockTxns int
+}
+
+// filtersBlocks reports whether MinBlockTxns or MaxBlockTxns is set.
+func (o Options) filtersBlocks() bool {
+	return o.MinBlockTxns > 0 || o.MaxBlockTxns > 0
+}
+
+// DBWorkerCount returns Options.DBWorkers, or Options.Workers if it isn't set.
+func (o Options) DBWorkerCount() int {
+	if o.DBWorkers > 0 {
+		return o.DBWorkers
+	}
+	return o.Workers
+}
+
+// DefaultQueueDepthMultiplier is the parallel fetch queue depth per worker when none is configured.
+const DefaultQueueDepthMultiplier = 2
+
+// DefaultReorderBufferSize is how many blocks a parallel gap fetches ahead when none is configured.
+const DefaultReorderBufferSize = 1000
+
+// DefaultOptions returns the options the repair tool runs with when nothing is configured.
+func DefaultOptions() Options {
+	return Options{
+		Workers:              100,
+		StateChangeDir:       config.DefaultStateChangeDir,
+		SequentialThreshold:  100,
+		QueueDepthMultiplier: DefaultQueueDepthMultiplier,
+		ReorderBufferSize:    DefaultReorderBufferSize,
+		CommitBatchSize:      10000,
+		BeginRetries:         5,
+		BeginRetryBackoff:    time.Second,
+	}
+}
+
+const (
+	// apiWorkersPerCPU is the workers per CPU in API mode, where workers mostly wait on the node.
+	apiWorkersPerCPU = 16
+	// stateChangeWorkersPerCPU is the workers per CPU in state-change mode, where decoding is CPU-bound.
+	stateChangeWorkersPerCPU = 1
+)
+
+// WorkersForCPUs returns a worker count for a machine with numCPU CPUs: many per CPU when fetching from the
+// node, and one per CPU when decoding the state-change files, so small machines aren't oversubscribed.
+func WorkersForCPUs(numCPU int, useStateChanges bool) int {
+	if numCPU < 1 {
+		numCPU = 1
+	}
+	if useStateChanges {
+		return numCPU * stateChangeWorkersPerCPU
+	}
+	return numCPU * apiWorkersPerCPU
+}
+
+// Repairer fills gaps by fetching blocks from a BlockSource (or reading the state-change files) and writing
+// them through an EntryHandler.
+type Repairer struct {
+	Handler EntryHandler
+	Source  BlockSource
+	Clock   Clock
+	Options Options
+
+	// MissingRanges, if set, is consulted before each gap is processed and returns the parts of the gap that
+	// are actually missing; only those are processed. Returning none skips the gap. It is ignored with
+	// Options.TransactionsOnly, whose blocks are in the DB by design.
+	MissingRanges func(gap Gap) ([]Gap, error)
+	// OnGapStatus, if set, is called with the index of a gap when it is skipped, repaired or flagged as
+	// undecodable.
+	OnGapStatus func(index int, status string)
+	// OnCommit, if set, is called after each successful commit with the range of heights it covered.
+	OnCommit func(committed Gap)
+	// Audit, if set, records the raw bytes of every state-change entry processed. The records are written when
+	// their transaction commits and dropped when it rolls back.
+	Audit *AuditLog
+	// Timings is how long each gap Run reached took, in the order they were processed.
+	Timings []GapTiming
+	// Undecodable are the ranges Run flagged for too many undecodable state-change entries, with
+	// Options.MaxDecodeErrorRatio.
+	Undecodable []*UndecodableGapError
+	// UnsupportedEncoders counts, by encoder type, the state-change entries Run left out because the handler
+	// has no handling for them.
+	UnsupportedEncoders map[lib.EncoderType]uint64
+	// DeadLetter, if set, records the raw bytes of each entry left out under UnsupportedEncoderDeadLetter and
+	// is flushed on commit.
+	DeadLetter *AuditLog
+	// Filtered are the heights Run left out for Options.MinBlockTxns and MaxBlockTxns, in the order they were
+	// met.
+	Filtered []uint64
+
+	// gapCommits are the ranges whose commits are held back until the gap commits, with
+	// Options.PerGapTransaction.
+	gapCommits []Gap
+	// rampCommitSize is the current batch size while ramping up to Options.CommitBatchSize, or zero.
+	rampCommitSize uint64
+}
+
+// NewRepairer returns a Repairer using the wall clock.
+func NewRepairer(handler EntryHandler, source BlockSource, options Options) *Repairer {
+	return &Repairer{
+		Handler: handler,
+		Source:  source,
+		Clock:   SystemClock,
+		Options: options,
+	}
+}
+
+// Run processes each gap in order. If ctx ends, or a gap fails with work in the open transaction that is
+// complete, the current batch is committed and a *RunStoppedError carrying the unprocessed remainder of gaps
+// is returned. Any other failure rolls the open transaction back, so the DB is left as of the last commit.
+// With Options.PerGapTransaction, a gap that doesn't complete is rolled back whole instead, and whatever
+// ended it, the *RunStoppedError resumes from its start.
+func (r *Repairer) Run(ctx context.Context, gaps []Gap) error {
+	r.Timings = nil
+	r.Undecodable = nil
+	r.Filtered = nil
+	r.UnsupportedEncoders = nil
+	r.gapCommits = nil
+	r.rampCommitSize = r.Options.CommitRampStart
+	processedAny := false
+	for i, gap := range gaps {
+		if ctx.Err() != nil {
+			return &RunStoppedError{NextHeight: gap.Start, Cause: ctx.Err(), Remaining: gaps[i:]}
+		}
+		blockCount := gap.End - gap.Start + 1
+		log.Printf("Processing gap: %d -> %d (%d blocks)", gap.Start, gap.End, blockCount)
+
+		ranges := []Gap{gap}
+		if r.MissingRanges != nil && !r.Options.TransactionsOnly {
+			gapStart := r.Clock.Now()
+			var err error
+			ranges, err = r.MissingRanges(gap)
+			if err != nil {
+				r.recordTiming(gap, gapStart, RunStatusFailed)
+				return fmt.Errorf("find missing heights in gap %d -> %d: %w", gap.Start, gap.End, err)
+			}
+			if len(ranges) == 0 {
+				log.Printf("WARNING: All blocks in gap %d -> %d already exist in database, skipping gap", gap.Start, gap.End)
+				r.setGapStatus(i, GapStatusSkipped)
+				r.recordTiming(gap, gapStart, GapStatusSkipped)
+				continue
+			}
+			if len(ranges) > 1 || ranges[0] != gap {
+				log.Printf("Gap %d -> %d is partially present, repairing %d missing range(s)", gap.Start, gap.End, len(ranges))
+			}
+		}
+
+		if processedAny && r.Options.InterGapDelay > 0 {
+			log.Printf("Waiting %v before the next gap", r.Options.InterGapDelay)
+			r.Clock.Sleep(r.Options.InterGapDelay)
+		}
+		processedAny = true
+
+		// The time is taken after InterGapDelay, so the delay isn't counted against the gap.
+		gapStart := r.Clock.Now()
+		undecodable := false
+		filteredBefore := len(r.Filtered)
+		for j, missing := range ranges {
+			if err := r.initiateTransaction(); err != nil {
+				r.recordTiming(gap, gapStart, RunStatusFailed)
+				return fmt.Errorf("InitiateTransaction: %w", err)
+			}
+			if err := r.processGap(ctx, missing); err != nil {
+				if r.Options.PerGapTransaction {
+					return r.rollBackGap(gaps, i, gapStart, err)
+				}
+				// The entries that decoded are committed; the rest of the gap has to come from the node.
+				var undecodableErr *UndecodableGapError
+				if errors.As(err, &undecodableErr) {
+					log.Printf("WARNING: %v", undecodableErr)
+					r.Undecodable = append(r.Undecodable, undecodableErr)
+					undecodable = true
+					continue
+				}
+				var endOfData *EndOfDataError
+				if errors.As(err, &endOfData) {
+					r.recordTiming(gap, gapStart, RunStatusStopped)
+					log.Printf("Node has no block at height %d, treating it as the end of available data and stopping", endOfData.Height)
+					return nil
+				}
+				var stopped *RunStoppedError
+				if errors.As(err, &stopped) {
+					r.recordTiming(gap, gapStart, RunStatusStopped)
+					stopped.Remaining = append([]Gap{{Start: stopped.NextHeight, End: missing.End}}, ranges[j+1:]...)
+					stopped.Remaining = append(stopped.Remaining, gaps[i+1:]...)
+					return stopped
+				}
+				r.recordTiming(gap, gapStart, RunStatusFailed)
+				r.rollbackAfterFailure(err)
+				return err
+			}
+		}
+
+		if r.Options.PerGapTransaction {
+			if err := r.commitGap(); err != nil {
+				r.recordTiming(gap, gapStart, RunStatusFailed)
+				r.rollbackAfterFailure(err)
+				return fmt.Errorf("commit gap %d -> %d: %w", gap.Start, gap.End, err)
+			}
+		}
+
+		if undecodable {
+			r.setGapStatus(i, GapStatusUndecodable)
+			r.recordTiming(gap, gapStart, GapStatusUndecodable)
+			log.Printf("Gap %d -> %d is likely unrepairable from the state-change files", gap.Start, gap.End)
+			continue
+		}
+		if filtered := len(r.Filtered) - filteredBefore; filtered > 0 {
+			r.setGapStatus(i, GapStatusFiltered)
+			r.recordTiming(gap, gapStart, GapStatusFiltered)
+			log.Printf("Repaired gap %d -> %d except %d height(s) left out by the block txn filter", gap.Start, gap.End, filtered)
+			continue
+		}
+		r.setGapStatus(i, GapStatusRepaired)
+		r.recordTiming(gap, gapStart, GapStatusRepaired)
+		log.Printf("Successfully repaired gap %d -> %d", gap.Start, gap.End)
+	}
+	return nil
+}
+
+// rollBackGap rolls back gaps[i], which failed with err in its own transaction under
+// Options.PerGapTransaction. Since none of the gap is left committed, every failure, whether a stop or a
+// block that failed in the sequential or the parallel path, returns a *RunStoppedError that resumes from the
+// start of the gap, with the failure as its Cause.
+func (r *Repairer) rollBackGap(gaps []Gap, i int, gapStart time.Time, err error) error {
+	gap := gaps[i]
+	r.gapCommits = nil
+	r.discardRecords()
+	if r.Handler.InTransaction() {
+		if rbErr := r.Handler.RollbackTransaction(); rbErr != nil {
+			log.Printf("WARNING: Failed to roll back gap %d -> %d after %v: %v", gap.Start, gap.End, err, rbErr)
+		} else {
+			log.Printf("Rolled back gap %d -> %d; none of it was committed", gap.Start, gap.End)
+		}
+	}
+	var endOfData *EndOfDataError
+	var stopped *RunStoppedError
+	switch {
+	case errors.As(err, &stopped):
+		err = stopped.Cause
+		if isRunStop(err) {
+			r.recordTiming(gap, gapStart, RunStatusStopped)
+		} else {
+			r.recordTiming(gap, gapStart, RunStatusFailed)
+		}
+	case errors.As(err, &endOfData):
+		r.recordTiming(gap, gapStart, RunStatusStopped)
+	default:
+		r.recordTiming(gap, gapStart, RunStatusFailed)
+	}
+	return &RunStoppedError{NextHeight: gap.Start, Cause: err, Remaining: gaps[i:]}
+}
+
+// isRunStop reports whether cause stops a run rather than failing it: ctx ending or the node being too slow.
+func isRunStop(cause error) bool {
+	return errors.Is(cause, context.Canceled) || errors.Is(cause, context.DeadlineExceeded) || errors.Is(cause, ErrNodeTooSlow)
+}
+
+// GapTiming is how long Run spent on one gap and how the gap ended.
+type GapTiming struct {
+	Gap   Gap
+	Start time.Time
+	End   time.Time
+	// Status is GapStatusRepaired, GapStatusSkipped, GapStatusUndecodable or GapStatusFiltered, or
+	// RunStatusStopped or RunStatusFailed for the gap the run ended in.
+	Status string
+}
+
+// Duration is the time spent on the gap.
+func (t GapTiming) Duration() time.Duration { return t.End.Sub(t.Start) }
+
+func (r *Repairer) recordTiming(gap Gap, start time.Time, status string) {
+	r.Timings = append(r.Timings, GapTiming{Gap: gap, Start: start, End: r.Clock.Now(), Status: status})
+}
+
+func (r *Repairer) setGapStatus(i int, status string) {
+	if r.OnGapStatus != nil {
+		r.OnGapStatus(i, status)
+	}
+}
+
+// commitRange commits the open transaction and reports the committed ranges to OnCommit. With
+// Options.PerGapTransaction the commit is held back until the whole gap commits.
+func (r *Repairer) commitRange(committed ...Gap) error {
+	if r.Options.PerGapTransaction {
+		r.gapCommits = append(r.gapCommits, committed...)
+		return nil
+	}
+	return r.commit(committed)
+}
+
+// commitGap commits the gap's transaction under Options.PerGapTransaction and reports every range held back
+// for it to OnCommit.
+func (r *Repairer) commitGap() error {
+	committed := r.gapCommits
+	r.gapCommits = nil
+	if !r.Handler.InTransaction() {
+		return nil
+	}
+	return r.commit(committed)
+}
+
+func (r *Repairer) commit(committed []Gap) error {
+	if err := r.Handler.CommitTransaction(); err != nil {
+		return err
+	}
+	if r.Audit != nil {
+		if err := r.Audit.Flush(); err != nil {
+			return err
+		}
+	}
+	if r.DeadLetter != nil {
+		if err := r.DeadLetter.Flush(); err != nil {
+			return err
+		}
+	}
+	if r.OnCommit != nil {
+		for _, c := range committed {
+			r.OnCommit(c)
+		}
+	}
+	if r.rampCommitSize > 0 {
+		r.rampCommitSize *= 2
+		if r.rampCommitSize >= r.Options.CommitBatchSize {
+			log.Printf("Commit size ramped up to %d", r.Options.CommitBatchSize)
+			r.rampCommitSize = 0
+		}
+	}
+	return nil
+}
+
+// discardRecords drops the Audit and DeadLetter records of a transaction that is being rolled back.
+func (r *Repairer) discardRecords() {
+	if r.Audit != nil {
+		r.Audit.Discard()
+	}
+	if r.DeadLetter != nil {
+		r.DeadLetter.Discard()
+	}
+}
+
+// initiateTransaction opens a transaction on the handler, retrying with exponential backoff up to
+// Options.BeginRetries times. The handler's connection pool replaces dead connections between attempts. With
+// Options.PerGapTransaction, the gap's transaction is kept if one is already open.
+func (r *Repairer) initiateTransaction() error {
+	if r.Options.PerGapTransaction && r.Handler.InTransaction() {
+		return nil
+	}
+	backoff := r.Options.BeginRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := r.Handler.InitiateTransaction()
+		if err == nil {
+			if attempt > 0 {
+				log.Printf("Started transaction after %d retries", attempt)
+			}
+			return nil
+		}
+		if attempt >= r.Options.BeginRetries {
+			return fmt.Errorf("could not start a transaction after %d attempts, is the database reachable?: %w", attempt+1, err)
+		}
+		log.Printf("WARNING: Failed to start transaction (attempt %d/%d), retrying in %v: %v",
+			attempt+1, r.Options.BeginRetries+1, backoff, err)
+		r.Clock.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// commitDue reports whether a batch commit is due after uncommitted entries, holding txnRows transactions,
+// were written since lastCommit.
+func (r *Repairer) commitDue(uncommitted, txnRows uint64, lastCommit time.Time) bool {
+	if uncommitted == 0 || r.Options.PerGapTransaction {
+		return false
+	}
+	if uncommitted >= r.batchCommitSize() {
+		return true
+	}
+	if r.Options.CommitTxnRows > 0 && txnRows >= r.Options.CommitTxnRows {
+		return true
+	}
+	return r.Options.CommitInterval > 0 && r.Clock.Now().Sub(lastCommit) >= r.Options.CommitInterval
+}
+
+// batchCommitSize is how many blocks or entries a batch commit is due at: Options.CommitBatchSize, or the
+// current size while ramping up to it.
+func (r *Repairer) batchCommitSize() uint64 {
+	if r.rampCommitSize > 0 && r.rampCommitSize < r.Options.CommitBatchSize {
+		return r.rampCommitSize
+	}
+	return r.Options.CommitBatchSize
+}
+
+// entryTxnRows returns the number of transaction rows writing entry produces: one per transaction for a
+// block entry, none for anything else.
+func entryTxnRows(entry *lib.StateChangeEntry) uint64 {
+	block, ok := entry.Encoder.(*lib.MsgDeSoBlock)
+	if !ok || block == nil {
+		return 0
+	}
+	return uint64(len(block.Txns))
+}
+
+// rollbackAfterFailure rolls back the open transaction, if any, after a failure that left it in an unknown
+// state (e.g. a failed commit), so the DB holds exactly what was committed before it.
+func (r *Repairer) rollbackAfterFailure(cause error) {
+	r.discardRecords()
+	if !r.Handler.InTransaction() {
+		return
+	}
+	if err := r.Handler.RollbackTransaction(); err != nil {
+		log.Printf("WARNING: Failed to roll back after %v: %v", cause, err)
+		return
+	}
+	log.Printf("Rolled back the open transaction after the failure; only the batches committed before it are in the DB")
+}
+
+// stopRun commits the open transaction, if any, and returns a RunStoppedError resuming at nextHeight.
+// committed holds the ranges of heights written since the last commit.
+func (r *Repairer) stopRun(committed []Gap, nextHeight uint64, cause error) error {
+	if err := r.commitBeforeStop(committed, nextHeight); err != nil {
+		return err
+	}
+	return &RunStoppedError{NextHeight: nextHeight, Cause: cause}
+}
+
+// stopAtEndOfData commits the open transaction, if any, and returns an EndOfDataError for height.
+func (r *Repairer) stopAtEndOfData(committed []Gap, height uint64) error {
+	if err := r.commitBeforeStop(committed, height); err != nil {
+		return err
+	}
+	return &EndOfDataError{Height: height}
+}
+
+// commitBeforeStop commits the open transaction, if any, before stopping at nextHeight. With
+// Options.PerGapTransaction nothing is committed, since Run rolls the whole gap back.
+func (r *Repairer) commitBeforeStop(committed []Gap, nextHeight uint64) error {
+	if !r.Handler.InTransaction() || r.Options.PerGapTransaction {
+		return nil
+	}
+	if err := r.commitRange(committed...); err != nil {
+		return fmt.Errorf("commit before stopping at height %d: %w", nextHeight, err)
+	}
+	log.Printf("Committed current batch before stopping at height %d", nextHeight)
+	return nil
+}
+
+// processGap processes a single gap inside the transaction opened by Run and leaves it committed.
+func (r *Repairer) processGap(ctx context.Context, gap Gap) error {
+	if r.Options.UseStateChanges {
+		log.Printf("Processing from state-change files: %s", r.Options.StateChangeDir)
+		err := r.ProcessGapFromStateChange(ctx, gap.Start, gap.End)
+		var undecodable *UndecodableGapError
+		if err != nil && !errors.As(err, &undecodable) {
+			return fmt.Errorf("processGapFromStateChange: %w", err)
+		}
+		if err := r.commitRange(withoutHeights(gap, r.Filtered)...); err != nil {
+			return fmt.Errorf("CommitTransaction: %w", err)
+		}
+		if undecodable != nil {
+			return undecodable
+		}
+		return nil
+	}
+
+	// Process blocks from API
+	// Each block will be processed with ALL its transactions via bulkInsertBlockEntry
+	// Hybrid strategy:
+	// - Small gaps (≤SequentialThreshold blocks): Sequential API calls
+	// - Medium/Large gaps: Parallel API calls
+	if gap.End-gap.Start+1 > r.Options.SequentialThreshold {
+		log.Printf("Using parallel API processing (%d fetch workers, %d DB workers) for gap...", r.Options.Workers, r.Options.DBWorkerCount())
+		// Transaction is committed inside ProcessGapParallel in batches
+		if err := r.ProcessGapParallel(ctx, gap.Start, gap.End); err != nil {
+			return fmt.Errorf("processGapParallel: %w", err)
+		}
+		return nil
+	}
+
+	log.Printf("Using sequential API processing for small gap...")
+	written, err := r.processGapSequential(ctx, gap.Start, gap.End)
+	if err != nil {
+		return err
+	}
+	if err := r.commitRange(HeightsToGaps(written)...); err != nil {
+		return fmt.Errorf("CommitTransaction: %w", err)
+	}
+	return nil
+}
+
+// ErrBlockFiltered is returned by ProcessBlock for a block left out by Options.MinBlockTxns or MaxBlockTxns.
+var ErrBlockFiltered = errors.New("block left out by the block txn filter")
+
+// filterBlock reports whether Options.MinBlockTxns or MaxBlockTxns leave out the block at height, and records
+// the height in Filtered if so.
+func (r *Repairer) filterBlock(height uint64, block *lib.MsgDeSoBlock) bool {
+	txns := len(block.Txns)
+	if txns >= r.Options.MinBlockTxns && (r.Options.MaxBlockTxns == 0 || txns <= r.Options.MaxBlockTxns) {
+		return false
+	}
+	log.Printf("Leaving out block %d: %d txns is outside MIN_BLOCK_TXNS/MAX_BLOCK_TXNS", height, txns)
+	r.Filtered = append(r.Filtered, height)
+	return true
+}
+
+// withoutHeights returns the parts of gap that aren't among heights, which needn't be sorted.
+func withoutHeights(gap Gap, heights []uint64) []Gap {
+	var inside []uint64
+	for _, h := range heights {
+		if h >= gap.Start && h <= gap.End {
+			inside = append(inside, h)
+		}
+	}
+	sort.Slice(inside, func(i, j int) bool { return inside[i] < inside[j] })
+	var parts []Gap
+	next := gap.Start
+	for _, h := range inside {
+		if h > next {
+			parts = append(parts, Gap{Start: next, End: h - 1})
+		}
+		next = h + 1
+	}
+	if next <= gap.End {
+		parts = append(parts, Gap{Start: next, End: gap.End})
+	}
+	return parts
+}
+
+// ProcessBlock fetches the block at height from the Source and processes it.
+// With OperationType=Upsert, bulkInsertBlockEntry will extract and process all transactions
+func (r *Repairer) ProcessBlock(height uint64) error {
+	block, blockHash, err := r.Source.FetchBlock(height)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Fetched block %d with %d transactions", height, len(block.Txns))
+	if r.filterBlock(height, block) {
+		return ErrBlockFiltered
+	}
+
+	// Use the block hash from the API (don't compute it)
+	// Create state change entry for the block with UPSERT operation
+	// CRITICAL: Using Upsert ensures bulkInsertBlockEntry processes the block
+	// bulkInsertBlockEntry will automatically:
+	// 1. Insert/update the block
+	// 2. Extract ALL transactions from block.Txns[]
+	// 3. Process each transaction (posts, follows, likes, diamonds, etc.)
+	// 4. Insert transactions into transaction table
+	blockEntry := &lib.StateChangeEntry{
+		EncoderType:   lib.EncoderTypeBlock,
+		OperationType: lib.DbOperationTypeUpsert, // UPSERT triggers transaction processing
+		Encoder:       block,
+		Block:         block,
+		BlockHeight:   height,
+		KeyBytes:      blockHash[:],
+	}
+
+	// Process the block entry - this processes the block AND all its transactions
+	if err := handleEntryBatchAtomic(r.Handler, []*lib.StateChangeEntry{blockEntry}); err != nil {
+		return fmt.Errorf("failed to process block for height %d: %w", height, err)
+	}
+
+	log.Printf("Successfully processed block %d via API (%d transactions)", height, len(block.Txns))
+	return nil
+}
+
+// ProcessGapSequential processes [startHeight, endHeight] one block at a time in the open transaction,
+// leaving it uncommitted. Blocks that fail are logged and skipped, or retried at the end when
+// Options.DeferFailed is set. ErrNodeTooSlow from the source stops the gap like ctx ending. With
+// Options.StopAtBlockNotFound, a height the node has no block for ends the gap: the heights below it are
+// committed and an *EndOfDataError is returned. With Options.PerGapTransaction, a block that still fails
+// at the end fails the gap.
+func (r *Repairer) ProcessGapSequential(ctx context.Context, startHeight, endHeight uint64) error {
+	_, err := r.processGapSequential(ctx, startHeight, endHeight)
+	return err
+}
+
+// processGapSequential is ProcessGapSequential returning the heights it wrote, in ascending order.
+func (r *Repairer) processGapSequential(ctx context.Context, startHeight, endHeight uint64) ([]uint64, error) {
+	var written []uint64
+	var deferredHeights []uint64
+	// failedHeights are the blocks that were skipped for good, which fail the gap with
+	// Options.PerGapTransaction; firstFailure is the first error a block failed with.
+	var failedHeights []uint64
+	var firstFailure error
+	var endOfData *uint64
+	for h := startHeight; h <= endHeight; h++ {
+		if ctx.Err() != nil {
+			next := h
+			if len(deferredHeights) > 0 {
+				next = deferredHeights[0]
+			}
+			return written, r.stopRun(HeightsToGaps(written), next, ctx.Err())
+		}
+		log.Printf("Processing height %d...", h)
+		if err := r.ProcessBlock(h); err != nil {
+			if errors.Is(err, ErrBlockFiltered) {
+				continue
+			}
+			if errors.Is(err, ErrNodeTooSlow) {
+				next := h
+				if len(deferredHeights) > 0 {
+					next = deferredHeights[0]
+				}
+				return written, r.stopRun(HeightsToGaps(written), next, err)
+			}
+			if r.Options.StopAtBlockNotFound && errors.Is(err, ErrBlockNotFound) {
+				endOfData = &h
+				break
+			}
+			log.Printf("WARNING: Failed to process block %d: %v", h, err)
+			if firstFailure == nil {
+				firstFailure = err
+			}
+			if r.Options.DeferFailed {
+				deferredHeights = append(deferredHeights, h)
+			} else {
+				failedHeights = append(failedHeights, h)
+			}
+			continue
+		}
+		written = append(written, h)
+	}
+	if len(deferredHeights) > 0 {
+		failed := retryDeferredHeights(deferredHeights, func(h uint64) error {
+			if err := r.ProcessBlock(h); err != nil {
+				return err
+			}
+			written = append(written, h)
+			return nil
+		})
+		if len(failed) > 0 {
+			log.Printf("WARNING: %d deferred block(s) still failing after retries: %v", len(failed), failed)
+		}
+		failedHeights = append(failedHeights, failed...)
+		sort.Slice(written, func(i, j int) bool { return written[i] < written[j] })
+	}
+	if r.Options.PerGapTransaction && len(failedHeights) > 0 {
+		return written, fmt.Errorf("%d block(s) in %d -> %d failed to process: %w", len(failedHeights), startHeight, endHeight, firstFailure)
+	}
+	if endOfData != nil {
+		return written, r.stopAtEndOfData(HeightsToGaps(written), *endOfData)
+	}
+	return written, nil
+}
+
+// retryDeferredHeights re-runs process for heights whose first attempt failed, in height order. Passes are
+// repeated as long as at least one height succeeds, so a block that depends on state written by another
+// deferred block converges once its dependency lands. It returns the heights that never succeeded.
+func retryDeferredHeights(heights []uint64, process func(height uint64) error) []uint64 {
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	for pass := 1; len(heights) > 0; pass++ {
+		log.Printf("Retrying %d deferred block(s), pass %d", len(heights), pass)
+		var stillFailing []uint64
+		for _, h := range heights {
+			if err := process(h); err != nil {
+				log.Printf("WARNING: Deferred block %d failed again: %v", h, err)
+				stillFailing = append(stillFailing, h)
+			}
+		}
+		if len(stillFailing) == len(heights) {
+			return stillFailing
+		}
+		heights = stillFailing
+	}
+	return nil
+}
+
+// blockResult is the outcome of fetching one block of a parallel gap.
+type blockResult struct {
+	height uint64
+	entry  *lib.StateChangeEntry
+	err    error
+}
+
+// startFetchWorkers starts Options.Workers workers that fetch each height sent on jobs and send the outcome
+// on results, which is closed once jobs is closed and every fetch has been sent.
+func (r *Repairer) startFetchWorkers(jobs <-chan uint64, results chan<- blockResult) {
+	var wg sync.WaitGroup
+	for i := 0; i < r.Options.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for height := range jobs {
+				block, blockHash, err := r.Source.FetchBlock(height)
+				if err != nil {
+					results <- blockResult{height: height, err: err}
+					continue
+				}
+
+				// Use the block hash from the API (don't compute it)
+				blockEntry := &lib.StateChangeEntry{
+					OperationType: lib.DbOperationTypeUpsert,
+					EncoderType:   lib.EncoderTypeBlock,
+					KeyBytes:      blockHash[:],
+					Encoder:       block,
+					BlockHeight:   height,
+				}
+				results <- blockResult{height: height, entry: blockEntry, err: nil}
+			}
+		}()
+	}
+
+	// Close results when all workers done
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+}
+
+// fetchQueues makes the job and result queues of a parallel fetch, Options.QueueDepthMultiplier entries per
+// worker deep.
+func (r *Repairer) fetchQueues() (chan uint64, chan blockResult) {
+	multiplier := r.Options.QueueDepthMultiplier
+	if multiplier <= 0 {
+		multiplier = DefaultQueueDepthMultiplier
+	}
+	depth := r.Options.Workers * multiplier
+	return make(chan uint64, depth), make(chan blockResult, depth)
+}
+
+// gapWriter writes the blocks of a parallel gap through the open transaction in height order, committing
+// every CommitBatchSize blocks, CommitTxnRows transactions or CommitInterval, and at endHeight.
+type gapWriter struct {
+	r           *Repairer
+	endHeight   uint64
+	totalBlocks uint64
+
+	blocksCommitted uint64
+	// uncommitted holds the heights written since the last commit, in ascending order. Deferred heights
+	// aren't among them.
+	uncommitted        []uint64
+	uncommittedTxnRows uint64
+	lastCommit         time.Time
+	deferred           map[uint64]*lib.StateChangeEntry
+}
+
+func (r *Repairer) newGapWriter(startHeight, endHeight uint64) *gapWriter {
+	return &gapWriter{
+		r:           r,
+		endHeight:   endHeight,
+		totalBlocks: endHeight - startHeight + 1,
+		lastCommit:  r.Clock.Now(),
+		deferred:    make(map[uint64]*lib.StateChangeEntry),
+	}
+}
+
+// stop commits what has been processed and resumes from the lowest unprocessed height. It is used both
+// when ctx ends and when the gap fails, since every block since the last commit was written in its own
+// savepoint and is complete.
+func (w *gapWriter) stop(h uint64, cause error) error {
+	for deferredHeight := range w.deferred {
+		if deferredHeight < h {
+			h = deferredHeight
+		}
+	}
+	return w.r.stopRun(HeightsToGaps(w.uncommitted), h, cause)
+}
+
+// write processes the block at h, which must be the height after the last one written, and commits if a
+// commit is due.
+func (w *gapWriter) write(h uint64, entry *lib.StateChangeEntry) error {
+	r := w.r
+	processed := true
+	if block, ok := entry.Encoder.(*lib.MsgDeSoBlock); ok && r.filterBlock(h, block) {
+		processed = false
+	} else if err := handleEntryBatchAtomic(r.Handler, []*lib.StateChangeEntry{entry}); err != nil {
+		if !r.Options.DeferFailed {
+			return w.stop(h, fmt.Errorf("failed to process block %d: %w", h, err))
+		}
+		log.Printf("WARNING: Deferring block %d for retry after the rest of the range: %v", h, err)
+		w.deferred[h] = entry
+		processed = false
+	} else {
+		w.blocksCommitted++
+		w.uncommitted = append(w.uncommitted, h)
+		w.uncommittedTxnRows += entryTxnRows(entry)
+	}
+
+	// Commit every CommitBatchSize blocks, CommitTxnRows transactions or CommitInterval, and at the end
+	if (processed && r.commitDue(uint64(len(w.uncommitted)), w.uncommittedTxnRows, w.lastCommit)) || h == w.endHeight {
+		if err := r.commitRange(HeightsToGaps(w.uncommitted)...); err != nil {
+			return fmt.Errorf("failed to commit at block %d: %w", h, err)
+		}
+		w.uncommitted = nil
+		w.uncommittedTxnRows = 0
+		w.lastCommit = r.Clock.Now()
+		log.Printf("✓ Committed: %d/%d blocks (%.2f%%)",
+			w.blocksCommitted, w.totalBlocks, float64(w.blocksCommitted)/float64(w.totalBlocks)*100)
+
+		// Start new transaction if not at end
+		if h < w.endHeight {
+			if err := r.initiateTransaction(); err != nil {
+				return fmt.Errorf("failed to start new transaction at block %d: %w", h, err)
+			}
+		}
+	} else if w.blocksCommitted%1000 == 0 {
+		log.Printf("Progress: %d/%d blocks processed", w.blocksCommitted, w.totalBlocks)
+	}
+	return nil
+}
+
+// finish commits the blocks written below endOfData, if the node's data ended inside the gap, and retries
+// the deferred blocks.
+func (w *gapWriter) finish(endOfData *uint64) error {
+	r := w.r
+	if endOfData != nil && r.Handler.InTransaction() {
+		// The gap ended before endHeight was written, so the blocks since the last commit haven't been
+		// committed yet.
+		if err := r.commitBeforeStop(HeightsToGaps(w.uncommitted), *endOfData); err != nil {
+			return err
+		}
+	}
+	if len(w.deferred) == 0 {
+		if endOfData != nil {
+			return &EndOfDataError{Height: *endOfData}
+		}
+		return nil
+	}
+
+	if err := r.initiateTransaction(); err != nil {
+		return fmt.Errorf("failed to start transaction for deferred blocks: %w", err)
+	}
+	heights := make([]uint64, 0, len(w.deferred))
+	for h := range w.deferred {
+		heights = append(heights, h)
+	}
+	var retried []uint64
+	failed := retryDeferredHeights(heights, func(h uint64) error {
+		if err := handleEntryBatchAtomic(r.Handler, []*lib.StateChangeEntry{w.deferred[h]}); err != nil {
+			return err
+		}
+		retried = append(retried, h)
+		return nil
+	})
+	sort.Slice(retried, func(i, j int) bool { return retried[i] < retried[j] })
+	if err := r.commitRange(HeightsToGaps(retried)...); err != nil {
+		return fmt.Errorf("failed to commit deferred blocks: %w", err)
+	}
+	log.Printf("✓ Committed %d/%d deferred blocks", len(w.deferred)-len(failed), len(w.deferred))
+	if len(failed) > 0 {
+		return fmt.Errorf("%d deferred blocks could not be processed (first: %d)", len(failed), failed[0])
+	}
+	if endOfData != nil {
+		return &EndOfDataError{Height: *endOfData}
+	}
+	return nil
+}
+
+// ProcessGapParallel fetches the blocks of [startHeight, endHeight] with Options.Workers concurrent requests
+// and writes them in height order through one transaction. Heights are handed to the workers in order, but
+// only while fewer than Options.ReorderBufferSize of them are fetched or being fetched and not yet written, so
+// the workers run ahead of the writer by at most that many blocks. Blocks that arrive ahead of the next
+// height to write wait in the buffer until it does. When Options.DeferFailed is set, blocks that fail to
+// process (e.g. because they reference state from a block that hasn't been repaired yet) are queued and
+// retried after the rest of the range instead of aborting. If ctx ends or the gap fails, including a failed
+// fetch once it is the next height to write, the blocks processed since the last commit are committed and a
+// *RunStoppedError is returned. With Options.StopAtBlockNotFound, the lowest height the node has no block for
+// ends the gap as in ProcessGapSequential.
+func (r *Repairer) ProcessGapParallel(ctx context.Context, startHeight, endHeight uint64) error {
+	w := r.newGapWriter(startHeight, endHeight)
+	bufferSize := r.Options.ReorderBufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultReorderBufferSize
+	}
+	log.Printf("Streaming heights %d -> %d through a reorder buffer of %d blocks", startHeight, endHeight, bufferSize)
+
+	fetchCtx, cancelFetch := context.WithCancel(ctx)
+	jobs, results := r.fetchQueues()
+	r.startFetchWorkers(jobs, results)
+	defer func() {
+		// Fetches still in flight when the gap returns early are discarded.
+		cancelFetch()
+		go func() {
+			for range results {
+			}
+		}()
+	}()
+
+	// slots holds one token per height handed out and not yet written.
+	slots := make(chan struct{}, bufferSize)
+	go func() {
+		defer close(jobs)
+		for h := startHeight; h <= endHeight; h++ {
+			select {
+			case slots <- struct{}{}:
+			case <-fetchCtx.Done():
+				return
+			}
+			select {
+			case jobs <- h:
+			case <-fetchCtx.Done():
+				return
+			}
+		}
+	}()
+
+	buffer := make(map[uint64]blockResult)
+	// endOfData is the height the node reported no block for, when Options.StopAtBlockNotFound is set.
+	var endOfData *uint64
+	for h := startHeight; h <= endHeight; {
+		if ctx.Err() != nil {
+			return w.stop(h, ctx.Err())
+		}
+		result, ok := buffer[h]
+		if !ok {
+			select {
+			case result, ok = <-results:
+				if !ok {
+					return w.stop(h, ctx.Err())
+				}
+			case <-ctx.Done():
+				return w.stop(h, ctx.Err())
+			}
+			if result.height != h {
+				buffer[result.height] = result
+				continue
+			}
+		}
+		delete(buffer, h)
+		<-slots
+
+		if result.err != nil {
+			if r.Options.StopAtBlockNotFound && errors.Is(result.err, ErrBlockNotFound) {
+				height := h
+				endOfData = &height
+				break
+			}
+			if errors.Is(result.err, ErrNodeTooSlow) {
+				return w.stop(h, result.err)
+			}
+			log.Printf("WARNING: Failed to fetch block %d: %v", h, result.err)
+			return w.stop(h, fmt.Errorf("failed to fetch block %d: %w", h, result.err))
+		}
+		if err := w.write(h, result.entry); err != nil {
+			return err
+		}
+		h++
+	}
+	return w.finish(endOfData)
+}
+
+// ExitReason describes why a run context ended.
+func ExitReason(cause error) string {
+	if errors.Is(cause, context.DeadlineExceeded) {
+		return "deadline reached"
+	}
+	return cause.Error()
+}
+
+// ParseRunDeadline parses RUN_DEADLINE as either an RFC3339 timestamp ("stop at 06:00") or a duration
+// relative to now ("stop after 8h").
+func ParseRunDeadline(value string, now time.Time) (time.Time, error) {
+	if deadline, err := time.Parse(time.RFC3339, value); err == nil {
+		return deadline, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("RUN_DEADLINE %q is neither an RFC3339 timestamp nor a duration", value)
+	}
+	return now.Add(d), nil
+}
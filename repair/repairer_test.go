@@ -0,0 +1,672 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRepairer(handler EntryHandler, source BlockSource) *Repairer {
+	r := NewRepairer(handler, source, DefaultOptions())
+	r.Clock = &fakeClock{now: time.Unix(0, 0)}
+	r.Options.Workers = 4
+	return r
+}
+
+func TestRunRepairsSmallGapSequentially(t *testing.T) {
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	var statuses []string
+	r.OnGapStatus = func(i int, status string) { statuses = append(statuses, status) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 10, End: 14}}))
+
+	require.Equal(t, heightRange(10, 14), handler.committedHeights())
+	require.False(t, handler.InTransaction())
+	require.Equal(t, []string{GapStatusRepaired}, statuses)
+	for _, entry := range handler.committed {
+		require.Equal(t, lib.DbOperationTypeUpsert, entry.OperationType)
+		require.Equal(t, lib.EncoderTypeBlock, entry.EncoderType)
+	}
+}
+
+func TestRunRepairsLargeGapInParallel(t *testing.T) {
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.SequentialThreshold = 0
+	r.Options.ReorderBufferSize = 4
+	r.Options.CommitBatchSize = 3
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 10}}))
+
+	require.Equal(t, heightRange(1, 10), handler.committedHeights())
+	require.False(t, handler.InTransaction())
+	// Commits after blocks 3, 6, 9 and at the end of the gap.
+	require.Equal(t, 4, handler.commits)
+}
+
+func TestRunRampsUpCommitSize(t *testing.T) {
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.SequentialThreshold = 0
+	r.Options.ReorderBufferSize = 10
+	r.Options.CommitBatchSize = 16
+	r.Options.CommitRampStart = 2
+	var sizes []uint64
+	r.OnCommit = func(committed Gap) { sizes = append(sizes, committed.End-committed.Start+1) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 60}}))
+
+	require.Equal(t, heightRange(1, 60), handler.committedHeights())
+	// Doubling from 2 to the full size, which the rest of the gap is committed at.
+	require.Equal(t, []uint64{2, 4, 8, 16, 16, 14}, sizes)
+
+	// Each run starts the ramp over.
+	sizes = nil
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 61, End: 70}}))
+	require.Equal(t, []uint64{2, 4, 4}, sizes)
+}
+
+// gaugedSource counts the fetches in flight at once.
+type gaugedSource struct {
+	*fakeSource
+	gauge *concurrencyGauge
+}
+
+func (s *gaugedSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	s.gauge.enter()
+	return s.fakeSource.FetchBlock(height)
+}
+
+func TestParallelGapFetchesWithFetchWorkersAndWritesInOneTransaction(t *testing.T) {
+	fetches, writes := newConcurrencyGauge(6), newConcurrencyGauge(0)
+	handler := newFakeHandler()
+	handler.fail = func(*lib.StateChangeEntry) error {
+		writes.enter()
+		return nil
+	}
+	r := newTestRepairer(handler, &gaugedSource{fakeSource: newFakeSource(), gauge: fetches})
+	r.Options.SequentialThreshold = 0
+	r.Options.Workers = 6
+	r.Options.DBWorkers = 3
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 30}}))
+
+	require.Equal(t, heightRange(1, 30), handler.committedHeights())
+	require.Equal(t, 6, fetches.peak())
+	require.Equal(t, 1, writes.peak())
+	require.Equal(t, 3, r.Options.DBWorkerCount())
+	r.Options.DBWorkers = 0
+	require.Equal(t, 6, r.Options.DBWorkerCount())
+}
+
+func TestRunDefersBlocksThatDependOnLaterBlocks(t *testing.T) {
+	handler := newFakeHandler()
+	// Block 5 can only be processed once block 7 has been written.
+	handler.fail = func(entry *lib.StateChangeEntry) error {
+		if entry.BlockHeight == 5 && !handler.hasHeight(7) {
+			return errors.New("depends on block 7")
+		}
+		return nil
+	}
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.SequentialThreshold = 0
+	r.Options.DeferFailed = true
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 8}}))
+
+	require.Equal(t, []uint64{1, 2, 3, 4, 6, 7, 8, 5}, handler.committedHeights())
+}
+
+func TestOnCommitReportsOnlyCommittedHeightsWithDeferral(t *testing.T) {
+	for _, threshold := range []uint64{0, 100} {
+		handler := newFakeHandler()
+		handler.fail = func(entry *lib.StateChangeEntry) error {
+			if entry.BlockHeight == 2 || entry.BlockHeight == 8 {
+				return errors.New("boom")
+			}
+			return nil
+		}
+		r := newTestRepairer(handler, newFakeSource())
+		r.Options.SequentialThreshold = threshold
+		r.Options.CommitBatchSize = 3
+		r.Options.DeferFailed = true
+		var reported []uint64
+		r.OnCommit = func(g Gap) { reported = append(reported, heightRange(g.Start, g.End)...) }
+
+		// The parallel path fails the gap over the blocks that never succeeded; the sequential one skips them.
+		_ = r.Run(context.Background(), []Gap{{Start: 1, End: 8}})
+
+		require.ElementsMatch(t, []uint64{1, 3, 4, 5, 6, 7}, handler.committedHeights(), "threshold %d", threshold)
+		require.ElementsMatch(t, handler.committedHeights(), reported, "threshold %d", threshold)
+	}
+}
+
+func TestRunRebuildsTransactionsOfBlocksAlreadyInTheDB(t *testing.T) {
+	// Gaps from GAP_FILE in API mode: every block is already in the DB.
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.TransactionsOnly = true
+	r.MissingRanges = func(gap Gap) ([]Gap, error) { return nil, nil }
+	var statuses []string
+	r.OnGapStatus = func(i int, status string) { statuses = append(statuses, status) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 10, End: 12}}))
+
+	require.Equal(t, heightRange(10, 12), handler.committedHeights())
+	require.Equal(t, []string{GapStatusRepaired}, statuses)
+}
+
+func TestRunFailsWithoutDeferral(t *testing.T) {
+	handler := newFakeHandler()
+	handler.fail = func(entry *lib.StateChangeEntry) error {
+		if entry.BlockHeight == 5 {
+			return errors.New("boom")
+		}
+		return nil
+	}
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.SequentialThreshold = 0
+
+	err := r.Run(context.Background(), []Gap{{Start: 1, End: 8}})
+
+	// The blocks before the failure are complete, so they are committed and the run can resume at 5.
+	var stopped *RunStoppedError
+	require.ErrorAs(t, err, &stopped)
+	require.ErrorContains(t, err, "boom")
+	require.Equal(t, uint64(5), stopped.NextHeight)
+	require.Equal(t, []Gap{{Start: 5, End: 8}}, stopped.Remaining)
+	require.Equal(t, []uint64{1, 2, 3, 4}, handler.committedHeights())
+	require.False(t, handler.InTransaction())
+}
+
+func TestRunRollsBackWhenCommitFails(t *testing.T) {
+	handler := newFakeHandler()
+	handler.commitErr = errors.New("connection reset")
+	r := newTestRepairer(handler, newFakeSource())
+
+	err := r.Run(context.Background(), []Gap{{Start: 1, End: 5}})
+
+	var stopped *RunStoppedError
+	require.False(t, errors.As(err, &stopped))
+	require.ErrorContains(t, err, "connection reset")
+	require.Empty(t, handler.committedHeights())
+	require.Equal(t, 1, handler.rollbacks)
+	require.False(t, handler.InTransaction())
+}
+
+func TestRunPerGapTransactionRollsBackTheFailedGap(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		sequentialThreshold uint64
+	}{
+		{"sequential", 100},
+		{"parallel", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := newFakeHandler()
+			handler.fail = func(entry *lib.StateChangeEntry) error {
+				if entry.BlockHeight == 13 {
+					return errors.New("boom")
+				}
+				return nil
+			}
+			r := newTestRepairer(handler, newFakeSource())
+			r.Options.SequentialThreshold = tc.sequentialThreshold
+			r.Options.PerGapTransaction = true
+			// Without PerGapTransaction this would commit 10 and 11, then 12, before the failure.
+			r.Options.CommitBatchSize = 2
+			var commits []Gap
+			r.OnCommit = func(committed Gap) { commits = append(commits, committed) }
+
+			err := r.Run(context.Background(), []Gap{{Start: 1, End: 3}, {Start: 10, End: 15}})
+
+			// Both paths resume from the start of the rolled-back gap.
+			require.ErrorContains(t, err, "boom")
+			var stopped *RunStoppedError
+			require.ErrorAs(t, err, &stopped)
+			require.Equal(t, uint64(10), stopped.NextHeight)
+			require.Equal(t, []Gap{{Start: 10, End: 15}}, stopped.Remaining)
+			require.Equal(t, RunStatusFailed, r.Timings[len(r.Timings)-1].Status)
+			// The first gap committed whole; none of the failed gap did.
+			require.Equal(t, []uint64{1, 2, 3}, handler.committedHeights())
+			require.Equal(t, []Gap{{Start: 1, End: 3}}, commits)
+			require.Equal(t, 1, handler.commits)
+			require.Equal(t, 1, handler.rollbacks)
+			require.False(t, handler.InTransaction())
+		})
+	}
+}
+
+func TestRunStopsWhenContextEnds(t *testing.T) {
+	handler := newFakeHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	handler.fail = func(entry *lib.StateChangeEntry) error {
+		if entry.BlockHeight == 3 {
+			cancel()
+		}
+		return nil
+	}
+	r := newTestRepairer(handler, newFakeSource())
+
+	err := r.Run(ctx, []Gap{{Start: 1, End: 5}, {Start: 20, End: 21}})
+
+	var stopped *RunStoppedError
+	require.ErrorAs(t, err, &stopped)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, uint64(4), stopped.NextHeight)
+	require.Equal(t, []Gap{{Start: 4, End: 5}, {Start: 20, End: 21}}, stopped.Remaining)
+	require.Equal(t, heightRange(1, 3), handler.committedHeights())
+	require.False(t, handler.InTransaction())
+}
+
+func TestRunSkipsGapsThatAreAlreadyPresent(t *testing.T) {
+	handler := newFakeHandler()
+	source := newFakeSource()
+	r := newTestRepairer(handler, source)
+	r.MissingRanges = func(gap Gap) ([]Gap, error) {
+		if gap.Start == 1 {
+			return nil, nil
+		}
+		return []Gap{gap}, nil
+	}
+	var statuses []string
+	r.OnGapStatus = func(i int, status string) { statuses = append(statuses, status) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 2}, {Start: 5, End: 5}}))
+
+	require.Equal(t, []uint64{5}, handler.committedHeights())
+	require.Equal(t, []string{GapStatusSkipped, GapStatusRepaired}, statuses)
+	require.Zero(t, source.fetches[1])
+}
+
+func TestRunRepairsOnlyMissingHeightsOfPartiallyPresentGap(t *testing.T) {
+	handler := newFakeHandler()
+	source := newFakeSource()
+	r := newTestRepairer(handler, source)
+	// Heights 10 and 13 already exist; the first height being present must not skip the rest.
+	present := map[uint64]bool{10: true, 13: true}
+	r.MissingRanges = func(gap Gap) ([]Gap, error) {
+		var missing []Gap
+		for h := gap.Start; h <= gap.End; h++ {
+			if present[h] {
+				continue
+			}
+			if n := len(missing); n > 0 && missing[n-1].End == h-1 {
+				missing[n-1].End = h
+			} else {
+				missing = append(missing, Gap{Start: h, End: h})
+			}
+		}
+		return missing, nil
+	}
+	var statuses []string
+	r.OnGapStatus = func(i int, status string) { statuses = append(statuses, status) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 10, End: 15}}))
+
+	require.Equal(t, []uint64{11, 12, 14, 15}, handler.committedHeights())
+	require.Equal(t, []string{GapStatusRepaired}, statuses)
+	require.Zero(t, source.fetches[10])
+	require.Zero(t, source.fetches[13])
+}
+
+func TestEntryTransformDropsEntries(t *testing.T) {
+	RegisterEntryTransform(func(entry *lib.StateChangeEntry) (*lib.StateChangeEntry, bool) {
+		return entry, entry.BlockHeight%2 == 0
+	})
+	defer RegisterEntryTransform(nil)
+	dropped := EntriesDroppedByTransform()
+
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 6}}))
+
+	require.Equal(t, []uint64{2, 4, 6}, handler.committedHeights())
+	require.Equal(t, dropped+3, EntriesDroppedByTransform())
+}
+
+func TestParseRunDeadline(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+
+	deadline, err := ParseRunDeadline("8h", now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(8*time.Hour), deadline)
+
+	deadline, err = ParseRunDeadline("2026-01-02T06:00:00Z", now)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2026, 1, 2, 6, 0, 0, 0, time.UTC), deadline)
+
+	_, err = ParseRunDeadline("tomorrow", now)
+	require.Error(t, err)
+}
+
+// slowHandler advances the fake clock for every entry it handles, simulating slow blocks.
+type slowHandler struct {
+	*fakeHandler
+	clock   *fakeClock
+	perItem time.Duration
+}
+
+func (h *slowHandler) HandleEntryBatch(batchedEntries []*lib.StateChangeEntry, isMempool bool) error {
+	h.clock.now = h.clock.now.Add(h.perItem * time.Duration(len(batchedEntries)))
+	return h.fakeHandler.HandleEntryBatch(batchedEntries, isMempool)
+}
+
+func TestRunCommitsOnIntervalBeforeBatchSize(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	handler := &slowHandler{fakeHandler: newFakeHandler(), clock: clock, perItem: 10 * time.Second}
+	r := newTestRepairer(handler, newFakeSource())
+	r.Clock = clock
+	r.Options.SequentialThreshold = 0
+	r.Options.CommitBatchSize = 100
+	r.Options.CommitInterval = 25 * time.Second
+	var commits []Gap
+	r.OnCommit = func(committed Gap) { commits = append(commits, committed) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 8}}))
+
+	require.Equal(t, heightRange(1, 8), handler.committedHeights())
+	// Every third block takes 30s, past the 25s interval, long before 100 blocks are written.
+	require.Equal(t, []Gap{{Start: 1, End: 3}, {Start: 4, End: 6}, {Start: 7, End: 8}}, commits)
+}
+
+// flakyBeginHandler fails the first failures calls to InitiateTransaction.
+type flakyBeginHandler struct {
+	*fakeHandler
+	failures int
+	begins   int
+}
+
+func (h *flakyBeginHandler) InitiateTransaction() error {
+	h.begins++
+	if h.begins <= h.failures {
+		return errors.New("connection refused")
+	}
+	return h.fakeHandler.InitiateTransaction()
+}
+
+func TestRunRetriesInitiateTransaction(t *testing.T) {
+	handler := &flakyBeginHandler{fakeHandler: newFakeHandler(), failures: 1}
+	r := newTestRepairer(handler, newFakeSource())
+	clock := r.Clock.(*fakeClock)
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 3}}))
+
+	require.Equal(t, heightRange(1, 3), handler.committedHeights())
+	require.Equal(t, 2, handler.begins)
+	require.Equal(t, []time.Duration{time.Second}, clock.sleeps)
+}
+
+func TestRunFailsAfterInitiateTransactionRetries(t *testing.T) {
+	handler := &flakyBeginHandler{fakeHandler: newFakeHandler(), failures: 100}
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.BeginRetries = 2
+	clock := r.Clock.(*fakeClock)
+
+	err := r.Run(context.Background(), []Gap{{Start: 1, End: 3}})
+	require.ErrorContains(t, err, "could not start a transaction after 3 attempts")
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second}, clock.sleeps)
+	require.Empty(t, handler.committed)
+}
+
+func TestRunSleepsBetweenGaps(t *testing.T) {
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	clock := r.Clock.(*fakeClock)
+	r.Options.InterGapDelay = 3 * time.Second
+	r.Options.SequentialThreshold = 5
+	r.Options.ReorderBufferSize = 4
+
+	// The last gap is parallel, and streams through without pausing.
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 2}, {Start: 5, End: 5}, {Start: 20, End: 29}}))
+
+	require.Equal(t, append(append(heightRange(1, 2), 5), heightRange(20, 29)...), handler.committedHeights())
+	require.Equal(t, []time.Duration{3 * time.Second, 3 * time.Second}, clock.sleeps)
+}
+
+// heavySource serves blocks with 1000 transactions at every fifth height and one transaction elsewhere.
+type heavySource struct{ *fakeSource }
+
+func (s heavySource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	block, blockHash, err := s.fakeSource.FetchBlock(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	txnCount := 1
+	if height%5 == 0 {
+		txnCount = 1000
+	}
+	block.Txns = make([]*lib.MsgDeSoTxn, txnCount)
+	return block, blockHash, nil
+}
+
+func TestRunCommitsOnTxnRowsBeforeBatchSize(t *testing.T) {
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, heavySource{newFakeSource()})
+	r.Options.SequentialThreshold = 0
+	r.Options.ReorderBufferSize = 20
+	r.Options.CommitBatchSize = 100
+	r.Options.CommitTxnRows = 1500
+	var commits []Gap
+	r.OnCommit = func(committed Gap) { commits = append(commits, committed) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 20}}))
+
+	// Blocks 1-10 hold 2008 transactions, so the row threshold commits at 10 though only 10 blocks were written.
+	require.Equal(t, []Gap{{Start: 1, End: 10}, {Start: 11, End: 20}}, commits)
+	require.Equal(t, heightRange(1, 20), handler.committedHeights())
+}
+
+func TestWorkersForCPUsScalesWithCPUCountAndMode(t *testing.T) {
+	for _, numCPU := range []int{1, 2, 8, 64} {
+		api := WorkersForCPUs(numCPU, false)
+		stateChanges := WorkersForCPUs(numCPU, true)
+		require.Equal(t, numCPU*apiWorkersPerCPU, api, "%d CPUs", numCPU)
+		require.Equal(t, numCPU*stateChangeWorkersPerCPU, stateChanges, "%d CPUs", numCPU)
+		require.Greater(t, api, stateChanges, "API mode is IO-bound and should get more workers")
+	}
+	require.Equal(t, WorkersForCPUs(1, true), WorkersForCPUs(0, true))
+}
+
+func TestRunStopsCleanlyAtBlockNotFound(t *testing.T) {
+	// A tip of 12 ends the data at a multiple of the reorder buffer, a tip of 10 inside it.
+	for _, tip := range []uint64{10, 12} {
+		server := tipServer(tip, false)
+		for _, threshold := range []uint64{100, 0} {
+			handler := newFakeHandler()
+			r := newTestRepairer(handler, NewAPIBlockSource(server.URL))
+			r.Options.StopAtBlockNotFound = true
+			r.Options.SequentialThreshold = threshold
+			r.Options.ReorderBufferSize = 4
+			r.Options.CommitBatchSize = 3
+
+			require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 20}, {Start: 30, End: 31}}))
+
+			require.Equal(t, heightRange(1, tip), handler.committedHeights())
+			require.False(t, handler.InTransaction())
+		}
+		server.Close()
+	}
+}
+
+func TestRunFailsAtBlockNotFoundByDefault(t *testing.T) {
+	server := tipServer(12, false)
+	defer server.Close()
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, NewAPIBlockSource(server.URL))
+	r.Options.SequentialThreshold = 0
+
+	require.ErrorContains(t, r.Run(context.Background(), []Gap{{Start: 1, End: 20}}), "failed to fetch")
+}
+
+// laggingSource holds back each height that is 1 mod 4 until the height three above it has been fetched, so
+// every group of four completes out of order, lowest height last.
+type laggingSource struct {
+	*fakeSource
+	mu        sync.Mutex
+	completed []uint64
+	released  map[uint64]chan struct{}
+}
+
+func (s *laggingSource) release(height uint64) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released[height] == nil {
+		s.released[height] = make(chan struct{})
+	}
+	return s.released[height]
+}
+
+func (s *laggingSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	if height%4 == 1 {
+		select {
+		case <-s.release(height):
+		case <-time.After(5 * time.Second):
+			return nil, nil, fmt.Errorf("height %d wasn't fetched ahead of %d", height+3, height)
+		}
+	}
+	block, blockHash, err := s.fakeSource.FetchBlock(height)
+	s.mu.Lock()
+	s.completed = append(s.completed, height)
+	s.mu.Unlock()
+	if height%4 == 0 {
+		close(s.release(height - 3))
+	}
+	return block, blockHash, err
+}
+
+func TestRunWritesReorderedFetchesInHeightOrder(t *testing.T) {
+	source := &laggingSource{fakeSource: newFakeSource(), released: make(map[uint64]chan struct{})}
+	handler := newFakeHandler()
+	var written []uint64
+	// ahead is the most blocks fetched but not yet written at once.
+	ahead := 0
+	handler.fail = func(entry *lib.StateChangeEntry) error {
+		source.mu.Lock()
+		if n := len(source.completed) - len(written); n > ahead {
+			ahead = n
+		}
+		source.mu.Unlock()
+		written = append(written, entry.BlockHeight)
+		return nil
+	}
+	r := newTestRepairer(handler, source)
+	r.Options.SequentialThreshold = 0
+	r.Options.ReorderBufferSize = 4
+	r.Options.CommitBatchSize = 3
+	var commits []Gap
+	r.OnCommit = func(committed Gap) { commits = append(commits, committed) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 12}}))
+
+	// Each group of four was fetched lowest height last, but written and committed in height order.
+	require.NotEqual(t, heightRange(1, 12), source.completed)
+	require.Equal(t, heightRange(1, 12), written)
+	require.Equal(t, heightRange(1, 12), handler.committedHeights())
+	require.Equal(t, []Gap{{Start: 1, End: 3}, {Start: 4, End: 6}, {Start: 7, End: 9}, {Start: 10, End: 12}}, commits)
+	require.LessOrEqual(t, ahead, 4)
+	require.False(t, handler.InTransaction())
+}
+
+func TestFetchQueuesAreSizedByMultiplier(t *testing.T) {
+	r := newTestRepairer(newFakeHandler(), newFakeSource())
+	for multiplier, wantDepth := range map[int]int{0: 8, 1: 4, 2: 8, 5: 20} {
+		r.Options.QueueDepthMultiplier = multiplier
+		jobs, results := r.fetchQueues()
+		require.Equal(t, wantDepth, cap(jobs), "multiplier %d", multiplier)
+		require.Equal(t, wantDepth, cap(results), "multiplier %d", multiplier)
+	}
+
+	// A queue shallower than the worker count still fetches every block.
+	handler := newFakeHandler()
+	r = newTestRepairer(handler, newFakeSource())
+	r.Options.SequentialThreshold = 0
+	r.Options.QueueDepthMultiplier = 1
+	r.Options.Workers = 1
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 10}}))
+	require.Equal(t, heightRange(1, 10), handler.committedHeights())
+}
+
+func TestBlockTxnCountFilterLeavesOutHeightsOutsideBounds(t *testing.T) {
+	// heavySource gives every fifth block 1000 txns and the others one.
+	run := func(minTxns, maxTxns int, threshold uint64) (*fakeHandler, *Repairer, []uint64, []string) {
+		handler := newFakeHandler()
+		r := newTestRepairer(handler, heavySource{newFakeSource()})
+		r.Options.MinBlockTxns, r.Options.MaxBlockTxns = minTxns, maxTxns
+		r.Options.SequentialThreshold = threshold
+		r.Options.CommitBatchSize = 3
+		var reported []uint64
+		r.OnCommit = func(g Gap) { reported = append(reported, heightRange(g.Start, g.End)...) }
+		var statuses []string
+		r.OnGapStatus = func(i int, status string) { statuses = append(statuses, status) }
+		require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 10}}))
+		return handler, r, reported, statuses
+	}
+
+	for _, threshold := range []uint64{0, 100} {
+		handler, r, reported, statuses := run(2, 500, threshold)
+		require.Empty(t, handler.committedHeights())
+		require.Empty(t, reported)
+		require.Len(t, r.Filtered, 10)
+		require.Equal(t, []string{GapStatusFiltered}, statuses)
+
+		handler, r, reported, statuses = run(0, 500, threshold)
+		require.Equal(t, []uint64{1, 2, 3, 4, 6, 7, 8, 9}, handler.committedHeights())
+		require.Equal(t, handler.committedHeights(), reported)
+		require.Equal(t, []uint64{5, 10}, r.Filtered)
+		require.Equal(t, []string{GapStatusFiltered}, statuses)
+
+		handler, _, reported, statuses = run(1000, 0, threshold)
+		require.Equal(t, []uint64{5, 10}, handler.committedHeights())
+		require.Equal(t, []uint64{5, 10}, reported)
+		require.Equal(t, []string{GapStatusFiltered}, statuses)
+
+		handler, r, _, statuses = run(1, 1000, threshold)
+		require.Equal(t, heightRange(1, 10), handler.committedHeights())
+		require.Empty(t, r.Filtered)
+		require.Equal(t, []string{GapStatusRepaired}, statuses)
+	}
+}
+
+func TestRunRecordsGapTimings(t *testing.T) {
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	clock := r.Clock.(*fakeClock)
+	// Each block takes a second of fake time.
+	handler.fail = func(entry *lib.StateChangeEntry) error {
+		clock.now = clock.now.Add(time.Second)
+		return nil
+	}
+	r.MissingRanges = func(gap Gap) ([]Gap, error) {
+		if gap.Start == 20 {
+			return nil, nil
+		}
+		return []Gap{gap}, nil
+	}
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 3}, {Start: 10, End: 15}, {Start: 20, End: 21}}))
+
+	require.Len(t, r.Timings, 3)
+	require.Equal(t, Gap{Start: 1, End: 3}, r.Timings[0].Gap)
+	require.Equal(t, GapStatusRepaired, r.Timings[0].Status)
+	require.Equal(t, GapStatusRepaired, r.Timings[1].Status)
+	require.Greater(t, r.Timings[1].Duration(), r.Timings[0].Duration())
+	require.Equal(t, GapStatusSkipped, r.Timings[2].Status)
+	for _, timing := range r.Timings[:2] {
+		require.Greater(t, timing.Duration(), time.Duration(0))
+	}
+
+	var report strings.Builder
+	require.NoError(t, WriteGapTimingReport(&report, r.Timings))
+	require.Contains(t, report.String(), "gap 10 -> 15: 6 blocks in ")
+	require.Contains(t, report.String(), "[skipped]")
+	require.Contains(t, report.String(), "across 3 gap(s)")
+}
@@ -0,0 +1,123 @@
+package repair
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RangeCounts is the number of block and transaction rows stored for a range of heights.
+type RangeCounts struct {
+	Range        Gap
+	Blocks       int64
+	Transactions int64
+}
+
+// CountRows returns the block and transaction row counts for each range.
+func CountRows(ctx context.Context, db Querier, ranges []Gap) ([]RangeCounts, error) {
+	counts := make([]RangeCounts, 0, len(ranges))
+	for _, r := range ranges {
+		query := fmt.Sprintf(`SELECT
+  (SELECT COUNT(*) FROM block WHERE height BETWEEN %d AND %d),
+  (SELECT COUNT(*) FROM "transaction" WHERE block_height BETWEEN %d AND %d)`, r.Start, r.End, r.Start, r.End)
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("count rows for %d -> %d: %w", r.Start, r.End, err)
+		}
+		c := RangeCounts{Range: r}
+		if rows.Next() {
+			err = rows.Scan(&c.Blocks, &c.Transactions)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("count rows for %d -> %d: %w", r.Start, r.End, err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, nil
+}
+
+// RowCountDelta is the change in a range's row counts over a run.
+type RowCountDelta struct {
+	Range                                 Gap
+	BlocksBefore, BlocksAfter             int64
+	TransactionsBefore, TransactionsAfter int64
+}
+
+// DiffRowCounts pairs up before and after snapshots of the same ranges.
+func DiffRowCounts(before, after []RangeCounts) []RowCountDelta {
+	afterByRange := make(map[Gap]RangeCounts, len(after))
+	for _, c := range after {
+		afterByRange[c.Range] = c
+	}
+	deltas := make([]RowCountDelta, 0, len(before))
+	for _, b := range before {
+		a := afterByRange[b.Range]
+		deltas = append(deltas, RowCountDelta{
+			Range:              b.Range,
+			BlocksBefore:       b.Blocks,
+			BlocksAfter:        a.Blocks,
+			TransactionsBefore: b.Transactions,
+			TransactionsAfter:  a.Transactions,
+		})
+	}
+	return deltas
+}
+
+// WriteRowCountReport writes deltas as a diff-style report, one line per table and range. partial marks a
+// report for a run that stopped before finishing.
+func WriteRowCountReport(w io.Writer, deltas []RowCountDelta, partial bool) error {
+	bw := bufio.NewWriter(w)
+	if partial {
+		fmt.Fprintf(bw, "# Row count report (PARTIAL: run stopped early)\n")
+	} else {
+		fmt.Fprintf(bw, "# Row count report\n")
+	}
+	var blocks, txns int64
+	for _, d := range deltas {
+		fmt.Fprintf(bw, "@@ heights %d -> %d @@\n", d.Range.Start, d.Range.End)
+		fmt.Fprintf(bw, "  block:       %d -> %d (%+d)\n", d.BlocksBefore, d.BlocksAfter, d.BlocksAfter-d.BlocksBefore)
+		fmt.Fprintf(bw, "  transaction: %d -> %d (%+d)\n", d.TransactionsBefore, d.TransactionsAfter, d.TransactionsAfter-d.TransactionsBefore)
+		blocks += d.BlocksAfter - d.BlocksBefore
+		txns += d.TransactionsAfter - d.TransactionsBefore
+	}
+	fmt.Fprintf(bw, "Total: block %+d, transaction %+d across %d range(s)\n", blocks, txns, len(deltas))
+	return bw.Flush()
+}
+
+// WriteGapTimingReport writes one line per gap with how long it took, then the slowest gap by blocks per
+// second, so anomalously slow regions of a long run stand out.
+func WriteGapTimingReport(w io.Writer, timings []GapTiming) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Gap timing report\n")
+	var total time.Duration
+	slowest := -1
+	for i, t := range timings {
+		blocks := t.Gap.End - t.Gap.Start + 1
+		fmt.Fprintf(bw, "  gap %d -> %d: %d blocks in %s (%.1f blocks/s) [%s]\n",
+			t.Gap.Start, t.Gap.End, blocks, t.Duration().Round(time.Millisecond), blocksPerSecond(t), t.Status)
+		total += t.Duration()
+		if t.Status == GapStatusRepaired && (slowest < 0 || blocksPerSecond(t) < blocksPerSecond(timings[slowest])) {
+			slowest = i
+		}
+	}
+	fmt.Fprintf(bw, "Total: %s across %d gap(s)\n", total.Round(time.Millisecond), len(timings))
+	if slowest >= 0 {
+		s := timings[slowest]
+		fmt.Fprintf(bw, "Slowest repaired gap: %d -> %d (%.1f blocks/s)\n", s.Gap.Start, s.Gap.End, blocksPerSecond(s))
+	}
+	return bw.Flush()
+}
+
+func blocksPerSecond(t GapTiming) float64 {
+	seconds := t.Duration().Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(t.Gap.End-t.Gap.Start+1) / seconds
+}
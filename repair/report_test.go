@@ -0,0 +1,107 @@
+package repair
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+)
+
+// txnSource serves blocks with height%3 transactions.
+type txnSource struct{ *fakeSource }
+
+func (s txnSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	block, blockHash, err := s.fakeSource.FetchBlock(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	block.Txns = make([]*lib.MsgDeSoTxn, height%3)
+	return block, blockHash, nil
+}
+
+// countingFixture answers CountRows queries from the entries handler has committed.
+func countingFixture(handler *fakeHandler) *queryFixture {
+	return &queryFixture{
+		columns: []string{"blocks", "transactions"},
+		respond: func(query string) [][]driver.Value {
+			var start, end uint64
+			fmt.Sscanf(query[strings.Index(query, "BETWEEN"):], "BETWEEN %d AND %d", &start, &end)
+			var blocks, txns int64
+			for _, entry := range handler.committed {
+				if entry.BlockHeight >= start && entry.BlockHeight <= end {
+					blocks++
+					txns += int64(len(entry.Encoder.(*lib.MsgDeSoBlock).Txns))
+				}
+			}
+			return [][]driver.Value{{blocks, txns}}
+		},
+	}
+}
+
+func TestRowCountReportMatchesRunChanges(t *testing.T) {
+	handler := newFakeHandler()
+	db := openFixtureDB(t, countingFixture(handler))
+	gaps := []Gap{{Start: 1, End: 5}, {Start: 10, End: 12}}
+	// Height 11 is already stored before the run.
+	require.NoError(t, handler.InitiateTransaction())
+	require.NoError(t, handler.HandleEntryBatch([]*lib.StateChangeEntry{{BlockHeight: 11, Encoder: &lib.MsgDeSoBlock{}}}, false))
+	require.NoError(t, handler.CommitTransaction())
+
+	before, err := CountRows(context.Background(), db, gaps)
+	require.NoError(t, err)
+
+	r := newTestRepairer(handler, txnSource{newFakeSource()})
+	r.MissingRanges = func(gap Gap) ([]Gap, error) {
+		if gap.Start == 10 {
+			return []Gap{{Start: 10, End: 10}, {Start: 12, End: 12}}, nil
+		}
+		return []Gap{gap}, nil
+	}
+	require.NoError(t, r.Run(context.Background(), gaps))
+
+	after, err := CountRows(context.Background(), db, gaps)
+	require.NoError(t, err)
+	deltas := DiffRowCounts(before, after)
+	require.Equal(t, []RowCountDelta{
+		// Heights 1-5 carry 1+2+0+1+2 transactions.
+		{Range: Gap{Start: 1, End: 5}, BlocksBefore: 0, BlocksAfter: 5, TransactionsBefore: 0, TransactionsAfter: 6},
+		{Range: Gap{Start: 10, End: 12}, BlocksBefore: 1, BlocksAfter: 3, TransactionsBefore: 0, TransactionsAfter: 1},
+	}, deltas)
+
+	var report bytes.Buffer
+	require.NoError(t, WriteRowCountReport(&report, deltas, false))
+	require.Contains(t, report.String(), "@@ heights 1 -> 5 @@\n  block:       0 -> 5 (+5)\n  transaction: 0 -> 6 (+6)\n")
+	require.Contains(t, report.String(), "Total: block +7, transaction +7 across 2 range(s)")
+	require.NotContains(t, report.String(), "PARTIAL")
+}
+
+func TestRowCountReportForStoppedRun(t *testing.T) {
+	handler := newFakeHandler()
+	db := openFixtureDB(t, countingFixture(handler))
+	gaps := []Gap{{Start: 1, End: 3}, {Start: 7, End: 8}}
+	before, err := CountRows(context.Background(), db, gaps)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newTestRepairer(handler, newFakeSource())
+	r.OnGapStatus = func(int, string) { cancel() }
+	var stopped *RunStoppedError
+	require.ErrorAs(t, r.Run(ctx, gaps), &stopped)
+
+	after, err := CountRows(context.Background(), db, gaps)
+	require.NoError(t, err)
+	deltas := DiffRowCounts(before, after)
+	require.Equal(t, int64(3), deltas[0].BlocksAfter)
+	require.Equal(t, int64(0), deltas[1].BlocksAfter)
+
+	var report bytes.Buffer
+	require.NoError(t, WriteRowCountReport(&report, deltas, true))
+	require.Contains(t, report.String(), "PARTIAL")
+	require.Contains(t, report.String(), "Total: block +3, transaction +0 across 2 range(s)")
+}
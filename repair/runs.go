@@ -0,0 +1,104 @@
+package repair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Repair run statuses recorded in the repair_runs table.
+const (
+	RunStatusRunning   = "running"
+	RunStatusCompleted = "completed"
+	RunStatusStopped   = "stopped"
+	RunStatusFailed    = "failed"
+)
+
+// PGRepairRun is a row in the repair_runs table, one per run of the repair tool.
+type PGRepairRun struct {
+	bun.BaseModel `bun:"table:repair_runs"`
+	ID            int64 `bun:",pk,autoincrement"`
+	StartedAt     time.Time
+	FinishedAt    time.Time `bun:",nullzero"`
+	StartHeight   uint64
+	EndHeight     uint64
+	GapCount      int
+	Mode          string
+	NodeURL       string
+	// HeightsCommitted is the number of heights covered by the run's commits.
+	HeightsCommitted uint64
+	Status           string
+	Error            string `bun:",nullzero"`
+}
+
+// EnsureRepairRunsTable creates the repair_runs table if it doesn't already exist.
+func EnsureRepairRunsTable(db *bun.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS repair_runs (
+			id                BIGSERIAL PRIMARY KEY,
+			started_at        TIMESTAMP NOT NULL,
+			finished_at       TIMESTAMP,
+			start_height      BIGINT NOT NULL,
+			end_height        BIGINT NOT NULL,
+			gap_count         INT NOT NULL,
+			mode              VARCHAR NOT NULL,
+			node_url          VARCHAR NOT NULL,
+			heights_committed BIGINT NOT NULL,
+			status            VARCHAR NOT NULL,
+			error             VARCHAR
+		);
+		CREATE INDEX IF NOT EXISTS repair_runs_height_range_idx ON repair_runs (start_height, end_height);
+	`)
+	if err != nil {
+		return fmt.Errorf("create repair_runs table: %w", err)
+	}
+	return nil
+}
+
+// StartRepairRun inserts a running row for a run over gaps and returns it with its generated ID.
+func StartRepairRun(db *bun.DB, gaps []Gap, mode, nodeURL string) (*PGRepairRun, error) {
+	run := &PGRepairRun{
+		StartedAt: time.Now().UTC(),
+		GapCount:  len(gaps),
+		Mode:      mode,
+		NodeURL:   nodeURL,
+		Status:    RunStatusRunning,
+	}
+	for i, g := range gaps {
+		if i == 0 || g.Start < run.StartHeight {
+			run.StartHeight = g.Start
+		}
+		if g.End > run.EndHeight {
+			run.EndHeight = g.End
+		}
+	}
+	if _, err := db.NewInsert().Model(run).Exec(context.Background()); err != nil {
+		return nil, fmt.Errorf("insert repair_runs row: %w", err)
+	}
+	return run, nil
+}
+
+// FinishRepairRun records the outcome of a run: completed when runErr is nil, stopped when the run stopped
+// early with a checkpoint, and failed otherwise.
+func FinishRepairRun(db *bun.DB, run *PGRepairRun, heightsCommitted uint64, runErr error) error {
+	run.FinishedAt = time.Now().UTC()
+	run.HeightsCommitted = heightsCommitted
+	var stopped *RunStoppedError
+	switch {
+	case runErr == nil:
+		run.Status = RunStatusCompleted
+	case errors.As(runErr, &stopped):
+		run.Status = RunStatusStopped
+		run.Error = runErr.Error()
+	default:
+		run.Status = RunStatusFailed
+		run.Error = runErr.Error()
+	}
+	if _, err := db.NewUpdate().Model(run).Column("finished_at", "heights_committed", "status", "error").WherePK().Exec(context.Background()); err != nil {
+		return fmt.Errorf("update repair_runs row %d: %w", run.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+func TestRepairRunIsRecordedAndFinalized(t *testing.T) {
+	fixture := &queryFixture{
+		columns: []string{"id"},
+		respond: func(query string) [][]driver.Value {
+			if strings.HasPrefix(query, "INSERT") {
+				return [][]driver.Value{{int64(7)}}
+			}
+			return nil
+		},
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+
+	run, err := StartRepairRun(db, []Gap{{Start: 500, End: 510}, {Start: 100, End: 120}}, "api", "http://node:17001")
+	require.NoError(t, err)
+	require.Equal(t, int64(7), run.ID)
+	require.Equal(t, uint64(100), run.StartHeight)
+	require.Equal(t, uint64(510), run.EndHeight)
+	require.Len(t, fixture.queries, 1)
+	require.Contains(t, fixture.queries[0], `INSERT INTO "repair_runs"`)
+	require.Contains(t, fixture.queries[0], "'running'")
+	require.Contains(t, fixture.queries[0], "'http://node:17001'")
+
+	require.NoError(t, FinishRepairRun(db, run, 32, nil))
+	require.Equal(t, RunStatusCompleted, run.Status)
+	require.Len(t, fixture.queries, 2)
+	require.Contains(t, fixture.queries[1], `UPDATE "repair_runs"`)
+	require.Contains(t, fixture.queries[1], "'completed'")
+	require.Contains(t, fixture.queries[1], `"id" = 7`)
+
+	require.NoError(t, FinishRepairRun(db, run, 5, &RunStoppedError{NextHeight: 105, Cause: context.DeadlineExceeded}))
+	require.Equal(t, RunStatusStopped, run.Status)
+	require.NoError(t, FinishRepairRun(db, run, 0, errors.New("boom")))
+	require.Equal(t, RunStatusFailed, run.Status)
+	require.Contains(t, fixture.queries[3], "'boom'")
+}
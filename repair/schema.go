@@ -0,0 +1,84 @@
+package repair
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultFingerprintTables are the tables the repair tool writes or reads, and so the ones whose schema
+// differences explain most "works here but not there" failures.
+var DefaultFingerprintTables = []string{
+	"block",
+	"block_signer",
+	"transaction",
+	"transaction_partitioned",
+	"utxo_operation",
+	"affected_public_key",
+}
+
+// SchemaFingerprint is a normalized description of a set of tables. Lines holds one sorted line per column
+// and per key constraint, so two fingerprints can be compared with diff; Hash summarizes them.
+type SchemaFingerprint struct {
+	Lines []string
+	Hash  string
+}
+
+// FingerprintSchema introspects tables through information_schema and returns their fingerprint. Columns
+// are described by name, type, nullability and default; primary key, unique and foreign key constraints by
+// type and columns. Constraint names and column positions are left out, since they differ between
+// databases that ran the same migrations in a different order. CHECK constraints are left out too, as
+// Postgres reports NOT NULL as CHECK constraints with OID-derived names; nullability is on the columns.
+func FingerprintSchema(ctx context.Context, db Querier, tables []string) (*SchemaFingerprint, error) {
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables to fingerprint")
+	}
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		if strings.ContainsAny(table, `'"\`) {
+			return nil, fmt.Errorf("invalid table name %q", table)
+		}
+		quoted[i] = "'" + table + "'"
+	}
+	tableList := strings.Join(quoted, ", ")
+	query := fmt.Sprintf(`SELECT c.table_name, 'column' AS kind,
+	c.column_name || ' ' || c.udt_name ||
+		CASE WHEN c.is_nullable = 'NO' THEN ' NOT NULL' ELSE '' END ||
+		COALESCE(' DEFAULT ' || c.column_default, '') AS definition
+FROM information_schema.columns AS c
+WHERE c.table_schema = current_schema() AND c.table_name IN (%s)
+UNION ALL
+SELECT tc.table_name, lower(tc.constraint_type) AS kind,
+	string_agg(k.column_name, ',' ORDER BY k.ordinal_position) AS definition
+FROM information_schema.table_constraints AS tc
+JOIN information_schema.key_column_usage AS k
+	ON k.constraint_schema = tc.constraint_schema AND k.constraint_name = tc.constraint_name
+WHERE tc.table_schema = current_schema() AND tc.table_name IN (%s)
+	AND tc.constraint_type IN ('PRIMARY KEY', 'UNIQUE', 'FOREIGN KEY')
+GROUP BY tc.table_name, tc.constraint_type, tc.constraint_name`, tableList, tableList)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("schema fingerprint query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var table, kind, definition string
+		if err := rows.Scan(&table, &kind, &definition); err != nil {
+			return nil, fmt.Errorf("schema fingerprint scan: %w", err)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s", table, kind, definition))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("schema fingerprint rows: %w", err)
+	}
+	// Sort here rather than in SQL so the order doesn't depend on the database's collation.
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return &SchemaFingerprint{Lines: lines, Hash: hex.EncodeToString(sum[:])}, nil
+}
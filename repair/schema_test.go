@@ -0,0 +1,58 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintSchemaIsStableAndDetectsAddedColumn(t *testing.T) {
+	schema := [][]driver.Value{
+		{"block", "column", "block_hash varchar NOT NULL"},
+		{"block", "column", "height int8 NOT NULL"},
+		{"block", "primary key", "block_hash"},
+		{"block_signer", "column", "block_hash varchar NOT NULL"},
+		{"block_signer", "column", "signer_index int8 NOT NULL"},
+		{"block_signer", "primary key", "block_hash,signer_index"},
+	}
+	calls := 0
+	fixture := &queryFixture{
+		columns: []string{"table_name", "kind", "definition"},
+		respond: func(query string) [][]driver.Value {
+			calls++
+			if calls%2 == 0 {
+				// Return the rows in a different order on alternate runs.
+				reversed := make([][]driver.Value, len(schema))
+				for i, row := range schema {
+					reversed[len(schema)-1-i] = row
+				}
+				return reversed
+			}
+			return schema
+		},
+	}
+	db := openFixtureDB(t, fixture)
+	tables := []string{"block", "block_signer"}
+
+	first, err := FingerprintSchema(context.Background(), db, tables)
+	require.NoError(t, err)
+	second, err := FingerprintSchema(context.Background(), db, tables)
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+	require.Len(t, first.Lines, len(schema))
+	require.Contains(t, fixture.queries[0], "information_schema.columns")
+
+	schema = append(schema, []driver.Value{"block_signer", "column", "view int8"})
+	changed, err := FingerprintSchema(context.Background(), db, tables)
+	require.NoError(t, err)
+	require.NotEqual(t, first.Hash, changed.Hash)
+	require.Contains(t, changed.Lines, "block_signer column view int8")
+}
+
+func TestFingerprintSchemaRejectsQuotedTableNames(t *testing.T) {
+	db := openFixtureDB(t, &queryFixture{columns: []string{"table_name", "kind", "definition"}})
+	_, err := FingerprintSchema(context.Background(), db, []string{"block'; DROP TABLE block; --"})
+	require.ErrorContains(t, err, "invalid table name")
+}
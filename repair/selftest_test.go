@@ -0,0 +1,32 @@
+package repair
+
+import (
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/entries"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTestPassesOnFixture(t *testing.T) {
+	problems, err := SelfTest(&lib.DeSoTestnetParams)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+}
+
+func TestSelfTestHandlerRevertsToSavepoint(t *testing.T) {
+	// The rows handled after a savepoint that is reverted to are never committed.
+	fixture, err := selfTestFixture()
+	require.NoError(t, err)
+	handler := &selfTestHandler{params: &lib.DeSoTestnetParams, rows: make(map[uint64][]*entries.PGBlockEntry)}
+	require.NoError(t, handler.InitiateTransaction())
+	require.NoError(t, handler.HandleEntryBatch(fixture[:2], false))
+	sp, err := handler.CreateSavepoint()
+	require.NoError(t, err)
+	require.NoError(t, handler.HandleEntryBatch(fixture[2:], false))
+	require.NoError(t, handler.RevertToSavepoint(sp))
+	require.NoError(t, handler.CommitTransaction())
+
+	require.Len(t, handler.rows, 2)
+	require.Equal(t, fixture[0].BlockHeight, handler.rows[fixture[0].BlockHeight][0].Height)
+}
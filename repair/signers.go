@@ -0,0 +1,247 @@
+package repair
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/entries"
+	"github.com/uptrace/bun"
+)
+
+// SignerlessBlock is a PoS block that has no block_signer rows.
+type SignerlessBlock struct {
+	Height    uint64 `bun:"height"`
+	BlockHash string `bun:"block_hash"`
+}
+
+// DetectSignerlessBlocks returns PoS-era blocks (above the PoS cutover height) that have no block_signer
+// rows. Every such block carries a QC, so an empty signer set means signer population failed. If end is
+// non-zero, detection is restricted to [start, end].
+func DetectSignerlessBlocks(db *bun.DB, posCutoverHeight, start, end uint64) ([]SignerlessBlock, error) {
+	var blocks []SignerlessBlock
+	query := db.NewSelect().
+		TableExpr("block AS b").
+		Column("b.height", "b.block_hash").
+		Where("b.height > ?", posCutoverHeight).
+		Where("NOT EXISTS (SELECT 1 FROM block_signer AS s WHERE s.block_hash = b.block_hash)").
+		Order("b.height")
+	if end > 0 {
+		query = query.Where("b.height BETWEEN ? AND ?", start, end)
+	}
+	if err := query.Scan(context.Background(), &blocks); err != nil {
+		return nil, fmt.Errorf("detectSignerlessBlocks query failed: %w", err)
+	}
+	return blocks, nil
+}
+
+// RepairSignerlessBlocks re-upserts the block entries for the given heights from the state-change files,
+// which carry the full QC (unlike the API), so their block_signer rows are populated.
+func RepairSignerlessBlocks(stateChangeDir string, format IndexFormat, blocks []SignerlessBlock, h EntryHandler) (int, error) {
+	wanted := make(map[uint64]bool, len(blocks))
+	for _, b := range blocks {
+		wanted[b.Height] = true
+	}
+
+	if err := h.InitiateTransaction(); err != nil {
+		return 0, fmt.Errorf("initiate transaction: %w", err)
+	}
+	repaired := 0
+	err := ForEachStateChangeEntry(stateChangeDir, format, func(entry *lib.StateChangeEntry) error {
+		if entry.EncoderType != lib.EncoderTypeBlock || !wanted[entry.BlockHeight] {
+			return nil
+		}
+		entry.OperationType = lib.DbOperationTypeUpsert
+		if err := handleEntryBatchAtomic(h, []*lib.StateChangeEntry{entry}); err != nil {
+			log.Printf("WARNING: Failed to repair signers for block %d: %v", entry.BlockHeight, err)
+			return nil
+		}
+		delete(wanted, entry.BlockHeight)
+		repaired++
+		if repaired%1000 == 0 {
+			if err := h.CommitTransaction(); err != nil {
+				return fmt.Errorf("commit transaction: %w", err)
+			}
+			log.Printf("Repaired signers for %d/%d blocks", repaired, len(blocks))
+			if err := h.InitiateTransaction(); err != nil {
+				return fmt.Errorf("initiate transaction: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		rollBackSignerRepair(h, err)
+		return repaired, err
+	}
+	if err := h.CommitTransaction(); err != nil {
+		err = fmt.Errorf("commit transaction: %w", err)
+		rollBackSignerRepair(h, err)
+		return repaired, err
+	}
+	if len(wanted) > 0 {
+		log.Printf("WARNING: %d signerless block(s) were not found in the state-change files", len(wanted))
+	}
+	return repaired, nil
+}
+
+// rollBackSignerRepair rolls back the transaction a failed signer repair left open, so the blocks repaired
+// since the last commit don't linger in it.
+func rollBackSignerRepair(h EntryHandler, cause error) {
+	if !h.InTransaction() {
+		return
+	}
+	if err := h.RollbackTransaction(); err != nil {
+		log.Printf("WARNING: Failed to roll back signer repair after %v: %v", cause, err)
+	}
+}
+
+// SignerMismatch is a block whose block_signer row count differs from the signers set in its QC.
+type SignerMismatch struct {
+	Height    uint64
+	BlockHash string
+	Expected  int
+	Actual    int
+}
+
+// expectedSignerCount returns the number of block_signer rows the handler writes for block, i.e. the number
+// of set bits in its QC's signers list.
+func expectedSignerCount(block *lib.MsgDeSoBlock, blockHash []byte) (int, error) {
+	_, signers, err := entries.BlockEncoderToPGStruct(block, blockHash, &lib.GlobalDeSoParams)
+	if err != nil {
+		return 0, err
+	}
+	return len(signers), nil
+}
+
+// checkBlockSigners compares the block_signer rows stored for block with its QC. It returns nil if they match.
+func checkBlockSigners(ctx context.Context, db Querier, height uint64, block *lib.MsgDeSoBlock, blockHash []byte) (*SignerMismatch, error) {
+	hashHex := hex.EncodeToString(blockHash)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM block_signer WHERE block_hash = '%s'", hashHex))
+	if err != nil {
+		return nil, fmt.Errorf("count signers for block %d: %w", height, err)
+	}
+	defer rows.Close()
+	var actual int
+	if rows.Next() {
+		if err := rows.Scan(&actual); err != nil {
+			return nil, fmt.Errorf("scan signer count for block %d: %w", height, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("count signers for block %d: %w", height, err)
+	}
+
+	expected, err := expectedSignerCount(block, blockHash)
+	if err != nil {
+		return nil, fmt.Errorf("expected signers for block %d: %w", height, err)
+	}
+	if actual == expected {
+		return nil, nil
+	}
+	return &SignerMismatch{Height: height, BlockHash: hashHex, Expected: expected, Actual: actual}, nil
+}
+
+// VerifySigners checks that every block in [start, end] has as many block_signer rows as its QC has
+// signers, fetching the blocks from source. It returns the blocks that don't.
+func VerifySigners(ctx context.Context, db Querier, source BlockSource, start, end uint64) ([]SignerMismatch, error) {
+	var mismatches []SignerMismatch
+	for h := start; h <= end; h++ {
+		if err := ctx.Err(); err != nil {
+			return mismatches, err
+		}
+		block, blockHash, err := source.FetchBlock(h)
+		if err != nil {
+			return mismatches, fmt.Errorf("fetch block %d: %w", h, err)
+		}
+		mismatch, err := checkBlockSigners(ctx, db, h, block, blockHash[:])
+		if err != nil {
+			return mismatches, err
+		}
+		if mismatch != nil {
+			mismatches = append(mismatches, *mismatch)
+		}
+	}
+	return mismatches, nil
+}
+
+// VerifySignersFromStateChanges is VerifySigners reading the blocks in [start, end] from the state-change
+// files, whose QCs are complete.
+func VerifySignersFromStateChanges(ctx context.Context, db Querier, stateChangeDir string, format IndexFormat, start, end uint64) ([]SignerMismatch, error) {
+	var mismatches []SignerMismatch
+	err := ForEachStateChangeEntry(stateChangeDir, format, func(entry *lib.StateChangeEntry) error {
+		if entry.EncoderType != lib.EncoderTypeBlock || entry.BlockHeight < start || entry.BlockHeight > end {
+			return nil
+		}
+		block, ok := entry.Encoder.(*lib.MsgDeSoBlock)
+		if !ok {
+			return nil
+		}
+		mismatch, err := checkBlockSigners(ctx, db, entry.BlockHeight, block, entry.KeyBytes)
+		if err != nil {
+			return err
+		}
+		if mismatch != nil {
+			mismatches = append(mismatches, *mismatch)
+		}
+		return ctx.Err()
+	})
+	return mismatches, err
+}
+
+// OrphanedSigners is a block hash with block_signer rows but no block row, e.g. left behind by an incomplete
+// delete.
+type OrphanedSigners struct {
+	BlockHash string
+	Rows      int
+}
+
+// orphanedSignersCondition matches block_signer rows aliased as s whose block is gone.
+const orphanedSignersCondition = "NOT EXISTS (SELECT 1 FROM block AS b WHERE b.block_hash = s.block_hash)"
+
+// DetectOrphanedSigners returns the block hashes that have block_signer rows but no block row. Nothing in
+// the schema enforces the reference, so these survive the blocks they belonged to.
+func DetectOrphanedSigners(ctx context.Context, db Querier) ([]OrphanedSigners, error) {
+	rows, err := db.QueryContext(ctx, `SELECT s.block_hash, COUNT(*) FROM block_signer AS s
+WHERE `+orphanedSignersCondition+`
+GROUP BY s.block_hash
+ORDER BY s.block_hash`)
+	if err != nil {
+		return nil, fmt.Errorf("orphaned signers query failed: %w", err)
+	}
+	defer rows.Close()
+	var orphans []OrphanedSigners
+	for rows.Next() {
+		var o OrphanedSigners
+		if err := rows.Scan(&o.BlockHash, &o.Rows); err != nil {
+			return nil, fmt.Errorf("orphaned signers scan: %w", err)
+		}
+		orphans = append(orphans, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("orphaned signers rows: %w", err)
+	}
+	return orphans, nil
+}
+
+// DeleteOrphanedSigners deletes every block_signer row whose block is gone and returns how many were deleted.
+// The condition is re-evaluated by the delete, so a block written since detection keeps its signers.
+func DeleteOrphanedSigners(ctx context.Context, db Querier) (int, error) {
+	// RETURNING lets the delete run through QueryContext, so any Querier can do it.
+	rows, err := db.QueryContext(ctx, `DELETE FROM block_signer AS s
+WHERE `+orphanedSignersCondition+`
+RETURNING s.block_hash`)
+	if err != nil {
+		return 0, fmt.Errorf("delete orphaned signers: %w", err)
+	}
+	defer rows.Close()
+	deleted := 0
+	for rows.Next() {
+		deleted++
+	}
+	if err := rows.Err(); err != nil {
+		return deleted, fmt.Errorf("delete orphaned signers: %w", err)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,161 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deso-protocol/core/collections/bitset"
+	"github.com/deso-protocol/core/lib"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+// qcSource serves PoS blocks whose vote QC was signed by the validators at signerIndices.
+type qcSource struct {
+	*fakeSource
+	signerIndices []int
+}
+
+func (s *qcSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	block, blockHash, err := s.fakeSource.FetchBlock(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	signers := bitset.NewBitset()
+	for _, i := range s.signerIndices {
+		signers.Set(i, true)
+	}
+	block.Header.ValidatorsVoteQC = &lib.QuorumCertificate{
+		BlockHash:                         &lib.BlockHash{},
+		ValidatorsVoteAggregatedSignature: &lib.AggregatedBLSSignature{SignersList: signers},
+	}
+	return block, blockHash, nil
+}
+
+func TestVerifySignersFlagsWrongSignerCount(t *testing.T) {
+	source := &qcSource{fakeSource: newFakeSource(), signerIndices: []int{0, 2, 5}}
+	// The DB only has two block_signer rows for the block.
+	fixture := &queryFixture{columns: []string{"count"}, rows: [][]driver.Value{{int64(2)}}}
+	db := openFixtureDB(t, fixture)
+
+	mismatches, err := VerifySigners(context.Background(), db, source, 40, 40)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	_, blockHash, _ := source.FetchBlock(40)
+	require.Equal(t, SignerMismatch{Height: 40, BlockHash: hex.EncodeToString(blockHash[:]), Expected: 3, Actual: 2}, mismatches[0])
+	require.Contains(t, fixture.queries[0], hex.EncodeToString(blockHash[:]))
+}
+
+func TestVerifySignersAcceptsMatchingSignerCount(t *testing.T) {
+	source := &qcSource{fakeSource: newFakeSource(), signerIndices: []int{0, 2, 5}}
+	db := openFixtureDB(t, &queryFixture{columns: []string{"count"}, rows: [][]driver.Value{{int64(3)}}})
+
+	mismatches, err := VerifySigners(context.Background(), db, source, 40, 42)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
+
+func TestDetectAndDeleteOrphanedSigners(t *testing.T) {
+	blocks := map[string]bool{"aa": true}
+	// Signer rows by block hash; "bb" lost its block.
+	signers := map[string]int{"aa": 3, "bb": 2}
+	fixture := &queryFixture{}
+	fixture.respond = func(query string) [][]driver.Value {
+		var rows [][]driver.Value
+		if strings.HasPrefix(query, "DELETE") {
+			fixture.columns = []string{"block_hash"}
+			for hash, count := range signers {
+				if blocks[hash] {
+					continue
+				}
+				for i := 0; i < count; i++ {
+					rows = append(rows, []driver.Value{hash})
+				}
+				delete(signers, hash)
+			}
+			return rows
+		}
+		fixture.columns = []string{"block_hash", "count"}
+		for hash, count := range signers {
+			if !blocks[hash] {
+				rows = append(rows, []driver.Value{hash, int64(count)})
+			}
+		}
+		return rows
+	}
+	db := openFixtureDB(t, fixture)
+
+	orphans, err := DetectOrphanedSigners(context.Background(), db)
+	require.NoError(t, err)
+	require.Equal(t, []OrphanedSigners{{BlockHash: "bb", Rows: 2}}, orphans)
+	require.Contains(t, fixture.queries[0], orphanedSignersCondition)
+
+	deleted, err := DeleteOrphanedSigners(context.Background(), db)
+	require.NoError(t, err)
+	require.Equal(t, 2, deleted)
+	require.Equal(t, map[string]int{"aa": 3}, signers)
+
+	orphans, err = DetectOrphanedSigners(context.Background(), db)
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+}
+
+func TestDetectSignerlessBlocksSkipsBlocksWithSigners(t *testing.T) {
+	const posCutoverHeight = 100
+	// Block hashes by height; 90 predates PoS and has no signers either.
+	blocks := map[int64]string{90: "a0", 101: "a1", 102: "a2", 103: "a3", 104: "a4"}
+	signers := map[string]int{"a1": 3, "a3": 2}
+	fixture := &queryFixture{columns: []string{"height", "block_hash"}}
+	fixture.respond = func(query string) [][]driver.Value {
+		require.Contains(t, query, "b.height > 100")
+		require.Contains(t, query, "NOT EXISTS (SELECT 1 FROM block_signer AS s WHERE s.block_hash = b.block_hash)")
+		start, end := int64(posCutoverHeight+1), int64(104)
+		if i := strings.Index(query, "BETWEEN"); i >= 0 {
+			_, err := fmt.Sscanf(query[i:], "BETWEEN %d AND %d", &start, &end)
+			require.NoError(t, err)
+		}
+		var rows [][]driver.Value
+		for height := start; height <= end; height++ {
+			if signers[blocks[height]] == 0 {
+				rows = append(rows, []driver.Value{height, blocks[height]})
+			}
+		}
+		return rows
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+
+	detected, err := DetectSignerlessBlocks(db, posCutoverHeight, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []SignerlessBlock{{Height: 102, BlockHash: "a2"}, {Height: 104, BlockHash: "a4"}}, detected)
+
+	detected, err = DetectSignerlessBlocks(db, posCutoverHeight, 103, 104)
+	require.NoError(t, err)
+	require.Equal(t, []SignerlessBlock{{Height: 104, BlockHash: "a4"}}, detected)
+}
+
+func TestRepairSignerlessBlocksRollsBackOnFailure(t *testing.T) {
+	blocks := []SignerlessBlock{{Height: 5}, {Height: 6}}
+
+	handler := newFakeHandler()
+	_, err := RepairSignerlessBlocks(filepath.Join(t.TempDir(), "missing"), DefaultIndexFormat, blocks, handler)
+	require.ErrorContains(t, err, "failed to open state-change files")
+	require.False(t, handler.InTransaction())
+	require.Equal(t, 1, handler.rollbacks)
+
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{blockStateChange(5), blockStateChange(6)})
+	handler = newFakeHandler()
+	handler.commitErr = errors.New("connection reset")
+	repaired, err := RepairSignerlessBlocks(dir, DefaultIndexFormat, blocks, handler)
+	require.ErrorContains(t, err, "connection reset")
+	require.Equal(t, 2, repaired)
+	require.False(t, handler.InTransaction())
+	require.Equal(t, 1, handler.rollbacks)
+	require.Empty(t, handler.committed)
+}
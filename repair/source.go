@@ -0,0 +1,438 @@
+package repair
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// BlockSource fetches a block and its hash by height.
+type BlockSource interface {
+	FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error)
+}
+
+// BlockHeader is the part of a block header needed to fix block timestamps.
+type BlockHeader struct {
+	BlockHashHex   string
+	TstampNanoSecs int64
+}
+
+// HeaderSource fetches a block header by height without its transactions.
+type HeaderSource interface {
+	FetchHeader(height uint64) (*BlockHeader, error)
+}
+
+// TipSource reports the height of the node's current chain tip.
+type TipSource interface {
+	FetchTipHeight() (uint64, error)
+}
+
+// APIBlockSource fetches blocks from a DeSo node's /api/v1/block endpoint.
+type APIBlockSource struct {
+	NodeURL string
+	// VerifyTxnCount makes FetchBlock compare the returned transaction list against the count the node
+	// reports in a separate header-only request.
+	VerifyTxnCount bool
+	// TruncatedRetries is how many times a block that comes back truncated is refetched.
+	TruncatedRetries int
+	// RawBlockPath, if set, is a node endpoint (e.g. /api/v1/block-bytes) that returns the serialized block at
+	// the POSTed height. Those bytes decode into a complete block, QC and BLS fields included, whose hash is
+	// computed locally. If the node doesn't serve the endpoint, the JSON endpoint is used instead.
+	RawBlockPath string
+	// ExtraRequestFields are added to the JSON body of every /api/v1/block request, for nodes or proxies that
+	// expect more than Height and FullBlock (an API version, a flag to include utxo ops). They can't override
+	// Height or FullBlock.
+	ExtraRequestFields map[string]interface{}
+	Client             *http.Client
+	Clock              Clock
+
+	// rawUnavailable is set once the node has answered that it doesn't serve RawBlockPath.
+	rawUnavailable int32
+}
+
+// ErrBlockNotFound is returned by APIBlockSource when the node has no block at the requested height, e.g.
+// because it is past the tip or the node has pruned it.
+var ErrBlockNotFound = errors.New("block not found")
+
+// isBlockNotFound reports whether a node response means there is no block at the requested height. The node
+// answers with a 404 or with an error message that says the block wasn't found or the height is past the tip.
+func isBlockNotFound(statusCode int, message string) bool {
+	if statusCode == http.StatusNotFound {
+		return true
+	}
+	message = strings.ToLower(message)
+	return strings.Contains(message, "not found") || strings.Contains(message, "greater than")
+}
+
+// errRawBlockUnavailable reports that the node doesn't serve the raw block endpoint.
+var errRawBlockUnavailable = errors.New("raw block endpoint unavailable")
+
+// NewAPIBlockSource returns an APIBlockSource for nodeURL with the default client and retry settings.
+func NewAPIBlockSource(nodeURL string) *APIBlockSource {
+	return &APIBlockSource{
+		NodeURL:          nodeURL,
+		TruncatedRetries: 3,
+		Client:           &http.Client{Timeout: 30 * time.Second},
+		Clock:            SystemClock,
+	}
+}
+
+// NewHTTP2Transport returns a transport for node requests that speaks only HTTP/2: negotiated with ALPN for
+// https:// node URLs, and unencrypted with prior knowledge (h2c) for http:// ones. Concurrent fetches share a
+// connection as separate streams, so a run with hundreds of workers needs a handful of connections instead
+// of one each. Once the server's SETTINGS_MAX_CONCURRENT_STREAMS are in use, a further request opens another
+// connection rather than wait. A node or proxy that only speaks HTTP/1.1 fails every request.
+func NewHTTP2Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+// ParseExtraRequestFields parses BLOCK_REQUEST_EXTRA_FIELDS, a JSON object whose fields are added to every
+// block request body. Height and FullBlock are set per request, so they are rejected.
+func ParseExtraRequestFields(value string) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return nil, fmt.Errorf("BLOCK_REQUEST_EXTRA_FIELDS must be a JSON object: %w", err)
+	}
+	for _, name := range []string{"Height", "FullBlock"} {
+		if _, ok := fields[name]; ok {
+			return nil, fmt.Errorf("BLOCK_REQUEST_EXTRA_FIELDS can't set %s, which is set per request", name)
+		}
+	}
+	return fields, nil
+}
+
+// postBlockRequest sends a /api/v1/block request for height and returns the raw response body.
+func (s *APIBlockSource) postBlockRequest(height uint64, fullBlock bool) ([]byte, error) {
+	url := fmt.Sprintf("%s/api/v1/block", s.NodeURL)
+	fields := make(map[string]interface{}, len(s.ExtraRequestFields)+2)
+	for name, value := range s.ExtraRequestFields {
+		fields[name] = value
+	}
+	fields["Height"] = height
+	fields["FullBlock"] = fullBlock
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("marshal block request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if isBlockNotFound(resp.StatusCode, string(respBody)) {
+			return nil, fmt.Errorf("%w at height %d: status %d: %s", ErrBlockNotFound, height, resp.StatusCode, string(respBody))
+		}
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+	}
+	return respBody, nil
+}
+
+// FetchTxnCount asks the node for the block at height without full transactions and returns the
+// number of transactions it reports.
+func (s *APIBlockSource) FetchTxnCount(height uint64) (int, error) {
+	respBody, err := s.postBlockRequest(height, false)
+	if err != nil {
+		return 0, err
+	}
+	var apiResult struct {
+		Transactions []json.RawMessage `json:"Transactions"`
+		Error        string            `json:"Error"`
+	}
+	if err := json.Unmarshal(respBody, &apiResult); err != nil {
+		return 0, fmt.Errorf("unmarshal response: %w", err)
+	}
+	if apiResult.Error != "" {
+		return 0, fmt.Errorf("API error: %s", apiResult.Error)
+	}
+	return len(apiResult.Transactions), nil
+}
+
+// FetchBlock fetches a block from the DeSo node by height using the /api/v1/block endpoint.
+// Returns the block and its hash (from the API, not computed).
+// When VerifyTxnCount is set, a block whose transaction list is shorter than the count the node
+// reports separately is treated as a transient truncation and refetched, failing after TruncatedRetries.
+func (s *APIBlockSource) FetchBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	for attempt := 0; ; attempt++ {
+		block, blockHash, err := s.fetchBlockOnce(height)
+		if err != nil || !s.VerifyTxnCount {
+			return block, blockHash, err
+		}
+
+		reported, err := s.FetchTxnCount(height)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetch txn count for block %d: %w", height, err)
+		}
+		if reported <= len(block.Txns) {
+			return block, blockHash, nil
+		}
+		if attempt >= s.TruncatedRetries {
+			return nil, nil, fmt.Errorf("block %d still truncated after %d retries: node reports %d txns, got %d",
+				height, s.TruncatedRetries, reported, len(block.Txns))
+		}
+		log.Printf("WARNING: Block %d returned %d txns but node reports %d, refetching (attempt %d/%d)",
+			height, len(block.Txns), reported, attempt+1, s.TruncatedRetries)
+		s.Clock.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+}
+
+// fetchBlockOnce fetches the block at height once, from RawBlockPath when the node serves it and from the
+// JSON endpoint otherwise.
+func (s *APIBlockSource) fetchBlockOnce(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	if s.RawBlockPath != "" && atomic.LoadInt32(&s.rawUnavailable) == 0 {
+		block, blockHash, err := s.fetchRawBlockByHeight(height)
+		if !errors.Is(err, errRawBlockUnavailable) {
+			return block, blockHash, err
+		}
+		if atomic.CompareAndSwapInt32(&s.rawUnavailable, 0, 1) {
+			log.Printf("WARNING: Node doesn't serve %s (%v), falling back to /api/v1/block", s.RawBlockPath, err)
+		}
+	}
+	return s.fetchFullBlock(height)
+}
+
+// fetchRawBlockByHeight fetches the serialized block at height from RawBlockPath and decodes it. Unlike
+// fetchFullBlock, the block is complete, so its hash is computed rather than taken from the node.
+func (s *APIBlockSource) fetchRawBlockByHeight(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	body, err := json.Marshal(map[string]interface{}{"Height": height})
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal raw block request: %w", err)
+	}
+	resp, err := s.Client.Post(s.NodeURL+s.RawBlockPath, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read response: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, nil, fmt.Errorf("%w: status %d", errRawBlockUnavailable, resp.StatusCode)
+	default:
+		return nil, nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	block := &lib.MsgDeSoBlock{}
+	if err := block.FromBytes(respBody); err != nil {
+		return nil, nil, fmt.Errorf("decode raw block %d: %w", height, err)
+	}
+	if block.Header == nil || block.Header.Height != height {
+		return nil, nil, fmt.Errorf("raw block endpoint returned the wrong block for height %d", height)
+	}
+	blockHash, err := block.Hash()
+	if err != nil {
+		return nil, nil, fmt.Errorf("hash raw block %d: %w", height, err)
+	}
+	return block, blockHash, nil
+}
+
+// fetchFullBlock performs a single FullBlock request and decodes the response.
+func (s *APIBlockSource) fetchFullBlock(height uint64) (*lib.MsgDeSoBlock, *lib.BlockHash, error) {
+	respBody, err := s.postBlockRequest(height, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Parse APIBlockResponse format
+	// The API returns hashes as hex strings in specific field names
+	var apiResult struct {
+		Header struct {
+			BlockHashHex                 string `json:"BlockHashHex"`
+			Version                      uint32 `json:"Version"`
+			PrevBlockHashHex             string `json:"PrevBlockHashHex"`
+			TransactionMerkleRootHex     string `json:"TransactionMerkleRootHex"`
+			TstampNanoSecs               int64  `json:"TstampNanoSecs"`
+			Height                       uint64 `json:"Height"`
+			Nonce                        uint64 `json:"Nonce"`
+			ExtraNonce                   uint64 `json:"ExtraNonce"`
+			ProposerVotingPublicKey      string `json:"ProposerVotingPublicKey"`
+			ProposerRandomSeedSignature  string `json:"ProposerRandomSeedSignature"`
+			ProposedInView               uint64 `json:"ProposedInView"`
+			ProposerVotePartialSignature string `json:"ProposerVotePartialSignature"`
+		} `json:"Header"`
+		Transactions []struct {
+			RawTransactionHex string `json:"RawTransactionHex"`
+		} `json:"Transactions"`
+		Error string `json:"Error"`
+	}
+	if err := json.Unmarshal(respBody, &apiResult); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	if apiResult.Error != "" {
+		if isBlockNotFound(http.StatusOK, apiResult.Error) {
+			return nil, nil, fmt.Errorf("%w at height %d: %s", ErrBlockNotFound, height, apiResult.Error)
+		}
+		return nil, nil, fmt.Errorf("API error: %s", apiResult.Error)
+	}
+
+	// Decode hex strings to BlockHash
+	prevBlockHash, err := decodeBlockHash(apiResult.Header.PrevBlockHashHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode prev block hash: %w", err)
+	}
+
+	txnMerkleRoot, err := decodeBlockHash(apiResult.Header.TransactionMerkleRootHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode txn merkle root: %w", err)
+	}
+
+	// Build the proper Header struct
+	header := &lib.MsgDeSoHeader{
+		Version:               apiResult.Header.Version,
+		PrevBlockHash:         prevBlockHash,
+		TransactionMerkleRoot: txnMerkleRoot,
+		TstampNanoSecs:        apiResult.Header.TstampNanoSecs,
+		Height:                apiResult.Header.Height,
+		Nonce:                 apiResult.Header.Nonce,
+		ExtraNonce:            apiResult.Header.ExtraNonce,
+		ProposedInView:        apiResult.Header.ProposedInView,
+	}
+
+	// For PoS blocks, the API returns BLS fields as base64-encoded strings
+	// We need to decode them, but for now we'll use a simpler approach:
+	// skip BLS validation (RawBlockPath gives complete blocks when the node serves it)
+	// The state-consumer doesn't validate block hashes, it just stores them
+	// So we can leave BLS fields nil and use the block hash from the API response
+
+	// Decode transactions from hex
+	txns := make([]*lib.MsgDeSoTxn, len(apiResult.Transactions))
+	for i, txData := range apiResult.Transactions {
+		txnBytes, err := hex.DecodeString(txData.RawTransactionHex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decode transaction %d hex: %w", i, err)
+		}
+
+		txn := &lib.MsgDeSoTxn{}
+		if err := txn.FromBytes(txnBytes); err != nil {
+			return nil, nil, fmt.Errorf("parse transaction %d bytes: %w", i, err)
+		}
+		txns[i] = txn
+	}
+
+	// Some block versions come back without a merkle root. It is derived from the transactions so the
+	// block row is complete, but only when missing: a root the API did send is kept as is, so a wrong
+	// one still shows up as a mismatch instead of being silently replaced.
+	if header.TransactionMerkleRoot == nil && len(txns) > 0 {
+		header.TransactionMerkleRoot, _, err = lib.ComputeMerkleRoot(txns)
+		if err != nil {
+			return nil, nil, fmt.Errorf("compute txn merkle root for block %d: %w", height, err)
+		}
+		log.Printf("Block %d: API response has no transaction merkle root, derived %s from its %d transactions",
+			height, header.TransactionMerkleRoot, len(txns))
+	}
+
+	block := &lib.MsgDeSoBlock{
+		Header: header,
+		Txns:   txns,
+	}
+
+	// Return the block hash from the API (don't compute it, as that requires BLS fields for PoS blocks)
+	blockHash, err := decodeBlockHash(apiResult.Header.BlockHashHex)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode block hash from API: %w", err)
+	}
+
+	return block, blockHash, nil
+}
+
+// FetchHeader fetches only the header of the block at height.
+func (s *APIBlockSource) FetchHeader(height uint64) (*BlockHeader, error) {
+	respBody, err := s.postBlockRequest(height, false)
+	if err != nil {
+		return nil, err
+	}
+	var apiResult struct {
+		Header BlockHeader `json:"Header"`
+		Error  string      `json:"Error"`
+	}
+	if err := json.Unmarshal(respBody, &apiResult); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+	if apiResult.Error != "" {
+		return nil, fmt.Errorf("API error: %s", apiResult.Error)
+	}
+	return &apiResult.Header, nil
+}
+
+// FetchTipHeight returns the height of the node's best block from the /api/v1 endpoint.
+func (s *APIBlockSource) FetchTipHeight() (uint64, error) {
+	resp, err := s.Client.Get(fmt.Sprintf("%s/api/v1", s.NodeURL))
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d: %s", resp.StatusCode, string(respBody))
+	}
+	var apiResult struct {
+		Header *struct {
+			Height uint64 `json:"Height"`
+		} `json:"Header"`
+		Error string `json:"Error"`
+	}
+	if err := json.Unmarshal(respBody, &apiResult); err != nil {
+		return 0, fmt.Errorf("unmarshal response: %w", err)
+	}
+	if apiResult.Error != "" {
+		return 0, fmt.Errorf("API error: %s", apiResult.Error)
+	}
+	if apiResult.Header == nil {
+		return 0, fmt.Errorf("node returned no tip header")
+	}
+	return apiResult.Header.Height, nil
+}
+
+// decodeBlockHash converts a hex string to *lib.BlockHash
+func decodeBlockHash(hexStr string) (*lib.BlockHash, error) {
+	if hexStr == "" {
+		return nil, nil
+	}
+
+	hashBytes, err := hex.DecodeString(hexStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hashBytes) != lib.HashSizeBytes {
+		return nil, fmt.Errorf("invalid hash length: got %d, want %d", len(hashBytes), lib.HashSizeBytes)
+	}
+
+	var blockHash lib.BlockHash
+	copy(blockHash[:], hashBytes)
+	return &blockHash, nil
+}
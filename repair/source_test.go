@@ -0,0 +1,281 @@
+package repair
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/entries"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIBlockSourceRefetchesTruncatedBlocks(t *testing.T) {
+	var fullFetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Height    uint64
+			FullBlock bool
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := map[string]interface{}{
+			"Header": map[string]interface{}{
+				"BlockHashHex": strings.Repeat("ab", 32),
+				"Height":       req.Height,
+			},
+			"Transactions": []interface{}{},
+		}
+		if req.FullBlock {
+			atomic.AddInt32(&fullFetches, 1)
+		} else {
+			// The header-only response reports a transaction the full block never returns.
+			resp["Transactions"] = []interface{}{map[string]interface{}{}}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	clock := &fakeClock{}
+	source := NewAPIBlockSource(server.URL)
+	source.Clock = clock
+	source.TruncatedRetries = 2
+
+	source.VerifyTxnCount = false
+	block, blockHash, err := source.FetchBlock(7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), block.Header.Height)
+	require.Equal(t, byte(0xab), blockHash[0])
+	require.Equal(t, int32(1), atomic.LoadInt32(&fullFetches))
+
+	atomic.StoreInt32(&fullFetches, 0)
+	source.VerifyTxnCount = true
+	_, _, err = source.FetchBlock(7)
+	require.ErrorContains(t, err, "still truncated after 2 retries")
+	require.Equal(t, int32(3), atomic.LoadInt32(&fullFetches))
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second}, clock.sleeps)
+}
+
+func TestAPIBlockSourceSendsExtraRequestFields(t *testing.T) {
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bodies = append(bodies, req)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Header":       map[string]interface{}{"BlockHashHex": strings.Repeat("ab", 32), "Height": req["Height"]},
+			"Transactions": []interface{}{},
+		})
+	}))
+	defer server.Close()
+
+	fields, err := ParseExtraRequestFields(`{"APIVersion": 2, "IncludeUtxoOps": true}`)
+	require.NoError(t, err)
+	source := NewAPIBlockSource(server.URL)
+	source.ExtraRequestFields = fields
+
+	_, _, err = source.FetchBlock(7)
+	require.NoError(t, err)
+	require.Equal(t, []map[string]interface{}{
+		{"Height": float64(7), "FullBlock": true, "APIVersion": float64(2), "IncludeUtxoOps": true},
+	}, bodies)
+
+	_, err = ParseExtraRequestFields(`{"Height": 1}`)
+	require.ErrorContains(t, err, "can't set Height")
+	_, err = ParseExtraRequestFields(`[1]`)
+	require.Error(t, err)
+}
+
+func TestAPIBlockSourceNegotiatesHTTP2(t *testing.T) {
+	var mu sync.Mutex
+	var protos []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protos = append(protos, r.Proto)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Header":       map[string]interface{}{"BlockHashHex": strings.Repeat("ab", 32), "Height": 7},
+			"Transactions": []interface{}{},
+		})
+	})
+
+	// Over TLS, HTTP/2 is negotiated with ALPN.
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	transport := NewHTTP2Transport()
+	transport.TLSClientConfig = tlsServer.Client().Transport.(*http.Transport).TLSClientConfig
+	source := NewAPIBlockSource(tlsServer.URL)
+	source.Client.Transport = transport
+	_, _, err := source.FetchBlock(7)
+	require.NoError(t, err)
+
+	// A plain http:// node is spoken to with h2c.
+	h2cServer := httptest.NewUnstartedServer(handler)
+	h2cServer.Config.Protocols = new(http.Protocols)
+	h2cServer.Config.Protocols.SetHTTP1(true)
+	h2cServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cServer.Start()
+	defer h2cServer.Close()
+	source = NewAPIBlockSource(h2cServer.URL)
+	source.Client.Transport = NewHTTP2Transport()
+	_, _, err = source.FetchBlock(7)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"HTTP/2.0", "HTTP/2.0"}, protos)
+}
+
+func TestAPIBlockSourceDecodesRawBlockBytes(t *testing.T) {
+	want := &lib.MsgDeSoBlock{
+		Header: &lib.MsgDeSoHeader{
+			Version:               1,
+			PrevBlockHash:         &lib.BlockHash{0x01},
+			TransactionMerkleRoot: &lib.BlockHash{0x02},
+			TstampNanoSecs:        1700000000000000000,
+			Height:                42,
+			Nonce:                 7,
+			ExtraNonce:            9,
+		},
+		Txns: []*lib.MsgDeSoTxn{{TxnMeta: &lib.BlockRewardMetadataa{ExtraData: []byte("reward")}}},
+	}
+	wantBytes, err := want.ToBytes(false)
+	require.NoError(t, err)
+	wantHash, err := want.Hash()
+	require.NoError(t, err)
+
+	var jsonFetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/block-bytes" {
+			w.Write(wantBytes)
+			return
+		}
+		atomic.AddInt32(&jsonFetches, 1)
+		http.Error(w, "unexpected JSON fetch", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	source := NewAPIBlockSource(server.URL)
+	source.RawBlockPath = "/api/v1/block-bytes"
+	block, blockHash, err := source.FetchBlock(42)
+	require.NoError(t, err)
+	require.Equal(t, *wantHash, *blockHash)
+	require.Equal(t, want.Header, block.Header)
+	require.Len(t, block.Txns, 1)
+	require.Equal(t, lib.TxnTypeBlockReward, block.Txns[0].TxnMeta.GetTxnType())
+	require.Zero(t, atomic.LoadInt32(&jsonFetches))
+}
+
+func TestAPIBlockSourceFallsBackWhenRawBlocksUnavailable(t *testing.T) {
+	var rawFetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/block-bytes" {
+			atomic.AddInt32(&rawFetches, 1)
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Header":       map[string]interface{}{"BlockHashHex": strings.Repeat("cd", 32), "Height": 5},
+			"Transactions": []interface{}{},
+		})
+	}))
+	defer server.Close()
+
+	source := NewAPIBlockSource(server.URL)
+	source.RawBlockPath = "/api/v1/block-bytes"
+	for i := 0; i < 2; i++ {
+		block, blockHash, err := source.FetchBlock(5)
+		require.NoError(t, err)
+		require.Equal(t, uint64(5), block.Header.Height)
+		require.Equal(t, byte(0xcd), blockHash[0])
+	}
+	// The missing endpoint is only tried once.
+	require.Equal(t, int32(1), atomic.LoadInt32(&rawFetches))
+}
+
+// tipServer serves blocks up to tip, answering a 404 above it or, with errorBody, a 200 carrying the node's
+// error message.
+func tipServer(tip uint64, errorBody bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Height uint64 }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Height > tip {
+			if errorBody {
+				json.NewEncoder(w).Encode(map[string]interface{}{"Error": "Block with height not found"})
+				return
+			}
+			http.Error(w, "block not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Header":       map[string]interface{}{"BlockHashHex": strings.Repeat("ef", 32), "Height": req.Height},
+			"Transactions": []interface{}{},
+		})
+	}))
+}
+
+func TestAPIBlockSourceReportsBlockNotFound(t *testing.T) {
+	for _, errorBody := range []bool{false, true} {
+		server := tipServer(5, errorBody)
+		source := NewAPIBlockSource(server.URL)
+
+		_, _, err := source.FetchBlock(5)
+		require.NoError(t, err)
+		_, _, err = source.FetchBlock(6)
+		require.ErrorIs(t, err, ErrBlockNotFound)
+		server.Close()
+	}
+
+	require.True(t, isBlockNotFound(http.StatusNotFound, ""))
+	require.True(t, isBlockNotFound(http.StatusOK, "Height 900 is greater than the tip"))
+	require.False(t, isBlockNotFound(http.StatusInternalServerError, "database is locked"))
+}
+
+func TestAPIBlockSourceDerivesMissingTxnMerkleRoot(t *testing.T) {
+	txn := &lib.MsgDeSoTxn{TxnMeta: &lib.BlockRewardMetadataa{ExtraData: []byte("reward")}}
+	txnBytes, err := txn.ToBytes(false)
+	require.NoError(t, err)
+	wantRoot, _, err := lib.ComputeMerkleRoot([]*lib.MsgDeSoTxn{txn})
+	require.NoError(t, err)
+
+	var merkleRootHex string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Header": map[string]interface{}{
+				"BlockHashHex":             strings.Repeat("ef", 32),
+				"Height":                   9,
+				"TransactionMerkleRootHex": merkleRootHex,
+			},
+			"Transactions": []interface{}{map[string]interface{}{"RawTransactionHex": hex.EncodeToString(txnBytes)}},
+		})
+	}))
+	defer server.Close()
+	source := NewAPIBlockSource(server.URL)
+
+	block, blockHash, err := source.FetchBlock(9)
+	require.NoError(t, err)
+	require.Equal(t, *wantRoot, *block.Header.TransactionMerkleRoot)
+	row, _, err := entries.BlockEncoderToPGStruct(block, blockHash[:], &lib.DeSoTestnetParams)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(wantRoot[:]), row.TxnMerkleRoot)
+
+	// A root the API sent is kept even though it doesn't match the transactions.
+	merkleRootHex = strings.Repeat("01", 32)
+	block, _, err = source.FetchBlock(9)
+	require.NoError(t, err)
+	require.Equal(t, merkleRootHex, hex.EncodeToString(block.Header.TransactionMerkleRoot[:]))
+}
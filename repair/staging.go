@@ -0,0 +1,80 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// StagingBlockTable is where STAGE_BLOCKS writes repaired block rows until MergeStagedBlocks moves them into
+// block.
+const StagingBlockTable = "block_repair_staging"
+
+// CreateBlockStagingTable creates StagingBlockTable with block's columns, defaults and indexes unless it
+// already exists. Rows left there by a stopped run are kept, so the next merge picks them up. The table's
+// indexes grow alongside block's, so the disk needs room for a second copy of every repaired row until the
+// merge.
+func CreateBlockStagingTable(ctx context.Context, db Querier) error {
+	rows, err := db.QueryContext(ctx, "CREATE TABLE IF NOT EXISTS "+StagingBlockTable+" (LIKE block INCLUDING ALL)")
+	if err != nil {
+		return fmt.Errorf("create %s: %w", StagingBlockTable, err)
+	}
+	return rows.Close()
+}
+
+// stagingColumns returns the columns of StagingBlockTable in table order.
+func stagingColumns(ctx context.Context, db Querier) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT column_name FROM information_schema.columns
+WHERE table_name = '`+StagingBlockTable+`' AND table_schema = current_schema()
+ORDER BY ordinal_position`)
+	if err != nil {
+		return nil, fmt.Errorf("%s columns: %w", StagingBlockTable, err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, fmt.Errorf("%s columns: %w", StagingBlockTable, err)
+		}
+		columns = append(columns, `"`+column+`"`)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s columns: %w", StagingBlockTable, err)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("%s does not exist", StagingBlockTable)
+	}
+	return columns, nil
+}
+
+// MergeStagedBlocks moves every row of StagingBlockTable into block in one statement, upserting on
+// conflictTarget the way the handler does, and returns how many rows it merged. The staging table is left
+// empty, so the merge can be repeated after a failure.
+func MergeStagedBlocks(ctx context.Context, db Querier, conflictTarget string) (int, error) {
+	columns, err := stagingColumns(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	list := strings.Join(columns, ", ")
+	updates := make([]string, len(columns))
+	for i, column := range columns {
+		updates[i] = column + " = EXCLUDED." + column
+	}
+	rows, err := db.QueryContext(ctx, `WITH staged AS (DELETE FROM `+StagingBlockTable+` RETURNING `+list+`)
+INSERT INTO block (`+list+`) SELECT `+list+` FROM staged
+ON CONFLICT (`+conflictTarget+`) DO UPDATE SET `+strings.Join(updates, ", ")+`
+RETURNING block_hash`)
+	if err != nil {
+		return 0, fmt.Errorf("merge %s into block: %w", StagingBlockTable, err)
+	}
+	defer rows.Close()
+	merged := 0
+	for rows.Next() {
+		merged++
+	}
+	if err := rows.Err(); err != nil {
+		return merged, fmt.Errorf("merge %s into block: %w", StagingBlockTable, err)
+	}
+	return merged, nil
+}
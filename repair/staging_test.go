@@ -0,0 +1,55 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeStagedBlocksMovesStagedRowsIntoBlock(t *testing.T) {
+	// Heights by block hash. The repair wrote "bb" and "cc" to staging; "aa" was already live.
+	live := map[string]int64{"aa": 1}
+	staging := map[string]int64{"bb": 2, "cc": 3}
+	fixture := &queryFixture{}
+	fixture.respond = func(query string) [][]driver.Value {
+		var rows [][]driver.Value
+		switch {
+		case strings.HasPrefix(query, "CREATE TABLE"):
+			fixture.columns = nil
+		case strings.Contains(query, "information_schema.columns"):
+			fixture.columns = []string{"column_name"}
+			rows = [][]driver.Value{{"block_hash"}, {"height"}}
+		case strings.HasPrefix(query, "WITH staged"):
+			fixture.columns = []string{"block_hash"}
+			for hash, height := range staging {
+				live[hash] = height
+				rows = append(rows, []driver.Value{hash})
+			}
+			staging = map[string]int64{}
+		}
+		return rows
+	}
+	db := openFixtureDB(t, fixture)
+	ctx := context.Background()
+
+	require.NoError(t, CreateBlockStagingTable(ctx, db))
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS block_repair_staging (LIKE block INCLUDING ALL)", fixture.queries[0])
+
+	merged, err := MergeStagedBlocks(ctx, db, "block_hash")
+	require.NoError(t, err)
+	require.Equal(t, 2, merged)
+	require.Equal(t, map[string]int64{"aa": 1, "bb": 2, "cc": 3}, live)
+	require.Empty(t, staging)
+	query := fixture.queries[len(fixture.queries)-1]
+	require.Contains(t, query, `DELETE FROM block_repair_staging RETURNING "block_hash", "height"`)
+	require.Contains(t, query, `INSERT INTO block ("block_hash", "height") SELECT "block_hash", "height" FROM staged`)
+	require.Contains(t, query, `ON CONFLICT (block_hash) DO UPDATE SET "block_hash" = EXCLUDED."block_hash", "height" = EXCLUDED."height"`)
+
+	// A second merge finds nothing left to move.
+	merged, err = MergeStagedBlocks(ctx, db, "block_hash")
+	require.NoError(t, err)
+	require.Zero(t, merged)
+}
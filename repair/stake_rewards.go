@@ -0,0 +1,62 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+)
+
+// OrphanedStakeRewards is a block hash with stake_reward rows but no block row, e.g. left behind by an
+// incomplete delete or a block replaced without its rewards being cleaned up.
+type OrphanedStakeRewards struct {
+	BlockHash   string
+	Rows        int
+	RewardNanos uint64
+}
+
+// orphanedStakeRewardsCondition matches stake_reward rows aliased as r whose block is gone.
+const orphanedStakeRewardsCondition = "NOT EXISTS (SELECT 1 FROM block AS b WHERE b.block_hash = r.block_hash)"
+
+// DetectOrphanedStakeRewards returns the block hashes that have stake_reward rows but no block row, with the
+// rewards they hold. Like block_signer, nothing in the schema enforces the reference.
+func DetectOrphanedStakeRewards(ctx context.Context, db Querier) ([]OrphanedStakeRewards, error) {
+	rows, err := db.QueryContext(ctx, `SELECT r.block_hash, COUNT(*), COALESCE(SUM(r.reward_nanos), 0) FROM stake_reward AS r
+WHERE `+orphanedStakeRewardsCondition+`
+GROUP BY r.block_hash
+ORDER BY r.block_hash`)
+	if err != nil {
+		return nil, fmt.Errorf("orphaned stake rewards query failed: %w", err)
+	}
+	defer rows.Close()
+	var orphans []OrphanedStakeRewards
+	for rows.Next() {
+		var o OrphanedStakeRewards
+		if err := rows.Scan(&o.BlockHash, &o.Rows, &o.RewardNanos); err != nil {
+			return nil, fmt.Errorf("orphaned stake rewards scan: %w", err)
+		}
+		orphans = append(orphans, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("orphaned stake rewards rows: %w", err)
+	}
+	return orphans, nil
+}
+
+// DeleteOrphanedStakeRewards deletes every stake_reward row whose block is gone and returns how many were
+// deleted. As with DeleteOrphanedSigners, a block written since detection keeps its rewards.
+func DeleteOrphanedStakeRewards(ctx context.Context, db Querier) (int, error) {
+	rows, err := db.QueryContext(ctx, `DELETE FROM stake_reward AS r
+WHERE `+orphanedStakeRewardsCondition+`
+RETURNING r.block_hash`)
+	if err != nil {
+		return 0, fmt.Errorf("delete orphaned stake rewards: %w", err)
+	}
+	defer rows.Close()
+	deleted := 0
+	for rows.Next() {
+		deleted++
+	}
+	if err := rows.Err(); err != nil {
+		return deleted, fmt.Errorf("delete orphaned stake rewards: %w", err)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,60 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectAndDeleteOrphanedStakeRewards(t *testing.T) {
+	blocks := map[string]bool{"aa": true}
+	// Reward amounts by block hash; "bb" was replaced without its rewards being cleaned.
+	rewards := map[string][]int64{"aa": {100, 200}, "bb": {50, 70, 30}}
+	fixture := &queryFixture{}
+	fixture.respond = func(query string) [][]driver.Value {
+		var rows [][]driver.Value
+		if strings.HasPrefix(query, "DELETE") {
+			fixture.columns = []string{"block_hash"}
+			for hash, amounts := range rewards {
+				if blocks[hash] {
+					continue
+				}
+				for range amounts {
+					rows = append(rows, []driver.Value{hash})
+				}
+				delete(rewards, hash)
+			}
+			return rows
+		}
+		fixture.columns = []string{"block_hash", "count", "sum"}
+		for hash, amounts := range rewards {
+			if blocks[hash] {
+				continue
+			}
+			var sum int64
+			for _, a := range amounts {
+				sum += a
+			}
+			rows = append(rows, []driver.Value{hash, int64(len(amounts)), sum})
+		}
+		return rows
+	}
+	db := openFixtureDB(t, fixture)
+
+	orphans, err := DetectOrphanedStakeRewards(context.Background(), db)
+	require.NoError(t, err)
+	require.Equal(t, []OrphanedStakeRewards{{BlockHash: "bb", Rows: 3, RewardNanos: 150}}, orphans)
+	require.Contains(t, fixture.queries[0], orphanedStakeRewardsCondition)
+
+	deleted, err := DeleteOrphanedStakeRewards(context.Background(), db)
+	require.NoError(t, err)
+	require.Equal(t, 3, deleted)
+	require.Equal(t, map[string][]int64{"aa": {100, 200}}, rewards)
+
+	orphans, err = DetectOrphanedStakeRewards(context.Background(), db)
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+}
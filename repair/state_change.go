@@ -0,0 +1,616 @@
+package repair
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// OpenStateChangeFiles opens both the index and data files for reading
+func OpenStateChangeFiles(stateChangeDir string) (*os.File, *os.File, error) {
+	indexPath := filepath.Join(stateChangeDir, lib.StateChangeIndexFileName)
+	dataPath := filepath.Join(stateChangeDir, lib.StateChangeFileName)
+
+	indexFile, err := os.Open(indexPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open index file %s: %w", indexPath, err)
+	}
+
+	dataFile, err := os.Open(dataPath)
+	if err != nil {
+		indexFile.Close()
+		return nil, nil, fmt.Errorf("failed to open data file %s: %w", dataPath, err)
+	}
+
+	return indexFile, dataFile, nil
+}
+
+// ReadBlockFromStateChange reads the block StateChangeEntry for a specific height from state-change files.
+// With sequential addressing (the default) it scans the index for the last block entry at height, as the gap
+// scans would find it. With height addressing it reads record height directly, and fails if that record
+// isn't the block at height, since that means the index isn't keyed by height.
+func ReadBlockFromStateChange(indexFile, dataFile *os.File, format IndexFormat, height uint64) (*lib.StateChangeEntry, error) {
+	dataSize, err := dataFileSize(dataFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if format.Addressing == IndexAddressingHeight {
+		offset, err := format.OffsetAt(indexFile, height)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index at height %d: %w", height, err)
+		}
+		entry, err := readEntryAt(dataFile, dataSize, height, offset)
+		if err != nil {
+			return nil, err
+		}
+		if entry.EncoderType != lib.EncoderTypeBlock || entry.BlockHeight != height {
+			return nil, fmt.Errorf("index record %d holds a type %d entry at height %d, not the block at height %d; the index isn't keyed by height, use sequential addressing",
+				height, entry.EncoderType, entry.BlockHeight, height)
+		}
+		return entry, nil
+	}
+
+	if _, err := indexFile.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek index file: %w", err)
+	}
+	indexReader := NewIndexReader(indexFile, format)
+	var found *lib.StateChangeEntry
+	for entryIndex := uint64(0); ; entryIndex++ {
+		offset, err := indexReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading index: %w", err)
+		}
+		entry, err := readEntryAt(dataFile, dataSize, entryIndex, offset)
+		if err != nil {
+			var beyondEOF *DataBeyondEOFError
+			if errors.As(err, &beyondEOF) {
+				return nil, err
+			}
+			log.Printf("WARNING: %v", err)
+			continue
+		}
+		// A later entry for the same height supersedes an earlier one.
+		if entry.EncoderType == lib.EncoderTypeBlock && entry.BlockHeight == height {
+			found = entry
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no block entry at height %d in the state-change files", height)
+	}
+	return found, nil
+}
+
+// readEntryAt reads and decodes the entry at offset in the data file. entryIndex is only used in errors.
+func readEntryAt(dataFile io.ReaderAt, dataSize int64, entryIndex, offset uint64) (*lib.StateChangeEntry, error) {
+	if err := checkEntryInData(entryIndex, offset, 0, dataSize); err != nil {
+		return nil, err
+	}
+	bufReader := bufio.NewReader(io.NewSectionReader(dataFile, int64(offset), dataSize-int64(offset)))
+
+	// Read the entry length (uvarint)
+	entryLength, err := lib.ReadUvarint(bufReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entry length at offset %d: %w", offset, err)
+	}
+	if err := checkEntryInData(entryIndex, offset, entryLength, dataSize); err != nil {
+		return nil, err
+	}
+
+	// Read the entry bytes
+	entryBytes := make([]byte, entryLength)
+	if _, err := io.ReadFull(bufReader, entryBytes); err != nil {
+		return nil, fmt.Errorf("failed to read entry bytes at offset %d: %w", offset, err)
+	}
+
+	// Decode the entry
+	entry := &lib.StateChangeEntry{}
+	if _, err := lib.DecodeFromBytes(entry, bytes.NewReader(entryBytes)); err != nil {
+		return nil, fmt.Errorf("failed to decode entry at offset %d: %w", offset, err)
+	}
+	return entry, nil
+}
+
+// ForEachStateChangeEntry decodes every entry in the state-change files in index order and calls fn for it.
+// Entries that can't be read or decoded are logged and skipped. Returning an error from fn stops the scan.
+func ForEachStateChangeEntry(stateChangeDir string, format IndexFormat, fn func(entry *lib.StateChangeEntry) error) error {
+	indexFile, dataFile, format, err := OpenStateChangeIndex(stateChangeDir, format)
+	if err != nil {
+		return fmt.Errorf("failed to open state-change files: %w", err)
+	}
+	defer indexFile.Close()
+	defer dataFile.Close()
+	dataSize, err := dataFileSize(dataFile)
+	if err != nil {
+		return err
+	}
+
+	indexReader := NewIndexReader(indexFile, format)
+	bufReader := bufio.NewReader(dataFile)
+	scanned := uint64(0)
+	lastLogTime := time.Now()
+	for {
+		offset, err := indexReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("error reading index: %w", err)
+		}
+		scanned++
+		if time.Since(lastLogTime) > 10*time.Second {
+			log.Printf("Progress: Scanned %d entries", scanned)
+			lastLogTime = time.Now()
+		}
+
+		// A truncated data file isn't a decode failure, so it stops the scan instead of being skipped.
+		if err := checkEntryInData(scanned-1, offset, 0, dataSize); err != nil {
+			return err
+		}
+		if _, err := dataFile.Seek(int64(offset), io.SeekStart); err != nil {
+			return fmt.Errorf("seek error at offset %d: %w", offset, err)
+		}
+		bufReader.Reset(dataFile)
+
+		entryLength, err := binary.ReadUvarint(bufReader)
+		if err != nil {
+			log.Printf("WARNING: Failed to read entry length at offset %d: %v", offset, err)
+			continue
+		}
+		if err := checkEntryInData(scanned-1, offset, entryLength, dataSize); err != nil {
+			return err
+		}
+		if entryLength > 10*1024*1024 {
+			log.Printf("WARNING: Entry too large at offset %d: %d bytes", offset, entryLength)
+			continue
+		}
+		entryBytes := make([]byte, entryLength)
+		if _, err := io.ReadFull(bufReader, entryBytes); err != nil {
+			log.Printf("WARNING: Failed to read entry data: %v", err)
+			continue
+		}
+		entry := &lib.StateChangeEntry{}
+		if _, err := lib.DecodeFromBytes(entry, bytes.NewReader(entryBytes)); err != nil {
+			log.Printf("WARNING: Failed to decode entry at offset %d: %v", offset, err)
+			continue
+		}
+
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// filteredStateChangeHeights returns the heights in [startHeight, endHeight] whose block entry in the
+// state-change files Options.MinBlockTxns or MaxBlockTxns leave out, recording them in Filtered.
+func (r *Repairer) filteredStateChangeHeights(startHeight, endHeight uint64) (map[uint64]bool, error) {
+	filtered := make(map[uint64]bool)
+	err := ForEachStateChangeEntry(r.Options.StateChangeDir, r.Options.IndexFormat, func(entry *lib.StateChangeEntry) error {
+		if entry.EncoderType != lib.EncoderTypeBlock || entry.BlockHeight < startHeight || entry.BlockHeight > endHeight {
+			return nil
+		}
+		if block, ok := entry.Encoder.(*lib.MsgDeSoBlock); ok && r.filterBlock(entry.BlockHeight, block) {
+			filtered[entry.BlockHeight] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("find filtered blocks: %w", err)
+	}
+	return filtered, nil
+}
+
+// ProcessGapFromStateChange processes a gap by reading directly from the state-change files in
+// Options.StateChangeDir. When Options.DeleteOpsOnly is set, only entries recorded as Delete operations are
+// replayed (with their original operation type), so stale rows can be removed without re-upserting anything
+// else. When Options.UtxoOpsOnly is set, only utxo-operation entries are replayed, and when
+// Options.TransactionsOnly is set, only block entries. A transaction must already be open; it is committed
+// every Options.CommitBatchSize entries or Options.CommitInterval, whichever comes first. Entries the handler
+// fails on are logged and skipped, or fail the gap with Options.PerGapTransaction; those of an encoder type
+// it doesn't support go by Options.UnsupportedEncoderPolicy instead. Entries that fail to read or decode are
+// logged and skipped too, but if more of the gap's entries fail than Options.MaxDecodeErrorRatio allows, an
+// *UndecodableGapError is returned once the scan is done.
+func (r *Repairer) ProcessGapFromStateChange(ctx context.Context, startHeight, endHeight uint64) error {
+	stateChangeDir := r.Options.StateChangeDir
+	skipBlocks := r.Options.SkipBlocks
+	deleteOpsOnly := r.Options.DeleteOpsOnly
+	utxoOpsOnly := r.Options.UtxoOpsOnly
+	transactionsOnly := r.Options.TransactionsOnly
+	log.Printf("Opening state-change files from %s", stateChangeDir)
+
+	indexFile, dataFile, format, err := OpenStateChangeIndex(stateChangeDir, r.Options.IndexFormat)
+	if err != nil {
+		return fmt.Errorf("failed to open state-change files: %w", err)
+	}
+	defer indexFile.Close()
+	defer dataFile.Close()
+	dataSize, err := dataFileSize(dataFile)
+	if err != nil {
+		return err
+	}
+
+	if skipBlocks {
+		log.Printf("Processing NON-BLOCK state changes for blocks %d -> %d from state-change files", startHeight, endHeight)
+		log.Printf("Skipping blocks (already in DB), processing: posts, likes, follows, diamonds, transactions, etc.")
+	} else {
+		log.Printf("Processing ALL state changes for blocks %d -> %d from state-change files", startHeight, endHeight)
+	}
+	if deleteOpsOnly {
+		log.Printf("DELETE_OPS_ONLY: Replaying only Delete operations, inserts/upserts are left untouched")
+	}
+	if utxoOpsOnly {
+		log.Printf("REPAIR_UTXO_OPERATIONS: Replaying only utxo operations, other entries are left untouched")
+	}
+	if transactionsOnly {
+		log.Printf("REPROCESS_TRANSACTIONS_ONLY: Replaying only blocks to rebuild their transactions, other entries are left untouched")
+	}
+	// Entries aren't ordered by height, so the block txn filter needs every block in range before the other
+	// entries at a filtered height can be left out with it.
+	var filtered map[uint64]bool
+	if r.Options.filtersBlocks() {
+		if filtered, err = r.filteredStateChangeHeights(startHeight, endHeight); err != nil {
+			return err
+		}
+	}
+
+	// Track statistics
+	blocksFound := make(map[uint64]bool)
+	blocksSkipped := uint64(0)
+	entriesProcessed := uint64(0)
+	entriesSkipped := uint64(0)
+	nonDeleteSkipped := uint64(0)
+	nonUtxoSkipped := uint64(0)
+	nonBlockSkipped := uint64(0)
+	filteredSkipped := uint64(0)
+	totalEntries := uint64(0)
+	lastLogTime := r.Clock.Now()
+	lastCommit := lastLogTime
+	uncommittedEntries := uint64(0)
+	uncommittedTxnRows := uint64(0)
+	// uncommitted holds the range of block heights of entries processed since the last commit, once there
+	// are any.
+	var uncommitted []Gap
+	decodes := &decodeTally{gap: Gap{Start: startHeight, End: endHeight}, reverse: r.Options.ReverseIndexOrder}
+
+	// Scan through all entries in the state-change files, from the first or, with ReverseIndexOrder, the last.
+	nextOffset := NewIndexReader(indexFile, format).Next
+	entryIndex := func() uint64 { return totalEntries - 1 }
+	if r.Options.ReverseIndexOrder {
+		indexInfo, err := indexFile.Stat()
+		if err != nil {
+			return fmt.Errorf("stat index file: %w", err)
+		}
+		reverse := NewReverseIndexReader(indexFile, indexInfo.Size(), format)
+		nextOffset = reverse.Next
+		entryIndex = reverse.EntryIndex
+		log.Printf("Reading the index in reverse: entries are applied newest first, which is only safe for backfilling missing rows")
+	}
+	bufReader := bufio.NewReader(dataFile)
+
+	for {
+		// Entries aren't ordered by height, so a stopped scan has to redo the whole gap.
+		if ctx.Err() != nil {
+			return r.stopRun(uncommitted, startHeight, ctx.Err())
+		}
+		totalEntries++
+
+		// Log progress every 100K entries or every 10 seconds
+		if totalEntries%100000 == 0 || r.Clock.Now().Sub(lastLogTime) > 10*time.Second {
+			log.Printf("Progress: Scanned %d entries, found %d blocks in range, processed %d entries, skipped %d blocks",
+				totalEntries, len(blocksFound), entriesProcessed, blocksSkipped)
+			lastLogTime = r.Clock.Now()
+		}
+
+		// Read index entry (offset into data file)
+		offset, err := nextOffset()
+		if err != nil {
+			// Only EOF ends the scan. Entries aren't ordered by height, so having seen as many blocks as the gap
+			// spans (or a height past its end) doesn't mean the rest of the file holds nothing in range.
+			if err == io.EOF {
+				break
+			}
+			return r.stopRun(uncommitted, startHeight, fmt.Errorf("error reading index: %w", err))
+		}
+
+		// A truncated data file isn't a decode failure, so it stops the scan instead of being skipped.
+		if err := checkEntryInData(entryIndex(), offset, 0, dataSize); err != nil {
+			return r.stopRun(uncommitted, startHeight, err)
+		}
+
+		// Read the state change entry from data file
+		if _, err := dataFile.Seek(int64(offset), 0); err != nil {
+			return r.stopRun(uncommitted, startHeight, fmt.Errorf("seek error at offset %d: %w", offset, err))
+		}
+
+		// Reset buffered reader after seek
+		bufReader.Reset(dataFile)
+
+		// Read entry length (uvarint)
+		entryLength, err := binary.ReadUvarint(bufReader)
+		if err != nil {
+			log.Printf("WARNING: Failed to read entry length at offset %d: %v", offset, err)
+			decodes.fail()
+			continue
+		}
+		if err := checkEntryInData(entryIndex(), offset, entryLength, dataSize); err != nil {
+			return r.stopRun(uncommitted, startHeight, err)
+		}
+
+		// Sanity check: max 10MB per entry
+		if entryLength > 10*1024*1024 {
+			log.Printf("WARNING: Entry too large at offset %d: %d bytes", offset, entryLength)
+			decodes.fail()
+			continue
+		}
+
+		entryBytes := make([]byte, entryLength)
+		if _, err := io.ReadFull(bufReader, entryBytes); err != nil {
+			log.Printf("WARNING: Failed to read entry data: %v", err)
+			decodes.fail()
+			continue
+		}
+
+		// Decode the state change entry
+		entry := &lib.StateChangeEntry{}
+		rr := bytes.NewReader(entryBytes)
+		if _, err := lib.DecodeFromBytes(entry, rr); err != nil {
+			log.Printf("WARNING: Failed to decode entry at offset %d: %v", offset, err)
+			decodes.fail()
+			continue
+		}
+
+		// Get block height from the decoded entry
+		blockHeight := entry.BlockHeight
+		decodes.decodedAt(blockHeight)
+
+		// Debug: log first few entries to verify parsing
+		if totalEntries <= 10 {
+			log.Printf("DEBUG: Entry %d - offset=%d, encoder_type=%d, blockHeight=%d",
+				totalEntries, offset, entry.EncoderType, blockHeight)
+		}
+
+		// Skip entries outside our range
+		if blockHeight < startHeight || blockHeight > endHeight {
+			continue
+		}
+
+		// Track blocks found
+		if entry.EncoderType == lib.EncoderTypeBlock {
+			blocksFound[blockHeight] = true
+
+			// Skip block entries if blocks already exist in DB
+			if skipBlocks {
+				blocksSkipped++
+				if blocksSkipped%1000 == 0 {
+					log.Printf("Found %d blocks in state-changes (skipped, already in DB)", blocksSkipped)
+				}
+				continue
+			}
+		}
+		if filtered[blockHeight] {
+			filteredSkipped++
+			continue
+		}
+
+		if utxoOpsOnly && entry.EncoderType != lib.EncoderTypeUtxoOperation &&
+			entry.EncoderType != lib.EncoderTypeUtxoOperationBundle {
+			nonUtxoSkipped++
+			continue
+		}
+		if transactionsOnly && entry.EncoderType != lib.EncoderTypeBlock {
+			nonBlockSkipped++
+			continue
+		}
+
+		if deleteOpsOnly {
+			// Only replay deletes, keeping their original operation type.
+			if entry.OperationType != lib.DbOperationTypeDelete {
+				nonDeleteSkipped++
+				continue
+			}
+		} else {
+			// Change operation type from Insert to Upsert for repair operations
+			entry.OperationType = lib.DbOperationTypeUpsert
+		}
+
+		// Process this entry
+		if err := handleEntryBatchAtomic(r.Handler, []*lib.StateChangeEntry{entry}); err != nil {
+			// An encoder type the handler can't write isn't a failed entry: it goes by its own policy.
+			if isUnsupportedEncoder(err) {
+				if err := r.unsupportedEncoder(entry, offset, entryBytes, err); err != nil {
+					return r.stopRun(uncommitted, startHeight, err)
+				}
+				continue
+			}
+			log.Printf("WARNING: Failed to process entry for block %d, encoder type %v: %v", blockHeight, entry.EncoderType, err)
+			entriesSkipped++
+			continue
+		}
+
+		if r.Audit != nil {
+			if err := r.Audit.Record(offset, blockHeight, entryBytes); err != nil {
+				return r.stopRun(uncommitted, startHeight, err)
+			}
+		}
+
+		entriesProcessed++
+		uncommittedEntries++
+		uncommittedTxnRows += entryTxnRows(entry)
+		if len(uncommitted) == 0 {
+			uncommitted = []Gap{{Start: blockHeight, End: blockHeight}}
+		} else if blockHeight < uncommitted[0].Start {
+			uncommitted[0].Start = blockHeight
+		} else if blockHeight > uncommitted[0].End {
+			uncommitted[0].End = blockHeight
+		}
+
+		// Commit periodically to avoid huge or long-running transactions
+		if r.commitDue(uncommittedEntries, uncommittedTxnRows, lastCommit) {
+			log.Printf("Processed %d entries (skipped %d blocks, %d failed)", entriesProcessed, blocksSkipped, entriesSkipped)
+			log.Printf("Committing batch after %d entries...", entriesProcessed)
+			if err := r.commitRange(uncommitted...); err != nil {
+				return fmt.Errorf("commit transaction: %w", err)
+			}
+			uncommitted = nil
+			uncommittedEntries = 0
+			uncommittedTxnRows = 0
+			lastCommit = r.Clock.Now()
+			if err := r.initiateTransaction(); err != nil {
+				return fmt.Errorf("initiate transaction: %w", err)
+			}
+		}
+	}
+
+	log.Printf("Successfully processed %d state changes", entriesProcessed)
+	log.Printf("Found %d blocks in range (skipped: %d)", len(blocksFound), blocksSkipped)
+	log.Printf("Scanned %d total entries in state-change files", totalEntries)
+	log.Printf("Failed to process: %d entries", entriesSkipped)
+	decodes.finish()
+	if decodes.failed > 0 {
+		log.Printf("Failed to read or decode: %d entries in or around the range", decodes.failed)
+	}
+	if deleteOpsOnly {
+		log.Printf("Skipped %d non-delete entries (DELETE_OPS_ONLY)", nonDeleteSkipped)
+	}
+	if utxoOpsOnly {
+		log.Printf("Skipped %d non-utxo-operation entries (REPAIR_UTXO_OPERATIONS)", nonUtxoSkipped)
+	}
+	if transactionsOnly {
+		log.Printf("Skipped %d non-block entries (REPROCESS_TRANSACTIONS_ONLY)", nonBlockSkipped)
+	}
+	if len(filtered) > 0 {
+		log.Printf("Left out %d entries at %d height(s) filtered by MIN_BLOCK_TXNS/MAX_BLOCK_TXNS", filteredSkipped, len(filtered))
+	}
+
+	// Verify all blocks in range were found
+	missingBlocks := uint64(0)
+	for h := startHeight; h <= endHeight; h++ {
+		if !blocksFound[h] {
+			missingBlocks++
+			if missingBlocks <= 10 {
+				log.Printf("WARNING: Block %d not found in state-change files", h)
+			}
+		}
+	}
+	if missingBlocks > 10 {
+		log.Printf("WARNING: %d additional blocks not found in state-change files", missingBlocks-10)
+	}
+	if r.Options.PerGapTransaction && entriesSkipped > 0 {
+		return fmt.Errorf("%d entries in %d -> %d failed to process", entriesSkipped, startHeight, endHeight)
+	}
+	if decodes.exceeds(r.Options.MaxDecodeErrorRatio) {
+		return &UndecodableGapError{
+			Gap:      decodes.gap,
+			Failed:   decodes.failed,
+			Decoded:  decodes.decoded,
+			MaxRatio: r.Options.MaxDecodeErrorRatio,
+		}
+	}
+
+	return nil
+}
+
+// UndecodableGapError reports a gap more of whose state-change entries failed to read or decode than
+// Options.MaxDecodeErrorRatio allows. The entries that did decode were applied, but the files are likely
+// corrupt around the gap, so it should be repaired from the node instead.
+type UndecodableGapError struct {
+	Gap Gap
+	// Failed is the number of entries that failed to read or decode, and Decoded the number in the gap that
+	// didn't.
+	Failed   uint64
+	Decoded  uint64
+	MaxRatio float64
+}
+
+// Ratio is the fraction of the gap's entries that failed.
+func (e *UndecodableGapError) Ratio() float64 {
+	return float64(e.Failed) / float64(e.Failed+e.Decoded)
+}
+
+func (e *UndecodableGapError) Error() string {
+	return fmt.Sprintf("%d of %d entries in %d -> %d failed to decode (%.1f%%, over the %.1f%% tolerance); "+
+		"the gap is likely unrepairable from the state-change files, repair it from the node with USE_STATE_CHANGES=false",
+		e.Failed, e.Failed+e.Decoded, e.Gap.Start, e.Gap.End, 100*e.Ratio(), 100*e.MaxRatio)
+}
+
+// decodeTally counts the entries that fail to read or decode against a gap. A failed entry has no height,
+// so a run of failures is counted when the entries decoded on either side of it span heights in the gap:
+// entries are written in block order, so the failed ones lie between them.
+type decodeTally struct {
+	gap Gap
+	// reverse is set when the index is read from the last entry back, so heights run downwards.
+	reverse bool
+	// pending is the number of failures since the last decoded entry, at height prev.
+	pending  uint64
+	prev     uint64
+	havePrev bool
+	failed   uint64
+	decoded  uint64
+}
+
+func (t *decodeTally) fail() {
+	t.pending++
+}
+
+// decodedAt records an entry at height that decoded, settling the failures before it.
+func (t *decodeTally) decodedAt(height uint64) {
+	if t.pending > 0 {
+		switch {
+		case t.havePrev:
+			t.settle(min(t.prev, height), max(t.prev, height))
+		case t.reverse:
+			t.settle(height, math.MaxUint64)
+		default:
+			t.settle(0, height)
+		}
+	}
+	t.prev, t.havePrev = height, true
+	if height >= t.gap.Start && height <= t.gap.End {
+		t.decoded++
+	}
+}
+
+// finish settles the failures after the last decoded entry.
+func (t *decodeTally) finish() {
+	if t.pending == 0 {
+		return
+	}
+	switch {
+	case !t.havePrev:
+		t.settle(0, math.MaxUint64)
+	case t.reverse:
+		t.settle(0, t.prev)
+	default:
+		t.settle(t.prev, math.MaxUint64)
+	}
+}
+
+// settle counts the pending failures against the gap if the heights [lo, hi] they lie between overlap it.
+func (t *decodeTally) settle(lo, hi uint64) {
+	if lo <= t.gap.End && hi >= t.gap.Start {
+		t.failed += t.pending
+	}
+	t.pending = 0
+}
+
+// exceeds reports whether the failures are more than maxRatio of the gap's entries. Zero disables the check.
+func (t *decodeTally) exceeds(maxRatio float64) bool {
+	if maxRatio <= 0 || t.failed == 0 {
+		return false
+	}
+	return float64(t.failed)/float64(t.failed+t.decoded) > maxRatio
+}
@@ -0,0 +1,438 @@
+package repair
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/handler"
+	"github.com/stretchr/testify/require"
+)
+
+// writeStateChangeDir encodes entries into state-change index and data files in a new directory, the way the
+// node's state syncer writes them.
+func writeStateChangeDir(t *testing.T, entries []*lib.StateChangeEntry) string {
+	t.Helper()
+	var index, data []byte
+	for _, entry := range entries {
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+		entryBytes := lib.EncodeToBytes(entry.BlockHeight, entry)
+		data = binary.AppendUvarint(data, uint64(len(entryBytes)))
+		data = append(data, entryBytes...)
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, lib.StateChangeIndexFileName), index, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, lib.StateChangeFileName), data, 0o644))
+	return dir
+}
+
+func blockStateChange(height uint64) *lib.StateChangeEntry {
+	return &lib.StateChangeEntry{
+		OperationType: lib.DbOperationTypeInsert,
+		EncoderType:   lib.EncoderTypeBlock,
+		BlockHeight:   height,
+		Encoder: &lib.MsgDeSoBlock{Header: &lib.MsgDeSoHeader{
+			Version:               1,
+			PrevBlockHash:         &lib.BlockHash{},
+			TransactionMerkleRoot: &lib.BlockHash{},
+			Height:                height,
+		}},
+	}
+}
+
+func utxoOpsStateChange(height uint64) *lib.StateChangeEntry {
+	return &lib.StateChangeEntry{
+		OperationType: lib.DbOperationTypeInsert,
+		EncoderType:   lib.EncoderTypeUtxoOperationBundle,
+		KeyBytes:      []byte{byte(height)},
+		BlockHeight:   height,
+		Encoder:       &lib.UtxoOperationBundle{},
+	}
+}
+
+func TestRunReplaysOnlyUtxoOperationsFromStateChanges(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(5), utxoOpsStateChange(5),
+		blockStateChange(6), utxoOpsStateChange(6),
+		blockStateChange(9), utxoOpsStateChange(9),
+	})
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.UseStateChanges = true
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+	r.Options.UtxoOpsOnly = true
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 5, End: 6}}))
+
+	var heights []uint64
+	for _, entry := range handler.committed {
+		require.Equal(t, lib.EncoderTypeUtxoOperationBundle, entry.EncoderType)
+		require.Equal(t, lib.DbOperationTypeUpsert, entry.OperationType)
+		heights = append(heights, entry.BlockHeight)
+	}
+	require.Equal(t, []uint64{5, 6}, heights)
+}
+
+func TestRunReplaysOnlyDeleteOperationsFromStateChanges(t *testing.T) {
+	withOperation := func(entry *lib.StateChangeEntry, operation lib.StateSyncerOperationType) *lib.StateChangeEntry {
+		entry.OperationType = operation
+		return entry
+	}
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(5), withOperation(utxoOpsStateChange(5), lib.DbOperationTypeDelete),
+		withOperation(blockStateChange(6), lib.DbOperationTypeUpsert), utxoOpsStateChange(6),
+		withOperation(blockStateChange(7), lib.DbOperationTypeDelete),
+	})
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.UseStateChanges = true
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+	r.Options.DeleteOpsOnly = true
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 5, End: 7}}))
+
+	for _, entry := range handler.committed {
+		require.Equal(t, lib.DbOperationTypeDelete, entry.OperationType)
+	}
+	require.Equal(t, []uint64{5, 7}, handler.committedHeights())
+	require.Equal(t, lib.EncoderTypeUtxoOperationBundle, handler.committed[0].EncoderType)
+	require.Equal(t, lib.EncoderTypeBlock, handler.committed[1].EncoderType)
+}
+
+func TestBlockTxnCountFilterLeavesOutEveryEntryAtAFilteredHeight(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		utxoOpsStateChange(5), blockStateChange(5),
+		blockStateChange(6), utxoOpsStateChange(6),
+	})
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(auditPath)
+	require.NoError(t, err)
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.UseStateChanges = true
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+	// The blocks have no transactions, so every height is filtered, the utxo operations listed before their
+	// block included.
+	r.Options.MinBlockTxns = 1
+	r.Audit = audit
+	var reported []Gap
+	r.OnCommit = func(g Gap) { reported = append(reported, g) }
+	var statuses []string
+	r.OnGapStatus = func(i int, status string) { statuses = append(statuses, status) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 5, End: 6}}))
+	require.NoError(t, audit.Close())
+
+	require.Empty(t, handler.committed)
+	require.Empty(t, reported)
+	require.ElementsMatch(t, []uint64{5, 6}, r.Filtered)
+	require.Equal(t, []string{GapStatusFiltered}, statuses)
+	contents, err := os.ReadFile(auditPath)
+	require.NoError(t, err)
+	require.Empty(t, contents)
+}
+
+func TestRunReplaysOnlyBlocksWhenRebuildingTransactions(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(5), utxoOpsStateChange(5),
+		blockStateChange(6), utxoOpsStateChange(6),
+		blockStateChange(9),
+	})
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.UseStateChanges = true
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+	r.Options.TransactionsOnly = true
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 5, End: 6}}))
+
+	for _, entry := range handler.committed {
+		require.Equal(t, lib.EncoderTypeBlock, entry.EncoderType)
+	}
+	require.Equal(t, []uint64{5, 6}, handler.committedHeights())
+}
+
+func TestRunAppliesUnsupportedEncoderPolicy(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(5), utxoOpsStateChange(5),
+		blockStateChange(6), utxoOpsStateChange(6),
+	})
+	run := func(policy string, deadLetter *AuditLog) (*fakeHandler, *Repairer, error) {
+		h := newFakeHandler()
+		// The handler in use has no handling for utxo operation bundles.
+		h.fail = func(entry *lib.StateChangeEntry) error {
+			if entry.EncoderType == lib.EncoderTypeUtxoOperationBundle {
+				return &handler.UnsupportedEncoderError{EncoderType: entry.EncoderType, BlockHeight: entry.BlockHeight}
+			}
+			return nil
+		}
+		r := newTestRepairer(h, newFakeSource())
+		r.Options.UseStateChanges = true
+		r.Options.StateChangeDir = dir
+		r.Options.IndexFormat = DefaultIndexFormat
+		// Unsupported entries don't count as failed ones, so they don't fail a per-gap transaction.
+		r.Options.PerGapTransaction = true
+		r.Options.UnsupportedEncoderPolicy = policy
+		r.DeadLetter = deadLetter
+		return h, r, r.Run(context.Background(), []Gap{{Start: 5, End: 6}})
+	}
+
+	h, r, err := run(UnsupportedEncoderSkip, nil)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{5, 6}, h.committedHeights())
+	require.Equal(t, []UnsupportedEncoderCount{{EncoderType: lib.EncoderTypeUtxoOperationBundle, Entries: 2}}, r.UnsupportedEncoderSummary())
+
+	path := filepath.Join(t.TempDir(), "dead-letter.log")
+	deadLetter, err := OpenAuditLog(path)
+	require.NoError(t, err)
+	h, r, err = run(UnsupportedEncoderDeadLetter, deadLetter)
+	require.NoError(t, err)
+	require.NoError(t, deadLetter.Close())
+	require.Equal(t, []uint64{5, 6}, h.committedHeights())
+	require.Equal(t, uint64(2), r.UnsupportedEncoders[lib.EncoderTypeUtxoOperationBundle])
+	recorded, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(recorded)), "\n")
+	require.Len(t, lines, 2)
+	for i, height := range []string{"5", "6"} {
+		require.Equal(t, height, strings.Fields(lines[i])[1])
+	}
+
+	h, _, err = run(UnsupportedEncoderFail, nil)
+	require.ErrorContains(t, err, "UNSUPPORTED_ENCODER_POLICY=fail")
+	require.Empty(t, h.committed)
+}
+
+func TestRunReverseIndexOrderCoversTheSameEntries(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(5), utxoOpsStateChange(5),
+		blockStateChange(6), utxoOpsStateChange(6),
+		blockStateChange(12), blockStateChange(7), utxoOpsStateChange(7),
+	})
+	committed := func(reverse bool) []*lib.StateChangeEntry {
+		handler := newFakeHandler()
+		r := newTestRepairer(handler, newFakeSource())
+		r.Options.UseStateChanges = true
+		r.Options.StateChangeDir = dir
+		r.Options.IndexFormat = DefaultIndexFormat
+		r.Options.ReverseIndexOrder = reverse
+		require.NoError(t, r.Run(context.Background(), []Gap{{Start: 5, End: 7}}))
+		return handler.committed
+	}
+
+	forward, reverse := committed(false), committed(true)
+	require.Len(t, reverse, 6)
+	require.ElementsMatch(t, forward, reverse)
+	// The most recent entry comes first.
+	require.Equal(t, uint64(7), reverse[0].BlockHeight)
+	require.Equal(t, lib.EncoderTypeUtxoOperationBundle, reverse[0].EncoderType)
+}
+
+func TestRunProcessesOutOfOrderStateChangesToEOF(t *testing.T) {
+	// Every height of the gap and a height past it appear before the last in-range entries.
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(7), blockStateChange(5), blockStateChange(6), blockStateChange(12),
+		blockStateChange(3), utxoOpsStateChange(6), blockStateChange(5),
+	})
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.UseStateChanges = true
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 5, End: 7}}))
+
+	require.Equal(t, []uint64{7, 5, 6, 6, 5}, handler.committedHeights())
+	require.Equal(t, lib.EncoderTypeUtxoOperationBundle, handler.committed[3].EncoderType)
+}
+
+func TestAuditLogRecordsEveryProcessedEntry(t *testing.T) {
+	entries := []*lib.StateChangeEntry{blockStateChange(5), utxoOpsStateChange(5), blockStateChange(9)}
+	dir := writeStateChangeDir(t, entries)
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(auditPath)
+	require.NoError(t, err)
+
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.UseStateChanges = true
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+	r.Audit = audit
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 5, End: 6}}))
+	require.NoError(t, audit.Close())
+
+	// Height 9 is outside the gap, so only the first two entries are processed.
+	var want []string
+	offset := 0
+	for _, entry := range entries[:2] {
+		raw := lib.EncodeToBytes(entry.BlockHeight, entry)
+		want = append(want, fmt.Sprintf("%d %d %s", offset, entry.BlockHeight, hex.EncodeToString(raw)))
+		offset += len(binary.AppendUvarint(nil, uint64(len(raw)))) + len(raw)
+	}
+	contents, err := os.ReadFile(auditPath)
+	require.NoError(t, err)
+	require.Equal(t, want, strings.Split(strings.TrimSpace(string(contents)), "\n"))
+	require.Len(t, handler.committed, 2)
+}
+
+func TestAuditLogLeavesOutRolledBackEntries(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(5), utxoOpsStateChange(5),
+		blockStateChange(6), utxoOpsStateChange(6),
+	})
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(auditPath)
+	require.NoError(t, err)
+
+	handler := newFakeHandler()
+	// Height 6's block is written, then its utxo operations fail, so its gap is rolled back whole.
+	handler.fail = func(entry *lib.StateChangeEntry) error {
+		if entry.BlockHeight == 6 && entry.EncoderType == lib.EncoderTypeUtxoOperationBundle {
+			return fmt.Errorf("utxo operations of block 6 failed")
+		}
+		return nil
+	}
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.UseStateChanges = true
+	r.Options.StateChangeDir = dir
+	r.Options.IndexFormat = DefaultIndexFormat
+	r.Options.PerGapTransaction = true
+	r.Audit = audit
+	require.Error(t, r.Run(context.Background(), []Gap{{Start: 5, End: 5}, {Start: 6, End: 6}}))
+	require.NoError(t, audit.Close())
+
+	require.Equal(t, []uint64{5, 5}, handler.committedHeights())
+	contents, err := os.ReadFile(auditPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		require.Equal(t, "5", strings.Fields(line)[1])
+	}
+}
+
+func TestForEachStateChangeEntryReportsDataTruncatedBeforeIndex(t *testing.T) {
+	dir := writeStateChangeDir(t, []*lib.StateChangeEntry{blockStateChange(1), blockStateChange(2), blockStateChange(3)})
+	dataPath := filepath.Join(dir, lib.StateChangeFileName)
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	// The three entries differ only in their single-byte heights, so they're the same length.
+	entryLength := len(data) / 3
+	thirdOffset := 2 * entryLength
+
+	for _, truncateAt := range []int{thirdOffset, thirdOffset + entryLength/2} {
+		require.NoError(t, os.WriteFile(dataPath, data[:truncateAt], 0o644))
+		var seen []uint64
+		err := ForEachStateChangeEntry(dir, DefaultIndexFormat, func(entry *lib.StateChangeEntry) error {
+			seen = append(seen, entry.BlockHeight)
+			return nil
+		})
+		var beyondEOF *DataBeyondEOFError
+		require.ErrorAs(t, err, &beyondEOF)
+		require.ErrorContains(t, err, fmt.Sprintf("index references data beyond EOF at offset %d", thirdOffset))
+		require.Equal(t, uint64(2), beyondEOF.EntryIndex)
+		require.Equal(t, int64(truncateAt), beyondEOF.DataSize)
+		require.Equal(t, []uint64{1, 2}, seen)
+	}
+}
+
+func readBlockFromDir(t *testing.T, dir string, addressing IndexAddressing, height uint64) (*lib.StateChangeEntry, error) {
+	t.Helper()
+	indexFile, dataFile, err := OpenStateChangeFiles(dir)
+	require.NoError(t, err)
+	defer indexFile.Close()
+	defer dataFile.Close()
+	format := DefaultIndexFormat
+	format.Addressing = addressing
+	return ReadBlockFromStateChange(indexFile, dataFile, format, height)
+}
+
+func TestReadBlockFromStateChangeAddressing(t *testing.T) {
+	// An index holding only one block per height from genesis is both sequential and keyed by height, so the
+	// two models agree.
+	dense := writeStateChangeDir(t, []*lib.StateChangeEntry{blockStateChange(0), blockStateChange(1), blockStateChange(2)})
+	for _, addressing := range []IndexAddressing{IndexAddressingSequential, IndexAddressingHeight} {
+		entry, err := readBlockFromDir(t, dense, addressing, 2)
+		require.NoError(t, err, addressing)
+		require.Equal(t, lib.EncoderTypeBlock, entry.EncoderType)
+		require.Equal(t, uint64(2), entry.BlockHeight)
+	}
+
+	// The state syncer writes every entry type into the index, so record N isn't the block at height N. Only
+	// the sequential model finds it; the height model reports the mismatch instead of returning another entry.
+	mixed := writeStateChangeDir(t, []*lib.StateChangeEntry{
+		blockStateChange(0), utxoOpsStateChange(0),
+		blockStateChange(1), utxoOpsStateChange(1),
+		blockStateChange(2), utxoOpsStateChange(2),
+	})
+	entry, err := readBlockFromDir(t, mixed, IndexAddressingSequential, 2)
+	require.NoError(t, err)
+	require.Equal(t, lib.EncoderTypeBlock, entry.EncoderType)
+	require.Equal(t, uint64(2), entry.BlockHeight)
+
+	_, err = readBlockFromDir(t, mixed, IndexAddressingHeight, 2)
+	require.ErrorContains(t, err, "isn't keyed by height")
+
+	_, err = readBlockFromDir(t, mixed, IndexAddressingSequential, 7)
+	require.ErrorContains(t, err, "no block entry at height 7")
+}
+
+func TestRunFlagsGapWithTooManyUndecodableEntries(t *testing.T) {
+	// Every entry of the gap 10 -> 14 is cut in half, so none of them decode.
+	var index, data []byte
+	heights := []uint64{1, 2, 10, 11, 12, 13, 14, 30, 31, 32}
+	for _, h := range heights {
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(data)))
+		entryBytes := lib.EncodeToBytes(h, blockStateChange(h))
+		if h >= 10 && h <= 14 {
+			entryBytes = entryBytes[:len(entryBytes)/2]
+		}
+		data = binary.AppendUvarint(data, uint64(len(entryBytes)))
+		data = append(data, entryBytes...)
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, lib.StateChangeIndexFileName), index, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, lib.StateChangeFileName), data, 0o644))
+	gaps := []Gap{{Start: 1, End: 1}, {Start: 10, End: 14}, {Start: 31, End: 32}}
+
+	run := func(maxRatio float64) (*Repairer, *fakeHandler, []string) {
+		handler := newFakeHandler()
+		r := newTestRepairer(handler, newFakeSource())
+		r.Options.UseStateChanges = true
+		r.Options.StateChangeDir = dir
+		r.Options.IndexFormat = DefaultIndexFormat
+		r.Options.MaxDecodeErrorRatio = maxRatio
+		var statuses []string
+		r.OnGapStatus = func(i int, status string) { statuses = append(statuses, status) }
+		require.NoError(t, r.Run(context.Background(), gaps))
+		return r, handler, statuses
+	}
+
+	// Without a tolerance the corrupt entries are skipped and the gap reported as repaired.
+	r, handler, statuses := run(0)
+	require.Empty(t, r.Undecodable)
+	require.Equal(t, []string{GapStatusRepaired, GapStatusRepaired, GapStatusRepaired}, statuses)
+	require.Equal(t, []uint64{1, 31, 32}, handler.committedHeights())
+
+	r, handler, statuses = run(0.5)
+	require.Equal(t, []string{GapStatusRepaired, GapStatusUndecodable, GapStatusRepaired}, statuses)
+	require.Len(t, r.Undecodable, 1)
+	require.Equal(t, Gap{Start: 10, End: 14}, r.Undecodable[0].Gap)
+	require.Equal(t, uint64(5), r.Undecodable[0].Failed)
+	require.Equal(t, uint64(0), r.Undecodable[0].Decoded)
+	require.ErrorContains(t, r.Undecodable[0], "USE_STATE_CHANGES=false")
+	require.Equal(t, GapStatusUndecodable, r.Timings[1].Status)
+	// The gaps either side are still repaired.
+	require.Equal(t, []uint64{1, 31, 32}, handler.committedHeights())
+}
@@ -0,0 +1,166 @@
+package repair
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ParseTimeRange parses the REPAIR_START_TIME and REPAIR_END_TIME settings, RFC 3339 timestamps such as
+// 2024-03-01T12:00:00Z.
+func ParseTimeRange(start, end string) (time.Time, time.Time, error) {
+	startTime, err := time.Parse(time.RFC3339Nano, start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("REPAIR_START_TIME %q is not an RFC 3339 timestamp: %w", start, err)
+	}
+	endTime, err := time.Parse(time.RFC3339Nano, end)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("REPAIR_END_TIME %q is not an RFC 3339 timestamp: %w", end, err)
+	}
+	if endTime.Before(startTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("REPAIR_START_TIME %s is after REPAIR_END_TIME %s", start, end)
+	}
+	return startTime, endTime, nil
+}
+
+// ResolveTimeRange maps the wall-clock window [start, end] to the heights to repair, using the block table's
+// timestamps. The range runs from just above the last block stamped before the window to just below the
+// first block stamped after it, so heights missing from the DB inside the window, which have no timestamp to
+// match, are still covered. At either end with no block beyond the window, the lowest or highest block
+// inside it bounds the range instead. It fails if no height falls in the window.
+func ResolveTimeRange(ctx context.Context, db Querier, start, end time.Time) (Gap, error) {
+	// The timestamp column has no time zone and holds UTC.
+	const layout = "2006-01-02 15:04:05.999999999"
+	startLit, endLit := start.UTC().Format(layout), end.UTC().Format(layout)
+	query := fmt.Sprintf(`SELECT
+  (SELECT MAX(height) FROM block WHERE timestamp < '%s'),
+  (SELECT MIN(height) FROM block WHERE timestamp > '%s'),
+  (SELECT MIN(height) FROM block WHERE timestamp BETWEEN '%s' AND '%s'),
+  (SELECT MAX(height) FROM block WHERE timestamp BETWEEN '%s' AND '%s')`,
+		startLit, endLit, startLit, endLit, startLit, endLit)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return Gap{}, fmt.Errorf("resolveTimeRange query failed: %w", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return Gap{}, fmt.Errorf("resolveTimeRange rows: %w", err)
+		}
+		return Gap{}, fmt.Errorf("resolveTimeRange: no result row")
+	}
+	var before, after, firstIn, lastIn sql.NullInt64
+	if err := rows.Scan(&before, &after, &firstIn, &lastIn); err != nil {
+		return Gap{}, fmt.Errorf("resolveTimeRange scan: %w", err)
+	}
+
+	window := fmt.Sprintf("%s -> %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	if !before.Valid && !firstIn.Valid {
+		return Gap{}, fmt.Errorf("no blocks are stamped in or before %s; the window is before the stored chain", window)
+	}
+	if !after.Valid && !lastIn.Valid {
+		return Gap{}, fmt.Errorf("no blocks are stamped in or after %s; the window is beyond the stored chain", window)
+	}
+	var r Gap
+	if before.Valid {
+		r.Start = uint64(before.Int64) + 1
+	} else {
+		r.Start = uint64(firstIn.Int64)
+	}
+	// A block after the window is above one before or in it, so it is never at height 0.
+	if after.Valid {
+		r.End = uint64(after.Int64) - 1
+	} else {
+		r.End = uint64(lastIn.Int64)
+	}
+	if r.Start > r.End {
+		return Gap{}, fmt.Errorf("no block heights fall in %s: block %d is stamped before it and block %d after it",
+			window, before.Int64, after.Int64)
+	}
+	return r, nil
+}
+
+// GapTimeSpan is a gap with the timestamps of the stored blocks bracketing it: the highest block below its
+// start and the lowest above its end. Either is nil when there is no block on that side.
+type GapTimeSpan struct {
+	Gap
+	Before, After *time.Time
+}
+
+// String reads like "heights 100 -> 150 (51 blocks), roughly 2024-03-01 12:00:00 to 12:45:00 UTC", leaving
+// out the end's date when it is the start's.
+func (s GapTimeSpan) String() string {
+	const day, clock = "2006-01-02 ", "15:04:05"
+	before, after := "?", "?"
+	if s.Before != nil {
+		before = s.Before.UTC().Format(day + clock)
+	}
+	if s.After != nil {
+		layout := day + clock
+		if s.Before != nil && s.Before.UTC().Format(day) == s.After.UTC().Format(day) {
+			layout = clock
+		}
+		after = s.After.UTC().Format(layout)
+	}
+	return fmt.Sprintf("heights %d -> %d (%d blocks), roughly %s to %s UTC", s.Start, s.End, s.End-s.Start+1, before, after)
+}
+
+// gapTimeSpanBatch is how many gaps GapTimeSpans looks up per query.
+const gapTimeSpanBatch = 1000
+
+// GapTimeSpans returns each gap with the timestamps of the blocks bracketing it, to show the wall-clock
+// window a gap covers. The gaps are looked up gapTimeSpanBatch at a time, each side with one index probe on
+// height.
+func GapTimeSpans(ctx context.Context, db Querier, gaps []Gap) ([]GapTimeSpan, error) {
+	spans := make([]GapTimeSpan, 0, len(gaps))
+	for len(gaps) > 0 {
+		batch := gaps
+		if len(batch) > gapTimeSpanBatch {
+			batch = batch[:gapTimeSpanBatch]
+		}
+		gaps = gaps[len(batch):]
+		values := make([]string, len(batch))
+		for i, g := range batch {
+			values[i] = fmt.Sprintf("(%d, %d, %d)", i, g.Start, g.End)
+		}
+		query := `SELECT g.i,
+  (SELECT b.timestamp FROM block b WHERE b.height < g.start_height ORDER BY b.height DESC LIMIT 1),
+  (SELECT b.timestamp FROM block b WHERE b.height > g.end_height ORDER BY b.height LIMIT 1)
+FROM (VALUES ` + strings.Join(values, ", ") + `) AS g(i, start_height, end_height)`
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("gapTimeSpans query failed: %w", err)
+		}
+		found := make([]GapTimeSpan, len(batch))
+		for i, g := range batch {
+			found[i].Gap = g
+		}
+		for rows.Next() {
+			var i int
+			var before, after sql.NullTime
+			if err := rows.Scan(&i, &before, &after); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("gapTimeSpans scan: %w", err)
+			}
+			if i < 0 || i >= len(found) {
+				rows.Close()
+				return nil, fmt.Errorf("gapTimeSpans: unexpected gap index %d", i)
+			}
+			if before.Valid {
+				found[i].Before = &before.Time
+			}
+			if after.Valid {
+				found[i].After = &after.Time
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("gapTimeSpans rows: %w", err)
+		}
+		spans = append(spans, found...)
+	}
+	return spans, nil
+}
@@ -0,0 +1,146 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockTimesFixture answers the time-range query against a block table holding a block a minute from
+// height 10 to 20, stamped at base + height minutes, with heights 14 and 15 missing.
+func blockTimesFixture(base time.Time) *queryFixture {
+	stamps := make(map[int64]time.Time)
+	for h := int64(10); h <= 20; h++ {
+		if h != 14 && h != 15 {
+			stamps[h] = base.Add(time.Duration(h) * time.Minute)
+		}
+	}
+	literal := regexp.MustCompile(`'([^']+)'`)
+	fixture := &queryFixture{columns: []string{"before", "after", "first_in", "last_in"}}
+	fixture.respond = func(query string) [][]driver.Value {
+		var bounds []time.Time
+		for _, m := range literal.FindAllStringSubmatch(query, 2) {
+			t, err := time.Parse("2006-01-02 15:04:05.999999999", m[1])
+			if err != nil {
+				panic(err)
+			}
+			bounds = append(bounds, t)
+		}
+		start, end := bounds[0], bounds[1]
+		var before, after, firstIn, lastIn driver.Value
+		for h := int64(10); h <= 20; h++ {
+			stamp, ok := stamps[h]
+			switch {
+			case !ok:
+			case stamp.Before(start):
+				before = h
+			case stamp.After(end):
+				if after == nil {
+					after = h
+				}
+			default:
+				if firstIn == nil {
+					firstIn = h
+				}
+				lastIn = h
+			}
+		}
+		return [][]driver.Value{{before, after, firstIn, lastIn}}
+	}
+	return fixture
+}
+
+func TestResolveTimeRange(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	db := openFixtureDB(t, blockTimesFixture(base))
+	at := func(minutes float64) time.Time { return base.Add(time.Duration(minutes * float64(time.Minute))) }
+
+	for _, tc := range []struct {
+		name       string
+		start, end time.Time
+		want       Gap
+	}{
+		// The heights missing from the DB inside the window have no timestamp but are still covered.
+		{"window over missing heights", at(12.5), at(16.5), Gap{Start: 13, End: 16}},
+		{"window inside the missing heights", at(13.2), at(15.8), Gap{Start: 14, End: 15}},
+		{"window from before the chain", at(0), at(11.5), Gap{Start: 10, End: 11}},
+		{"window past the tip", at(18.5), at(60), Gap{Start: 19, End: 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ResolveTimeRange(context.Background(), db, tc.start, tc.end)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+
+	_, err := ResolveTimeRange(context.Background(), db, at(11.2), at(11.8))
+	require.ErrorContains(t, err, "no block heights fall in")
+	_, err = ResolveTimeRange(context.Background(), db, at(0), at(5))
+	require.ErrorContains(t, err, "before the stored chain")
+	_, err = ResolveTimeRange(context.Background(), db, at(30), at(40))
+	require.ErrorContains(t, err, "beyond the stored chain")
+}
+
+func TestParseTimeRange(t *testing.T) {
+	start, end, err := ParseTimeRange("2024-03-01T12:00:00Z", "2024-03-01T13:30:00+01:00")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), start.UTC())
+	require.Equal(t, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC), end.UTC())
+
+	_, _, err = ParseTimeRange("2024-03-01", "2024-03-01T13:00:00Z")
+	require.ErrorContains(t, err, "REPAIR_START_TIME")
+	_, _, err = ParseTimeRange("2024-03-01T13:00:00Z", "2024-03-01T12:00:00Z")
+	require.ErrorContains(t, err, "is after")
+}
+
+func TestGapTimeSpansReportsBracketingBlockTimestamps(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// Blocks a minute apart at heights 10 to 40, with 14-15 and 30-32 missing.
+	stamps := make(map[int64]time.Time)
+	for h := int64(10); h <= 40; h++ {
+		if (h < 14 || h > 15) && (h < 30 || h > 32) {
+			stamps[h] = base.Add(time.Duration(h) * time.Minute)
+		}
+	}
+	value := regexp.MustCompile(`\((\d+), (\d+), (\d+)\)`)
+	fixture := &queryFixture{columns: []string{"i", "before", "after"}}
+	fixture.respond = func(query string) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, m := range value.FindAllStringSubmatch(query, -1) {
+			i, _ := strconv.ParseInt(m[1], 10, 64)
+			start, _ := strconv.ParseInt(m[2], 10, 64)
+			end, _ := strconv.ParseInt(m[3], 10, 64)
+			var before, after driver.Value
+			for h := start - 1; h >= 0 && before == nil; h-- {
+				if stamp, ok := stamps[h]; ok {
+					before = stamp
+				}
+			}
+			for h := end + 1; h <= 40 && after == nil; h++ {
+				if stamp, ok := stamps[h]; ok {
+					after = stamp
+				}
+			}
+			rows = append(rows, []driver.Value{i, before, after})
+		}
+		return rows
+	}
+	db := openFixtureDB(t, fixture)
+
+	spans, err := GapTimeSpans(context.Background(), db, []Gap{{14, 15}, {30, 32}, {41, 45}})
+	require.NoError(t, err)
+	require.Len(t, spans, 3)
+	at := func(h int64) *time.Time { stamp := stamps[h]; return &stamp }
+	require.Equal(t, GapTimeSpan{Gap: Gap{14, 15}, Before: at(13), After: at(16)}, spans[0])
+	require.Equal(t, GapTimeSpan{Gap: Gap{30, 32}, Before: at(29), After: at(33)}, spans[1])
+	// Nothing is stored above the last gap.
+	require.Equal(t, GapTimeSpan{Gap: Gap{41, 45}, Before: at(40)}, spans[2])
+
+	require.Equal(t, "heights 14 -> 15 (2 blocks), roughly 2024-03-01 12:13:00 to 12:16:00 UTC", spans[0].String())
+	require.Equal(t, "heights 41 -> 45 (5 blocks), roughly 2024-03-01 12:40:00 to ? UTC", spans[2].String())
+}
@@ -0,0 +1,49 @@
+package repair
+
+import (
+	"sync/atomic"
+
+	"github.com/deso-protocol/core/lib"
+)
+
+// EntryTransform rewrites an entry before it is handed to the data handler. Returning false skips the entry.
+type EntryTransform func(entry *lib.StateChangeEntry) (*lib.StateChangeEntry, bool)
+
+// noopEntryTransform passes every entry through unchanged.
+func noopEntryTransform(entry *lib.StateChangeEntry) (*lib.StateChangeEntry, bool) {
+	return entry, true
+}
+
+var (
+	entryTransform EntryTransform = noopEntryTransform
+	// entriesDroppedByTransform counts entries the transform chose to skip.
+	entriesDroppedByTransform uint64
+)
+
+// RegisterEntryTransform installs a custom per-entry transform. It must be called at startup (e.g. from an
+// init function in the repair command) before any entries are processed. Passing nil restores the no-op.
+func RegisterEntryTransform(transform EntryTransform) {
+	if transform == nil {
+		transform = noopEntryTransform
+	}
+	entryTransform = transform
+}
+
+// EntriesDroppedByTransform returns the number of entries the registered transform has skipped.
+func EntriesDroppedByTransform() uint64 {
+	return atomic.LoadUint64(&entriesDroppedByTransform)
+}
+
+// applyEntryTransform runs the registered transform over batch, dropping entries it skips.
+func applyEntryTransform(batch []*lib.StateChangeEntry) []*lib.StateChangeEntry {
+	transformed := make([]*lib.StateChangeEntry, 0, len(batch))
+	for _, entry := range batch {
+		newEntry, keep := entryTransform(entry)
+		if !keep || newEntry == nil {
+			atomic.AddUint64(&entriesDroppedByTransform, 1)
+			continue
+		}
+		transformed = append(transformed, newEntry)
+	}
+	return transformed
+}
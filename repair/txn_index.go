@@ -0,0 +1,69 @@
+package repair
+
+import (
+	"context"
+	"fmt"
+)
+
+// TxnIndexHole is a block whose stored transactions' index_in_block values don't form a contiguous
+// 0..N-1 sequence.
+type TxnIndexHole struct {
+	Height    uint64
+	BlockHash string
+	// Missing are the indices below the highest stored index that have no transaction row.
+	Missing []uint64
+	// Duplicates are indices stored more than once.
+	Duplicates []uint64
+}
+
+// FindTxnIndexHoles checks the index_in_block sequence of every block in [start, end] and returns the blocks
+// with holes or duplicates. Inner atomic transactions have a NULL index_in_block and are ignored. Trailing
+// transactions missing after the highest stored index can't be seen here; the sample verifier's count check
+// catches those.
+func FindTxnIndexHoles(ctx context.Context, db Querier, start, end uint64) ([]TxnIndexHole, error) {
+	query := fmt.Sprintf(`SELECT b.height, t.block_hash, t.index_in_block
+FROM "transaction" AS t
+JOIN block AS b ON b.block_hash = t.block_hash
+WHERE b.height BETWEEN %d AND %d AND t.index_in_block IS NOT NULL
+ORDER BY b.height, t.block_hash, t.index_in_block`, start, end)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("txn index query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var holes []TxnIndexHole
+	var current *TxnIndexHole
+	var next uint64
+	flush := func() {
+		if current != nil && (len(current.Missing) > 0 || len(current.Duplicates) > 0) {
+			holes = append(holes, *current)
+		}
+	}
+	for rows.Next() {
+		var height, index uint64
+		var blockHash string
+		if err := rows.Scan(&height, &blockHash, &index); err != nil {
+			return nil, fmt.Errorf("txn index scan: %w", err)
+		}
+		if current == nil || current.BlockHash != blockHash {
+			flush()
+			current = &TxnIndexHole{Height: height, BlockHash: blockHash}
+			next = 0
+		}
+		if index < next {
+			// Rows are ordered by index, so a repeat of the previous index is a duplicate.
+			current.Duplicates = append(current.Duplicates, index)
+			continue
+		}
+		for missing := next; missing < index; missing++ {
+			current.Missing = append(current.Missing, missing)
+		}
+		next = index + 1
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("txn index rows: %w", err)
+	}
+	flush()
+	return holes, nil
+}
@@ -0,0 +1,33 @@
+package repair
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindTxnIndexHolesDetectsMissingIndex(t *testing.T) {
+	fixture := &queryFixture{columns: []string{"height", "block_hash", "index_in_block"}}
+	seed := func(height int64, hash string, indices ...int64) {
+		for _, i := range indices {
+			fixture.rows = append(fixture.rows, []driver.Value{height, hash, i})
+		}
+	}
+	seed(10, "aa", 0, 1, 2, 3)
+	// Index 2 was never inserted.
+	seed(11, "bb", 0, 1, 3)
+	seed(12, "cc", 0)
+	// Index 0 is missing and 4 is stored twice.
+	seed(13, "dd", 1, 2, 3, 4, 4, 6)
+	db := openFixtureDB(t, fixture)
+
+	holes, err := FindTxnIndexHoles(context.Background(), db, 10, 13)
+	require.NoError(t, err)
+	require.Equal(t, []TxnIndexHole{
+		{Height: 11, BlockHash: "bb", Missing: []uint64{2}},
+		{Height: 13, BlockHash: "dd", Missing: []uint64{0, 5}, Duplicates: []uint64{4}},
+	}, holes)
+	require.Contains(t, fixture.queries[0], "BETWEEN 10 AND 13")
+}
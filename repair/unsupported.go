@@ -0,0 +1,85 @@
+package repair
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/deso-protocol/core/lib"
+	"github.com/deso-protocol/postgres-data-handler/handler"
+)
+
+// Options.UnsupportedEncoderPolicy values.
+const (
+	// UnsupportedEncoderSkip logs the first entry of each unsupported encoder type and skips them all.
+	UnsupportedEncoderSkip = "skip"
+	// UnsupportedEncoderFail stops the run at the first unsupported entry.
+	UnsupportedEncoderFail = "fail"
+	// UnsupportedEncoderDeadLetter skips unsupported entries like UnsupportedEncoderSkip and records their raw
+	// bytes in Repairer.DeadLetter, so a handler that supports them can replay them later.
+	UnsupportedEncoderDeadLetter = "deadletter"
+)
+
+var unsupportedEncoderPolicies = []string{UnsupportedEncoderSkip, UnsupportedEncoderFail, UnsupportedEncoderDeadLetter}
+
+// ParseUnsupportedEncoderPolicy parses the UNSUPPORTED_ENCODER_POLICY setting. An empty value is
+// UnsupportedEncoderSkip.
+func ParseUnsupportedEncoderPolicy(value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return UnsupportedEncoderSkip, nil
+	}
+	for _, policy := range unsupportedEncoderPolicies {
+		if value == policy {
+			return policy, nil
+		}
+	}
+	return "", fmt.Errorf("UNSUPPORTED_ENCODER_POLICY must be one of %s, got %q", strings.Join(unsupportedEncoderPolicies, ", "), value)
+}
+
+// isUnsupportedEncoder reports whether err is the handler rejecting an entry for its encoder type, a gap in
+// what this version of the handler can write rather than a problem with the data.
+func isUnsupportedEncoder(err error) bool {
+	var unsupported *handler.UnsupportedEncoderError
+	return errors.As(err, &unsupported)
+}
+
+// unsupportedEncoder applies Options.UnsupportedEncoderPolicy to an entry the handler rejected for its
+// encoder type, counting it in UnsupportedEncoders. It returns an error only if the run should stop.
+func (r *Repairer) unsupportedEncoder(entry *lib.StateChangeEntry, offset uint64, raw []byte, err error) error {
+	if r.Options.UnsupportedEncoderPolicy == UnsupportedEncoderFail {
+		return fmt.Errorf("entry for block %d has encoder type %d, which the handler doesn't support (UNSUPPORTED_ENCODER_POLICY=fail): %w",
+			entry.BlockHeight, entry.EncoderType, err)
+	}
+	if r.UnsupportedEncoders == nil {
+		r.UnsupportedEncoders = make(map[lib.EncoderType]uint64)
+	}
+	if r.UnsupportedEncoders[entry.EncoderType] == 0 {
+		log.Printf("WARNING: The handler doesn't support encoder type %d (first seen at block %d); skipping its entries", entry.EncoderType, entry.BlockHeight)
+	}
+	r.UnsupportedEncoders[entry.EncoderType]++
+	if r.Options.UnsupportedEncoderPolicy == UnsupportedEncoderDeadLetter && r.DeadLetter != nil {
+		if err := r.DeadLetter.Record(offset, entry.BlockHeight, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnsupportedEncoderCount is the number of entries of one encoder type the handler didn't support.
+type UnsupportedEncoderCount struct {
+	EncoderType lib.EncoderType
+	Entries     uint64
+}
+
+// UnsupportedEncoderSummary returns UnsupportedEncoders ordered by encoder type.
+func (r *Repairer) UnsupportedEncoderSummary() []UnsupportedEncoderCount {
+	summary := make([]UnsupportedEncoderCount, 0, len(r.UnsupportedEncoders))
+	for encoderType, entries := range r.UnsupportedEncoders {
+		summary = append(summary, UnsupportedEncoderCount{EncoderType: encoderType, Entries: entries})
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].EncoderType < summary[j].EncoderType })
+	return summary
+}
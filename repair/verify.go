@@ -0,0 +1,217 @@
+package repair
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deso-protocol/state-consumer/consumer"
+	"github.com/uptrace/bun"
+)
+
+// sampleHeights picks k distinct heights uniformly from [start, end] using rng, returned in ascending
+// order. If the range holds k or fewer heights, every height is returned.
+func sampleHeights(start, end uint64, k int, rng *rand.Rand) []uint64 {
+	size := end - start + 1
+	if uint64(k) >= size {
+		heights := make([]uint64, 0, size)
+		for h := start; h <= end; h++ {
+			heights = append(heights, h)
+		}
+		return heights
+	}
+
+	// Floyd's algorithm: k draws, no rejection loop, no allocation proportional to the range.
+	chosen := make(map[uint64]struct{}, k)
+	for j := size - uint64(k); j < size; j++ {
+		t := uint64(rng.Int63n(int64(j + 1)))
+		if _, ok := chosen[t]; ok {
+			t = j
+		}
+		chosen[t] = struct{}{}
+	}
+	heights := make([]uint64, 0, k)
+	for offset := range chosen {
+		heights = append(heights, start+offset)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// SampleMismatch describes a sampled height whose DB state disagrees with the node.
+type SampleMismatch struct {
+	Height uint64
+	Reason string
+}
+
+// verifySampledBlock compares the DB's block hash and top-level transaction count at height with the node.
+// It returns a non-empty reason when they disagree.
+func verifySampledBlock(db *bun.DB, source BlockSource, height uint64) (string, error) {
+	block, blockHash, err := source.FetchBlock(height)
+	if err != nil {
+		return "", fmt.Errorf("fetch block %d from node: %w", height, err)
+	}
+
+	ctx := context.Background()
+	var dbHashes []string
+	if err := db.NewSelect().Table("block").Column("block_hash").Where("height = ?", height).Scan(ctx, &dbHashes); err != nil {
+		return "", fmt.Errorf("query block %d: %w", height, err)
+	}
+	if len(dbHashes) == 0 {
+		return "missing from DB", nil
+	}
+	nodeHash := hex.EncodeToString(blockHash[:])
+	if len(dbHashes) > 1 {
+		return fmt.Sprintf("%d block rows at this height", len(dbHashes)), nil
+	}
+	if dbHashes[0] != nodeHash {
+		return fmt.Sprintf("hash mismatch: db=%s node=%s", dbHashes[0], nodeHash), nil
+	}
+
+	// Inner atomic transactions are stored with a NULL index_in_block, so only count top-level ones.
+	txnCount, err := db.NewSelect().Table("transaction").
+		Where("block_hash = ?", nodeHash).
+		Where("index_in_block IS NOT NULL").
+		Count(ctx)
+	if err != nil {
+		return "", fmt.Errorf("count transactions for block %d: %w", height, err)
+	}
+	if txnCount != len(block.Txns) {
+		return fmt.Sprintf("transaction count mismatch: db=%d node=%d", txnCount, len(block.Txns)), nil
+	}
+	return "", nil
+}
+
+// RunSampleVerify verifies a random sample of k heights in [start, end] against the node and reports the
+// pass rate. It returns the mismatches found.
+func RunSampleVerify(db *bun.DB, source BlockSource, start, end uint64, k int, seed int64) ([]SampleMismatch, error) {
+	heights := sampleHeights(start, end, k, rand.New(rand.NewSource(seed)))
+	log.Printf("Sample verify: checking %d of %d heights in %d -> %d (seed %d)", len(heights), end-start+1, start, end, seed)
+
+	var mismatches []SampleMismatch
+	for _, h := range heights {
+		reason, err := verifySampledBlock(db, source, h)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			log.Printf("MISMATCH at height %d: %s", h, reason)
+			mismatches = append(mismatches, SampleMismatch{Height: h, Reason: reason})
+		}
+	}
+
+	passed := len(heights) - len(mismatches)
+	log.Printf("Sample verify: %d/%d passed (%.2f%%)", passed, len(heights), float64(passed)/float64(len(heights))*100)
+	if len(mismatches) == 0 {
+		// Rule of three: zero failures in n samples bounds the true failure rate below 3/n at ~95% confidence.
+		log.Printf("No mismatches in sample; the range's mismatch rate is below %.2f%% with ~95%% confidence",
+			300/float64(len(heights)))
+	} else {
+		log.Printf("Mismatches found in sample; run a full verification over %d -> %d", start, end)
+	}
+	return mismatches, nil
+}
+
+// badTimestampCondition matches block rows whose timestamp a partial or buggy insert left NULL or at (or
+// before) the Unix epoch, e.g. a zero time.Time, which time-range queries can't place.
+const badTimestampCondition = "(timestamp IS NULL OR timestamp <= TIMESTAMP 'epoch')"
+
+// DetectBadTimestamps returns the heights of block rows with a NULL or epoch-zero timestamp, in ascending
+// order. If end is non-zero, detection is restricted to [start, end].
+func DetectBadTimestamps(ctx context.Context, db Querier, start, end uint64) ([]uint64, error) {
+	query := "SELECT DISTINCT height FROM block WHERE " + badTimestampCondition
+	if end > 0 {
+		query += fmt.Sprintf(" AND height BETWEEN %d AND %d", start, end)
+	}
+	rows, err := db.QueryContext(ctx, query+" ORDER BY height")
+	if err != nil {
+		return nil, fmt.Errorf("bad timestamp query failed: %w", err)
+	}
+	defer rows.Close()
+	var heights []uint64
+	for rows.Next() {
+		var height uint64
+		if err := rows.Scan(&height); err != nil {
+			return nil, fmt.Errorf("bad timestamp scan: %w", err)
+		}
+		heights = append(heights, height)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("bad timestamp rows: %w", err)
+	}
+	return heights, nil
+}
+
+// FixBlockTimestamps rewrites the timestamp column of existing block rows in [start, end] with the header
+// timestamp reported by the node. Nothing else about the block (or its transactions) is touched. It returns
+// the number of rows whose timestamp was changed. Headers are fetched fetchWorkers at a time, and at most
+// dbWorkers of the updates run at once.
+func FixBlockTimestamps(db *bun.DB, source HeaderSource, start, end uint64, fetchWorkers, dbWorkers int) (int64, error) {
+	return FixBlockTimestampsInGaps(db, source, []Gap{{Start: start, End: end}}, fetchWorkers, dbWorkers)
+}
+
+// FixBlockTimestampsInGaps is FixBlockTimestamps over every height of gaps, sharing one set of workers, so
+// the scattered heights DetectBadTimestamps finds are fixed as concurrently as a single range.
+func FixBlockTimestampsInGaps(db *bun.DB, source HeaderSource, gaps []Gap, fetchWorkers, dbWorkers int) (int64, error) {
+	var fixed int64
+	var firstErr error
+	var mu sync.Mutex
+	sem := make(chan struct{}, fetchWorkers)
+	dbSem := make(chan struct{}, dbWorkers)
+	var wg sync.WaitGroup
+fetch:
+	for _, g := range gaps {
+		for h := g.Start; h <= g.End; h++ {
+			mu.Lock()
+			stop := firstErr != nil
+			mu.Unlock()
+			if stop {
+				break fetch
+			}
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(height uint64) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				header, err := source.FetchHeader(height)
+				if err == nil {
+					timestamp := consumer.UnixNanoToTime(uint64(header.TstampNanoSecs))
+					var result sql.Result
+					dbSem <- struct{}{}
+					result, err = db.NewUpdate().Table("block").
+						Set("timestamp = ?", timestamp).
+						Where("height = ?", height).
+						Where("block_hash = ?", header.BlockHashHex).
+						Where("timestamp IS DISTINCT FROM ?", timestamp).
+						Exec(context.Background())
+					<-dbSem
+					if err == nil {
+						rows, _ := result.RowsAffected()
+						if rows > 0 {
+							log.Printf("Fixed timestamp for block %d -> %s", height, timestamp.Format(time.RFC3339Nano))
+						}
+						atomic.AddInt64(&fixed, rows)
+					}
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("fix timestamp for block %d: %w", height, err)
+					}
+					mu.Unlock()
+				}
+			}(h)
+		}
+	}
+	wg.Wait()
+	return fixed, firstErr
+}
@@ -0,0 +1,198 @@
+package repair
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+func TestSampleHeights(t *testing.T) {
+	heights := sampleHeights(1000, 1999, 50, rand.New(rand.NewSource(42)))
+	require.Len(t, heights, 50)
+	seen := make(map[uint64]bool)
+	for i, h := range heights {
+		require.GreaterOrEqual(t, h, uint64(1000))
+		require.LessOrEqual(t, h, uint64(1999))
+		require.False(t, seen[h], "duplicate height %d", h)
+		seen[h] = true
+		if i > 0 {
+			require.Less(t, heights[i-1], h)
+		}
+	}
+
+	// The same seed reproduces the same sample.
+	require.Equal(t, heights, sampleHeights(1000, 1999, 50, rand.New(rand.NewSource(42))))
+
+	// Asking for at least the whole range returns every height.
+	require.Equal(t, heightRange(5, 9), sampleHeights(5, 9, 10, rand.New(rand.NewSource(1))))
+}
+
+func TestRunSampleVerifyReportsMismatchesAndPassRate(t *testing.T) {
+	source := newFakeSource()
+	heights := sampleHeights(40, 59, 5, rand.New(rand.NewSource(7)))
+	hashes := make(map[string]uint64)
+	for _, h := range heights {
+		_, blockHash, _ := source.FetchBlock(h)
+		hashes[hex.EncodeToString(blockHash[:])] = h
+	}
+	// The DB stored the wrong hash at the first sampled height and an extra transaction at the third.
+	wrongHash, wrongCount := heights[0], heights[2]
+	heightPattern := regexp.MustCompile(`height = (\d+)`)
+	hashPattern := regexp.MustCompile(`block_hash = '([0-9a-f]+)'`)
+	fixture := &queryFixture{}
+	fixture.respond = func(query string) [][]driver.Value {
+		if strings.Contains(query, "count(*)") {
+			fixture.columns = []string{"count"}
+			if hashes[hashPattern.FindStringSubmatch(query)[1]] == wrongCount {
+				return [][]driver.Value{{int64(1)}}
+			}
+			return [][]driver.Value{{int64(0)}}
+		}
+		fixture.columns = []string{"block_hash"}
+		height, _ := strconv.ParseUint(heightPattern.FindStringSubmatch(query)[1], 10, 64)
+		if height == wrongHash {
+			return [][]driver.Value{{strings.Repeat("ff", 32)}}
+		}
+		_, blockHash, _ := source.FetchBlock(height)
+		return [][]driver.Value{{hex.EncodeToString(blockHash[:])}}
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	mismatches, err := RunSampleVerify(db, source, 40, 59, 5, 7)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 2)
+	require.Equal(t, wrongHash, mismatches[0].Height)
+	require.Contains(t, mismatches[0].Reason, "hash mismatch")
+	require.Equal(t, SampleMismatch{Height: wrongCount, Reason: "transaction count mismatch: db=1 node=0"}, mismatches[1])
+	require.Contains(t, logs.String(), "Sample verify: 3/5 passed (60.00%)")
+}
+
+type headerSourceFunc func(height uint64) (*BlockHeader, error)
+
+func (f headerSourceFunc) FetchHeader(height uint64) (*BlockHeader, error) { return f(height) }
+
+func TestFixBlockTimestampsLimitsFetchAndDBWorkersSeparately(t *testing.T) {
+	fetches, updates := newConcurrencyGauge(8), newConcurrencyGauge(2)
+	source := headerSourceFunc(func(height uint64) (*BlockHeader, error) {
+		fetches.enter()
+		return &BlockHeader{BlockHashHex: "aa", TstampNanoSecs: int64(height)}, nil
+	})
+	fixture := &queryFixture{exec: func(string) { updates.enter() }}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+
+	_, err := FixBlockTimestamps(db, source, 1, 40, 8, 2)
+	require.NoError(t, err)
+	require.Equal(t, 8, fetches.peak())
+	require.Equal(t, 2, updates.peak())
+}
+
+func TestFixBlockTimestampsCorrectsWrongTimestamps(t *testing.T) {
+	type blockRow struct{ hash, timestamp string }
+	// 10 has a wrong timestamp, 11 is already right, and 12 is wrong but the DB holds a different block there.
+	var mu sync.Mutex
+	blocks := map[uint64]*blockRow{
+		10: {hash: "0a", timestamp: "2021-01-01 00:00:00"},
+		11: {hash: "0b", timestamp: "2023-11-14 22:13:31"},
+		12: {hash: "ff", timestamp: "2021-01-01 00:00:02"},
+	}
+	updatePattern := regexp.MustCompile(`SET timestamp = '([^']*)' WHERE \(height = (\d+)\) AND \(block_hash = '([^']*)'\)`)
+	var updated []uint64
+	fixture := &queryFixture{}
+	fixture.exec = func(query string) {
+		m := updatePattern.FindStringSubmatch(query)
+		require.NotNil(t, m, query)
+		height, _ := strconv.ParseUint(m[2], 10, 64)
+		mu.Lock()
+		defer mu.Unlock()
+		// The stored timestamps have second precision, so compare at that.
+		if row := blocks[height]; row.hash == m[3] && row.timestamp != m[1][:19] {
+			row.timestamp = m[1][:19]
+			updated = append(updated, height)
+		}
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+	source := headerSourceFunc(func(height uint64) (*BlockHeader, error) {
+		return &BlockHeader{
+			BlockHashHex:   fmt.Sprintf("%02x", height),
+			TstampNanoSecs: (1700000000 + int64(height)) * int64(time.Second),
+		}, nil
+	})
+
+	_, err := FixBlockTimestamps(db, source, 10, 12, 2, 1)
+	require.NoError(t, err)
+	require.Len(t, fixture.queries, 3)
+	require.Equal(t, []uint64{10}, updated)
+	require.Equal(t, "2023-11-14 22:13:30", blocks[10].timestamp)
+	require.Equal(t, "2023-11-14 22:13:31", blocks[11].timestamp)
+	require.Equal(t, "2021-01-01 00:00:02", blocks[12].timestamp)
+}
+
+func TestDetectBadTimestampsFindsAndFixesEpochZeroBlocks(t *testing.T) {
+	// Timestamps by height as the DB stores them; 6 was left NULL and 7 at the zero time by a partial insert.
+	var mu sync.Mutex
+	timestamps := map[uint64]string{5: "2023-11-14 22:13:20", 6: "", 7: "0001-01-01 00:00:00"}
+	setPattern := regexp.MustCompile(`SET timestamp = '([^']*)' WHERE \(height = (\d+)\)`)
+	fixture := &queryFixture{columns: []string{"height"}}
+	fixture.respond = func(query string) [][]driver.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		var rows [][]driver.Value
+		for _, h := range []uint64{5, 6, 7} {
+			if ts := timestamps[h]; ts == "" || ts < "1970-01-01 00:00:01" {
+				rows = append(rows, []driver.Value{int64(h)})
+			}
+		}
+		return rows
+	}
+	fixture.exec = func(query string) {
+		m := setPattern.FindStringSubmatch(query)
+		if m == nil {
+			return
+		}
+		height, _ := strconv.ParseUint(m[2], 10, 64)
+		mu.Lock()
+		timestamps[height] = m[1]
+		mu.Unlock()
+	}
+	db := bun.NewDB(openFixtureDB(t, fixture), pgdialect.New())
+	ctx := context.Background()
+
+	heights, err := DetectBadTimestamps(ctx, db, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{6, 7}, heights)
+	require.Equal(t, "SELECT DISTINCT height FROM block WHERE (timestamp IS NULL OR timestamp <= TIMESTAMP 'epoch') ORDER BY height", fixture.queries[0])
+
+	source := headerSourceFunc(func(height uint64) (*BlockHeader, error) {
+		return &BlockHeader{BlockHashHex: "aa", TstampNanoSecs: 1700000000*int64(time.Second) + int64(height)}, nil
+	})
+	_, err = FixBlockTimestampsInGaps(db, source, HeightsToGaps(heights), 4, 2)
+	require.NoError(t, err)
+	for _, h := range []uint64{6, 7} {
+		require.True(t, strings.HasPrefix(timestamps[h], "2023-11-14 22:13:20"), "height %d: %s", h, timestamps[h])
+	}
+	require.Equal(t, "2023-11-14 22:13:20", timestamps[5])
+
+	fixture.queries = nil
+	heights, err = DetectBadTimestamps(ctx, db, 6, 7)
+	require.NoError(t, err)
+	require.Empty(t, heights)
+	require.Contains(t, fixture.queries[0], "AND height BETWEEN 6 AND 7 ORDER BY height")
+}
@@ -0,0 +1,113 @@
+package repair
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CommitWebhook POSTs committed height ranges to a URL so downstream caches can invalidate them. Commits that
+// land within MinInterval of the last delivery are held and sent with the next delivery, one POST per range
+// after overlapping or adjacent ranges are merged, and failed deliveries are logged and retried the same way,
+// so the webhook never fails the repair.
+type CommitWebhook struct {
+	URL         string
+	Client      *http.Client
+	Clock       Clock
+	MinInterval time.Duration
+
+	mu       sync.Mutex
+	pending  []Gap
+	lastSent time.Time
+}
+
+// commitWebhookPayload is the JSON body sent to the webhook.
+type commitWebhookPayload struct {
+	StartHeight uint64 `json:"start_height"`
+	EndHeight   uint64 `json:"end_height"`
+}
+
+// NewCommitWebhook returns a CommitWebhook for url using the wall clock.
+func NewCommitWebhook(url string, minInterval time.Duration) *CommitWebhook {
+	return &CommitWebhook{
+		URL:         url,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Clock:       SystemClock,
+		MinInterval: minInterval,
+	}
+}
+
+// Notify records a committed range and delivers everything pending unless the last delivery was too recent.
+func (w *CommitWebhook) Notify(committed Gap) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = addPendingRange(w.pending, committed)
+	if !w.lastSent.IsZero() && w.Clock.Now().Sub(w.lastSent) < w.MinInterval {
+		return
+	}
+	w.send()
+}
+
+// Flush delivers any pending ranges regardless of MinInterval. Call it once the run is over.
+func (w *CommitWebhook) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 {
+		w.send()
+	}
+}
+
+// send delivers the pending ranges in height order, keeping the undelivered ones after a failure. w.mu must
+// be held.
+func (w *CommitWebhook) send() {
+	w.lastSent = w.Clock.Now()
+	for len(w.pending) > 0 {
+		if err := w.post(w.pending[0]); err != nil {
+			log.Printf("WARNING: Post-commit webhook failed for heights %d -> %d, will retry with the next commit: %v",
+				w.pending[0].Start, w.pending[0].End, err)
+			return
+		}
+		w.pending = w.pending[1:]
+	}
+	w.pending = nil
+}
+
+// addPendingRange adds committed to ranges, which are sorted and disjoint, merging it with the ranges it
+// overlaps or adjoins so that they stay that way.
+func addPendingRange(ranges []Gap, committed Gap) []Gap {
+	merged := make([]Gap, 0, len(ranges)+1)
+	i := 0
+	for ; i < len(ranges) && ranges[i].End+1 < committed.Start; i++ {
+		merged = append(merged, ranges[i])
+	}
+	for ; i < len(ranges) && ranges[i].Start <= committed.End+1; i++ {
+		if ranges[i].Start < committed.Start {
+			committed.Start = ranges[i].Start
+		}
+		if ranges[i].End > committed.End {
+			committed.End = ranges[i].End
+		}
+	}
+	merged = append(merged, committed)
+	return append(merged, ranges[i:]...)
+}
+
+func (w *CommitWebhook) post(committed Gap) error {
+	body, err := json.Marshal(commitWebhookPayload{StartHeight: committed.Start, EndHeight: committed.End})
+	if err != nil {
+		return fmt.Errorf("marshal webhook payload: %w", err)
+	}
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package repair
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOnCommitReportsCommittedRanges(t *testing.T) {
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.Options.SequentialThreshold = 0
+	r.Options.CommitBatchSize = 4
+	var committed []Gap
+	r.OnCommit = func(g Gap) { committed = append(committed, g) }
+
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 1, End: 10}, {Start: 20, End: 21}}))
+
+	require.Equal(t, []Gap{{Start: 1, End: 4}, {Start: 5, End: 8}, {Start: 9, End: 10}, {Start: 20, End: 21}}, committed)
+}
+
+func TestCommitWebhookReceivesCommittedRange(t *testing.T) {
+	var mu sync.Mutex
+	var received []commitWebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload commitWebhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	hook := NewCommitWebhook(server.URL, time.Minute)
+	hook.Clock = clock
+
+	handler := newFakeHandler()
+	r := newTestRepairer(handler, newFakeSource())
+	r.OnCommit = hook.Notify
+	require.NoError(t, r.Run(context.Background(), []Gap{{Start: 100, End: 105}}))
+
+	// Commits within the interval are held and delivered on flush, merged only where they overlap or adjoin.
+	hook.Notify(Gap{Start: 200, End: 210})
+	hook.Notify(Gap{Start: 190, End: 195})
+	hook.Notify(Gap{Start: 196, End: 199})
+	hook.Notify(Gap{Start: 300, End: 310})
+	hook.Notify(Gap{Start: 250, End: 260})
+	hook.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []commitWebhookPayload{
+		{StartHeight: 100, EndHeight: 105},
+		{StartHeight: 190, EndHeight: 210},
+		{StartHeight: 250, EndHeight: 260},
+		{StartHeight: 300, EndHeight: 310},
+	}, received)
+}
+
+func TestCommitWebhookFailuresAreRetried(t *testing.T) {
+	var mu sync.Mutex
+	fail := true
+	var received []commitWebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var payload commitWebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	hook := NewCommitWebhook(server.URL, 0)
+	hook.Notify(Gap{Start: 1, End: 2})
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	hook.Notify(Gap{Start: 3, End: 4})
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []commitWebhookPayload{{StartHeight: 1, EndHeight: 4}}, received)
+}